@@ -0,0 +1,215 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+type cluster struct {
+	fs *flag.FlagSet
+
+	socket string
+	action string
+
+	id         string
+	name       string
+	peerURL    string
+	managerURL string
+
+	asJson bool
+}
+
+func Cluster() *cluster {
+	gc := &cluster{
+		fs: flag.NewFlagSet("cluster", flag.ContinueOnError),
+	}
+
+	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
+
+	gc.fs.StringVar(&gc.id, "id", "", "Hex ID of the cluster member (or error for -resolve) to act on")
+	gc.fs.StringVar(&gc.name, "name", "", "Label for new member (Optional)")
+	gc.fs.StringVar(&gc.peerURL, "peer", "", "Peer URL of new member, e.g https://10.0.0.2:2380")
+	gc.fs.StringVar(&gc.managerURL, "manager", "", "Manager URL of new member (Optional)")
+
+	gc.fs.BoolVar(&gc.asJson, "json", false, "Print output as json")
+
+	gc.fs.Bool("list", false, "List cluster members and their health")
+	gc.fs.Bool("add", false, "Add new member to cluster, prints join token")
+	gc.fs.Bool("promote", false, "Promote learner to full member")
+	gc.fs.Bool("drain", false, "Drain member, clients will be directed to other nodes")
+	gc.fs.Bool("undrain", false, "Restore drained member")
+	gc.fs.Bool("stepdown", false, "Step down current leader (must be run against leaders socket)")
+	gc.fs.Bool("witness", false, "Mark node as a witness until it next starts, set Clustering.Witness to keep it (must be run against the nodes socket)")
+	gc.fs.Bool("unwitness", false, "Remove witness mark from node (must be run against the nodes socket)")
+	gc.fs.Bool("remove", false, "Remove member from cluster")
+	gc.fs.Bool("errors", false, "List cluster errors")
+	gc.fs.Bool("resolve", false, "Resolve (delete) cluster error")
+
+	return gc
+}
+
+func (g *cluster) FlagSet() *flag.FlagSet {
+	return g.fs
+}
+
+func (g *cluster) Name() string {
+
+	return g.fs.Name()
+}
+
+func (g *cluster) PrintUsage() {
+	g.fs.Usage()
+}
+
+func (g *cluster) Check() error {
+	g.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "list", "add", "promote", "drain", "undrain", "stepdown", "witness", "unwitness", "remove", "errors", "resolve":
+			g.action = strings.ToLower(f.Name)
+		}
+	})
+
+	switch g.action {
+	case "add":
+		if g.peerURL == "" {
+			return errors.New("peer url must be supplied")
+		}
+	case "promote", "drain", "undrain", "remove", "resolve":
+		if g.id == "" {
+			return errors.New("id must be supplied")
+		}
+	case "list", "stepdown", "witness", "unwitness", "errors":
+	default:
+		return errors.New("Unknown flag: " + g.action)
+	}
+
+	return nil
+}
+
+func (g *cluster) Run() error {
+
+	ctl := wagctl.NewControlClient(g.socket)
+
+	switch g.action {
+	case "list":
+		members, err := ctl.GetClusterMembersHealth()
+		if err != nil {
+			return err
+		}
+
+		if g.asJson {
+			return printJson(members)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tROLE\tSTATUS\tVERSION\tLAST PING\tPEER URLS")
+		for _, member := range members {
+			role := "member"
+			if member.IsLearner {
+				role = "learner"
+			} else if member.IsWitness {
+				role = "witness"
+			}
+
+			if member.IsLeader {
+				role = "leader/" + role
+			}
+
+			ping := "N/A"
+			if !member.LastPing.IsZero() {
+				ping = member.LastPing.Format(time.RFC822)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", member.ID, member.Name, role, member.Status, member.Version, ping, strings.Join(member.PeerURLs, ","))
+		}
+
+		return w.Flush()
+
+	case "errors":
+		clusterErrors, err := ctl.GetClusterErrors()
+		if err != nil {
+			return err
+		}
+
+		if g.asJson {
+			return printJson(clusterErrors)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNODE\tTIME\tERROR")
+		for _, e := range clusterErrors {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.ErrorID, e.NodeID, e.Time.Format(time.RFC822), e.Error)
+		}
+
+		return w.Flush()
+
+	case "add":
+		token, err := ctl.AddClusterMember(g.name, g.peerURL, g.managerURL)
+		if err != nil {
+			return err
+		}
+
+		if g.asJson {
+			return printJson(map[string]string{"JoinToken": token})
+		}
+
+		fmt.Println("Start the new node with: wag start -join", token)
+
+	case "promote":
+		if err := ctl.PromoteClusterMember(g.id); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "drain", "undrain":
+		if err := ctl.DrainClusterMember(g.id, g.action == "drain"); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "stepdown":
+		if err := ctl.StepDownLeader(); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "witness", "unwitness":
+		if err := ctl.SetClusterMemberWitness(g.action == "witness"); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "remove":
+		if err := ctl.RemoveClusterMember(g.id); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "resolve":
+		if err := ctl.ResolveClusterError(g.id); err != nil {
+			return err
+		}
+		fmt.Println("OK")
+	}
+
+	return nil
+}
+
+func printJson(v any) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(b))
+	return nil
+}
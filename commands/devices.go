@@ -15,6 +15,8 @@ type devices struct {
 	fs *flag.FlagSet
 
 	address, username, socket string
+	name, tags                string
+	subnet, iface             string
 	action                    string
 }
 
@@ -36,6 +38,21 @@ func Devices() *devices {
 	gc.fs.Bool("unlock", false, "Unlock device")
 	gc.fs.Bool("lock", false, "Lock device access to mfa routes")
 
+	gc.fs.StringVar(&gc.name, "name", "", "Device name, used with -rename")
+	gc.fs.StringVar(&gc.tags, "tags", "", "',' delimited list of device tags, used with -tag. Policies with the effects 'tag:<name>' apply to tagged devices")
+	gc.fs.Bool("rename", false, "Set device name (requires -address)")
+	gc.fs.Bool("tag", false, "Replace device tags, an empty -tags removes all tags (requires -address)")
+
+	gc.fs.StringVar(&gc.subnet, "subnet", "", "Address pool subnet, used with -add-pool")
+	gc.fs.StringVar(&gc.iface, "interface", "", "Wireguard interface the address pool is on, used with -add-pool (defaults to the default interface)")
+	gc.fs.Bool("pools", false, "List address pools")
+	gc.fs.Bool("add-pool", false, "Create an address pool that registration tokens can allocate from (requires -name, -subnet)")
+	gc.fs.Bool("del-pool", false, "Delete address pool (requires -name)")
+	gc.fs.Bool("reservations", false, "List address reservations")
+	gc.fs.Bool("reserve", false, "Reserve an address so it can only be assigned to devices owned by a user (requires -address, -username)")
+	gc.fs.Bool("unreserve", false, "Remove address reservation (requires -address)")
+	gc.fs.Bool("history", false, "Show the connection history of a device, or of all devices owned by -username (requires -address or -username)")
+
 	return gc
 }
 
@@ -55,17 +72,38 @@ func (g *devices) PrintUsage() {
 func (g *devices) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "unlock", "del", "list", "lock", "mfa_sessions":
+		case "unlock", "del", "list", "lock", "mfa_sessions", "rename", "tag",
+			"pools", "add-pool", "del-pool", "reservations", "reserve", "unreserve", "history":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "del", "unlock", "lock":
+	case "del", "unlock", "lock", "history":
 		if g.address == "" && g.username == "" {
 			return errors.New("address or username must be supplied")
 		}
-	case "list", "mfa_sessions":
+	case "rename", "tag":
+		if g.address == "" {
+			return errors.New("address must be supplied")
+		}
+	case "add-pool":
+		if g.name == "" || g.subnet == "" {
+			return errors.New("name and subnet must be supplied")
+		}
+	case "del-pool":
+		if g.name == "" {
+			return errors.New("name must be supplied")
+		}
+	case "reserve":
+		if g.address == "" || g.username == "" {
+			return errors.New("address and username must be supplied")
+		}
+	case "unreserve":
+		if g.address == "" {
+			return errors.New("address must be supplied")
+		}
+	case "list", "mfa_sessions", "pools", "reservations":
 	default:
 		return errors.New("Unknown flag: " + g.action)
 	}
@@ -113,9 +151,39 @@ func (g *devices) Run() error {
 			return err
 		}
 
-		fmt.Println("username,address,publickey,authattempts,endpoint")
+		fmt.Println("username,name,address,publickey,authattempts,endpoint,tags,created,lasthandshake,interface,pool")
 		for _, device := range ds {
-			fmt.Printf("%s,%s,%s,%d,%s\n", device.Username, device.Address, device.Publickey, device.Attempts, device.Endpoint.String())
+			fmt.Printf("%s,%s,%s,%s,%d,%s,%s,%s,%s,%s,%s\n", device.Username, device.Name, device.Address, device.Publickey, device.Attempts, device.Endpoint.String(),
+				strings.Join(device.Tags, ";"), formatTime(device.Created), formatTime(device.LastHandshake), device.GetInterfaceName(), device.Pool)
+		}
+	case "rename":
+		err := ctl.SetDeviceName(g.address, g.name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "tag":
+		var tags []string
+		if g.tags != "" {
+			tags = strings.Split(g.tags, ",")
+		}
+
+		err := ctl.SetDeviceTags(g.address, tags)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "history":
+		history, err := ctl.ConnectionHistory(g.username, g.address)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("time,type,username,address,endpoint,node,reason")
+		for _, event := range history {
+			fmt.Printf("%s,%s,%s,%s,%s,%s,%s\n", formatTime(event.Time), event.Type, event.Username, event.Address, event.Endpoint, event.Node, event.Reason)
 		}
 	case "mfa_sessions":
 		sessions, err := ctl.Sessions()
@@ -177,8 +245,63 @@ func (g *devices) Run() error {
 			return err
 		}
 
+		fmt.Println("OK")
+	case "pools":
+		pools, err := ctl.ListAddressPools()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("name,subnet,interface")
+		for _, pool := range pools {
+			fmt.Printf("%s,%s,%s\n", pool.Name, pool.Subnet, pool.Interface)
+		}
+	case "add-pool":
+		err := ctl.AddAddressPool(control.AddressPool{Name: g.name, Subnet: g.subnet, Interface: g.iface})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "del-pool":
+		err := ctl.DeleteAddressPool(g.name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "reservations":
+		reservations, err := ctl.ListAddressReservations()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("address,username")
+		for _, reservation := range reservations {
+			fmt.Printf("%s,%s\n", reservation.Address, reservation.Username)
+		}
+	case "reserve":
+		err := ctl.AddAddressReservation(control.AddressReservation{Address: g.address, Username: g.username})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "unreserve":
+		err := ctl.DeleteAddressReservation(g.address)
+		if err != nil {
+			return err
+		}
+
 		fmt.Println("OK")
 	}
 
 	return nil
 }
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
+	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/pkg/control"
 	"github.com/NHAS/wag/pkg/control/wagctl"
 )
@@ -14,6 +17,9 @@ import (
 type firewallCmd struct {
 	fs             *flag.FlagSet
 	action, socket string
+
+	address  string
+	duration time.Duration
 }
 
 func Firewall() *firewallCmd {
@@ -22,6 +28,10 @@ func Firewall() *firewallCmd {
 	}
 
 	gc.fs.Bool("list", false, "List firewall rules")
+	gc.fs.Bool("flows", false, "Print the flow log of this node as json lines, most recent first")
+	gc.fs.StringVar(&gc.address, "trace", "", "Print the verdict of every packet to or from a device address on this node, until the trace ends")
+	gc.fs.StringVar(&gc.address, "stop-trace", "", "Stop tracing a device address")
+	gc.fs.DurationVar(&gc.duration, "duration", router.DefaultTraceDuration, fmt.Sprintf("Length of a trace, at most %s", router.MaxTraceDuration))
 	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
 
 	return gc
@@ -43,13 +53,17 @@ func (g *firewallCmd) PrintUsage() {
 func (g *firewallCmd) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "list":
+		case "list", "flows", "trace", "stop-trace":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "list":
+	case "list", "flows":
+	case "trace", "stop-trace":
+		if net.ParseIP(g.address) == nil {
+			return errors.New("trace address must be an ip address")
+		}
 	default:
 		return errors.New("invalid action choice")
 	}
@@ -72,6 +86,43 @@ func (g *firewallCmd) Run() error {
 		b, _ := json.Marshal(rules)
 
 		fmt.Println(string(b))
+
+	case "flows":
+
+		flows, err := ctl.FlowLogs()
+		if err != nil {
+			return err
+		}
+
+		for _, flow := range flows {
+			b, _ := json.Marshal(flow)
+			fmt.Println(string(b))
+		}
+
+	case "trace":
+
+		fmt.Printf("tracing %s for %s\n", g.address, g.duration)
+
+		return ctl.Trace(g.address, g.duration, func(event router.TraceEvent) {
+			policy := ""
+			if event.Policy != "none" {
+				policy = " policy: " + event.Policy
+			}
+
+			fmt.Printf("%s %s %s:%d -%s-> %s:%d %s (%s)%s\n",
+				event.Time.Format(time.TimeOnly), event.Username,
+				event.Source, event.SourcePort, event.Protocol, event.Destination, event.DestinationPort,
+				event.Verdict, event.Reason, policy)
+		})
+
+	case "stop-trace":
+
+		err := ctl.StopTrace(g.address)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
 	}
 	return nil
 
@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+type grantsCmd struct {
+	fs             *flag.FlagSet
+	action, socket string
+
+	effects, mfa, allow, reason, id string
+	duration                        time.Duration
+}
+
+func Grants() *grantsCmd {
+	gc := &grantsCmd{
+		fs: flag.NewFlagSet("grants", flag.ContinueOnError),
+	}
+
+	gc.fs.Bool("list", false, "List temporary access grants and the requests waiting for approval")
+	gc.fs.Bool("add", false, "Give a user or group temporary access to routes")
+	gc.fs.Bool("approve", false, "Approve a users access request, the duration starts from approval")
+	gc.fs.Bool("reject", false, "Reject a users access request")
+	gc.fs.Bool("revoke", false, "End a grant before it expires")
+
+	gc.fs.StringVar(&gc.effects, "effects", "", "Username or group:<name> to give access to, used with -add")
+	gc.fs.StringVar(&gc.mfa, "mfa", "", "',' delimited list of routes that need mfa, used with -add")
+	gc.fs.StringVar(&gc.allow, "allow", "", "',' delimited list of public routes, used with -add")
+	gc.fs.StringVar(&gc.reason, "reason", "", "Reason for the access, required with -add")
+	gc.fs.DurationVar(&gc.duration, "duration", time.Hour, "How long the access lasts, used with -add")
+
+	gc.fs.StringVar(&gc.id, "id", "", "Grant or request to act on")
+
+	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
+
+	return gc
+}
+
+func (g *grantsCmd) FlagSet() *flag.FlagSet {
+	return g.fs
+}
+
+func (g *grantsCmd) Name() string {
+
+	return g.fs.Name()
+}
+
+func (g *grantsCmd) PrintUsage() {
+	g.fs.Usage()
+}
+
+func (g *grantsCmd) Check() error {
+	g.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "list", "add", "approve", "reject", "revoke":
+			g.action = strings.ToLower(f.Name)
+		}
+	})
+
+	switch g.action {
+	case "add":
+		if g.effects == "" {
+			return errors.New("no user or group was specified with -effects")
+		}
+
+		if strings.TrimSpace(g.reason) == "" {
+			return errors.New("a grant must have a -reason")
+		}
+	case "approve", "reject", "revoke":
+		if g.id == "" {
+			return errors.New("no -id was specified")
+		}
+	case "list":
+	default:
+		return errors.New("invalid action choice")
+	}
+
+	return nil
+}
+
+// printGrant writes a grant as shown by 'wag grants -list' and 'wag users -acls'
+func printGrant(grant data.Grant) {
+	if grant.Pending {
+		fmt.Printf("%s (pending) %s requested %s for %s: %s\n", grant.ID, grant.Effects, grant.Created.Format(time.DateTime), grant.Duration, grant.Reason)
+	} else {
+		fmt.Printf("%s %s until %s, approved by %s: %s\n", grant.ID, grant.Effects, grant.Expires.Format(time.DateTime), grant.ApprovedBy, grant.Reason)
+	}
+
+	if len(grant.Mfa) != 0 {
+		fmt.Printf("\tmfa: %s\n", strings.Join(grant.Mfa, ", "))
+	}
+
+	if len(grant.Allow) != 0 {
+		fmt.Printf("\tallow: %s\n", strings.Join(grant.Allow, ", "))
+	}
+}
+
+func (g *grantsCmd) Run() error {
+
+	ctl := wagctl.NewControlClient(g.socket)
+
+	// Recorded as the approver of the grant
+	by := "wag cli"
+	if u, err := user.Current(); err == nil {
+		by += " (" + u.Username + ")"
+	}
+
+	switch g.action {
+	case "list":
+
+		grants, err := ctl.GetGrants()
+		if err != nil {
+			return err
+		}
+
+		for _, grant := range grants {
+			printGrant(grant)
+		}
+
+	case "add":
+		err := ctl.GrantAccess(data.Grant{
+			Effects:    g.effects,
+			Mfa:        splitList(g.mfa),
+			Allow:      splitList(g.allow),
+			Reason:     g.reason,
+			Duration:   g.duration,
+			ApprovedBy: by,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "approve":
+		err := ctl.ApproveAccessRequest(g.id, by)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "reject":
+		err := ctl.RejectAccessRequest(g.id)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "revoke":
+		err := ctl.RevokeGrant(g.id)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+type lockdownCmd struct {
+	fs             *flag.FlagSet
+	action, socket string
+
+	reason      string
+	exempt      string
+	duration    time.Duration
+	blockPublic bool
+}
+
+func Lockdown() *lockdownCmd {
+	gc := &lockdownCmd{
+		fs: flag.NewFlagSet("lockdown", flag.ContinueOnError),
+	}
+
+	gc.fs.Bool("start", false, "Deauthenticate every device in the cluster and block new authorisations until the lockdown expires or is ended")
+	gc.fs.Bool("end", false, "End the current lockdown")
+	gc.fs.Bool("status", false, "Show the current lockdown and the lockdown history")
+
+	gc.fs.StringVar(&gc.reason, "reason", "", "Reason for starting or ending the lockdown, required with -start")
+	gc.fs.StringVar(&gc.exempt, "exempt", "", "',' delimited list of groups whose members keep their access, used with -start")
+	gc.fs.DurationVar(&gc.duration, "duration", time.Hour, "How long the lockdown lasts before it is lifted automatically, used with -start")
+	gc.fs.BoolVar(&gc.blockPublic, "block-public", false, "Also block public routes, leaving only the wag server reachable, used with -start")
+
+	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
+
+	return gc
+}
+
+func (g *lockdownCmd) FlagSet() *flag.FlagSet {
+	return g.fs
+}
+
+func (g *lockdownCmd) Name() string {
+
+	return g.fs.Name()
+}
+
+func (g *lockdownCmd) PrintUsage() {
+	g.fs.Usage()
+}
+
+func (g *lockdownCmd) Check() error {
+	g.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "start", "end", "status":
+			g.action = strings.ToLower(f.Name)
+		}
+	})
+
+	switch g.action {
+	case "start":
+		if strings.TrimSpace(g.reason) == "" {
+			return errors.New("a lockdown must have a -reason")
+		}
+	case "end", "status":
+	default:
+		return errors.New("invalid action choice")
+	}
+
+	return nil
+}
+
+func (g *lockdownCmd) Run() error {
+
+	ctl := wagctl.NewControlClient(g.socket)
+
+	// Recorded in the lockdown history
+	by := "wag cli"
+	if u, err := user.Current(); err == nil {
+		by += " (" + u.Username + ")"
+	}
+
+	switch g.action {
+	case "start":
+
+		var exempt []string
+		for _, group := range strings.Split(g.exempt, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				exempt = append(exempt, group)
+			}
+		}
+
+		err := ctl.StartLockdown(by, g.reason, g.duration, exempt, g.blockPublic)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("cluster in lockdown until %s\n", time.Now().Add(g.duration).Format(time.DateTime))
+
+	case "end":
+
+		err := ctl.EndLockdown(by, g.reason)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "status":
+
+		status, err := ctl.GetLockdown()
+		if err != nil {
+			return err
+		}
+
+		if status.Active {
+			fmt.Printf("LOCKDOWN until %s, started by %s: %s\n", status.Lockdown.Expires.Format(time.DateTime), status.Lockdown.By, status.Lockdown.Reason)
+			fmt.Printf("exempt groups: %s, public routes blocked: %t\n", strings.Join(status.Lockdown.ExemptGroups, ","), status.Lockdown.BlockPublic)
+		} else {
+			fmt.Println("not in lockdown")
+		}
+
+		for _, entry := range status.History {
+			fmt.Printf("%s %s by %s: %s\n", entry.Time.Format(time.DateTime), entry.Action, entry.By, entry.Reason)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+type objectsCmd struct {
+	fs             *flag.FlagSet
+	action, socket string
+
+	object, entries string
+}
+
+func Objects() *objectsCmd {
+	gc := &objectsCmd{
+		fs: flag.NewFlagSet("objects", flag.ContinueOnError),
+	}
+
+	gc.fs.Bool("list", false, "List all named networks and services")
+	gc.fs.Bool("add", false, "Add a named network or service")
+	gc.fs.Bool("edit", false, "Replace the entries of a named network or service, policies that use it are updated")
+	gc.fs.Bool("del", false, "Delete a named network or service, it must not be used by any policy")
+
+	gc.fs.StringVar(&gc.object, "object", "", "Object to act on, network:<name> or service:<name>")
+	gc.fs.StringVar(&gc.entries, "entries", "", "',' delimited list of addresses, subnets or domains for a network, or services such as 5432/tcp for a service")
+
+	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
+
+	return gc
+}
+
+func (g *objectsCmd) FlagSet() *flag.FlagSet {
+	return g.fs
+}
+
+func (g *objectsCmd) Name() string {
+
+	return g.fs.Name()
+}
+
+func (g *objectsCmd) PrintUsage() {
+	g.fs.Usage()
+}
+
+func (g *objectsCmd) Check() error {
+	g.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "list", "add", "edit", "del":
+			g.action = strings.ToLower(f.Name)
+		}
+	})
+
+	switch g.action {
+	case "add", "edit":
+		if g.entries == "" {
+			return errors.New("no entries were specified")
+		}
+		fallthrough
+	case "del":
+		if !strings.HasPrefix(g.object, "network:") && !strings.HasPrefix(g.object, "service:") {
+			return errors.New("object must be network:<name> or service:<name>")
+		}
+	case "list":
+	default:
+		return errors.New("invalid action choice")
+	}
+
+	return nil
+}
+
+func (g *objectsCmd) Run() error {
+
+	ctl := wagctl.NewControlClient(g.socket)
+
+	switch g.action {
+	case "list":
+
+		objects, err := ctl.GetObjects()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range objects {
+			fmt.Printf("%s\n\t%s\n", object.Object, strings.Join(object.Entries, ", "))
+		}
+
+	case "add":
+		err := ctl.AddObject(control.ObjectData{Object: g.object, Entries: splitList(g.entries)})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "edit":
+		err := ctl.EditObject(control.ObjectData{Object: g.object, Entries: splitList(g.entries)})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "del":
+		err := ctl.RemoveObjects([]string{g.object})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+type policyCmd struct {
+	fs             *flag.FlagSet
+	action, socket string
+
+	effects, mfa, allow, deny string
+
+	group, members, rules string
+
+	remove bool
+}
+
+func Policy() *policyCmd {
+	gc := &policyCmd{
+		fs: flag.NewFlagSet("policy", flag.ContinueOnError),
+	}
+
+	gc.fs.Bool("list", false, "List all policies")
+	gc.fs.Bool("simulate", false, "Report which users would gain or lose access if a policy or group was changed, without changing it. Also accepted as 'wag policy simulate'")
+
+	gc.fs.StringVar(&gc.effects, "effects", "", "Policy to simulate, a username, group:<name>, tag:<name> or * for everyone")
+	gc.fs.StringVar(&gc.mfa, "mfa", "", "',' delimited list of the proposed mfa routes, used with -effects")
+	gc.fs.StringVar(&gc.allow, "allow", "", "',' delimited list of the proposed public routes, used with -effects")
+	gc.fs.StringVar(&gc.deny, "deny", "", "',' delimited list of the proposed deny routes, used with -effects")
+
+	gc.fs.StringVar(&gc.group, "group", "", "Group to simulate, e.g group:nerds")
+	gc.fs.StringVar(&gc.members, "members", "", "',' delimited list of the proposed group members, used with -group")
+	gc.fs.StringVar(&gc.rules, "rules", "", "',' delimited list of the proposed group membership rules, used with -group")
+
+	gc.fs.BoolVar(&gc.remove, "remove", false, "Simulate deleting the -effects policy or -group instead of replacing it")
+
+	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
+
+	return gc
+}
+
+func (g *policyCmd) FlagSet() *flag.FlagSet {
+	return g.fs
+}
+
+func (g *policyCmd) Name() string {
+
+	return g.fs.Name()
+}
+
+func (g *policyCmd) PrintUsage() {
+	g.fs.Usage()
+}
+
+func (g *policyCmd) Check() error {
+	if g.fs.Arg(0) == "simulate" {
+		g.action = "simulate"
+		if err := g.fs.Parse(g.fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
+	g.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "list", "simulate":
+			g.action = strings.ToLower(f.Name)
+		}
+	})
+
+	switch g.action {
+	case "simulate":
+		if (g.effects == "") == (g.group == "") {
+			return errors.New("simulate requires exactly one of -effects or -group")
+		}
+
+		if g.group != "" && !strings.HasPrefix(g.group, "group:") {
+			return errors.New("group did not have the 'group:' prefix")
+		}
+	case "list":
+	default:
+		return errors.New("invalid action choice")
+	}
+
+	return nil
+}
+
+func splitList(list string) (result []string) {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+func (g *policyCmd) Run() error {
+
+	ctl := wagctl.NewControlClient(g.socket)
+
+	switch g.action {
+	case "list":
+
+		policies, err := ctl.GetPolicies()
+		if err != nil {
+			return err
+		}
+
+		for _, policy := range policies {
+			fmt.Printf("%s\n\tmfa: %s\n\tallow: %s\n\tdeny: %s\n", policy.Effects, strings.Join(policy.MfaRoutes, ", "), strings.Join(policy.PublicRoutes, ", "), strings.Join(policy.DenyRoutes, ", "))
+		}
+
+	case "simulate":
+
+		proposed := control.PolicySimulation{
+			Remove: g.remove,
+		}
+
+		if g.effects != "" {
+			proposed.Policy = &control.PolicyData{
+				Effects:      g.effects,
+				MfaRoutes:    splitList(g.mfa),
+				PublicRoutes: splitList(g.allow),
+				DenyRoutes:   splitList(g.deny),
+			}
+		} else {
+			proposed.Group = &control.GroupData{
+				Group:   g.group,
+				Members: splitList(g.members),
+				Rules:   splitList(g.rules),
+			}
+		}
+
+		report, err := ctl.SimulatePolicy(proposed)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range report.Changes {
+			subject := change.Username
+			if change.Device != "" {
+				subject += " (" + change.Device + ")"
+			}
+
+			fmt.Println(subject)
+			for _, access := range change.Gained {
+				fmt.Println("\t+", access)
+			}
+
+			for _, access := range change.Lost {
+				fmt.Println("\t-", access)
+			}
+		}
+
+		fmt.Printf("%d affected, %d users checked\n", len(report.Changes), report.UsersChecked)
+	}
+
+	return nil
+}
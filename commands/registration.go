@@ -8,6 +8,7 @@ import (
 
 	"github.com/NHAS/wag/pkg/control"
 	"github.com/NHAS/wag/pkg/control/wagctl"
+	"github.com/boombuler/barcode/qr"
 )
 
 type arrayFlags []string
@@ -32,6 +33,11 @@ type registration struct {
 	groups       arrayFlags
 	groupsString string
 	overwrite    string
+	iface        string
+	pool         string
+	address      string
+	email        string
+	qr           bool
 
 	uses int
 }
@@ -51,7 +57,13 @@ func Registration() *registration {
 
 	gc.fs.StringVar(&gc.overwrite, "overwrite", "", "Add registration token for an existing user device, will overwrite wireguard public key (but not 2FA)")
 
+	gc.fs.StringVar(&gc.iface, "interface", "", "Wireguard interface new devices are added to (Optional, defaults to the default interface)")
+	gc.fs.StringVar(&gc.pool, "pool", "", "Address pool new devices are given an address from (Optional)")
+	gc.fs.StringVar(&gc.address, "address", "", "Static address for the new device, only valid for single use tokens (Optional)")
+	gc.fs.StringVar(&gc.email, "email", "", "Email the registration link to this address, which becomes the users email address (Optional)")
+
 	gc.fs.IntVar(&gc.uses, "uses", 1, "Number of times a registration token can be used")
+	gc.fs.BoolVar(&gc.qr, "qr", false, "Print the registration link as a QR code that can be scanned to open the registration page (with -add)")
 
 	gc.fs.Bool("add", false, "Create a new enrolment token")
 	gc.fs.Bool("del", false, "Delete existing enrolment token")
@@ -106,6 +118,10 @@ func (g *registration) Check() error {
 		return errors.New("Unknown flag: " + g.action)
 	}
 
+	if g.qr && g.action != "add" {
+		return errors.New("-qr can only be used with -add")
+	}
+
 	return nil
 
 }
@@ -117,13 +133,31 @@ func (g *registration) Run() error {
 	switch g.action {
 	case "add":
 
-		result, err := ctl.NewRegistration(g.token, g.username, g.overwrite, g.uses, g.groups...)
+		result, err := ctl.NewRegistration(control.RegistrationResult{
+			Token:      g.token,
+			Username:   g.username,
+			Overwrites: g.overwrite,
+			Groups:     g.groups,
+			NumUses:    g.uses,
+			Interface:  g.iface,
+			Pool:       g.pool,
+			Address:    g.address,
+			Email:      g.email,
+		})
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("token,username\n")
-		fmt.Printf("%s,%s\n", result.Token, result.Username)
+		fmt.Printf("token,username,link\n")
+		fmt.Printf("%s,%s,%s\n", result.Token, result.Username, result.Link)
+
+		if g.qr {
+			if result.Link == "" {
+				return errors.New("wag could not create a registration link, set Webserver.Public.ExternalURL")
+			}
+
+			return printQR(result.Link)
+		}
 
 	case "del":
 
@@ -144,11 +178,57 @@ func (g *registration) Run() error {
 			return err
 		}
 
-		fmt.Println("token,username,overwrites,groups")
+		fmt.Println("token,username,overwrites,groups,interface,pool,address,email,link")
 		for _, token := range tokens {
-			fmt.Printf("%s,%s,%s,%s\n", token.Token, token.Username, token.Overwrites, token.Groups)
+			fmt.Printf("%s,%s,%s,%s,%s,%s,%s,%s,%s\n", token.Token, token.Username, token.Overwrites, token.Groups, token.Interface, token.Pool, token.Address, token.Email, token.Link)
+		}
+	}
+
+	return nil
+}
+
+// printQR draws the code with half blocks, two modules per character, black on white so it scans on dark and light terminals
+func printQR(content string) error {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return fmt.Errorf("could not create qr code: %s", err)
+	}
+
+	const quietZone = 2
+	bounds := code.Bounds()
+
+	dark := func(x, y int) bool {
+		x, y = x-quietZone, y-quietZone
+		if x < 0 || y < 0 || x >= bounds.Dx() || y >= bounds.Dy() {
+			return false
 		}
+
+		r, _, _, _ := code.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+		return r == 0
 	}
 
+	width := bounds.Dx() + 2*quietZone
+	height := bounds.Dy() + 2*quietZone
+
+	var out strings.Builder
+	for y := 0; y < height; y += 2 {
+		out.WriteString("\x1b[30;47m")
+		for x := 0; x < width; x++ {
+			switch top, bottom := dark(x, y), dark(x, y+1); {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\x1b[0m\n")
+	}
+
+	fmt.Print(out.String())
+
 	return nil
 }
@@ -13,6 +13,10 @@ import (
 
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/dnsproxy"
+	"github.com/NHAS/wag/internal/eventsinks"
+	"github.com/NHAS/wag/internal/geoip"
+	"github.com/NHAS/wag/internal/mailer"
 	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/internal/webserver"
 	"github.com/NHAS/wag/pkg/control/server"
@@ -25,6 +29,7 @@ type start struct {
 	config           string
 	clusterJoinToken string
 	noIptables       bool
+	witness          bool
 }
 
 func Start() *start {
@@ -36,6 +41,7 @@ func Start() *start {
 	gc.fs.StringVar(&gc.config, "config", "./config.json", "Configuration file location")
 
 	gc.fs.Bool("noiptables", false, "Do not add iptables rules")
+	gc.fs.Bool("witness", false, "Only run the cluster member, no wireguard device, firewall or webservers are started. Useful as a tie breaking voter")
 
 	return gc
 }
@@ -60,9 +66,15 @@ func (g *start) Check() error {
 		switch f.Name {
 		case "noiptables":
 			g.noIptables = true
+		case "witness":
+			g.witness = true
 		}
 	})
 
+	if g.witness {
+		return g.loadData(config.LoadWitness)
+	}
+
 	// Taken from: https://github.com/cilium/ebpf/blob/9444f0c545e0bda2f3db40bdaf69381df9f51af4/internal/version.go
 	var uname unix.Utsname
 	err := unix.Uname(&uname)
@@ -82,29 +94,43 @@ func (g *start) Check() error {
 		return errors.New("kernel is too old(" + kernelVersion + "), wag requires kernel version > 5.9")
 	}
 
+	return g.loadData(config.Load)
+}
+
+func (g *start) loadData(loadConfig func(path string) error) error {
 	if g.clusterJoinToken == "" {
-		err = config.Load(g.config)
+		err := loadConfig(g.config)
 		if err != nil {
 			return err
 		}
+	} else {
+		config.Values.Clustering.Witness = g.witness
 	}
 
-	err = data.Load(config.Values.DatabaseLocation, g.clusterJoinToken, false)
+	err := data.Load(config.Values.DatabaseLocation, g.clusterJoinToken, false)
 	if err != nil {
 		return fmt.Errorf("cannot load database: %v", err)
 	}
 
 	return nil
-
 }
 
 func teardown(force bool) {
+	if config.Values.Clustering.Witness {
+		// Only the control socket was started, and the wireguard device named in the config may belong to a different wag instance on this host
+		server.TearDown()
+		return
+	}
+
 	router.TearDown(force)
 	// Tear down Unix socket
 	server.TearDown()
 
 	ui.Teardown()
 	webserver.Teardown()
+	dnsproxy.Teardown()
+	eventsinks.Teardown()
+	mailer.Teardown()
 }
 
 func clusterState(noIptables bool, errorChan chan<- error) func(string) {
@@ -159,11 +185,29 @@ func clusterState(noIptables bool, errorChan chan<- error) func(string) {
 						return
 					}
 
+					err = dnsproxy.Start(errorChan)
+					if err != nil {
+						errorChan <- fmt.Errorf("unable to start dns proxy: %v", err)
+						return
+					}
+
 					err = ui.StartWebServer(errorChan)
 					if err != nil {
 						errorChan <- fmt.Errorf("unable to start management web server: %v", err)
 						return
 					}
+
+					err = eventsinks.Start()
+					if err != nil {
+						errorChan <- fmt.Errorf("unable to start event sinks: %v", err)
+						return
+					}
+
+					err = mailer.Start()
+					if err != nil {
+						errorChan <- fmt.Errorf("unable to start email notifications: %v", err)
+						return
+					}
 				}
 
 				if !data.IsLearner() {
@@ -192,6 +236,15 @@ func (g *start) Run() error {
 	var err error
 	defer data.TearDown()
 
+	// Witnesses never see a device connect so have no use for the geoip database
+	if config.Values.GeoIP.DatabasePath != "" && !config.Values.Clustering.Witness {
+		err = geoip.Load(config.Values.GeoIP.DatabasePath)
+		if err != nil {
+			return err
+		}
+		defer geoip.Close()
+	}
+
 	errorChan := make(chan error)
 
 	_, err = data.RegisterClusterHealthListener(clusterState(g.noIptables, errorChan))
@@ -199,8 +252,25 @@ func (g *start) Run() error {
 		return err
 	}
 
+	restartChan := make(chan string, 1)
+	_, err = data.RegisterRestartListener(func(binaryPath string) {
+		select {
+		case restartChan <- binaryPath:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+
 	if config.Values.Clustering.Witness {
 		log.Println("this node is a witness, and will not start a wireguard device")
+
+		// Started regardless of cluster health so the witness can always be unmarked or shut down
+		err = server.StartWitnessControlSocket()
+		if err != nil {
+			return fmt.Errorf("unable to create control socket: %v", err)
+		}
 	}
 
 	if data.IsLearner() {
@@ -235,7 +305,16 @@ func (g *start) Run() error {
 
 	log.Printf("%s starting, Ctrl + C to stop", wagType)
 
-	err = <-errorChan
+	select {
+	case err = <-errorChan:
+	case binaryPath := <-restartChan:
+		log.Printf("Cluster requested restart with %q for upgrade", binaryPath)
+
+		teardown(true)
+		data.TearDown()
+
+		return restart(binaryPath)
+	}
 
 	teardown(true)
 
@@ -245,3 +324,24 @@ func (g *start) Run() error {
 
 	return nil
 }
+
+// restart replaces the current process with binaryPath, keeping the same arguments.
+// The join token is removed as this node is already a member of the cluster
+func restart(binaryPath string) error {
+	args := []string{binaryPath}
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		if arg == "-join" || arg == "--join" {
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(arg, "-join=") || strings.HasPrefix(arg, "--join=") {
+			continue
+		}
+
+		args = append(args, arg)
+	}
+
+	return syscall.Exec(binaryPath, args, os.Environ())
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/NHAS/wag/pkg/control"
@@ -33,6 +34,8 @@ func Users() *users {
 
 	gc.fs.Bool("reset-mfa", false, "Reset MFA details, invalids all session and set MFA to be shown")
 
+	gc.fs.Bool("acls", false, "Show the effective policies of a user, including temporary grants")
+
 	return gc
 }
 
@@ -52,13 +55,13 @@ func (g *users) PrintUsage() {
 func (g *users) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "lockaccount", "unlockaccount", "del", "list", "reset-mfa":
+		case "lockaccount", "unlockaccount", "del", "list", "reset-mfa", "acls":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "del", "unlockaccount", "lockaccount", "reset-mfa":
+	case "del", "unlockaccount", "lockaccount", "reset-mfa", "acls":
 		if g.username == "" {
 			return errors.New("username must be supplied")
 		}
@@ -117,6 +120,30 @@ func (g *users) Run() error {
 			return err
 		}
 		fmt.Println("OK")
+	case "acls":
+		acl, err := ctl.GetUsersAcls(g.username)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n\tmfa: %s\n\tallow: %s\n\tdeny: %s\n", g.username, strings.Join(acl.Mfa, ", "), strings.Join(acl.Allow, ", "), strings.Join(acl.Deny, ", "))
+
+		groups, err := ctl.UserGroups(g.username)
+		if err != nil {
+			return err
+		}
+
+		grants, err := ctl.GetGrants()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("temporary grants:")
+		for _, grant := range grants {
+			if grant.Effects == g.username || slices.Contains(groups, grant.Effects) {
+				printGrant(grant)
+			}
+		}
 	}
 
 	return nil
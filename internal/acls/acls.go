@@ -1,7 +1,17 @@
 package acls
 
+import "slices"
+
 type Acl struct {
 	Mfa   []string `json:",omitempty"`
 	Allow []string `json:",omitempty"`
 	Deny  []string `json:",omitempty"`
+
+	// Restricts the policy to devices on the named wireguard interfaces, if empty the policy applies on all interfaces
+	Interfaces []string `json:",omitempty"`
+}
+
+// AppliesTo returns whether the policy should be applied to devices on the wireguard interface iface
+func (a Acl) AppliesTo(iface string) bool {
+	return len(a.Interfaces) == 0 || slices.Contains(a.Interfaces, iface)
 }
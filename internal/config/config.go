@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -26,6 +27,8 @@ type webserverDetails struct {
 
 type usualWeb struct {
 	ListenAddress string
+	// Url the endpoint is reached at, used in links wag sends e.g https://vpn.example.com
+	ExternalURL string `json:",omitempty"`
 	webserverDetails
 }
 
@@ -43,6 +46,22 @@ type Acls struct {
 	//Username -> groups name
 	rGroupLookup map[string]map[string]bool
 	Policies     map[string]*acls.Acl
+
+	// Group name -> session overrides for members of the group
+	Sessions map[string]GroupSession `json:",omitempty"`
+
+	// Group name -> rules that make users members without being listed, e.g "claim:department=eng" or "mfa=webauthn"
+	Rules map[string][]string `json:",omitempty"`
+}
+
+// GroupSession overrides the cluster wide session timeouts, unset values use the cluster wide setting and -1 disables the timeout
+type GroupSession struct {
+	InactivityTimeoutMinutes  *int `json:",omitempty"`
+	MaxSessionLifetimeMinutes *int `json:",omitempty"`
+
+	// Members may only register and authorise from these networks or ISO country codes, country codes need GeoIP.DatabasePath
+	AllowedNetworks  []string `json:",omitempty"`
+	AllowedCountries []string `json:",omitempty"`
 }
 
 type ClusteringDetails struct {
@@ -54,10 +73,20 @@ type ClusteringDetails struct {
 	Witness          bool
 	ClusterState     string
 
+	DeviceRoaming DeviceRoaming `json:",omitempty"`
+
 	TLSManagerStorage   string
 	TLSManagerListenURL string
 }
 
+// DeviceRoaming controls whether devices associated with a drained or dead node are moved to a healthy one
+type DeviceRoaming struct {
+	Enabled bool
+
+	// Force devices to redo MFA after they have been moved to another node
+	RequireReauthentication bool
+}
+
 type Config struct {
 	path          string
 	Socket        string `json:",omitempty"`
@@ -124,18 +153,38 @@ type Config struct {
 		ServerPersistentKeepAlive int
 
 		DNS []string `json:",omitempty"`
+
+		// Additional isolated tunnels run alongside the default device, all cluster members must define the same interfaces
+		Interfaces []WireguardInterface `json:",omitempty"`
 	}
 
 	DatabaseLocation string
 
 	Acls Acls
+
+	// Optional dns server on the tunnel, when enabled clients are configured to use it instead of the cluster wide dns servers
+	DNSProxy DNSProxy `json:",omitempty"`
+
+	// Flow events from the firewall, shown on the diagnostics page and optionally exported
+	FlowLogs FlowLogs `json:",omitempty"`
+
+	GeoIP GeoIP `json:",omitempty"`
+
+	// Webhooks, syslog servers and files that wag events are sent to
+	EventSinks []EventSink `json:",omitempty"`
+
+	// Smtp server used to email users and admins
+	Email Email `json:",omitempty"`
+
+	// How much of each devices connection history is kept
+	ConnectionHistory ConnectionHistory `json:",omitempty"`
 }
 
 var (
 	Values Config
 )
 
-func load(path string) (c Config, err error) {
+func load(path string, witness bool) (c Config, err error) {
 	configFile, err := os.Open(path)
 	if err != nil {
 		return c, fmt.Errorf("unable to load configuration file from %s: %v", path, err)
@@ -148,6 +197,8 @@ func load(path string) (c Config, err error) {
 		return c, fmt.Errorf("unable to load configuration file from %s: %v", path, err)
 	}
 
+	c.Clustering.Witness = c.Clustering.Witness || witness
+
 	if c.Socket == "" {
 		c.Socket = control.DefaultWagSocket
 	}
@@ -175,52 +226,85 @@ func load(path string) (c Config, err error) {
 		return c, fmt.Errorf("tls manager listen url must be https://")
 	}
 
-	i, err := net.InterfaceByName(c.Wireguard.DevName)
-	if err == nil {
-		//A device already exists, so we're assuming it was externally set up (with something like wg-quick)
-		c.Wireguard.External = true
+	// Witnesses only run the etcd member, so do not need a working wireguard configuration
+	if !c.Clustering.Witness {
+		i, err := net.InterfaceByName(c.Wireguard.DevName)
+		if err == nil {
+			//A device already exists, so we're assuming it was externally set up (with something like wg-quick)
+			c.Wireguard.External = true
 
-		addresses, err := i.Addrs()
-		if err != nil {
-			return c, fmt.Errorf("unable to get address for interface %s: %v", c.Wireguard.DevName, err)
-		}
+			addresses, err := i.Addrs()
+			if err != nil {
+				return c, fmt.Errorf("unable to get address for interface %s: %v", c.Wireguard.DevName, err)
+			}
 
-		if len(addresses) < 1 {
-			return c, errors.New("wireguard interface does not have an ip address")
-		}
+			if len(addresses) < 1 {
+				return c, errors.New("wireguard interface does not have an ip address")
+			}
 
-		addr := addresses[0].String()
-		for i := len(addr) - 1; i > 0; i-- {
-			if addr[i] == ':' || addr[i] == '/' {
-				addr = addr[:i]
-				break
+			addr := addresses[0].String()
+			for i := len(addr) - 1; i > 0; i-- {
+				if addr[i] == ':' || addr[i] == '/' {
+					addr = addr[:i]
+					break
+				}
+			}
+
+			c.Wireguard.ServerAddress = net.ParseIP(addr)
+			if c.Wireguard.ServerAddress == nil {
+				return c, fmt.Errorf("unable to find server address from tunnel interface:  '%s'", addr)
+			}
+
+			_, c.Wireguard.Range, err = net.ParseCIDR(addresses[0].String())
+			if err != nil {
+				return c, errors.New("unable to parse VPN range from tune device address: " + addresses[0].String() + " : " + err.Error())
+			}
+
+		} else {
+			// A device doesnt already exist
+			c.Wireguard.ServerAddress, c.Wireguard.Range, err = net.ParseCIDR(c.Wireguard.Address)
+			if err != nil {
+				return c, errors.New("wireguard address invalid: " + err.Error())
+			}
+
+			_, err = wgtypes.ParseKey(c.Wireguard.PrivateKey)
+			if err != nil {
+				return c, errors.New("cannot parse wireguard key: " + err.Error())
+			}
+
+			if c.Wireguard.ListenPort == 0 {
+				return c, errors.New("wireguard ListenPort not set")
 			}
 		}
 
-		c.Wireguard.ServerAddress = net.ParseIP(addr)
-		if c.Wireguard.ServerAddress == nil {
-			return c, fmt.Errorf("unable to find server address from tunnel interface:  '%s'", addr)
+		err = validateInterfaces(&c)
+		if err != nil {
+			return c, err
 		}
 
-		_, c.Wireguard.Range, err = net.ParseCIDR(addresses[0].String())
+		err = validateDNSProxy(&c)
 		if err != nil {
-			return c, errors.New("unable to parse VPN range from tune device address: " + addresses[0].String() + " : " + err.Error())
+			return c, err
 		}
 
-	} else {
-		// A device doesnt already exist
-		c.Wireguard.ServerAddress, c.Wireguard.Range, err = net.ParseCIDR(c.Wireguard.Address)
+		err = validateFlowLogs(&c)
 		if err != nil {
-			return c, errors.New("wireguard address invalid: " + err.Error())
+			return c, err
 		}
 
-		_, err = wgtypes.ParseKey(c.Wireguard.PrivateKey)
+		err = validateGeoIP(&c)
 		if err != nil {
-			return c, errors.New("cannot parse wireguard key: " + err.Error())
+			return c, err
 		}
 
-		if c.Wireguard.ListenPort == 0 {
-			return c, errors.New("wireguard ListenPort not set")
+		err = validateEventSinks(&c)
+		if err != nil {
+			return c, err
+		}
+
+		err = validateConnectionHistory(&c)
+		if err != nil {
+			return c, err
 		}
 	}
 
@@ -270,6 +354,22 @@ func load(path string) (c Config, err error) {
 		return c, fmt.Errorf("public listen address is not set (Public.ListenAddress)")
 	}
 
+	for name, externalURL := range map[string]string{"Webserver.Public": c.Webserver.Public.ExternalURL, "ManagementUI": c.ManagementUI.ExternalURL} {
+		if externalURL == "" {
+			continue
+		}
+
+		u, err := url.Parse(externalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c, fmt.Errorf("%s.ExternalURL %q must be a http or https url", name, externalURL)
+		}
+	}
+
+	err = validateEmail(&c)
+	if err != nil {
+		return c, err
+	}
+
 	c.Wireguard.DNS, err = validateDns(c.Wireguard.DNS)
 	if err != nil {
 		return c, err
@@ -331,6 +431,28 @@ func load(path string) (c Config, err error) {
 		}
 	}
 
+	for group := range c.Acls.Rules {
+		if !strings.HasPrefix(group, "group:") {
+			return c, fmt.Errorf("group rules group does not have 'group:' prefix: %s", group)
+		}
+	}
+
+	for group, session := range c.Acls.Sessions {
+		if !strings.HasPrefix(group, "group:") {
+			return c, fmt.Errorf("session policy group does not have 'group:' prefix: %s", group)
+		}
+
+		for _, timeout := range []*int{session.InactivityTimeoutMinutes, session.MaxSessionLifetimeMinutes} {
+			if timeout != nil && (*timeout == 0 || *timeout < -1) {
+				return c, fmt.Errorf("session policy for %s has an invalid timeout %d (must be positive, or -1 to disable it)", group, *timeout)
+			}
+		}
+
+		if len(session.AllowedCountries) != 0 && c.GeoIP.DatabasePath == "" {
+			return c, fmt.Errorf("session policy for %s restricts countries, which requires a geoip database (GeoIP.DatabasePath)", group)
+		}
+	}
+
 	for _, acl := range c.Acls.Policies {
 		err = routetypes.ValidateRules(acl.Mfa, acl.Allow, acl.Deny)
 		if err != nil {
@@ -371,7 +493,15 @@ func validateDns(input []string) (newDnsEntries []string, err error) {
 func Load(path string) error {
 
 	var err error
-	Values, err = load(path)
+	Values, err = load(path, false)
+	return err
+}
+
+// LoadWitness loads the configuration for a node that only participates in etcd voting, regardless of the Clustering.Witness setting
+func LoadWitness(path string) error {
+
+	var err error
+	Values, err = load(path, true)
 	return err
 }
 
@@ -0,0 +1,32 @@
+package config
+
+import "fmt"
+
+// ConnectionHistory bounds the per device record of endpoint changes, handshakes and (de)authorisations kept in etcd
+type ConnectionHistory struct {
+	// Most events kept per device, older events are removed first. Defaults to 200
+	MaxEvents int `json:",omitempty"`
+
+	// Days an event is kept for, defaults to 30
+	RetentionDays int `json:",omitempty"`
+}
+
+func validateConnectionHistory(c *Config) error {
+	if c.ConnectionHistory.MaxEvents == 0 {
+		c.ConnectionHistory.MaxEvents = 200
+	}
+
+	if c.ConnectionHistory.MaxEvents < 0 {
+		return fmt.Errorf("connection history max events %d is invalid", c.ConnectionHistory.MaxEvents)
+	}
+
+	if c.ConnectionHistory.RetentionDays == 0 {
+		c.ConnectionHistory.RetentionDays = 30
+	}
+
+	if c.ConnectionHistory.RetentionDays < 0 {
+		return fmt.Errorf("connection history retention %d days is invalid", c.ConnectionHistory.RetentionDays)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNSProxy configures the optional dns server that wag runs on the server address of every wireguard interface
+type DNSProxy struct {
+	Enabled bool
+
+	// Defaults to 53
+	ListenPort int `json:",omitempty"`
+
+	// Resolvers used for names that do not match a zone, host or host:port. If not set the cluster wide dns servers are used
+	Upstream []string `json:",omitempty"`
+
+	// Answer with NXDOMAIN when none of the addresses a name resolves to can be reached under the requesting device's policies
+	EnforceAcls bool `json:",omitempty"`
+
+	Zones []DNSZone `json:",omitempty"`
+}
+
+// DNSZone overrides resolution for a domain and all of its subdomains, optionally only for members of some groups (split horizon)
+type DNSZone struct {
+	// Domain the zone is responsible for, e.g "corp.example.com"
+	Name string
+
+	// Groups this zone applies to, e.g "group:ops". If empty the zone applies to everyone
+	Groups []string `json:",omitempty"`
+
+	// Resolvers to forward queries within this zone to, host or host:port.
+	// If not set names without a record in Records are answered with NXDOMAIN
+	Forward []string `json:",omitempty"`
+
+	// Static A records, keys are either fully qualified or relative to the zone name ("@" is the zone name itself)
+	Records map[string][]string `json:",omitempty"`
+}
+
+// NormaliseDNSName lower cases a domain name and removes the trailing root label
+func NormaliseDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func normaliseResolvers(resolvers []string) ([]string, error) {
+	var result []string
+	for _, resolver := range resolvers {
+		host, port, err := net.SplitHostPort(resolver)
+		if err != nil {
+			host, port = resolver, "53"
+		}
+
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("dns resolver %q must be an ip address", resolver)
+		}
+
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("dns resolver %q has an invalid port", resolver)
+		}
+
+		result = append(result, net.JoinHostPort(host, port))
+	}
+
+	return result, nil
+}
+
+func validateDNSProxy(c *Config) error {
+	if !c.DNSProxy.Enabled {
+		return nil
+	}
+
+	if c.DNSProxy.ListenPort == 0 {
+		c.DNSProxy.ListenPort = 53
+	}
+
+	if c.DNSProxy.ListenPort < 0 || c.DNSProxy.ListenPort > 65535 {
+		return fmt.Errorf("dns proxy listen port %d is invalid", c.DNSProxy.ListenPort)
+	}
+
+	var err error
+	c.DNSProxy.Upstream, err = normaliseResolvers(c.DNSProxy.Upstream)
+	if err != nil {
+		return err
+	}
+
+	for i := range c.DNSProxy.Zones {
+		zone := &c.DNSProxy.Zones[i]
+
+		zone.Name = NormaliseDNSName(zone.Name)
+		if zone.Name == "" {
+			return fmt.Errorf("dns zone %d has no name", i)
+		}
+
+		for _, group := range zone.Groups {
+			if !strings.HasPrefix(group, "group:") {
+				return fmt.Errorf("dns zone %q group %q does not have the 'group:' prefix", zone.Name, group)
+			}
+		}
+
+		zone.Forward, err = normaliseResolvers(zone.Forward)
+		if err != nil {
+			return fmt.Errorf("dns zone %q: %s", zone.Name, err)
+		}
+
+		records := map[string][]string{}
+		for name, addresses := range zone.Records {
+			name = NormaliseDNSName(name)
+			switch {
+			case name == "@" || name == "":
+				name = zone.Name
+			case name != zone.Name && !strings.HasSuffix(name, "."+zone.Name):
+				name = name + "." + zone.Name
+			}
+
+			for _, address := range addresses {
+				if ip := net.ParseIP(address); ip == nil || ip.To4() == nil {
+					return fmt.Errorf("dns zone %q record %q address %q is not an ipv4 address", zone.Name, name, address)
+				}
+			}
+
+			records[name] = append(records[name], addresses...)
+		}
+		zone.Records = records
+	}
+
+	return nil
+}
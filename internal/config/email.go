@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"slices"
+)
+
+// Email configures the smtp server wag sends user notifications and admin digests through, nothing is sent if SMTPServer is unset
+type Email struct {
+	// host:port of the smtp server
+	SMTPServer string `json:",omitempty"`
+	// none, starttls or tls, defaults to starttls
+	Security string `json:",omitempty"`
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+	From     string `json:",omitempty"`
+
+	// Users without an email address, whose username is not one, are mailed at <username>@UserDomain
+	UserDomain string `json:",omitempty"`
+
+	// Which user notifications to send, any of device, lockout and registration. Defaults to all of them
+	UserNotifications []string `json:",omitempty"`
+
+	// Addresses sent a digest of the management UI notifications, such as node errors
+	Admins []string `json:",omitempty"`
+	// Minutes between admin digests, defaults to 60
+	DigestIntervalMinutes int `json:",omitempty"`
+
+	// Directory of templates that replace the built in ones, templates not in the directory use the built in version
+	TemplatesDirectory string `json:",omitempty"`
+}
+
+func (e Email) Enabled() bool {
+	return e.SMTPServer != ""
+}
+
+// Notifies returns whether users should be sent the notification
+func (e Email) Notifies(notification string) bool {
+	return e.Enabled() && slices.Contains(e.UserNotifications, notification)
+}
+
+func validateEmail(c *Config) error {
+	if !c.Email.Enabled() {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.Email.SMTPServer); err != nil {
+		return fmt.Errorf("email smtp server %q must be host:port: %s", c.Email.SMTPServer, err)
+	}
+
+	if c.Email.Security == "" {
+		c.Email.Security = "starttls"
+	}
+
+	switch c.Email.Security {
+	case "none", "starttls", "tls":
+	default:
+		return fmt.Errorf("email security %q must be none, starttls or tls", c.Email.Security)
+	}
+
+	if c.Email.Password != "" && c.Email.Username == "" {
+		return errors.New("email has a password but no username")
+	}
+
+	if _, err := mail.ParseAddress(c.Email.From); err != nil {
+		return fmt.Errorf("email from address %q is invalid: %s", c.Email.From, err)
+	}
+
+	for _, admin := range c.Email.Admins {
+		if _, err := mail.ParseAddress(admin); err != nil {
+			return fmt.Errorf("email admin address %q is invalid: %s", admin, err)
+		}
+	}
+
+	if c.Email.UserNotifications == nil {
+		c.Email.UserNotifications = []string{"device", "lockout", "registration"}
+	}
+
+	for _, notification := range c.Email.UserNotifications {
+		switch notification {
+		case "device", "lockout", "registration":
+		default:
+			return fmt.Errorf("email user notification %q must be device, lockout or registration", notification)
+		}
+	}
+
+	if c.Email.DigestIntervalMinutes == 0 {
+		c.Email.DigestIntervalMinutes = 60
+	}
+
+	if c.Email.DigestIntervalMinutes < 0 {
+		return fmt.Errorf("email digest interval %d is invalid", c.Email.DigestIntervalMinutes)
+	}
+
+	if c.Email.TemplatesDirectory != "" {
+		info, err := os.Stat(c.Email.TemplatesDirectory)
+		if err != nil {
+			return fmt.Errorf("could not check email TemplatesDirectory (%s): %s", c.Email.TemplatesDirectory, err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("email TemplatesDirectory (%s) was not a directory, please check your configuration", c.Email.TemplatesDirectory)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+// EventSink sends wag events (user, device, policy and cluster changes) somewhere outside of wag
+type EventSink struct {
+	// Used in log messages when the sink fails, defaults to the type
+	Name string `json:",omitempty"`
+
+	// webhook, syslog or file
+	Type string
+
+	// Event types to send, e.g "user.locked" or "device.*", every event is sent if empty
+	Events []string `json:",omitempty"`
+
+	// Webhook: events are POSTed as json to URL, signed with HMAC-SHA256 using Secret
+	URL    string `json:",omitempty"`
+	Secret string `json:",omitempty"`
+	// Attempts made to deliver a webhook before the event is dropped, defaults to 5
+	MaxAttempts int `json:",omitempty"`
+
+	// Syslog: RFC5424 messages to Address (host:port) over udp, tcp or tls, defaults to udp
+	Address  string `json:",omitempty"`
+	Protocol string `json:",omitempty"`
+	// CA used to verify a tls syslog server, the system roots are used if unset
+	CACertPath string `json:",omitempty"`
+	// Syslog facility number, defaults to 10 (authpriv)
+	Facility *int `json:",omitempty"`
+
+	// File: events are appended to Path as one json object per line
+	Path string `json:",omitempty"`
+}
+
+func validateEventSinks(c *Config) error {
+	names := map[string]bool{}
+
+	for i := range c.EventSinks {
+		sink := &c.EventSinks[i]
+
+		if sink.Name == "" {
+			sink.Name = sink.Type
+		}
+
+		if names[sink.Name] {
+			return fmt.Errorf("event sink name %q is used more than once, set Name to tell them apart", sink.Name)
+		}
+		names[sink.Name] = true
+
+		switch sink.Type {
+		case "webhook":
+			u, err := url.Parse(sink.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("event sink %s url %q must be a http or https url", sink.Name, sink.URL)
+			}
+
+			if sink.Secret == "" {
+				return fmt.Errorf("event sink %s has no secret to sign events with", sink.Name)
+			}
+
+			if sink.MaxAttempts == 0 {
+				sink.MaxAttempts = 5
+			}
+
+			if sink.MaxAttempts < 0 {
+				return fmt.Errorf("event sink %s max attempts %d is invalid", sink.Name, sink.MaxAttempts)
+			}
+
+		case "syslog":
+			if sink.Protocol == "" {
+				sink.Protocol = "udp"
+			}
+
+			switch sink.Protocol {
+			case "udp", "tcp", "tls":
+			default:
+				return fmt.Errorf("event sink %s protocol %q must be udp, tcp or tls", sink.Name, sink.Protocol)
+			}
+
+			if _, _, err := net.SplitHostPort(sink.Address); err != nil {
+				return fmt.Errorf("event sink %s address %q must be host:port: %s", sink.Name, sink.Address, err)
+			}
+
+			if sink.CACertPath != "" {
+				if sink.Protocol != "tls" {
+					return fmt.Errorf("event sink %s has a CACertPath but does not use tls", sink.Name)
+				}
+
+				if _, err := os.Stat(sink.CACertPath); err != nil {
+					return fmt.Errorf("event sink %s ca certificate %q is not readable: %s", sink.Name, sink.CACertPath, err)
+				}
+			}
+
+			if sink.Facility == nil {
+				sink.Facility = new(int)
+				*sink.Facility = 10
+			}
+
+			if *sink.Facility < 0 || *sink.Facility > 23 {
+				return fmt.Errorf("event sink %s facility %d must be between 0 and 23", sink.Name, *sink.Facility)
+			}
+
+		case "file":
+			if sink.Path == "" {
+				return fmt.Errorf("event sink %s has no path", sink.Name)
+			}
+
+		case "":
+			return errors.New("event sink has no type, must be webhook, syslog or file")
+		default:
+			return fmt.Errorf("event sink %s type %q must be webhook, syslog or file", sink.Name, sink.Type)
+		}
+	}
+
+	return nil
+}
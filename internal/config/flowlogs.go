@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// FlowLogs configures the flow events emitted by the xdp firewall for sampled packets and packets matching policies with the "log" flag
+type FlowLogs struct {
+	// Emit a flow event for 1 in SampleRate packets, 0 disables sampling so only flagged policies are logged
+	SampleRate uint32 `json:",omitempty"`
+
+	// Number of flows kept in memory for the diagnostics page, defaults to 1000
+	Size int `json:",omitempty"`
+
+	// Append every flow event to this file as a json object per line
+	JSONLinesPath string `json:",omitempty"`
+
+	// Periodically export flows as IPFIX over udp to this collector, host:port
+	IPFIXCollector string `json:",omitempty"`
+}
+
+func validateFlowLogs(c *Config) error {
+	if c.FlowLogs.Size == 0 {
+		c.FlowLogs.Size = 1000
+	}
+
+	if c.FlowLogs.Size < 0 {
+		return fmt.Errorf("flow log size %d is invalid", c.FlowLogs.Size)
+	}
+
+	if c.FlowLogs.IPFIXCollector != "" {
+		if _, err := net.ResolveUDPAddr("udp", c.FlowLogs.IPFIXCollector); err != nil {
+			return fmt.Errorf("flow log ipfix collector %q is invalid: %s", c.FlowLogs.IPFIXCollector, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// GeoIP configures country based source restrictions and impossible travel detection from a local MaxMind format database
+type GeoIP struct {
+	// Path to a MaxMind DB format file, e.g GeoLite2-City.mmdb. A country database is enough for country restrictions, impossible travel detection needs city coordinates
+	DatabasePath string `json:",omitempty"`
+
+	// Deauthenticate devices whose wireguard endpoint moves faster than this between consecutive addresses, 0 disables impossible travel detection
+	MaxTravelSpeedKmh float64 `json:",omitempty"`
+}
+
+func validateGeoIP(c *Config) error {
+	if c.GeoIP.MaxTravelSpeedKmh < 0 {
+		return fmt.Errorf("geoip max travel speed %f is invalid", c.GeoIP.MaxTravelSpeedKmh)
+	}
+
+	if c.GeoIP.DatabasePath == "" {
+		if c.GeoIP.MaxTravelSpeedKmh > 0 {
+			return errors.New("impossible travel detection requires a geoip database (GeoIP.DatabasePath)")
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(c.GeoIP.DatabasePath); err != nil {
+		return fmt.Errorf("geoip database %q is not readable: %s", c.GeoIP.DatabasePath, err)
+	}
+
+	return nil
+}
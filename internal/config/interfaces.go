@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultInterface is the name given to the wireguard device described directly by the Wireguard section of the config
+const DefaultInterface = "default"
+
+// WireguardInterface is an additional isolated tunnel (network segment) run by the same wag instance.
+// Devices registered to an interface are given addresses from its range, and policies can be scoped to only apply to devices on specific interfaces
+type WireguardInterface struct {
+	// Name used to refer to this interface in registration tokens, policies and the UI, e.g "vendors"
+	Name string
+
+	DevName    string
+	ListenPort int
+	PrivateKey string
+	Address    string
+	MTU        int
+
+	// If not set the cluster wide dns servers are used
+	DNS []string `json:",omitempty"`
+
+	// Devices on this interface get the policies of this group, without the user becoming a member of it on other interfaces
+	DefaultGroup string `json:",omitempty"`
+
+	//Not externally configurable
+	Range         *net.IPNet `json:"-"`
+	ServerAddress net.IP     `json:"-"`
+}
+
+// AllInterfaces returns the default wireguard device followed by any additional interfaces
+func AllInterfaces() []WireguardInterface {
+	result := []WireguardInterface{
+		{
+			Name:          DefaultInterface,
+			DevName:       Values.Wireguard.DevName,
+			ListenPort:    Values.Wireguard.ListenPort,
+			PrivateKey:    Values.Wireguard.PrivateKey,
+			Address:       Values.Wireguard.Address,
+			MTU:           Values.Wireguard.MTU,
+			DNS:           Values.Wireguard.DNS,
+			Range:         Values.Wireguard.Range,
+			ServerAddress: Values.Wireguard.ServerAddress,
+		},
+	}
+
+	return append(result, Values.Wireguard.Interfaces...)
+}
+
+// GetInterface returns the interface with name, an empty name refers to the default interface
+func GetInterface(name string) (WireguardInterface, error) {
+	if name == "" {
+		name = DefaultInterface
+	}
+
+	for _, iface := range AllInterfaces() {
+		if iface.Name == name {
+			return iface, nil
+		}
+	}
+
+	return WireguardInterface{}, fmt.Errorf("wireguard interface %q does not exist", name)
+}
+
+// InterfaceForAddress returns the interface whose range contains address, or the default interface if none do
+func InterfaceForAddress(address string) WireguardInterface {
+	ip := net.ParseIP(address)
+
+	all := AllInterfaces()
+	for _, iface := range all[1:] {
+		if ip != nil && iface.Range != nil && iface.Range.Contains(ip) {
+			return iface
+		}
+	}
+
+	return all[0]
+}
+
+func validateInterfaces(c *Config) error {
+	var (
+		names   = map[string]bool{DefaultInterface: true}
+		devices = map[string]bool{c.Wireguard.DevName: true}
+		ports   = map[int]bool{c.Wireguard.ListenPort: true}
+		ranges  = []*net.IPNet{c.Wireguard.Range}
+	)
+
+	for i := range c.Wireguard.Interfaces {
+		iface := &c.Wireguard.Interfaces[i]
+
+		if iface.Name == "" {
+			return fmt.Errorf("wireguard interface %d has no name", i)
+		}
+
+		if names[iface.Name] {
+			return fmt.Errorf("wireguard interface name %q is used more than once", iface.Name)
+		}
+		names[iface.Name] = true
+
+		if iface.DevName == "" || devices[iface.DevName] {
+			return fmt.Errorf("wireguard interface %q must have a unique DevName", iface.Name)
+		}
+		devices[iface.DevName] = true
+
+		if iface.ListenPort == 0 || ports[iface.ListenPort] {
+			return fmt.Errorf("wireguard interface %q must have a unique ListenPort", iface.Name)
+		}
+		ports[iface.ListenPort] = true
+
+		var err error
+		iface.ServerAddress, iface.Range, err = net.ParseCIDR(iface.Address)
+		if err != nil {
+			return fmt.Errorf("wireguard interface %q address invalid: %s", iface.Name, err)
+		}
+
+		for _, r := range ranges {
+			if r != nil && (r.Contains(iface.Range.IP) || iface.Range.Contains(r.IP)) {
+				return fmt.Errorf("wireguard interface %q range %s overlaps with %s", iface.Name, iface.Range, r)
+			}
+		}
+		ranges = append(ranges, iface.Range)
+
+		_, err = wgtypes.ParseKey(iface.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("wireguard interface %q cannot parse key: %s", iface.Name, err)
+		}
+
+		iface.DNS, err = validateDns(iface.DNS)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -7,12 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"sort"
 
 	"github.com/NHAS/wag/internal/acls"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/routetypes"
 	"github.com/NHAS/wag/pkg/control"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/clientv3util"
 	"golang.org/x/exp/maps"
@@ -20,10 +22,27 @@ import (
 
 func SetAcl(effects string, policy acls.Acl, overwrite bool) error {
 
-	if err := routetypes.ValidateRules(policy.Mfa, policy.Allow, policy.Deny); err != nil {
+	objects, err := getObjects()
+	if err != nil {
+		return err
+	}
+
+	// Rules are validated with their objects expanded, but stored with the references so later changes to the objects apply
+	expanded, err := objects.expandAcl(policy)
+	if err != nil {
+		return err
+	}
+
+	if err := routetypes.ValidateRules(expanded.Mfa, expanded.Allow, expanded.Deny); err != nil {
 		return err
 	}
 
+	for _, iface := range policy.Interfaces {
+		if _, err := config.GetInterface(iface); err != nil {
+			return err
+		}
+	}
+
 	policyJson, _ := json.Marshal(policy)
 
 	if overwrite {
@@ -67,6 +86,7 @@ func GetPolicies() (result []control.PolicyData, err error) {
 			PublicRoutes: policy.Allow,
 			MfaRoutes:    policy.Mfa,
 			DenyRoutes:   policy.Deny,
+			Interfaces:   policy.Interfaces,
 		})
 	}
 
@@ -84,7 +104,12 @@ func insertMap(m map[string]bool, values ...string) {
 	}
 }
 
+// GetEffectiveAcl returns the policies that apply to the users devices on the default wireguard interface
 func GetEffectiveAcl(username string) acls.Acl {
+	return getEffectiveAcl(username, config.DefaultInterface)
+}
+
+func getEffectiveAcl(username, iface string) acls.Acl {
 
 	var (
 		// Do deduplication for multiple acls
@@ -93,19 +118,45 @@ func GetEffectiveAcl(username string) acls.Acl {
 		denySet  = map[string]bool{}
 	)
 
-	insertMap(allowSet, config.Values.Wireguard.ServerAddress.String()+"/32")
+	wgInterface, err := config.GetInterface(iface)
+	if err != nil {
+		log.Println("failed to get policy data for user", username, "err:", err)
+		return acls.Acl{}
+	}
+
+	insertMap(allowSet, wgInterface.ServerAddress.String()+"/32")
 
 	txn := etcd.Txn(context.Background())
-	txn.Then(clientv3.OpGet("wag-acls-*"), clientv3.OpGet("wag-acls-"+username), clientv3.OpGet(MembershipKey+"-"+username), clientv3.OpGet(dnsKey))
+	txn.Then(clientv3.OpGet("wag-acls-*"), clientv3.OpGet("wag-acls-"+username), clientv3.OpGet(MembershipKey+"-"+username), clientv3.OpGet(dnsKey), clientv3.OpGet(LockdownKey), clientv3.OpGet(ObjectsPrefix, clientv3.WithPrefix()), clientv3.OpGet(GrantsPrefix, clientv3.WithPrefix()))
 	resp, err := txn.Commit()
 	if err != nil {
 		log.Println("failed to get policy data for user", username, "err:", err)
 		return acls.Acl{
-			Allow: []string{config.Values.Wireguard.ServerAddress.String() + "/32"},
+			Allow: []string{wgInterface.ServerAddress.String() + "/32"},
 		}
 	}
 
+	userGroups := interfaceUserGroups(username, wgInterface, resp.Responses[2].GetResponseRange())
+
+	// A lockdown that blocks public routes leaves users that are not exempt with only the wag server
+	if blockedByLockdown(resp.Responses[4].GetResponseRange(), userGroups) {
+		return acls.Acl{
+			Allow: []string{wgInterface.ServerAddress.String() + "/32"},
+		}
+	}
+
+	objects := objectsFromKvs(resp.Responses[5].GetResponseRange().Kvs)
+
 	addAcls := func(acl acls.Acl) {
+		if !acl.AppliesTo(wgInterface.Name) {
+			return
+		}
+
+		acl, err := objects.expandAcl(acl)
+		if err != nil {
+			log.Println("policy for", username, "refers to objects that do not exist:", err)
+		}
+
 		insertMap(allowSet, acl.Allow...)
 		insertMap(mfaSet, acl.Mfa...)
 		insertMap(denySet, acl.Deny...)
@@ -137,49 +188,58 @@ func GetEffectiveAcl(username string) acls.Acl {
 	}
 
 	// Membership map for finding all the other policies
-	if resp.Responses[2].GetResponseRange().GetCount() != 0 {
-		var userGroups []string
-
-		err = json.Unmarshal(resp.Responses[2].GetResponseRange().Kvs[0].Value, &userGroups)
-		if err == nil {
-			txn := etcd.Txn(context.Background())
+	if len(userGroups) != 0 {
+		txn := etcd.Txn(context.Background())
 
-			//If the user belongs to a series of groups, grab those, and add their rules
-			var ops []clientv3.Op
-			for _, group := range userGroups {
-				ops = append(ops, clientv3.OpGet("wag-acls-"+group))
-			}
+		//If the user belongs to a series of groups, grab those, and add their rules
+		var ops []clientv3.Op
+		for _, group := range userGroups {
+			ops = append(ops, clientv3.OpGet("wag-acls-"+group))
+		}
 
-			resp, err := txn.Then(ops...).Commit()
-			if err != nil {
-				log.Println("failed to get acls for groups: ", err)
-				RaiseError(err, []byte("failed to determine acls from groups"))
-				return acls.Acl{}
-			}
+		resp, err := txn.Then(ops...).Commit()
+		if err != nil {
+			log.Println("failed to get acls for groups: ", err)
+			RaiseError(err, []byte("failed to determine acls from groups"))
+			return acls.Acl{}
+		}
 
-			for m := range resp.Responses {
-				r := resp.Responses[m].GetResponseRange()
-				if r.Count > 0 {
+		for m := range resp.Responses {
+			r := resp.Responses[m].GetResponseRange()
+			if r.Count > 0 {
 
-					var acl acls.Acl
+				var acl acls.Acl
 
-					err := json.Unmarshal(r.Kvs[0].Value, &acl)
-					if err != nil {
-						log.Println("failed to unmarshal acl from response: ", err, string(r.Kvs[0].Value))
-						continue
-					}
-					addAcls(acl)
+				err := json.Unmarshal(r.Kvs[0].Value, &acl)
+				if err != nil {
+					log.Println("failed to unmarshal acl from response: ", err, string(r.Kvs[0].Value))
+					continue
 				}
+				addAcls(acl)
 			}
+		}
+	}
 
-		} else {
-			log.Println("failed to decode reverse group mapping: ", err)
+	// Temporary grants to the user or any of their groups, expired grants are removed by their lease but may not have been yet
+	grants, err := grantsFromKvs(resp.Responses[6].GetResponseRange().Kvs)
+	if err != nil {
+		log.Println("failed to get grants for user", username, "err:", err)
+	}
+
+	for _, grant := range grants {
+		if grant.Active() && (grant.Effects == username || slices.Contains(userGroups, grant.Effects)) {
+			addAcls(grant.Acl())
 		}
 	}
 
 	// Add dns servers if defined
 	// Restrict dns servers to only having 53/any by default as per #49
-	if resp.Responses[3].GetResponseRange().GetCount() != 0 {
+	// Interfaces with their own dns servers do not use the cluster wide setting
+	if wgInterface.Name != config.DefaultInterface && len(wgInterface.DNS) > 0 {
+		for _, server := range wgInterface.DNS {
+			insertMap(allowSet, fmt.Sprintf("%s 53/any", server))
+		}
+	} else if resp.Responses[3].GetResponseRange().GetCount() != 0 {
 
 		var dns []string
 		err = json.Unmarshal(resp.Responses[3].GetResponseRange().Kvs[0].Value, &dns)
@@ -204,3 +264,114 @@ func GetEffectiveAcl(username string) acls.Acl {
 
 	return resultingACLs
 }
+
+// interfaceUserGroups takes the users reverse group mapping and returns every group they are in on the interface, including nested and dynamic groups
+func interfaceUserGroups(username string, wgInterface config.WireguardInterface, membershipResp *etcdserverpb.RangeResponse) []string {
+	var userGroups []string
+	if membershipResp.GetCount() != 0 {
+		err := json.Unmarshal(membershipResp.Kvs[0].Value, &userGroups)
+		if err != nil {
+			log.Println("failed to decode reverse group mapping: ", err)
+		}
+	}
+
+	// Devices on an interface are members of its default group, but only for that interface
+	if wgInterface.Name != config.DefaultInterface && wgInterface.DefaultGroup != "" && !slices.Contains(userGroups, wgInterface.DefaultGroup) {
+		userGroups = append(userGroups, wgInterface.DefaultGroup)
+	}
+
+	userGroups, err := resolveUserGroups(username, userGroups)
+	if err != nil {
+		log.Println("failed to resolve nested and dynamic groups for user", username, "err:", err)
+	}
+
+	return userGroups
+}
+
+// GetEffectiveDeviceAcl returns the users effective acl on the devices wireguard interface combined with any policies that apply to the devices tags
+func GetEffectiveDeviceAcl(username, iface string, tags []string) acls.Acl {
+	if iface == "" {
+		iface = config.DefaultInterface
+	}
+
+	userAcl := getEffectiveAcl(username, iface)
+	if len(tags) == 0 {
+		return userAcl
+	}
+
+	wgInterface, err := config.GetInterface(iface)
+	if err != nil {
+		log.Println("failed to get acls for device tags: ", err)
+		return userAcl
+	}
+
+	ops := []clientv3.Op{clientv3.OpGet(ObjectsPrefix, clientv3.WithPrefix()), clientv3.OpGet(MembershipKey + "-" + username), clientv3.OpGet(LockdownKey)}
+	for _, tag := range tags {
+		ops = append(ops, clientv3.OpGet(AclsPrefix+"tag:"+tag))
+	}
+
+	resp, err := etcd.Txn(context.Background()).Then(ops...).Commit()
+	if err != nil {
+		log.Println("failed to get acls for device tags: ", err)
+		RaiseError(err, []byte("failed to determine acls from device tags"))
+		return userAcl
+	}
+
+	// Tag policies do not get around a lockdown, the device is left with only the wag server like its owner
+	if blockedByLockdown(resp.Responses[2].GetResponseRange(), interfaceUserGroups(username, wgInterface, resp.Responses[1].GetResponseRange())) {
+		return acls.Acl{
+			Allow: []string{wgInterface.ServerAddress.String() + "/32"},
+		}
+	}
+
+	var (
+		allowSet = map[string]bool{}
+		mfaSet   = map[string]bool{}
+		denySet  = map[string]bool{}
+	)
+
+	insertMap(allowSet, userAcl.Allow...)
+	insertMap(mfaSet, userAcl.Mfa...)
+	insertMap(denySet, userAcl.Deny...)
+
+	objects := objectsFromKvs(resp.Responses[0].GetResponseRange().Kvs)
+
+	for _, response := range resp.Responses[3:] {
+		r := response.GetResponseRange()
+		if r.Count == 0 {
+			continue
+		}
+
+		var acl acls.Acl
+		err := json.Unmarshal(r.Kvs[0].Value, &acl)
+		if err != nil {
+			log.Println("failed to unmarshal tag acl from response: ", err, string(r.Kvs[0].Value))
+			continue
+		}
+
+		if !acl.AppliesTo(iface) {
+			continue
+		}
+
+		acl, err = objects.expandAcl(acl)
+		if err != nil {
+			log.Println("tag policy refers to objects that do not exist:", err)
+		}
+
+		insertMap(allowSet, acl.Allow...)
+		insertMap(mfaSet, acl.Mfa...)
+		insertMap(denySet, acl.Deny...)
+	}
+
+	resultingACLs := acls.Acl{
+		Allow: maps.Keys(allowSet),
+		Mfa:   maps.Keys(mfaSet),
+		Deny:  maps.Keys(denySet),
+	}
+
+	sort.Strings(resultingACLs.Allow)
+	sort.Strings(resultingACLs.Mfa)
+	sort.Strings(resultingACLs.Deny)
+
+	return resultingACLs
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/NHAS/wag/internal/acls"
+)
+
+func TestEffectiveDeviceAclAddsTagPolicies(t *testing.T) {
+	err := SetAcl("tag:printer", acls.Acl{Allow: []string{"10.9.9.9 631/tcp"}, Deny: []string{"10.9.9.10"}}, true)
+	if err != nil {
+		t.Fatal("could not set tag policy: ", err)
+	}
+	defer RemoveAcl("tag:printer")
+
+	untagged := GetEffectiveDeviceAcl("tester", "", nil)
+	if slices.Contains(untagged.Allow, "10.9.9.9 631/tcp") {
+		t.Fatal("untagged device got the tag policy: ", untagged.Allow)
+	}
+
+	if !slices.Equal(untagged.Allow, GetEffectiveAcl("tester").Allow) {
+		t.Fatal("untagged device acl differs from the users acl")
+	}
+
+	tagged := GetEffectiveDeviceAcl("tester", "", []string{"printer"})
+	if !slices.Contains(tagged.Allow, "10.9.9.9 631/tcp") || !slices.Contains(tagged.Deny, "10.9.9.10") {
+		t.Fatal("tagged device did not get the tag policy: ", tagged)
+	}
+
+	// The users own policies still apply to the tagged device
+	for _, rule := range untagged.Allow {
+		if !slices.Contains(tagged.Allow, rule) {
+			t.Fatal("tagged device lost users rule: ", rule)
+		}
+	}
+
+	other := GetEffectiveDeviceAcl("tester", "", []string{"scanner"})
+	if slices.Contains(other.Allow, "10.9.9.9 631/tcp") {
+		t.Fatal("device with a different tag got the tag policy")
+	}
+}
+
+func TestEffectiveDeviceAclIsSorted(t *testing.T) {
+	err := SetAcl("tag:b", acls.Acl{Allow: []string{"10.8.0.2", "10.8.0.1"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveAcl("tag:b")
+
+	err = SetAcl("tag:a", acls.Acl{Allow: []string{"10.8.0.2"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveAcl("tag:a")
+
+	acl := GetEffectiveDeviceAcl("tester", "", []string{"a", "b"})
+	if !slices.IsSorted(acl.Allow) {
+		t.Fatal("rules were not sorted: ", acl.Allow)
+	}
+
+	if len(slices.Compact(slices.Clone(acl.Allow))) != len(acl.Allow) {
+		t.Fatal("duplicate rules were not removed: ", acl.Allow)
+	}
+}
@@ -0,0 +1,276 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/pkg/control"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/clientv3util"
+)
+
+const (
+	AddressPoolsPrefix        = "wag-address-pools-"
+	AddressReservationsPrefix = "ip-reservation-"
+)
+
+func GetAddressPools() (pools []control.AddressPool, err error) {
+	response, err := etcd.Get(context.Background(), AddressPoolsPrefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range response.Kvs {
+		var pool control.AddressPool
+		err := json.Unmarshal(res.Value, &pool)
+		if err != nil {
+			return nil, err
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+func GetAddressPool(name string) (pool control.AddressPool, err error) {
+	response, err := etcd.Get(context.Background(), AddressPoolsPrefix+name)
+	if err != nil {
+		return pool, err
+	}
+
+	if len(response.Kvs) != 1 {
+		return pool, fmt.Errorf("address pool %q does not exist", name)
+	}
+
+	err = json.Unmarshal(response.Kvs[0].Value, &pool)
+	return pool, err
+}
+
+// AddAddressPool creates a pool of addresses within a wireguard interface's subnet, pools may not overlap
+func AddAddressPool(pool control.AddressPool) error {
+	if pool.Name == "" || strings.ContainsAny(pool.Name, " \t\n") {
+		return errors.New("address pool name cannot be empty or contain whitespace")
+	}
+
+	_, subnet, err := net.ParseCIDR(pool.Subnet)
+	if err != nil {
+		return fmt.Errorf("address pool subnet is invalid: %s", err)
+	}
+
+	wgInterface, err := config.GetInterface(pool.Interface)
+	if err != nil {
+		return err
+	}
+
+	poolSize, _ := subnet.Mask.Size()
+	interfaceSize, _ := wgInterface.Range.Mask.Size()
+	if !wgInterface.Range.Contains(subnet.IP) || poolSize < interfaceSize {
+		return fmt.Errorf("address pool %s is not within the %s interface subnet %s", subnet, wgInterface.Name, wgInterface.Range)
+	}
+
+	pool.Subnet = subnet.String()
+	pool.Interface = ""
+	if wgInterface.Name != config.DefaultInterface {
+		pool.Interface = wgInterface.Name
+	}
+
+	existing, err := etcd.Get(context.Background(), AddressPoolsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	for _, res := range existing.Kvs {
+		var other control.AddressPool
+		if err := json.Unmarshal(res.Value, &other); err != nil {
+			return err
+		}
+
+		if other.Name == pool.Name {
+			return fmt.Errorf("address pool %q already exists", pool.Name)
+		}
+
+		_, otherSubnet, err := net.ParseCIDR(other.Subnet)
+		if err != nil {
+			continue
+		}
+
+		if otherSubnet.Contains(subnet.IP) || subnet.Contains(otherSubnet.IP) {
+			return fmt.Errorf("address pool %s overlaps with pool %q (%s)", subnet, other.Name, other.Subnet)
+		}
+	}
+
+	b, _ := json.Marshal(pool)
+
+	// Only commit if no pool has changed since the overlap check
+	resp, err := etcd.Txn(context.Background()).If(
+		clientv3.Compare(clientv3.ModRevision(AddressPoolsPrefix), "<", existing.Header.Revision+1).WithPrefix(),
+	).Then(
+		clientv3.OpPut(AddressPoolsPrefix+pool.Name, string(b)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return errors.New("address pools were modified while adding pool, try again")
+	}
+
+	return nil
+}
+
+// DeleteAddressPool removes a pool, it is refused while registration tokens still allocate addresses from it
+func DeleteAddressPool(name string) error {
+	tokens, err := etcd.Get(context.Background(), RegistrationPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	var users []string
+	for _, res := range tokens.Kvs {
+		var token control.RegistrationResult
+		if err := json.Unmarshal(res.Value, &token); err != nil {
+			return err
+		}
+
+		if token.Pool == name {
+			users = append(users, token.Username)
+		}
+	}
+
+	if len(users) > 0 {
+		return fmt.Errorf("address pool %q is used by registration tokens for %s, delete them first", name, strings.Join(users, ", "))
+	}
+
+	// Only delete if no token has been added since the check
+	resp, err := etcd.Txn(context.Background()).If(
+		clientv3.Compare(clientv3.ModRevision(RegistrationPrefix), "<", tokens.Header.Revision+1).WithPrefix(),
+	).Then(
+		clientv3.OpDelete(AddressPoolsPrefix + name),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return errors.New("registration tokens were modified while deleting pool, try again")
+	}
+
+	return nil
+}
+
+// poolsOnInterface returns the subnets of all pools on the wireguard interface iface, these are excluded from random address allocation
+func poolsOnInterface(iface string) (subnets []*net.IPNet, err error) {
+	pools, err := GetAddressPools()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pool := range pools {
+		if pool.Interface != iface {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(pool.Subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+func GetAddressReservations() (reservations []control.AddressReservation, err error) {
+	response, err := etcd.Get(context.Background(), AddressReservationsPrefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range response.Kvs {
+		var reservation control.AddressReservation
+		err := json.Unmarshal(res.Value, &reservation)
+		if err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, nil
+}
+
+// AddAddressReservation holds an address for a user, if a device already has the address it must belong to that user
+func AddAddressReservation(reservation control.AddressReservation) error {
+	if reservation.Username == "" {
+		return errors.New("reservation must have a username")
+	}
+
+	ip, err := validDeviceAddress(reservation.Address)
+	if err != nil {
+		return err
+	}
+	reservation.Address = ip.String()
+
+	ref, err := etcd.Get(context.Background(), "deviceref-"+reservation.Address)
+	if err != nil {
+		return err
+	}
+
+	var deviceRevision int64
+	if len(ref.Kvs) == 1 {
+		if string(ref.Kvs[0].Value) != deviceKey(reservation.Username, reservation.Address) {
+			return fmt.Errorf("address %s is in use by a device that does not belong to %s", reservation.Address, reservation.Username)
+		}
+		deviceRevision = ref.Kvs[0].ModRevision
+	}
+
+	b, _ := json.Marshal(reservation)
+
+	resp, err := etcd.Txn(context.Background()).If(
+		clientv3util.KeyMissing(AddressReservationsPrefix+reservation.Address),
+		clientv3util.KeyMissing("ip-hold-"+reservation.Address),
+		clientv3.Compare(clientv3.ModRevision("deviceref-"+reservation.Address), "=", deviceRevision),
+	).Then(
+		clientv3.OpPut(AddressReservationsPrefix+reservation.Address, string(b)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return fmt.Errorf("address %s is already reserved or in use", reservation.Address)
+	}
+
+	return nil
+}
+
+func DeleteAddressReservation(address string) error {
+	_, err := etcd.Delete(context.Background(), AddressReservationsPrefix+address)
+	return err
+}
+
+// validDeviceAddress checks that address could be assigned to a device on one of the wireguard interfaces
+func validDeviceAddress(address string) (net.IP, error) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("address %q is not a valid ipv4 address", address)
+	}
+
+	wgInterface := config.InterfaceForAddress(ip.String())
+	if !wgInterface.Range.Contains(ip) {
+		return nil, fmt.Errorf("address %s is not within any wireguard interface subnet", ip)
+	}
+
+	if ip.Equal(wgInterface.ServerAddress) || ip.Equal(wgInterface.Range.IP) || ip.Equal(lastIP(wgInterface.Range)) {
+		return nil, fmt.Errorf("address %s cannot be assigned to a device", ip)
+	}
+
+	return ip, nil
+}
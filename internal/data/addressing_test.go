@@ -0,0 +1,122 @@
+package data
+
+import (
+	"net"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func TestPoolAllocationSkipsNetworkAndBroadcast(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("192.168.1.248/30")
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		address, err := getNextIP(pool, config.Values.Wireguard.ServerAddress, nil)
+		if err != nil {
+			t.Fatal("could not allocate from pool: ", err)
+		}
+		got[address] = true
+	}
+
+	if !got["192.168.1.249"] || !got["192.168.1.250"] {
+		t.Fatal("expected the two usable addresses of the /30, got: ", got)
+	}
+
+	// Both usable addresses are held, so the network and broadcast addresses are all that are left
+	if address, err := getNextIP(pool, config.Values.Wireguard.ServerAddress, nil); err == nil {
+		t.Fatal("allocated from a full pool: ", address)
+	}
+}
+
+func TestPoolsTooSmallForDevices(t *testing.T) {
+	for _, cidr := range []string{"192.168.1.252/31", "192.168.1.254/32"} {
+		_, pool, _ := net.ParseCIDR(cidr)
+		if address, err := getNextIP(pool, config.Values.Wireguard.ServerAddress, nil); err == nil {
+			t.Fatalf("allocated %s from %s which has no usable addresses", address, cidr)
+		}
+	}
+}
+
+func TestRandomAllocationAvoidsPools(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("192.168.1.0/25")
+
+	for i := 0; i < 50; i++ {
+		address, err := getNextIP(config.Values.Wireguard.Range, config.Values.Wireguard.ServerAddress, []*net.IPNet{pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ip := net.ParseIP(address)
+		if pool.Contains(ip) {
+			t.Fatal("randomly allocated an address from a pool: ", address)
+		}
+
+		if ip.Equal(lastIP(config.Values.Wireguard.Range)) || ip.Equal(config.Values.Wireguard.ServerAddress) {
+			t.Fatal("allocated the broadcast or server address: ", address)
+		}
+	}
+}
+
+func TestAddAddressPoolValidation(t *testing.T) {
+	err := AddAddressPool(control.AddressPool{Name: "ops", Subnet: "192.168.1.64/26"})
+	if err != nil {
+		t.Fatal("could not add pool: ", err)
+	}
+	defer DeleteAddressPool("ops")
+
+	pool, err := GetAddressPool("ops")
+	if err != nil || pool.Subnet != "192.168.1.64/26" || pool.Interface != "" {
+		t.Fatal("pool was not stored as expected: ", pool, err)
+	}
+
+	bad := map[string]control.AddressPool{
+		"duplicate name":    {Name: "ops", Subnet: "192.168.1.192/26"},
+		"overlapping":       {Name: "overlap", Subnet: "192.168.1.96/27"},
+		"containing":        {Name: "containing", Subnet: "192.168.1.0/25"},
+		"outside interface": {Name: "outside", Subnet: "10.0.0.0/24"},
+		"larger than range": {Name: "large", Subnet: "192.168.0.0/16"},
+		"whitespace name":   {Name: "o p s", Subnet: "192.168.1.192/26"},
+		"bad subnet":        {Name: "bad", Subnet: "192.168.1.300/26"},
+	}
+
+	for name, p := range bad {
+		if err := AddAddressPool(p); err == nil {
+			DeleteAddressPool(p.Name)
+			t.Errorf("%s pool was accepted", name)
+		}
+	}
+}
+
+func TestDeleteAddressPoolInUse(t *testing.T) {
+	err := AddAddressPool(control.AddressPool{Name: "printers", Subnet: "192.168.1.128/28"})
+	if err != nil {
+		t.Fatal("could not add pool: ", err)
+	}
+
+	token, err := GenerateToken(control.RegistrationResult{Username: "pooluser", Pool: "printers", NumUses: 1})
+	if err != nil {
+		t.Fatal("could not add token: ", err)
+	}
+
+	if err := DeleteAddressPool("printers"); err == nil {
+		t.Fatal("deleted a pool that a registration token still uses")
+	}
+
+	if _, err := GetAddressPool("printers"); err != nil {
+		t.Fatal("refused delete still removed the pool: ", err)
+	}
+
+	if err := DeleteRegistrationToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteAddressPool("printers"); err != nil {
+		t.Fatal("could not delete unused pool: ", err)
+	}
+
+	if _, err := GenerateToken(control.RegistrationResult{Username: "pooluser", Pool: "printers", NumUses: 1}); err == nil {
+		t.Fatal("added a token for a deleted pool")
+	}
+}
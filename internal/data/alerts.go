@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/NHAS/wag/internal/utils"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Security alerts expire on their own, they are a heads up to administrators rather than an audit log
+const securityAlertTTL = 24 * time.Hour
+
+// SecurityAlert is raised when wag takes action against a device it considers suspicious
+type SecurityAlert struct {
+	AlertID  string
+	NodeID   string
+	Username string
+	Address  string
+	Reason   string
+	Time     time.Time
+}
+
+func RaiseSecurityAlert(username, address, reason string) error {
+	alert := SecurityAlert{
+		NodeID:   GetServerID().String(),
+		Username: username,
+		Address:  address,
+		Reason:   reason,
+		Time:     time.Now(),
+	}
+
+	var err error
+	alert.AlertID, err = utils.GenerateRandomHex(16)
+	if err != nil {
+		return err
+	}
+
+	lease, err := clientv3.NewLease(etcd).Grant(context.Background(), int64(securityAlertTTL.Seconds()))
+	if err != nil {
+		return fmt.Errorf("could not create security alert lease: %s", err)
+	}
+
+	alertBytes, _ := json.Marshal(alert)
+	_, err = etcd.Put(context.Background(), path.Join(SecurityAlerts, alert.AlertID), string(alertBytes), clientv3.WithLease(lease.ID))
+
+	return err
+}
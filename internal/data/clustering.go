@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/utils"
 	"go.etcd.io/etcd/client/pkg/v3/types"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/server/v3/etcdserver/api/membership"
@@ -123,9 +124,28 @@ func GetVersion(idHex string) (string, error) {
 	return getString(path.Join(NodeInfo, idHex, "version"))
 }
 
+// bootID is different every time wag starts, it is how the upgrade orchestrator knows a node has really restarted
+var bootID, _ = utils.GenerateRandomHex(16)
+
+// GetBootID returns the ID the node wrote when it last started
+func GetBootID(idHex string) (string, error) {
+	_, err := strconv.ParseUint(idHex, 16, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad member ID arg (%v), expecting ID in Hex", err)
+	}
+
+	return getString(path.Join(NodeInfo, idHex, "boot"))
+}
+
+// SetVersion records the version of wag this node is running, along with its boot ID
 func SetVersion() error {
 	d, _ := json.Marshal(config.Version)
-	_, err := etcd.Put(context.Background(), path.Join(NodeInfo, GetServerID().String(), "version"), string(d))
+	b, _ := json.Marshal(bootID)
+
+	_, err := etcd.Txn(context.Background()).Then(
+		clientv3.OpPut(path.Join(NodeInfo, GetServerID().String(), "version"), string(d)),
+		clientv3.OpPut(path.Join(NodeInfo, GetServerID().String(), "boot"), string(b)),
+	).Commit()
 	return err
 }
 
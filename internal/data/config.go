@@ -12,6 +12,11 @@ import (
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+type DeviceRoaming struct {
+	Enabled                 bool
+	RequireReauthentication bool
+}
+
 type OIDC struct {
 	IssuerURL           string
 	ClientSecret        string
@@ -50,6 +55,8 @@ const (
 	OidcDetailsKey = "wag-config-authentication-oidc"
 	PamDetailsKey  = "wag-config-authentication-pam"
 
+	DeviceRoamingKey = "wag-config-clustering-device-roaming"
+
 	externalAddressKey = "wag-config-network-external-address"
 	dnsKey             = "wag-config-network-dns"
 
@@ -582,3 +589,28 @@ func GetLockout() (int, error) {
 
 	return lockout, nil
 }
+
+func SetDeviceRoaming(roaming DeviceRoaming) error {
+	data, err := json.Marshal(roaming)
+	if err != nil {
+		return err
+	}
+
+	_, err = etcd.Put(context.Background(), DeviceRoamingKey, string(data))
+	return err
+}
+
+// GetDeviceRoaming returns the cluster wide policy for moving devices off nodes that are drained or dead
+func GetDeviceRoaming() (roaming DeviceRoaming, err error) {
+	response, err := etcd.Get(context.Background(), DeviceRoamingKey)
+	if err != nil {
+		return DeviceRoaming{}, err
+	}
+
+	if len(response.Kvs) == 0 {
+		return DeviceRoaming{}, nil
+	}
+
+	err = json.Unmarshal(response.Kvs[0].Value, &roaming)
+	return
+}
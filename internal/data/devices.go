@@ -5,14 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"go.etcd.io/etcd/client/pkg/v3/types"
 
 	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/geoip"
 	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/pkg/control"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/clientv3util"
+	"golang.org/x/exp/maps"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -27,8 +34,45 @@ type Device struct {
 	Active       bool
 	Authorised   time.Time
 
+	// When the endpoint address last changed, used for impossible travel detection
+	EndpointChanged time.Time `json:",omitempty"`
+
 	Challenge      string
 	AssociatedNode types.ID
+
+	// User editable label for the device
+	Name string `json:",omitempty"`
+	// Admin assigned tags, policies with the effects "tag:<name>" apply to devices with that tag
+	Tags []string `json:",omitempty"`
+
+	Created           time.Time
+	RegistrationToken string `json:",omitempty"`
+
+	// Version of the wireguard config the device last downloaded, used to tell clients when their routes are out of date
+	ConfigVersion string `json:",omitempty"`
+
+	// Name of the wireguard interface the device is registered on, empty for the default interface
+	Interface string `json:",omitempty"`
+
+	// Name of the address pool the device address was allocated from
+	Pool string `json:",omitempty"`
+
+	// Not stored, populated from the wireguard device when listing
+	LastHandshake time.Time `json:"-"`
+}
+
+// ListedDevice is a device as sent over the control socket, where the last handshake is sent alongside it as it is not part of the stored device
+type ListedDevice struct {
+	Device
+	LastHandshake time.Time
+}
+
+// DisplayName returns the devices name, or its address if it has not been named
+func (d Device) DisplayName() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.Address
 }
 
 func (d Device) String() string {
@@ -55,7 +99,11 @@ func UpdateDeviceConnectionDetails(address string, endpoint *net.UDPAddr) error
 		return errors.New("device was not found")
 	}
 
-	return doSafeUpdate(context.Background(), string(realKey.Kvs[0].Value), false, func(gr *clientv3.GetResponse) (string, error) {
+	var (
+		suspicious, username, deviceAddress string
+		previousEndpoint                    *net.UDPAddr
+	)
+	err = doSafeUpdate(context.Background(), string(realKey.Kvs[0].Value), false, func(gr *clientv3.GetResponse) (string, error) {
 		if len(gr.Kvs) != 1 {
 			return "", errors.New("user device has multiple keys")
 		}
@@ -66,13 +114,97 @@ func UpdateDeviceConnectionDetails(address string, endpoint *net.UDPAddr) error
 			return "", err
 		}
 
+		suspicious = ""
+		if endpoint != nil && (device.Endpoint == nil || !device.Endpoint.IP.Equal(endpoint.IP)) {
+			if !device.Authorised.IsZero() {
+				suspicious = checkEndpointChange(device, endpoint)
+				if suspicious != "" {
+					// Terminating the session makes every node deauthenticate the device
+					device.Authorised = time.Time{}
+				}
+			}
+
+			device.EndpointChanged = time.Now()
+		}
+
+		previousEndpoint = device.Endpoint
 		device.Endpoint = endpoint
 		device.AssociatedNode = GetServerID()
 
+		username, deviceAddress = device.Username, device.Address
+
 		b, _ := json.Marshal(device)
 
 		return string(b), err
 	})
+	if err != nil {
+		return err
+	}
+
+	if endpoint != nil && (previousEndpoint == nil || previousEndpoint.String() != endpoint.String()) {
+		event := ConnectionEvent{
+			Type:     ConnectionEndpoint,
+			Username: username,
+			Address:  deviceAddress,
+			Endpoint: endpoint.String(),
+		}
+
+		if previousEndpoint != nil {
+			event.Reason = "changed from " + previousEndpoint.String()
+		}
+
+		recordConnectionEvent(event)
+	}
+
+	if suspicious != "" {
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionDeauthorised,
+			Username: username,
+			Address:  deviceAddress,
+			Endpoint: endpoint.String(),
+			Reason:   suspicious,
+		})
+
+		log.Printf("deauthenticating %s:%s device: %s", username, deviceAddress, suspicious)
+		return RaiseSecurityAlert(username, deviceAddress, suspicious)
+	}
+
+	return nil
+}
+
+// checkEndpointChange returns why an authorised devices new endpoint is suspicious, or an empty string if it is not
+func checkEndpointChange(device Device, endpoint *net.UDPAddr) string {
+	if err := CheckSource(device.Username, nil, endpoint.IP); err != nil {
+		return fmt.Sprintf("endpoint changed to a disallowed source: %s", err)
+	}
+
+	maxSpeed := config.Values.GeoIP.MaxTravelSpeedKmh
+	if maxSpeed <= 0 || device.Endpoint == nil || device.EndpointChanged.IsZero() {
+		return ""
+	}
+
+	from, err := geoip.Lookup(device.Endpoint.IP)
+	if err != nil || !from.HasCoordinates {
+		return ""
+	}
+
+	to, err := geoip.Lookup(endpoint.IP)
+	if err != nil || !to.HasCoordinates {
+		return ""
+	}
+
+	distance := geoip.DistanceKm(from, to)
+	if speed := travelSpeedKmh(distance, time.Since(device.EndpointChanged)); speed > maxSpeed {
+		return fmt.Sprintf("impossible travel, endpoint moved %.0fkm (%s -> %s, %s -> %s) at %.0fkm/h", distance, device.Endpoint.IP, endpoint.IP, from.Country, to.Country, speed)
+	}
+
+	return ""
+}
+
+// travelSpeedKmh returns the speed needed to cover distance in elapsed. The elapsed time is clamped to a minute so geoip inaccuracy in nearby locations is not treated as travelling at great speed
+func travelSpeedKmh(distance float64, elapsed time.Duration) float64 {
+	hours := max(elapsed.Hours(), 1.0/60)
+	return distance / hours
 }
 
 func GetDevice(username, id string) (device Device, err error) {
@@ -95,14 +227,15 @@ func GetDevice(username, id string) (device Device, err error) {
 	return
 }
 
-// Set device as authorized and clear authentication attempts
-func AuthoriseDevice(username, address string) (string, error) {
+// Set device as authorized and clear authentication attempts, method is the mfa method used and is recorded in the devices connection history
+func AuthoriseDevice(username, address, method string) (string, error) {
 
 	challenge, err := utils.GenerateRandomHex(32)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate random challenge on device authorisation: %s", err)
 	}
 
+	var endpoint string
 	err = doSafeUpdate(context.Background(), deviceKey(username, address), false, func(gr *clientv3.GetResponse) (string, error) {
 		if len(gr.Kvs) != 1 {
 			return "", errors.New("user device has multiple keys")
@@ -124,6 +257,26 @@ func AuthoriseDevice(username, address string) (string, error) {
 			return "", errors.New("account is locked")
 		}
 
+		lockedOut, err := IsLockedOut(device.Username)
+		if err != nil {
+			return "", err
+		}
+
+		if lockedOut {
+			return "", errors.New("the cluster is in lockdown")
+		}
+
+		var source net.IP
+		endpoint = ""
+		if device.Endpoint != nil {
+			source = device.Endpoint.IP
+			endpoint = device.Endpoint.String()
+		}
+
+		if err := CheckSource(device.Username, nil, source); err != nil {
+			return "", err
+		}
+
 		device.AssociatedNode = GetServerID()
 		device.Authorised = time.Now()
 		device.Attempts = 0
@@ -137,10 +290,19 @@ func AuthoriseDevice(username, address string) (string, error) {
 		return "", fmt.Errorf("failed to update device authorisation state: %s", err)
 	}
 
+	recordConnectionEvent(ConnectionEvent{
+		Type:     ConnectionAuthorised,
+		Username: username,
+		Address:  address,
+		Endpoint: endpoint,
+		Reason:   "authenticated with " + method,
+	})
+
 	return challenge, nil
 }
 
-func DeauthenticateDevice(address string) error {
+// DeauthenticateDevice ends the devices session, the reason is recorded in its connection history
+func DeauthenticateDevice(address, reason string) error {
 
 	realKey, err := etcd.Get(context.Background(), "deviceref-"+address)
 	if err != nil {
@@ -151,7 +313,12 @@ func DeauthenticateDevice(address string) error {
 		return errors.New("device was not found")
 	}
 
-	return doSafeUpdate(context.Background(), string(realKey.Kvs[0].Value), false, func(gr *clientv3.GetResponse) (string, error) {
+	var (
+		wasAuthorised bool
+		username      string
+		endpoint      string
+	)
+	err = doSafeUpdate(context.Background(), string(realKey.Kvs[0].Value), false, func(gr *clientv3.GetResponse) (string, error) {
 		if len(gr.Kvs) != 1 {
 			return "", errors.New("user device has multiple keys")
 		}
@@ -162,15 +329,41 @@ func DeauthenticateDevice(address string) error {
 			return "", err
 		}
 
+		wasAuthorised = !device.Authorised.IsZero()
+		username = device.Username
+		endpoint = ""
+		if device.Endpoint != nil {
+			endpoint = device.Endpoint.String()
+		}
+
 		device.Authorised = time.Time{}
 
 		b, _ := json.Marshal(device)
 
 		return string(b), err
 	})
+	if err != nil {
+		return err
+	}
+
+	if wasAuthorised {
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionDeauthorised,
+			Username: username,
+			Address:  address,
+			Endpoint: endpoint,
+			Reason:   reason,
+		})
+	}
+
+	return nil
 }
 
-func SetDeviceAuthenticationAttempts(username, address string, attempts int) error {
+func SetDeviceName(username, address, name string) error {
+	if len(name) > 64 {
+		return errors.New("device name is too long (max 64 characters)")
+	}
+
 	return doSafeUpdate(context.Background(), deviceKey(username, address), false, func(gr *clientv3.GetResponse) (string, error) {
 		if len(gr.Kvs) != 1 {
 			return "", errors.New("user device has multiple keys")
@@ -182,12 +375,127 @@ func SetDeviceAuthenticationAttempts(username, address string, attempts int) err
 			return "", err
 		}
 
+		device.Name = strings.TrimSpace(name)
+
+		b, _ := json.Marshal(device)
+
+		return string(b), err
+	})
+}
+
+func SetDeviceConfigVersion(username, address, version string) error {
+	return doSafeUpdate(context.Background(), deviceKey(username, address), false, func(gr *clientv3.GetResponse) (string, error) {
+		if len(gr.Kvs) != 1 {
+			return "", errors.New("user device has multiple keys")
+		}
+
+		var device Device
+		err := json.Unmarshal(gr.Kvs[0].Value, &device)
+		if err != nil {
+			return "", err
+		}
+
+		device.ConfigVersion = version
+
+		b, _ := json.Marshal(device)
+
+		return string(b), err
+	})
+}
+
+// SetDeviceTags replaces the tags on a device, tags are lowercased, deduplicated and sorted
+func SetDeviceTags(username, address string, tags []string) error {
+
+	cleanTags, err := normaliseTags(tags)
+	if err != nil {
+		return err
+	}
+
+	return doSafeUpdate(context.Background(), deviceKey(username, address), false, func(gr *clientv3.GetResponse) (string, error) {
+		if len(gr.Kvs) != 1 {
+			return "", errors.New("user device has multiple keys")
+		}
+
+		var device Device
+		err := json.Unmarshal(gr.Kvs[0].Value, &device)
+		if err != nil {
+			return "", err
+		}
+
+		device.Tags = cleanTags
+
+		b, _ := json.Marshal(device)
+
+		return string(b), err
+	})
+}
+
+func normaliseTags(tags []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(tag, "tag:")))
+		if tag == "" {
+			continue
+		}
+
+		if strings.ContainsAny(tag, " ,:") {
+			return nil, fmt.Errorf("tag %q contains invalid characters (space, comma or colon)", tag)
+		}
+
+		set[tag] = true
+	}
+
+	result := maps.Keys(set)
+	sort.Strings(result)
+
+	return result, nil
+}
+
+func SetDeviceAuthenticationAttempts(username, address string, attempts int) error {
+	lockout, err := GetLockout()
+	if err != nil {
+		return err
+	}
+
+	var previous int
+	err = doSafeUpdate(context.Background(), deviceKey(username, address), false, func(gr *clientv3.GetResponse) (string, error) {
+		if len(gr.Kvs) != 1 {
+			return "", errors.New("user device has multiple keys")
+		}
+
+		var device Device
+		err := json.Unmarshal(gr.Kvs[0].Value, &device)
+		if err != nil {
+			return "", err
+		}
+
+		previous = device.Attempts
 		device.Attempts = attempts
 
 		b, _ := json.Marshal(device)
 
 		return string(b), err
 	})
+	if err != nil {
+		return err
+	}
+
+	if previous <= lockout && attempts > lockout {
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionLocked,
+			Username: username,
+			Address:  address,
+			Reason:   "locked by an administrator",
+		})
+	} else if previous > lockout && attempts <= lockout {
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionUnlocked,
+			Username: username,
+			Address:  address,
+		})
+	}
+
+	return nil
 }
 
 func GetAllDevices() (devices []Device, err error) {
@@ -231,35 +539,136 @@ func GetAllDevicesAsMap() (devices map[string]Device, err error) {
 	return devices, nil
 }
 
-func AddDevice(username, publickey string) (Device, error) {
+// GetInterfaceName returns the name of the wireguard interface the device is on
+func (d Device) GetInterfaceName() string {
+	if d.Interface == "" {
+		return config.DefaultInterface
+	}
+	return d.Interface
+}
+
+// AddDevice creates a new device for username, the device address is chosen by the registration token.
+// Either the exact address set in the token, a random free address from the token's address pool, or a random free address from the interface that is not in any pool
+func AddDevice(username, publickey string, registration control.RegistrationResult) (Device, error) {
 
 	preshared_key, err := wgtypes.GenerateKey()
 	if err != nil {
 		return Device{}, err
 	}
 
-	address, err := getNextIP(config.Values.Wireguard.Address)
-	if err != nil {
-		return Device{}, err
+	var (
+		wgInterface config.WireguardInterface
+		address     string
+		conditions  []clientv3.Cmp
+	)
+
+	switch {
+	case registration.Address != "":
+		ip, err := validDeviceAddress(registration.Address)
+		if err != nil {
+			return Device{}, err
+		}
+		address = ip.String()
+		wgInterface = config.InterfaceForAddress(address)
+
+		reservation, err := etcd.Get(context.Background(), AddressReservationsPrefix+address)
+		if err != nil {
+			return Device{}, err
+		}
+
+		var reservationRevision int64
+		if len(reservation.Kvs) == 1 {
+			var r control.AddressReservation
+			if err := json.Unmarshal(reservation.Kvs[0].Value, &r); err != nil {
+				return Device{}, err
+			}
+
+			if r.Username != username {
+				return Device{}, fmt.Errorf("address %s is reserved for another user", address)
+			}
+			reservationRevision = reservation.Kvs[0].ModRevision
+		}
+
+		// Static addresses are not leased, so check the address is still free when the device is written
+		conditions = append(conditions,
+			clientv3util.KeyMissing("deviceref-"+address),
+			clientv3util.KeyMissing("ip-hold-"+address),
+			clientv3.Compare(clientv3.ModRevision(AddressReservationsPrefix+address), "=", reservationRevision),
+		)
+
+	case registration.Pool != "":
+		pool, err := GetAddressPool(registration.Pool)
+		if err != nil {
+			return Device{}, err
+		}
+
+		wgInterface, err = config.GetInterface(pool.Interface)
+		if err != nil {
+			return Device{}, err
+		}
+
+		_, subnet, err := net.ParseCIDR(pool.Subnet)
+		if err != nil {
+			return Device{}, err
+		}
+
+		address, err = getNextIP(subnet, wgInterface.ServerAddress, nil)
+		if err != nil {
+			return Device{}, fmt.Errorf("unable to allocate address from pool %q: %s", pool.Name, err)
+		}
+
+	default:
+		wgInterface, err = config.GetInterface(registration.Interface)
+		if err != nil {
+			return Device{}, err
+		}
+
+		iface := ""
+		if wgInterface.Name != config.DefaultInterface {
+			iface = wgInterface.Name
+		}
+
+		pools, err := poolsOnInterface(iface)
+		if err != nil {
+			return Device{}, err
+		}
+
+		address, err = getNextIP(wgInterface.Range, wgInterface.ServerAddress, pools)
+		if err != nil {
+			return Device{}, err
+		}
+	}
+
+	iface := wgInterface.Name
+	if wgInterface.Name == config.DefaultInterface {
+		iface = ""
 	}
 
 	d := Device{
-		Address:      address,
-		Publickey:    publickey,
-		Username:     username,
-		PresharedKey: preshared_key.String(),
+		Address:           address,
+		Publickey:         publickey,
+		Username:          username,
+		PresharedKey:      preshared_key.String(),
+		Created:           time.Now(),
+		RegistrationToken: registration.Token,
+		Interface:         iface,
+		Pool:              registration.Pool,
 	}
 
 	b, _ := json.Marshal(d)
 	key := deviceKey(username, address)
 
-	_, err = etcd.Txn(context.Background()).Then(clientv3.OpPut(key, string(b)),
+	resp, err := etcd.Txn(context.Background()).If(conditions...).Then(clientv3.OpPut(key, string(b)),
 		clientv3.OpPut(fmt.Sprintf("deviceref-%s", address), key),
 		clientv3.OpPut(fmt.Sprintf("deviceref-%s", publickey), key)).Commit()
 	if err != nil {
 		return Device{}, err
 	}
 
+	if !resp.Succeeded {
+		return Device{}, fmt.Errorf("address %s is already in use or reserved", address)
+	}
+
 	return d, err
 }
 
@@ -273,6 +682,7 @@ func SetDevice(username, address, publickey, preshared_key string) (Device, erro
 		Publickey:    publickey,
 		Username:     username,
 		PresharedKey: preshared_key,
+		Created:      time.Now(),
 	}
 
 	b, _ := json.Marshal(d)
@@ -321,7 +731,7 @@ func DeleteDevice(username, id string) error {
 		otherReferenceKey = "deviceref-" + d.Address
 	}
 
-	_, err = etcd.Txn(context.Background()).Then(clientv3.OpDelete(string(realKey.Kvs[0].Value)), clientv3.OpDelete(refKey), clientv3.OpDelete(otherReferenceKey), clientv3.OpDelete("allocated_ips/"+d.Address)).Commit()
+	_, err = etcd.Txn(context.Background()).Then(clientv3.OpDelete(string(realKey.Kvs[0].Value)), clientv3.OpDelete(refKey), clientv3.OpDelete(otherReferenceKey), clientv3.OpDelete("allocated_ips/"+d.Address), clientv3.OpDelete(connectionHistoryDevicePrefix(d.Address), clientv3.WithPrefix())).Commit()
 	if err != nil {
 		return err
 	}
@@ -331,7 +741,7 @@ func DeleteDevice(username, id string) error {
 
 func DeleteDevices(username string) error {
 
-	deleted, err := etcd.Delete(context.Background(), fmt.Sprintf("devices-%s-", username), clientv3.WithPrefix())
+	deleted, err := etcd.Delete(context.Background(), fmt.Sprintf("devices-%s-", username), clientv3.WithPrefix(), clientv3.WithPrevKV())
 	if err != nil {
 		return err
 	}
@@ -345,7 +755,7 @@ func DeleteDevices(username string) error {
 			return err
 		}
 
-		ops = append(ops, clientv3.OpDelete("devicesref-"+d.Publickey), clientv3.OpDelete("deviceref-"+d.Address), clientv3.OpDelete("allocated_ips/"+d.Address))
+		ops = append(ops, clientv3.OpDelete("deviceref-"+d.Publickey), clientv3.OpDelete("deviceref-"+d.Address), clientv3.OpDelete("allocated_ips/"+d.Address), clientv3.OpDelete(connectionHistoryDevicePrefix(d.Address), clientv3.WithPrefix()))
 	}
 
 	_, err = etcd.Txn(context.Background()).Then(ops...).Commit()
@@ -23,14 +23,15 @@ func incrementIP(ip net.IP, inc uint) net.IP {
 	return net.IPv4(v0, v1, v2, v3)
 }
 
-func getNextIP(subnet string) (string, error) {
+func lastIP(subnet *net.IPNet) net.IP {
+	ones, bits := subnet.Mask.Size()
+	return incrementIP(subnet.IP, uint(math.Pow(2, float64(bits-ones)))-1)
+}
 
-	serverIP, cidr, err := net.ParseCIDR(subnet)
-	if err != nil {
-		return "", err
-	}
+// getNextIP leases a random free address from subnet, never choosing the server address, a reserved address or an address within exclude
+func getNextIP(subnet *net.IPNet, serverIP net.IP, exclude []*net.IPNet) (string, error) {
 
-	used, _ := cidr.Mask.Size()
+	used, _ := subnet.Mask.Size()
 	maxNumberOfAddresses := int(math.Pow(2, float64(32-used))) - 2 // Do not allocate largest address or 0
 	if maxNumberOfAddresses < 1 {
 		return "", errors.New("subnet is too small to contain a new device")
@@ -38,53 +39,56 @@ func getNextIP(subnet string) (string, error) {
 
 	// Choose a random number that cannot be 0
 	addressAttempt := rand.Intn(maxNumberOfAddresses) + 1
-	addr := incrementIP(cidr.IP, uint(addressAttempt))
+	addr := incrementIP(subnet.IP, uint(addressAttempt))
 
 	lease, err := clientv3.NewLease(etcd).Grant(context.Background(), 3)
 	if err != nil {
 		return "", err
 	}
 
-	if serverIP.Equal(addr) {
-		addr = incrementIP(addr, 1)
-	}
+	broadcast := lastIP(subnet)
 
 	startIP := addr
 	for {
 
-		if serverIP.Equal(addr) {
-			addr = incrementIP(addr, 1)
-		}
-
-		txn := etcd.Txn(context.Background())
-		txn.If(
-			clientv3util.KeyMissing("deviceref-"+addr.String()),
-			clientv3util.KeyMissing("ip-hold-"+addr.String()),
-		)
-		txn.Then(
-			clientv3.OpPut("ip-hold-"+addr.String(), addr.String(), clientv3.WithLease(lease.ID)),
-		)
-
-		resp, err := txn.Commit()
-		if err != nil {
-			return "", err
-		}
-
-		if resp.Succeeded {
-			return addr.String(), nil
+		if !serverIP.Equal(addr) && !excluded(exclude, addr) {
+			txn := etcd.Txn(context.Background())
+			txn.If(
+				clientv3util.KeyMissing("deviceref-"+addr.String()),
+				clientv3util.KeyMissing("ip-hold-"+addr.String()),
+				clientv3util.KeyMissing(AddressReservationsPrefix+addr.String()),
+			)
+			txn.Then(
+				clientv3.OpPut("ip-hold-"+addr.String(), addr.String(), clientv3.WithLease(lease.ID)),
+			)
+
+			resp, err := txn.Commit()
+			if err != nil {
+				return "", err
+			}
+
+			if resp.Succeeded {
+				return addr.String(), nil
+			}
 		}
 
 		addr = incrementIP(addr, 1)
-		if cidr.Contains(addr) {
-			continue
-		} else {
-			addr = incrementIP(cidr.IP, 1)
+		if addr.Equal(broadcast) {
+			addr = incrementIP(subnet.IP, 1)
 		}
 
 		if addr.Equal(startIP) {
 			return "", errors.New("unable to obtain ip lease, subnet is full")
 		}
-
 	}
 
 }
+
+func excluded(ranges []*net.IPNet, addr net.IP) bool {
+	for _, r := range ranges {
+		if r.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
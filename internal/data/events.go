@@ -13,6 +13,7 @@ import (
 	"github.com/NHAS/wag/pkg/queue"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/clientv3util"
 )
 
 type EventType int
@@ -42,10 +43,17 @@ const (
 	GroupMembershipPrefix = MembershipKey + "-"
 	AclsPrefix            = "wag-acls-"
 	GroupsPrefix          = "wag-groups-"
+	SessionPoliciesPrefix = "wag-session-policies-"
 	ConfigPrefix          = "wag-config-"
 	AuthenticationPrefix  = "wag-config-authentication-"
 	NodeInfo              = "wag/node/"
 	NodeErrors            = "wag/node/errors"
+	SecurityAlerts        = "wag/security/alerts"
+	ObjectsPrefix         = "wag-objects-"
+	DynamicGroupsPrefix   = "wag-dynamic-groups-"
+	UserClaimsPrefix      = "wag-user-claims-"
+	EventClaimsPrefix     = "wag-event-claims-"
+	RegistrationPrefix    = "tokens-"
 )
 
 var (
@@ -213,11 +221,27 @@ func checkClusterHealth() {
 		}
 	}()
 
+	roamingMonitor := time.NewTicker(5 * time.Second)
+	go func() {
+		for range roamingMonitor.C {
+			roamDevices()
+		}
+	}()
+
+	upgradeMonitor := time.NewTicker(5 * time.Second)
+	go func() {
+		for range upgradeMonitor.C {
+			progressUpgrade()
+		}
+	}()
+
 	<-exit
 
 	log.Println("etcd server was instructed to terminate")
 	leaderMonitor.Stop()
 	clusterMonitor.Stop()
+	roamingMonitor.Stop()
+	upgradeMonitor.Stop()
 
 }
 
@@ -295,3 +319,21 @@ func ResolveError(errorId string) error {
 	_, err := etcd.Delete(context.Background(), path.Join(NodeErrors, errorId))
 	return err
 }
+
+// ClaimEvent returns true for only one of the nodes that claim an event id within a minute, so that events every node sees are only sent once
+func ClaimEvent(id string) (bool, error) {
+	lease, err := clientv3.NewLease(etcd).Grant(context.Background(), 60)
+	if err != nil {
+		return false, fmt.Errorf("could not create event claim lease: %s", err)
+	}
+
+	resp, err := etcd.Txn(context.Background()).
+		If(clientv3util.KeyMissing(EventClaimsPrefix + id)).
+		Then(clientv3.OpPut(EventClaimsPrefix+id, GetServerID().String(), clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("could not claim event: %s", err)
+	}
+
+	return resp.Succeeded, nil
+}
@@ -0,0 +1,265 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/NHAS/wag/internal/utils"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	GrantsPrefix        = "wag-grants-"
+	GrantRequestsPrefix = "wag-grant-requests-"
+
+	MaxGrantDuration = 7 * 24 * time.Hour
+
+	// Requests that are not approved in this time are dropped
+	grantRequestLifetime = 24 * time.Hour
+)
+
+// Grant is temporary access for a user or group on top of their policies.
+// Approved grants are attached to a lease so etcd removes them when they expire, which refreshes the firewall like any other policy change
+type Grant struct {
+	ID string `json:"id"`
+
+	// A username or group:<name>
+	Effects string `json:"effects"`
+
+	Mfa   []string `json:"mfa,omitempty"`
+	Allow []string `json:"allow,omitempty"`
+
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requested_by"`
+	ApprovedBy  string `json:"approved_by,omitempty"`
+
+	Duration time.Duration `json:"duration"`
+	Created  time.Time     `json:"created"`
+
+	// Unset until the grant is approved
+	Expires time.Time `json:"expires,omitempty"`
+	Pending bool      `json:"pending,omitempty"`
+}
+
+func (g Grant) Acl() acls.Acl {
+	return acls.Acl{
+		Mfa:   g.Mfa,
+		Allow: g.Allow,
+	}
+}
+
+func (g Grant) Active() bool {
+	return !g.Pending && time.Now().Before(g.Expires)
+}
+
+func validateGrant(grant Grant) error {
+	if grant.Effects == "" || grant.Effects == "*" || strings.HasPrefix(grant.Effects, "tag:") {
+		return errors.New("access can only be granted to a user or group")
+	}
+
+	if strings.TrimSpace(grant.Reason) == "" {
+		return errors.New("a grant must have a reason")
+	}
+
+	if grant.Duration < time.Minute || grant.Duration > MaxGrantDuration {
+		return fmt.Errorf("grant duration must be between 1 minute and %s", MaxGrantDuration)
+	}
+
+	if len(grant.Mfa) == 0 && len(grant.Allow) == 0 {
+		return errors.New("a grant must give access to at least one route")
+	}
+
+	objects, err := getObjects()
+	if err != nil {
+		return err
+	}
+
+	acl, err := objects.expandAcl(grant.Acl())
+	if err != nil {
+		return err
+	}
+
+	return routetypes.ValidateRules(acl.Mfa, acl.Allow, nil)
+}
+
+func putGrant(prefix string, grant Grant, lifetime time.Duration) error {
+	lease, err := clientv3.NewLease(etcd).Grant(context.Background(), int64(lifetime.Seconds()))
+	if err != nil {
+		return fmt.Errorf("could not create grant lease: %s", err)
+	}
+
+	grantJson, _ := json.Marshal(grant)
+
+	_, err = etcd.Put(context.Background(), prefix+grant.ID, string(grantJson), clientv3.WithLease(lease.ID))
+	return err
+}
+
+// GrantAccess gives the user or group the access in grant until its duration is up
+func GrantAccess(grant Grant, by string) (Grant, error) {
+	if by == "" {
+		return Grant{}, errors.New("a grant must record who approved it")
+	}
+
+	if err := validateGrant(grant); err != nil {
+		return Grant{}, err
+	}
+
+	if grant.ID == "" {
+		id, err := utils.GenerateRandomHex(16)
+		if err != nil {
+			return Grant{}, err
+		}
+		grant.ID = id
+	}
+
+	if grant.RequestedBy == "" {
+		grant.RequestedBy = by
+	}
+
+	now := time.Now()
+	if grant.Created.IsZero() {
+		grant.Created = now
+	}
+
+	grant.ApprovedBy = by
+	grant.Expires = now.Add(grant.Duration)
+	grant.Pending = false
+
+	if err := putGrant(GrantsPrefix, grant, grant.Duration); err != nil {
+		return Grant{}, fmt.Errorf("could not grant access: %s", err)
+	}
+
+	return grant, nil
+}
+
+// RequestAccess records a users request for temporary access, which does nothing until an admin approves it
+func RequestAccess(username string, grant Grant) (Grant, error) {
+	grant.Effects = username
+	grant.RequestedBy = username
+
+	if err := validateGrant(grant); err != nil {
+		return Grant{}, err
+	}
+
+	id, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		return Grant{}, err
+	}
+
+	grant.ID = id
+	grant.Created = time.Now()
+	grant.ApprovedBy = ""
+	grant.Expires = time.Time{}
+	grant.Pending = true
+
+	if err := putGrant(GrantRequestsPrefix, grant, grantRequestLifetime); err != nil {
+		return Grant{}, fmt.Errorf("could not request access: %s", err)
+	}
+
+	return grant, nil
+}
+
+// ApproveAccessRequest turns a pending request into a grant, the duration starts from approval
+func ApproveAccessRequest(id, by string) (Grant, error) {
+	resp, err := etcd.Delete(context.Background(), GrantRequestsPrefix+id, clientv3.WithPrevKV())
+	if err != nil {
+		return Grant{}, fmt.Errorf("could not get access request: %s", err)
+	}
+
+	if len(resp.PrevKvs) == 0 {
+		return Grant{}, fmt.Errorf("no pending access request %q", id)
+	}
+
+	var grant Grant
+	if err := json.Unmarshal(resp.PrevKvs[0].Value, &grant); err != nil {
+		return Grant{}, fmt.Errorf("could not unmarshal access request: %s", err)
+	}
+
+	return GrantAccess(grant, by)
+}
+
+func RejectAccessRequest(id string) error {
+	resp, err := etcd.Delete(context.Background(), GrantRequestsPrefix+id)
+	if err != nil {
+		return fmt.Errorf("could not reject access request: %s", err)
+	}
+
+	if resp.Deleted == 0 {
+		return fmt.Errorf("no pending access request %q", id)
+	}
+
+	return nil
+}
+
+// RevokeGrant ends a grant before it expires
+func RevokeGrant(id string) error {
+	resp, err := etcd.Get(context.Background(), GrantsPrefix+id)
+	if err != nil {
+		return fmt.Errorf("could not get grant: %s", err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return fmt.Errorf("no active grant %q", id)
+	}
+
+	// Revoking the lease deletes the key along with it
+	if lease := clientv3.LeaseID(resp.Kvs[0].Lease); lease != clientv3.NoLease {
+		_, err = clientv3.NewLease(etcd).Revoke(context.Background(), lease)
+	} else {
+		_, err = etcd.Delete(context.Background(), GrantsPrefix+id)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not revoke grant: %s", err)
+	}
+
+	return nil
+}
+
+func grantsFromKvs(kvs []*mvccpb.KeyValue) (result []Grant, err error) {
+	for _, kv := range kvs {
+		var grant Grant
+		if err := json.Unmarshal(kv.Value, &grant); err != nil {
+			return nil, fmt.Errorf("could not unmarshal grant %q: %s", kv.Key, err)
+		}
+
+		result = append(result, grant)
+	}
+
+	return result, nil
+}
+
+// GetGrants returns the active grants and pending requests, oldest first
+func GetGrants() ([]Grant, error) {
+	resp, err := etcd.Txn(context.Background()).Then(
+		clientv3.OpGet(GrantsPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(GrantRequestsPrefix, clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, fmt.Errorf("could not get grants: %s", err)
+	}
+
+	var result []Grant
+	for _, r := range resp.Responses {
+		grants, err := grantsFromKvs(r.GetResponseRange().Kvs)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, grants...)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+
+	return result, nil
+}
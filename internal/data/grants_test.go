@@ -0,0 +1,171 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidateGrant(t *testing.T) {
+	valid := Grant{Effects: "tester", Reason: "incident", Duration: time.Hour, Allow: []string{"10.9.0.1 443/tcp"}}
+	if err := validateGrant(valid); err != nil {
+		t.Fatal("valid grant was rejected: ", err)
+	}
+
+	group := valid
+	group.Effects = "group:nerds"
+	group.Allow = nil
+	group.Mfa = []string{"10.9.0.0/24"}
+	if err := validateGrant(group); err != nil {
+		t.Fatal("valid group grant was rejected: ", err)
+	}
+
+	invalid := map[string]func(g *Grant){
+		"no effects":     func(g *Grant) { g.Effects = "" },
+		"everyone":       func(g *Grant) { g.Effects = "*" },
+		"tag":            func(g *Grant) { g.Effects = "tag:servers" },
+		"no reason":      func(g *Grant) { g.Reason = "  " },
+		"too short":      func(g *Grant) { g.Duration = time.Second },
+		"too long":       func(g *Grant) { g.Duration = MaxGrantDuration + time.Minute },
+		"no routes":      func(g *Grant) { g.Allow = nil },
+		"bad route":      func(g *Grant) { g.Allow = []string{"10.9.0.1 443/nope"} },
+		"unknown object": func(g *Grant) { g.Allow = []string{"network:doesnotexist"} },
+	}
+
+	for name, modify := range invalid {
+		grant := valid
+		modify(&grant)
+		if err := validateGrant(grant); err == nil {
+			t.Errorf("%s: invalid grant was accepted", name)
+		}
+	}
+}
+
+func TestGrantActive(t *testing.T) {
+	if !(Grant{Expires: time.Now().Add(time.Minute)}).Active() {
+		t.Error("unexpired grant was not active")
+	}
+
+	if (Grant{Expires: time.Now().Add(-time.Minute)}).Active() {
+		t.Error("expired grant was active")
+	}
+
+	if (Grant{Expires: time.Now().Add(time.Minute), Pending: true}).Active() {
+		t.Error("pending request was active")
+	}
+}
+
+func TestGrantAccess(t *testing.T) {
+	grant := Grant{Effects: "group:nerds", Reason: "incident", Duration: time.Hour, Allow: []string{"10.9.1.1 22/tcp"}}
+
+	if _, err := GrantAccess(grant, ""); err == nil {
+		t.Fatal("grant without an approver was accepted")
+	}
+
+	before := time.Now()
+	grant, err := GrantAccess(grant, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RevokeGrant(grant.ID)
+
+	if grant.ID == "" || grant.Pending || grant.ApprovedBy != "admin" || grant.RequestedBy != "admin" {
+		t.Fatalf("grant was not recorded correctly: %+v", grant)
+	}
+
+	if grant.Expires.Before(before.Add(time.Hour)) || grant.Expires.After(time.Now().Add(time.Hour)) {
+		t.Fatal("grant does not expire after its duration: ", grant.Expires)
+	}
+
+	// tester is in group:nerds
+	if acl := GetEffectiveAcl("tester"); !slices.Contains(acl.Allow, "10.9.1.1 22/tcp") {
+		t.Fatal("group grant was not in the effective acl: ", acl.Allow)
+	}
+
+	if err := RevokeGrant(grant.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if acl := GetEffectiveAcl("tester"); slices.Contains(acl.Allow, "10.9.1.1 22/tcp") {
+		t.Fatal("revoked grant was still in the effective acl: ", acl.Allow)
+	}
+
+	if err := RevokeGrant(grant.ID); err == nil {
+		t.Fatal("revoking a grant twice succeeded")
+	}
+}
+
+func TestExpiredGrantIgnored(t *testing.T) {
+	// The lease outlives the grant, as happens between expiry and etcd removing the key
+	grant := Grant{ID: "expiredtest", Effects: "tester", Reason: "incident", Duration: time.Minute, Allow: []string{"10.9.2.1 80/tcp"}, Expires: time.Now().Add(-time.Second)}
+	if err := putGrant(GrantsPrefix, grant, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer RevokeGrant(grant.ID)
+
+	if acl := GetEffectiveAcl("tester"); slices.Contains(acl.Allow, "10.9.2.1 80/tcp") {
+		t.Fatal("expired grant was in the effective acl: ", acl.Allow)
+	}
+}
+
+func TestAccessRequests(t *testing.T) {
+	request := Grant{Effects: "group:nerds", Reason: "debugging", Duration: time.Hour, Allow: []string{"10.9.3.1 443/tcp"}, ApprovedBy: "forged"}
+
+	request, err := RequestAccess("tester", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Users can only ask for access for themselves
+	if request.Effects != "tester" || request.RequestedBy != "tester" || !request.Pending || request.ApprovedBy != "" {
+		t.Fatalf("request was not recorded correctly: %+v", request)
+	}
+
+	grants, err := GetGrants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.ContainsFunc(grants, func(g Grant) bool { return g.ID == request.ID && g.Pending }) {
+		t.Fatal("pending request was not listed: ", grants)
+	}
+
+	if acl := GetEffectiveAcl("tester"); slices.Contains(acl.Allow, "10.9.3.1 443/tcp") {
+		t.Fatal("pending request gave access: ", acl.Allow)
+	}
+
+	grant, err := ApproveAccessRequest(request.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RevokeGrant(grant.ID)
+
+	if !grant.Active() || grant.ApprovedBy != "admin" || grant.RequestedBy != "tester" {
+		t.Fatalf("approved grant was not recorded correctly: %+v", grant)
+	}
+
+	if acl := GetEffectiveAcl("tester"); !slices.Contains(acl.Allow, "10.9.3.1 443/tcp") {
+		t.Fatal("approved grant was not in the effective acl: ", acl.Allow)
+	}
+
+	if _, err := ApproveAccessRequest(request.ID, "admin"); err == nil {
+		t.Fatal("request was approved twice")
+	}
+
+	rejected, err := RequestAccess("tester", Grant{Reason: "debugging", Duration: time.Hour, Allow: []string{"10.9.3.2 443/tcp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RejectAccessRequest(rejected.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApproveAccessRequest(rejected.ID, "admin"); err == nil {
+		t.Fatal("rejected request was approved")
+	}
+
+	if err := RejectAccessRequest(rejected.ID); err == nil {
+		t.Fatal("request was rejected twice")
+	}
+}
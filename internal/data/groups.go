@@ -8,36 +8,67 @@ import (
 	"fmt"
 	"log"
 	"slices"
+	"strings"
 
 	"github.com/NHAS/wag/pkg/control"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/clientv3util"
 )
 
-func SetGroup(group string, members []string, overwrite bool) error {
-	response, err := etcd.Get(context.Background(), GroupsPrefix+group)
-	if err != nil {
-		return err
-	}
+// putGroupMembers writes the members of a group if doing so does not create a cycle of nested groups, returning the previous members key if there was one.
+// Another group changing between the check and the write could still create a cycle, so the write only happens if none have
+func putGroupMembers(group string, members []string, overwrite bool) (*mvccpb.KeyValue, error) {
+	membersJson, _ := json.Marshal(members)
+
+	for attempt := 0; attempt < 5; attempt++ {
+		unchanged, err := checkNesting(group, members)
+		if err != nil {
+			return nil, err
+		}
+
+		conditions := []clientv3.Cmp{unchanged}
+		if !overwrite {
+			conditions = append(conditions, clientv3util.KeyMissing(GroupsPrefix+group))
+		}
+
+		resp, err := etcd.Txn(context.Background()).If(conditions...).Then(
+			clientv3.OpPut(GroupsPrefix+group, string(membersJson), clientv3.WithPrevKV()),
+		).Else(
+			clientv3.OpGet(GroupsPrefix + group),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
 
-	if len(response.Kvs) > 0 && !overwrite {
-		return errors.New("group already exists")
+		if resp.Succeeded {
+			return resp.Responses[0].GetResponsePut().PrevKv, nil
+		}
+
+		if !overwrite && resp.Responses[0].GetResponseRange().Count > 0 {
+			return nil, errors.New("group already exists")
+		}
 	}
 
-	membersJson, _ := json.Marshal(members)
+	return nil, errors.New("groups kept changing while checking " + group + " for nesting, try again")
+}
 
-	putResp, err := etcd.Put(context.Background(), GroupsPrefix+group, string(membersJson), clientv3.WithPrevKV())
+// SetGroup sets the members of a group, a member with the group: prefix nests that group so all of its members are members of this group too
+func SetGroup(group string, members []string, overwrite bool) error {
+	prevKv, err := putGroupMembers(group, members, overwrite)
 	if err != nil {
 		return err
 	}
 
 	var existingMembers []string
-	if putResp.PrevKv != nil {
-		err = json.Unmarshal(putResp.PrevKv.Value, &existingMembers)
+	if prevKv != nil {
+		err = json.Unmarshal(prevKv.Value, &existingMembers)
 		if err != nil {
 			return err
 		}
 	}
 
+	// Nested groups have no membership key, their members are found when membership is resolved
 	currentMembers := map[string]bool{}
 	for _, member := range members {
 		currentMembers[member] = true
@@ -46,7 +77,7 @@ func SetGroup(group string, members []string, overwrite bool) error {
 	removedMembers := []string{}
 	previousMembers := map[string]bool{}
 	for _, member := range existingMembers {
-		if !currentMembers[member] {
+		if !currentMembers[member] && !strings.HasPrefix(member, "group:") {
 			removedMembers = append(removedMembers, member)
 		}
 		previousMembers[member] = true
@@ -54,7 +85,7 @@ func SetGroup(group string, members []string, overwrite bool) error {
 
 	addedMembers := []string{}
 	for _, member := range members {
-		if previousMembers[member] {
+		if previousMembers[member] || strings.HasPrefix(member, "group:") {
 			continue
 		}
 
@@ -133,6 +164,16 @@ func GetGroups() (result []control.GroupData, err error) {
 		return nil, fmt.Errorf("failed to get group from etcd: %s", err)
 	}
 
+	sessionPolicies, err := GetSessionPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	groupRules, err := GetGroupRules()
+	if err != nil {
+		return nil, err
+	}
+
 	for _, r := range resp.Kvs {
 
 		var groupMembers []string
@@ -141,9 +182,16 @@ func GetGroups() (result []control.GroupData, err error) {
 			return nil, err
 		}
 
+		group := string(bytes.TrimPrefix(r.Key, []byte(GroupsPrefix)))
+
 		result = append(result, control.GroupData{
-			Group:   string(bytes.TrimPrefix(r.Key, []byte(GroupsPrefix))),
-			Members: groupMembers,
+			Group:                     group,
+			Members:                   groupMembers,
+			Rules:                     groupRules[group],
+			InactivityTimeoutMinutes:  sessionPolicies[group].InactivityTimeoutMinutes,
+			MaxSessionLifetimeMinutes: sessionPolicies[group].MaxSessionLifetimeMinutes,
+			AllowedNetworks:           sessionPolicies[group].AllowedNetworks,
+			AllowedCountries:          sessionPolicies[group].AllowedCountries,
 		})
 	}
 
@@ -161,6 +209,14 @@ func RemoveGroup(groupName string) error {
 		return fmt.Errorf("failed to delete group: %s", err)
 	}
 
+	if err := RemoveSessionPolicy(groupName); err != nil {
+		return fmt.Errorf("failed to delete group session policy: %s", err)
+	}
+
+	if err := RemoveGroupRules(groupName); err != nil {
+		return fmt.Errorf("failed to delete group rules: %s", err)
+	}
+
 	var oldMembers []string
 	if len(delResp.PrevKvs) == 1 {
 		err = json.Unmarshal(delResp.PrevKvs[0].Value, &oldMembers)
@@ -171,6 +227,10 @@ func RemoveGroup(groupName string) error {
 
 	var errs []error
 	for _, member := range oldMembers {
+		if strings.HasPrefix(member, "group:") {
+			continue
+		}
+
 		err = doSafeUpdate(context.Background(), MembershipKey+"-"+member, false, func(gr *clientv3.GetResponse) (value string, err error) {
 
 			if len(gr.Kvs) != 1 {
@@ -203,6 +263,7 @@ func RemoveGroup(groupName string) error {
 	return nil
 }
 
+// GetUserGroupMembership returns every group a user is in, including through nested groups and group rules, and the default group
 func GetUserGroupMembership(username string) ([]string, error) {
 
 	response, err := etcd.Get(context.Background(), MembershipKey+"-"+username)
@@ -221,6 +282,11 @@ func GetUserGroupMembership(username string) ([]string, error) {
 		return nil, fmt.Errorf("failed to unmarshal group membership: %s", err)
 	}
 
+	groupMembership, err = resolveUserGroups(username, groupMembership)
+	if err != nil {
+		return nil, err
+	}
+
 	groupMembership = append(groupMembership, "*")
 
 	return groupMembership, nil
@@ -243,3 +309,32 @@ func SetUserGroupMembership(username string, newGroups []string) error {
 
 	return nil
 }
+
+// AddUserToGroup adds group to the users membership if they are not already a member
+func AddUserToGroup(username, group string) error {
+
+	err := doSafeUpdate(context.Background(), MembershipKey+"-"+username, false, func(gr *clientv3.GetResponse) (value string, err error) {
+		if len(gr.Kvs) != 1 {
+			return "", errors.New("bad number of membership keys")
+		}
+
+		var memberCurrentGroups []string
+		err = json.Unmarshal(gr.Kvs[0].Value, &memberCurrentGroups)
+		if err != nil {
+			return "", err
+		}
+
+		if !slices.Contains(memberCurrentGroups, group) {
+			memberCurrentGroups = append(memberCurrentGroups, group)
+		}
+
+		userGroups, _ := json.Marshal(memberCurrentGroups)
+		return string(userGroups), nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to add user to group: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	ConnectionHistoryPrefix = "wag-connection-history-"
+
+	ConnectionEndpoint     = "endpoint"
+	ConnectionHandshake    = "handshake"
+	ConnectionAuthorised   = "authorised"
+	ConnectionDeauthorised = "deauthorised"
+	ConnectionLocked       = "locked"
+	ConnectionUnlocked     = "unlocked"
+	ConnectionRoamed       = "roamed"
+	ConnectionDNSBlocked   = "dns-blocked"
+)
+
+// ConnectionEvent is a change to how a device is connected, kept for ConnectionHistory.RetentionDays
+type ConnectionEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Username string    `json:"username"`
+	Address  string    `json:"address"`
+
+	// The devices endpoint after the event, if it is known
+	Endpoint string `json:"endpoint,omitempty"`
+	// The node that served the device
+	Node   string `json:"node"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type historyLeaseBucket struct {
+	day       int64
+	retention time.Duration
+}
+
+var (
+	historyLeasesLck sync.Mutex
+	historyLeases    = map[historyLeaseBucket]clientv3.LeaseID{}
+)
+
+func connectionHistoryDevicePrefix(address string) string {
+	return ConnectionHistoryPrefix + address + "-"
+}
+
+func connectionHistoryKey(address string, t time.Time) string {
+	// Zero padded so the keys sort by time
+	return fmt.Sprintf("%s%020d", connectionHistoryDevicePrefix(address), t.UnixNano())
+}
+
+// connectionHistoryLease returns the lease shared by every event recorded today, so recording an event does not create a lease each time.
+// The lease ends retention after the end of the day, so events are kept for at least retention and at most a day longer
+func connectionHistoryLease(retention time.Duration) (clientv3.LeaseID, error) {
+	historyLeasesLck.Lock()
+	defer historyLeasesLck.Unlock()
+
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	bucket := historyLeaseBucket{day: day.Unix(), retention: retention}
+
+	if lease, ok := historyLeases[bucket]; ok {
+		return lease, nil
+	}
+
+	ttl := time.Until(day.Add(24*time.Hour + retention))
+	lease, err := clientv3.NewLease(etcd).Grant(context.Background(), int64(ttl.Seconds()))
+	if err != nil {
+		return clientv3.NoLease, fmt.Errorf("could not create connection history lease: %s", err)
+	}
+
+	// Earlier days are not recorded to again, their leases are left to expire
+	clear(historyLeases)
+	historyLeases[bucket] = lease.ID
+
+	return lease.ID, nil
+}
+
+// forgetConnectionHistoryLease drops a lease etcd no longer has, e.g after a restore from backup, so the next event creates a new one
+func forgetConnectionHistoryLease(lease clientv3.LeaseID) {
+	historyLeasesLck.Lock()
+	defer historyLeasesLck.Unlock()
+
+	for bucket, id := range historyLeases {
+		if id == lease {
+			delete(historyLeases, bucket)
+		}
+	}
+}
+
+func putConnectionEvent(event ConnectionEvent, value string) error {
+	days := config.Values.ConnectionHistory.RetentionDays
+	if days <= 0 {
+		_, err := etcd.Put(context.Background(), connectionHistoryKey(event.Address, event.Time), value)
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		lease, err := connectionHistoryLease(time.Duration(days) * 24 * time.Hour)
+		if err != nil {
+			return err
+		}
+
+		_, err = etcd.Put(context.Background(), connectionHistoryKey(event.Address, event.Time), value, clientv3.WithLease(lease))
+		if attempt == 0 && errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			forgetConnectionHistoryLease(lease)
+			continue
+		}
+
+		return err
+	}
+}
+
+// RecordConnectionEvent adds the event to its devices history, removing the oldest events once the device has more than ConnectionHistory.MaxEvents
+func RecordConnectionEvent(event ConnectionEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if event.Node == "" {
+		event.Node = GetServerID().String()
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = putConnectionEvent(event, string(b))
+	if err != nil {
+		return fmt.Errorf("could not record connection event: %s", err)
+	}
+
+	maxEvents := config.Values.ConnectionHistory.MaxEvents
+	if maxEvents <= 0 {
+		return nil
+	}
+
+	existing, err := etcd.Get(context.Background(), connectionHistoryDevicePrefix(event.Address), clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return fmt.Errorf("could not get connection history to trim: %s", err)
+	}
+
+	if len(existing.Kvs) <= maxEvents {
+		return nil
+	}
+
+	var ops []clientv3.Op
+	for _, kv := range existing.Kvs[:len(existing.Kvs)-maxEvents] {
+		ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+	}
+
+	_, err = etcd.Txn(context.Background()).Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("could not trim connection history: %s", err)
+	}
+
+	return nil
+}
+
+// recordConnectionEvent is for changes where failing to record the history should not fail the change
+func recordConnectionEvent(event ConnectionEvent) {
+	if err := RecordConnectionEvent(event); err != nil {
+		log.Printf("%s:%s unable to record %s connection event: %s", event.Username, event.Address, event.Type, err)
+	}
+}
+
+// GetConnectionHistory returns the history of a device, most recent first
+func GetConnectionHistory(username, address string) (events []ConnectionEvent, err error) {
+	response, err := etcd.Get(context.Background(), connectionHistoryDevicePrefix(address), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	if err != nil {
+		return nil, fmt.Errorf("could not get connection history: %s", err)
+	}
+
+	events = []ConnectionEvent{}
+	for _, kv := range response.Kvs {
+		var event ConnectionEvent
+		if err := json.Unmarshal(kv.Value, &event); err != nil {
+			return nil, fmt.Errorf("could not unmarshal connection event: %s", err)
+		}
+
+		// The history is deleted with the device, but an event recorded while it was being deleted may belong to a previous owner of the address
+		if username != "" && event.Username != username {
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// GetUserConnectionHistory returns the combined history of the users current devices, most recent first
+func GetUserConnectionHistory(username string) (events []ConnectionEvent, err error) {
+	devices, err := GetDevicesByUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	events = []ConnectionEvent{}
+	for _, device := range devices {
+		deviceEvents, err := GetConnectionHistory(username, device.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, deviceEvents...)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+
+	return events, nil
+}
@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/pkg/control"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func historyDevice(t *testing.T, username string) Device {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := AddDevice(username, key.PublicKey().String(), control.RegistrationResult{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return device
+}
+
+func storedHistoryLeases(t *testing.T, address string) map[clientv3.LeaseID]bool {
+	resp, err := etcd.Get(context.Background(), connectionHistoryDevicePrefix(address), clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leases := map[clientv3.LeaseID]bool{}
+	for _, kv := range resp.Kvs {
+		leases[clientv3.LeaseID(kv.Lease)] = true
+	}
+
+	return leases
+}
+
+func storedHistoryLease(t *testing.T, address string) clientv3.LeaseID {
+	for lease := range storedHistoryLeases(t, address) {
+		return lease
+	}
+
+	t.Fatal("device has no history")
+	return clientv3.NoLease
+}
+
+func TestConnectionHistorySharesLease(t *testing.T) {
+	first := historyDevice(t, "historytester")
+	second := historyDevice(t, "historytester")
+	defer DeleteDevices("historytester")
+
+	for _, device := range []Device{first, second, first} {
+		if err := RecordConnectionEvent(ConnectionEvent{Type: ConnectionHandshake, Username: "historytester", Address: device.Address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leases := storedHistoryLeases(t, first.Address)
+	for lease := range storedHistoryLeases(t, second.Address) {
+		leases[lease] = true
+	}
+
+	if len(leases) != 1 || leases[clientv3.NoLease] {
+		t.Fatal("events recorded on the same day did not share one lease: ", leases)
+	}
+
+	lease := storedHistoryLease(t, first.Address)
+	ttl, err := clientv3.NewLease(etcd).TimeToLive(context.Background(), lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retention := time.Duration(config.Values.ConnectionHistory.RetentionDays) * 24 * time.Hour
+	remaining := time.Duration(ttl.TTL) * time.Second
+	if remaining < retention || remaining > retention+24*time.Hour {
+		t.Fatalf("lease expires in %s, expected between %s and a day longer", remaining, retention)
+	}
+
+	// A lease that has gone from etcd is replaced rather than failing every event for the rest of the day
+	if _, err := clientv3.NewLease(etcd).Revoke(context.Background(), lease); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RecordConnectionEvent(ConnectionEvent{Type: ConnectionHandshake, Username: "historytester", Address: first.Address}); err != nil {
+		t.Fatal("event was not recorded after the shared lease was revoked: ", err)
+	}
+
+	if leases := storedHistoryLeases(t, first.Address); len(leases) != 1 || leases[lease] {
+		t.Fatal("event did not get a new lease: ", leases)
+	}
+}
+
+func TestConnectionHistoryTrimmed(t *testing.T) {
+	device := historyDevice(t, "historytester")
+	defer DeleteDevices("historytester")
+
+	start := time.Now()
+	for i := 0; i < config.Values.ConnectionHistory.MaxEvents+5; i++ {
+		err := RecordConnectionEvent(ConnectionEvent{Type: ConnectionHandshake, Username: "historytester", Address: device.Address, Time: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := GetConnectionHistory("historytester", device.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != config.Values.ConnectionHistory.MaxEvents {
+		t.Fatalf("history has %d events expected %d", len(events), config.Values.ConnectionHistory.MaxEvents)
+	}
+
+	// Most recent first, and the oldest were the ones removed
+	if !events[0].Time.Equal(start.Add(time.Duration(config.Values.ConnectionHistory.MaxEvents+4)*time.Second)) || !events[len(events)-1].Time.Equal(start.Add(5*time.Second)) {
+		t.Fatal("wrong events were kept: ", events[0].Time, events[len(events)-1].Time)
+	}
+}
+
+func TestConnectionHistoryDeletedWithDevice(t *testing.T) {
+	kept := historyDevice(t, "historytester")
+	deleted := historyDevice(t, "historytester")
+	defer DeleteDevices("historytester")
+
+	other := historyDevice(t, "historyother")
+
+	for _, device := range []Device{kept, deleted, other} {
+		if err := RecordConnectionEvent(ConnectionEvent{Type: ConnectionAuthorised, Username: device.Username, Address: device.Address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := DeleteDevice("historytester", deleted.Address); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(storedHistoryLeases(t, deleted.Address)) != 0 {
+		t.Fatal("history was kept after the device was deleted")
+	}
+
+	if len(storedHistoryLeases(t, kept.Address)) == 0 {
+		t.Fatal("deleting a device removed the history of another")
+	}
+
+	if err := DeleteDevices("historyother"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(storedHistoryLeases(t, other.Address)) != 0 {
+		t.Fatal("history was kept after the users devices were deleted")
+	}
+
+	for _, reference := range []string{"deviceref-" + other.Address, "deviceref-" + other.Publickey} {
+		if resp, err := etcd.Get(context.Background(), reference); err != nil || resp.Count != 0 {
+			t.Fatal("device reference was kept after the users devices were deleted: ", reference)
+		}
+	}
+}
@@ -93,6 +93,8 @@ func Load(path, joinToken string, testing bool) error {
 				config.Values.Clustering.TLSManagerStorage = "certificates"
 			}
 
+			// The config supplied by other members will not have this node marked as a witness
+			witness := config.Values.Clustering.Witness
 			TLSManager, err = manager.Join(joinToken, config.Values.Clustering.TLSManagerStorage, map[string]func(name string, data string){
 				"config.json": func(name, data string) {
 					err := os.WriteFile("config.json", []byte(data), 0600)
@@ -101,7 +103,11 @@ func Load(path, joinToken string, testing bool) error {
 					}
 
 					log.Println("got additional, loading config file")
-					err = config.Load("config.json")
+					if witness {
+						err = config.LoadWitness("config.json")
+					} else {
+						err = config.Load("config.json")
+					}
 					if err != nil {
 						log.Fatal("config supplied by other cluster member was invalid (potential version issues?): ", err)
 					}
@@ -231,6 +237,24 @@ func loadInitialSettings() error {
 			}
 		}
 
+		for groupName, rules := range config.Values.Acls.Rules {
+			if err := SetGroupRules(groupName, rules); err != nil {
+				return fmt.Errorf("group rules for %s: %s", groupName, err)
+			}
+		}
+
+		for groupName, session := range config.Values.Acls.Sessions {
+			err := SetSessionPolicy(groupName, SessionPolicy{
+				InactivityTimeoutMinutes:  session.InactivityTimeoutMinutes,
+				MaxSessionLifetimeMinutes: session.MaxSessionLifetimeMinutes,
+				AllowedNetworks:           session.AllowedNetworks,
+				AllowedCountries:          session.AllowedCountries,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
 	}
 
 	configData, _ := json.Marshal(config.Values)
@@ -264,6 +288,11 @@ func loadInitialSettings() error {
 		return err
 	}
 
+	err = putIfNotFound(DeviceRoamingKey, DeviceRoaming(config.Values.Clustering.DeviceRoaming), "device roaming")
+	if err != nil {
+		return err
+	}
+
 	err = putIfNotFound(LockoutKey, config.Values.Lockout, "lockout")
 	if err != nil {
 		return err
@@ -422,7 +451,7 @@ func migrateFromSql(database *sql.DB) error {
 		}
 
 		for _, token := range tokens {
-			err := AddRegistrationToken(token.Token, token.Username, token.Overwrites, token.Groups, token.NumUses)
+			err := AddRegistrationToken(token)
 			if err != nil {
 				return err
 			}
@@ -441,7 +470,12 @@ func migrateFromSql(database *sql.DB) error {
 }
 
 func TearDown() {
-	close(exit)
+	select {
+	case <-exit:
+	default:
+		close(exit)
+	}
+
 	if etcdServer != nil {
 
 		etcd.Close()
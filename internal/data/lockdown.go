@@ -0,0 +1,251 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	LockdownKey           = "wag-lockdown"
+	lockdownHistoryPrefix = "wag-lockdown-history-"
+
+	MaxLockdownDuration = 7 * 24 * time.Hour
+)
+
+// Lockdown cuts all mfa access cluster wide until it expires or is ended, the key is attached to a lease so etcd removes it on expiry
+type Lockdown struct {
+	Reason string `json:"reason"`
+	By     string `json:"by"`
+
+	Started time.Time `json:"started"`
+	Expires time.Time `json:"expires"`
+
+	// Members of these groups keep their access
+	ExemptGroups []string `json:"exempt_groups"`
+
+	// Also block public routes, leaving only the wag server reachable
+	BlockPublic bool `json:"block_public"`
+}
+
+func (l Lockdown) Active() bool {
+	return time.Now().Before(l.Expires)
+}
+
+// Exempt returns whether a user with membership of groups keeps their access during the lockdown
+func (l Lockdown) Exempt(groups []string) bool {
+	for _, group := range groups {
+		if slices.Contains(l.ExemptGroups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LockdownAudit records a lockdown being started or ended
+type LockdownAudit struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+
+	Expires      time.Time `json:"expires,omitempty"`
+	ExemptGroups []string  `json:"exempt_groups,omitempty"`
+	BlockPublic  bool      `json:"block_public,omitempty"`
+}
+
+// LockdownStatus is the current lockdown, if any, and the audit log of previous ones
+type LockdownStatus struct {
+	Active   bool            `json:"active"`
+	Lockdown *Lockdown       `json:"lockdown,omitempty"`
+	History  []LockdownAudit `json:"history"`
+}
+
+// StartLockdown puts the cluster in lockdown for duration, starting a lockdown while one is active replaces it
+func StartLockdown(by, reason string, duration time.Duration, exemptGroups []string, blockPublic bool) (Lockdown, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return Lockdown{}, errors.New("a lockdown must have a reason")
+	}
+
+	if by == "" {
+		return Lockdown{}, errors.New("a lockdown must record who started it")
+	}
+
+	if duration < time.Minute || duration > MaxLockdownDuration {
+		return Lockdown{}, fmt.Errorf("lockdown duration must be between 1 minute and %s", MaxLockdownDuration)
+	}
+
+	for _, group := range exemptGroups {
+		if !strings.HasPrefix(group, "group:") {
+			return Lockdown{}, fmt.Errorf("exempt group does not have 'group:' prefix: %s", group)
+		}
+	}
+
+	now := time.Now()
+	lockdown := Lockdown{
+		Reason:       reason,
+		By:           by,
+		Started:      now,
+		Expires:      now.Add(duration),
+		ExemptGroups: exemptGroups,
+		BlockPublic:  blockPublic,
+	}
+
+	lease, err := clientv3.NewLease(etcd).Grant(context.Background(), int64(duration.Seconds()))
+	if err != nil {
+		return Lockdown{}, fmt.Errorf("could not create lockdown lease: %s", err)
+	}
+
+	lockdownJson, _ := json.Marshal(lockdown)
+	auditJson, _ := json.Marshal(LockdownAudit{
+		Time:         now,
+		Action:       "started",
+		By:           by,
+		Reason:       reason,
+		Expires:      lockdown.Expires,
+		ExemptGroups: exemptGroups,
+		BlockPublic:  blockPublic,
+	})
+
+	_, err = etcd.Txn(context.Background()).Then(
+		clientv3.OpPut(LockdownKey, string(lockdownJson), clientv3.WithLease(lease.ID)),
+		clientv3.OpPut(lockdownHistoryKey(now), string(auditJson)),
+	).Commit()
+	if err != nil {
+		return Lockdown{}, fmt.Errorf("could not start lockdown: %s", err)
+	}
+
+	return lockdown, nil
+}
+
+// EndLockdown lifts the lockdown before it expires
+func EndLockdown(by, reason string) error {
+	if by == "" {
+		return errors.New("ending a lockdown must record who ended it")
+	}
+
+	auditJson, _ := json.Marshal(LockdownAudit{
+		Time:   time.Now(),
+		Action: "ended",
+		By:     by,
+		Reason: strings.TrimSpace(reason),
+	})
+
+	resp, err := etcd.Txn(context.Background()).If(
+		clientv3.Compare(clientv3.CreateRevision(LockdownKey), ">", 0),
+	).Then(
+		clientv3.OpDelete(LockdownKey),
+		clientv3.OpPut(lockdownHistoryKey(time.Now()), string(auditJson)),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("could not end lockdown: %s", err)
+	}
+
+	if !resp.Succeeded {
+		return errors.New("the cluster is not in lockdown")
+	}
+
+	return nil
+}
+
+// GetLockdown returns the current lockdown, ok is false if the cluster is not in lockdown
+func GetLockdown() (lockdown Lockdown, ok bool, err error) {
+	resp, err := etcd.Get(context.Background(), LockdownKey)
+	if err != nil {
+		return Lockdown{}, false, fmt.Errorf("could not get lockdown: %s", err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return Lockdown{}, false, nil
+	}
+
+	err = json.Unmarshal(resp.Kvs[0].Value, &lockdown)
+	if err != nil {
+		return Lockdown{}, false, fmt.Errorf("could not unmarshal lockdown: %s", err)
+	}
+
+	return lockdown, lockdown.Active(), nil
+}
+
+// GetLockdownHistory returns the audit log of lockdowns, most recent first
+func GetLockdownHistory() (result []LockdownAudit, err error) {
+	resp, err := etcd.Get(context.Background(), lockdownHistoryPrefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	if err != nil {
+		return nil, fmt.Errorf("could not get lockdown history: %s", err)
+	}
+
+	for _, r := range resp.Kvs {
+		var audit LockdownAudit
+		if err := json.Unmarshal(r.Value, &audit); err != nil {
+			return nil, fmt.Errorf("could not unmarshal lockdown history: %s", err)
+		}
+
+		result = append(result, audit)
+	}
+
+	return result, nil
+}
+
+func GetLockdownStatus() (status LockdownStatus, err error) {
+	lockdown, ok, err := GetLockdown()
+	if err != nil {
+		return status, err
+	}
+
+	if ok {
+		status.Active = true
+		status.Lockdown = &lockdown
+	}
+
+	status.History, err = GetLockdownHistory()
+	return status, err
+}
+
+// IsLockedOut returns whether the cluster is in lockdown and the user is not exempt from it
+func IsLockedOut(username string) (bool, error) {
+	lockdown, ok, err := GetLockdown()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	groups, err := GetUserGroupMembership(username)
+	if err != nil {
+		return false, err
+	}
+
+	return !lockdown.Exempt(groups), nil
+}
+
+// blockedByLockdown takes the lockdown key and a users resolved groups, and returns whether the user has no access to public routes
+func blockedByLockdown(lockdownResp *etcdserverpb.RangeResponse, groups []string) bool {
+	if lockdownResp.GetCount() == 0 {
+		return false
+	}
+
+	var lockdown Lockdown
+	if err := json.Unmarshal(lockdownResp.Kvs[0].Value, &lockdown); err != nil {
+		log.Println("failed to unmarshal lockdown: ", err)
+		return false
+	}
+
+	if !lockdown.Active() || !lockdown.BlockPublic {
+		return false
+	}
+
+	return !lockdown.Exempt(groups)
+}
+
+func lockdownHistoryKey(t time.Time) string {
+	// Zero padded so the keys sort by time
+	return fmt.Sprintf("%s%020d", lockdownHistoryPrefix, t.UnixNano())
+}
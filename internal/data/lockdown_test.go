@@ -0,0 +1,182 @@
+package data
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/acls"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestLockdownExempt(t *testing.T) {
+	lockdown := Lockdown{ExemptGroups: []string{"group:ops", "group:oncall"}}
+
+	tests := []struct {
+		groups []string
+		exempt bool
+	}{
+		{nil, false},
+		{[]string{"*"}, false},
+		{[]string{"group:users"}, false},
+		{[]string{"group:users", "group:oncall"}, true},
+		{[]string{"group:ops"}, true},
+		// Group names are matched exactly
+		{[]string{"group:op"}, false},
+	}
+
+	for _, test := range tests {
+		if lockdown.Exempt(test.groups) != test.exempt {
+			t.Errorf("Exempt(%v) expected %t", test.groups, test.exempt)
+		}
+	}
+
+	if (Lockdown{}).Exempt([]string{"group:ops"}) {
+		t.Error("lockdown without exempt groups exempted a user")
+	}
+}
+
+func lockdownResponse(t *testing.T, lockdown *Lockdown) *etcdserverpb.RangeResponse {
+	if lockdown == nil {
+		return &etcdserverpb.RangeResponse{}
+	}
+
+	b, err := json.Marshal(lockdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &etcdserverpb.RangeResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Key: []byte(LockdownKey), Value: b}}}
+}
+
+func TestBlockedByLockdown(t *testing.T) {
+	active := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		lockdown *Lockdown
+		groups   []string
+		blocked  bool
+	}{
+		{"no lockdown", nil, []string{"group:users"}, false},
+		{"mfa only lockdown", &Lockdown{Expires: active}, []string{"group:users"}, false},
+		{"blocks public", &Lockdown{Expires: active, BlockPublic: true}, []string{"group:users"}, true},
+		{"exempt", &Lockdown{Expires: active, BlockPublic: true, ExemptGroups: []string{"group:ops"}}, []string{"group:users", "group:ops"}, false},
+		{"not exempt", &Lockdown{Expires: active, BlockPublic: true, ExemptGroups: []string{"group:ops"}}, []string{"group:users"}, true},
+		// etcd removes the key when the lease expires, until then the expiry time is checked
+		{"expired", &Lockdown{Expires: expired, BlockPublic: true}, []string{"group:users"}, false},
+	}
+
+	for _, test := range tests {
+		if blockedByLockdown(lockdownResponse(t, test.lockdown), test.groups) != test.blocked {
+			t.Errorf("%s: expected blocked to be %t", test.name, test.blocked)
+		}
+	}
+
+	corrupt := &etcdserverpb.RangeResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Key: []byte(LockdownKey), Value: []byte("{")}}}
+	if blockedByLockdown(corrupt, nil) {
+		t.Error("a lockdown that could not be decoded blocked public routes")
+	}
+}
+
+func TestStartLockdownValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		by       string
+		reason   string
+		duration time.Duration
+		groups   []string
+	}{
+		{"no reason", "admin", "  ", time.Hour, nil},
+		{"no admin", "", "incident", time.Hour, nil},
+		{"too short", "admin", "incident", time.Second, nil},
+		{"too long", "admin", "incident", MaxLockdownDuration + time.Minute, nil},
+		{"bad group", "admin", "incident", time.Hour, []string{"ops"}},
+	}
+
+	for _, test := range tests {
+		if _, err := StartLockdown(test.by, test.reason, test.duration, test.groups, false); err == nil {
+			t.Errorf("%s: lockdown was started", test.name)
+		}
+	}
+
+	if _, ok, err := GetLockdown(); err != nil || ok {
+		t.Fatal("invalid lockdown was stored: ", ok, err)
+	}
+}
+
+func TestLockdown(t *testing.T) {
+	_, err := StartLockdown("admin", "incident", time.Hour, []string{"group:nerds"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer EndLockdown("admin", "")
+
+	lockdown, ok, err := GetLockdown()
+	if err != nil || !ok {
+		t.Fatal("lockdown was not active: ", ok, err)
+	}
+
+	if lockdown.Reason != "incident" || !lockdown.BlockPublic {
+		t.Fatalf("lockdown was not stored as started: %+v", lockdown)
+	}
+
+	lockedOut, err := IsLockedOut("tester")
+	if err != nil || lockedOut {
+		t.Fatal("member of an exempt group was locked out: ", err)
+	}
+
+	lockedOut, err = IsLockedOut("not_a_member")
+	if err != nil || !lockedOut {
+		t.Fatal("user outside the exempt groups was not locked out: ", err)
+	}
+
+	acl := GetEffectiveAcl("not_a_member")
+	if len(acl.Allow) != 1 || len(acl.Mfa) != 0 || len(acl.Deny) != 0 {
+		t.Fatal("lockdown blocking public routes left routes other than the wag server: ", acl)
+	}
+
+	if len(GetEffectiveAcl("tester").Mfa) == 0 {
+		t.Fatal("exempt user lost their routes")
+	}
+
+	err = SetAcl("tag:printer", acls.Acl{Allow: []string{"10.9.9.9 631/tcp"}}, true)
+	if err != nil {
+		t.Fatal("could not set tag policy: ", err)
+	}
+	defer RemoveAcl("tag:printer")
+
+	tagged := GetEffectiveDeviceAcl("not_a_member", "", []string{"printer"})
+	if len(tagged.Allow) != 1 || len(tagged.Mfa) != 0 || len(tagged.Deny) != 0 {
+		t.Fatal("tag policy gave a locked out users device routes other than the wag server: ", tagged)
+	}
+
+	if !slices.Contains(GetEffectiveDeviceAcl("tester", "", []string{"printer"}).Allow, "10.9.9.9 631/tcp") {
+		t.Fatal("exempt users tagged device lost the tag policy")
+	}
+
+	if err := EndLockdown("admin", "resolved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EndLockdown("admin", "resolved"); err == nil {
+		t.Fatal("ending a lockdown that is not active did not fail")
+	}
+
+	if lockedOut, _ := IsLockedOut("not_a_member"); lockedOut {
+		t.Fatal("user was still locked out after the lockdown ended")
+	}
+
+	history, err := GetLockdownHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) < 2 || history[0].Action != "ended" || history[0].Reason != "resolved" || history[1].Action != "started" || history[1].Reason != "incident" {
+		t.Fatalf("lockdown history was not recorded most recent first: %+v", history)
+	}
+}
@@ -0,0 +1,458 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/webserver/authenticators/types"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Groups may contain other groups, listed as a member with the group: prefix, and may have rules that make every user matching them a member.
+// A users membership key only holds the groups they were added to directly, the groups they are in through nesting or rules are worked out whenever membership is needed
+
+// membershipRule is a single condition of a dynamic group, one of claim:<name>=<value>, mfa=<type>, created<date> or created>date
+type membershipRule struct {
+	attribute string
+	operator  byte
+	value     string
+
+	claim   string
+	created time.Time
+}
+
+func parseRuleTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseMembershipRule(rule string) (membershipRule, error) {
+	i := strings.IndexAny(rule, "=<>")
+	if i <= 0 || i == len(rule)-1 {
+		return membershipRule{}, fmt.Errorf("rule %q must be claim:<name>=<value>, mfa=<type>, created<date> or created>date", rule)
+	}
+
+	r := membershipRule{
+		attribute: strings.TrimSpace(rule[:i]),
+		operator:  rule[i],
+		value:     strings.TrimSpace(rule[i+1:]),
+	}
+
+	switch {
+	case strings.HasPrefix(r.attribute, "claim:") && len(r.attribute) > len("claim:") && r.operator == '=':
+		r.claim = strings.TrimPrefix(r.attribute, "claim:")
+	case r.attribute == "mfa" && r.operator == '=':
+		switch types.MFA(r.value) {
+		case types.Totp, types.Webauthn, types.Oidc, types.Pam:
+		default:
+			return membershipRule{}, fmt.Errorf("rule %q has unknown mfa type %q", rule, r.value)
+		}
+	case r.attribute == "created" && r.operator != '=':
+		created, err := parseRuleTime(r.value)
+		if err != nil {
+			return membershipRule{}, fmt.Errorf("rule %q date must be YYYY-MM-DD or RFC3339", rule)
+		}
+		r.created = created
+	default:
+		return membershipRule{}, fmt.Errorf("rule %q must be claim:<name>=<value>, mfa=<type>, created<date> or created>date", rule)
+	}
+
+	return r, nil
+}
+
+func parseMembershipRules(rules []string) (result []membershipRule, err error) {
+	for _, rule := range rules {
+		r, err := parseMembershipRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, nil
+}
+
+// matches checks the rule against the user, users created before creation times were recorded never match a created rule
+func (r membershipRule) matches(user UserModel, claims map[string][]string) bool {
+	switch {
+	case r.claim != "":
+		return slices.Contains(claims[r.claim], r.value)
+	case r.attribute == "mfa":
+		return user.MfaType == r.value
+	default:
+		if user.Created.IsZero() {
+			return false
+		}
+
+		if r.operator == '<' {
+			return user.Created.Before(r.created)
+		}
+		return user.Created.After(r.created)
+	}
+}
+
+// membershipGraph holds what is needed to work out the groups a user is in beyond the ones they were added to directly
+type membershipGraph struct {
+	// group -> groups that list it as a member
+	parents map[string][]string
+	// group -> rules a user must match all of to be a member
+	rules map[string][]membershipRule
+}
+
+func (g membershipGraph) clone() membershipGraph {
+	result := membershipGraph{
+		parents: map[string][]string{},
+		rules:   map[string][]membershipRule{},
+	}
+
+	for group, parents := range g.parents {
+		result.parents[group] = slices.Clone(parents)
+	}
+
+	for group, rules := range g.rules {
+		result.rules[group] = rules
+	}
+
+	return result
+}
+
+func membershipGraphFromKvs(groups, dynamic []*mvccpb.KeyValue) membershipGraph {
+	graph := membershipGraph{
+		parents: map[string][]string{},
+		rules:   map[string][]membershipRule{},
+	}
+
+	for _, kv := range groups {
+		var members []string
+		if err := json.Unmarshal(kv.Value, &members); err != nil {
+			log.Println("failed to unmarshal group: ", string(kv.Key), err)
+			continue
+		}
+
+		group := string(bytes.TrimPrefix(kv.Key, []byte(GroupsPrefix)))
+		for _, member := range members {
+			if strings.HasPrefix(member, "group:") {
+				graph.parents[member] = append(graph.parents[member], group)
+			}
+		}
+	}
+
+	for _, kv := range dynamic {
+		var rules []string
+		if err := json.Unmarshal(kv.Value, &rules); err != nil {
+			log.Println("failed to unmarshal group rules: ", string(kv.Key), err)
+			continue
+		}
+
+		// A group with a rule that does not parse matches nobody, rather than everybody
+		parsed, err := parseMembershipRules(rules)
+		if err != nil {
+			log.Println("group rules are invalid: ", string(kv.Key), err)
+			continue
+		}
+
+		graph.rules[string(bytes.TrimPrefix(kv.Key, []byte(DynamicGroupsPrefix)))] = parsed
+	}
+
+	return graph
+}
+
+// resolve returns the groups a user was added to directly, followed by the groups they match the rules of and every group containing those.
+// Cycles are rejected by SetGroup, but are also safe here as each group is only visited once
+func (g membershipGraph) resolve(user UserModel, claims map[string][]string, direct []string) []string {
+	result := slices.Clone(direct)
+
+	var dynamic []string
+	for group, rules := range g.rules {
+		matched := true
+		for _, rule := range rules {
+			if !rule.matches(user, claims) {
+				matched = false
+				break
+			}
+		}
+
+		if matched && !slices.Contains(result, group) {
+			dynamic = append(dynamic, group)
+		}
+	}
+	sort.Strings(dynamic)
+	result = append(result, dynamic...)
+
+	seen := map[string]bool{}
+	for _, group := range result {
+		seen[group] = true
+	}
+
+	for i := 0; i < len(result); i++ {
+		for _, parent := range g.parents[result[i]] {
+			if !seen[parent] {
+				seen[parent] = true
+				result = append(result, parent)
+			}
+		}
+	}
+
+	return result
+}
+
+func userAttributesFromResponses(userResp, claimsResp *etcdserverpb.RangeResponse) (user UserModel, claims map[string][]string) {
+	if userResp.GetCount() != 0 {
+		if err := json.Unmarshal(userResp.Kvs[0].Value, &user); err != nil {
+			log.Println("failed to unmarshal user: ", err)
+		}
+	}
+
+	if claimsResp.GetCount() != 0 {
+		if err := json.Unmarshal(claimsResp.Kvs[0].Value, &claims); err != nil {
+			log.Println("failed to unmarshal user claims: ", err)
+		}
+	}
+
+	return user, claims
+}
+
+// membershipVersion identifies the state of the groups and group rules by the number of keys and the most recent modification of each,
+// between them these change on every create, update and delete
+type membershipVersion struct {
+	groups, groupsRevision int64
+	rules, rulesRevision   int64
+}
+
+// The membership graph needs every group and rule, so it is cached and only rebuilt when its version changes rather than on every lookup
+var (
+	membershipGraphLck     sync.Mutex
+	cachedMembershipGraph  *membershipGraph
+	cachedMembershipGraphV membershipVersion
+)
+
+// opLatestModification gets the number of keys under prefix and the most recently modified one, without their values
+func opLatestModification(prefix string) clientv3.Op {
+	return clientv3.OpGet(prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend), clientv3.WithLimit(1))
+}
+
+func membershipVersionFromResponses(groups, rules *etcdserverpb.RangeResponse) (version membershipVersion) {
+	version.groups = groups.GetCount()
+	if len(groups.GetKvs()) > 0 {
+		version.groupsRevision = groups.Kvs[0].ModRevision
+	}
+
+	version.rules = rules.GetCount()
+	if len(rules.GetKvs()) > 0 {
+		version.rulesRevision = rules.Kvs[0].ModRevision
+	}
+
+	return version
+}
+
+// getMembershipGraph returns the membership graph, rebuilding it if version differs from the cached graph
+func getMembershipGraph(version membershipVersion) (membershipGraph, error) {
+	membershipGraphLck.Lock()
+	defer membershipGraphLck.Unlock()
+
+	if cachedMembershipGraph != nil && cachedMembershipGraphV == version {
+		return *cachedMembershipGraph, nil
+	}
+
+	resp, err := etcd.Txn(context.Background()).Then(
+		clientv3.OpGet(GroupsPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(DynamicGroupsPrefix, clientv3.WithPrefix()),
+		opLatestModification(GroupsPrefix),
+		opLatestModification(DynamicGroupsPrefix),
+	).Commit()
+	if err != nil {
+		return membershipGraph{}, fmt.Errorf("failed to get group information: %s", err)
+	}
+
+	graph := membershipGraphFromKvs(resp.Responses[0].GetResponseRange().Kvs, resp.Responses[1].GetResponseRange().Kvs)
+
+	// The graph is read in one transaction with its version, which may be newer than the version asked for
+	cachedMembershipGraph = &graph
+	cachedMembershipGraphV = membershipVersionFromResponses(resp.Responses[2].GetResponseRange(), resp.Responses[3].GetResponseRange())
+
+	return graph, nil
+}
+
+// resolveUserGroups adds the groups a user is in through nesting and dynamic rules to the groups they were added to directly
+func resolveUserGroups(username string, direct []string) ([]string, error) {
+	resp, err := etcd.Txn(context.Background()).Then(
+		opLatestModification(GroupsPrefix),
+		opLatestModification(DynamicGroupsPrefix),
+		clientv3.OpGet(UsersPrefix+username+"-"),
+		clientv3.OpGet(UserClaimsPrefix+username),
+	).Commit()
+	if err != nil {
+		return direct, fmt.Errorf("failed to get group information: %s", err)
+	}
+
+	graph, err := getMembershipGraph(membershipVersionFromResponses(resp.Responses[0].GetResponseRange(), resp.Responses[1].GetResponseRange()))
+	if err != nil {
+		return direct, err
+	}
+
+	user, claims := userAttributesFromResponses(resp.Responses[2].GetResponseRange(), resp.Responses[3].GetResponseRange())
+
+	return graph.resolve(user, claims, direct), nil
+}
+
+// checkNesting returns an error if giving group these members would let a group contain itself.
+// The comparison only holds while the groups are as they were checked, so the members must be written in a transaction with it
+func checkNesting(group string, members []string) (clientv3.Cmp, error) {
+	resp, err := etcd.Get(context.Background(), GroupsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return clientv3.Cmp{}, fmt.Errorf("failed to get groups: %s", err)
+	}
+
+	// Any group created or changed since they were read has a later revision, deleting a group cannot create a cycle
+	unchanged := clientv3.Compare(clientv3.ModRevision(GroupsPrefix).WithPrefix(), "<", resp.Header.Revision+1)
+
+	children := map[string][]string{}
+	for _, kv := range resp.Kvs {
+		var groupMembers []string
+		if err := json.Unmarshal(kv.Value, &groupMembers); err != nil {
+			return unchanged, fmt.Errorf("failed to unmarshal group %q: %s", kv.Key, err)
+		}
+
+		name := string(bytes.TrimPrefix(kv.Key, []byte(GroupsPrefix)))
+		for _, member := range groupMembers {
+			if strings.HasPrefix(member, "group:") {
+				children[name] = append(children[name], member)
+			}
+		}
+	}
+
+	return unchanged, findCycle(group, members, children)
+}
+
+// findCycle returns an error if group with these members can reach itself through children, which maps each group to the groups it contains
+func findCycle(group string, members []string, children map[string][]string) error {
+	children[group] = nil
+	for _, member := range members {
+		if strings.HasPrefix(member, "group:") {
+			children[group] = append(children[group], member)
+		}
+	}
+
+	seen := map[string]bool{}
+	var visit func(current string, path []string) error
+	visit = func(current string, path []string) error {
+		for _, child := range children[current] {
+			if child == group {
+				return fmt.Errorf("group %s cannot contain itself: %s", group, strings.Join(append(slices.Clip(path), child), " -> "))
+			}
+
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+
+			if err := visit(child, append(slices.Clip(path), child)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return visit(group, []string{group})
+}
+
+func ValidateGroupRules(rules []string) error {
+	_, err := parseMembershipRules(rules)
+	return err
+}
+
+// SetGroupRules sets the rules that make users members of a group automatically, a user must match every rule. No rules removes them
+func SetGroupRules(group string, rules []string) error {
+	if err := ValidateGroupRules(rules); err != nil {
+		return err
+	}
+
+	if len(rules) == 0 {
+		return RemoveGroupRules(group)
+	}
+
+	if group == "*" {
+		return errors.New("every user is already a member of the default group")
+	}
+
+	rulesJson, _ := json.Marshal(rules)
+
+	_, err := etcd.Put(context.Background(), DynamicGroupsPrefix+group, string(rulesJson))
+	return err
+}
+
+func RemoveGroupRules(group string) error {
+	_, err := etcd.Delete(context.Background(), DynamicGroupsPrefix+group)
+	return err
+}
+
+// GetGroupRules returns the membership rules of every dynamic group
+func GetGroupRules() (map[string][]string, error) {
+	resp, err := etcd.Get(context.Background(), DynamicGroupsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group rules: %s", err)
+	}
+
+	result := map[string][]string{}
+	for _, r := range resp.Kvs {
+		var rules []string
+		if err := json.Unmarshal(r.Value, &rules); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal group rules %q: %s", r.Key, err)
+		}
+
+		result[string(r.Key[len(DynamicGroupsPrefix):])] = rules
+	}
+
+	return result, nil
+}
+
+// GetRuleClaims returns the names of the claims that group rules refer to, only these are recorded for each user
+func GetRuleClaims() ([]string, error) {
+	groupRules, err := GetGroupRules()
+	if err != nil {
+		return nil, err
+	}
+
+	var claims []string
+	for _, rules := range groupRules {
+		for _, rule := range rules {
+			r, err := parseMembershipRule(rule)
+			if err == nil && r.claim != "" && !slices.Contains(claims, r.claim) {
+				claims = append(claims, r.claim)
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// SetUserClaims records the claims a user had when they last signed in. The key is only written when the claims change, as that recalculates the users groups
+func SetUserClaims(username string, claims map[string][]string) error {
+	if len(claims) == 0 {
+		_, err := etcd.Delete(context.Background(), UserClaimsPrefix+username)
+		return err
+	}
+
+	claimsJson, _ := json.Marshal(claims)
+
+	_, err := etcd.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.Value(UserClaimsPrefix+username), "=", string(claimsJson))).
+		Else(clientv3.OpPut(UserClaimsPrefix+username, string(claimsJson))).
+		Commit()
+	return err
+}
@@ -0,0 +1,301 @@
+package data
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMembershipRule(t *testing.T) {
+	valid := []string{
+		"claim:department=engineering",
+		"claim:groups = admins",
+		"mfa=totp",
+		"mfa=webauthn",
+		"created<2024-01-01",
+		"created>2024-01-01T10:00:00Z",
+	}
+
+	for _, rule := range valid {
+		if _, err := parseMembershipRule(rule); err != nil {
+			t.Errorf("valid rule %q was rejected: %s", rule, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"=value",
+		"claim:department=",
+		"claim:=engineering",
+		"claim:department<engineering",
+		"mfa=sms",
+		"mfa<totp",
+		"created=2024-01-01",
+		"created<yesterday",
+		"email=someone@example.com",
+	}
+
+	for _, rule := range invalid {
+		if _, err := parseMembershipRule(rule); err == nil {
+			t.Errorf("invalid rule %q was accepted", rule)
+		}
+	}
+
+	if _, err := parseMembershipRules([]string{"mfa=totp", "mfa=sms"}); err == nil {
+		t.Error("rules with one invalid rule were accepted")
+	}
+}
+
+func mustParseRules(t *testing.T, rules ...string) []membershipRule {
+	parsed, err := parseMembershipRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestMembershipRuleMatches(t *testing.T) {
+	user := UserModel{Username: "tester", MfaType: "totp", Created: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}
+	claims := map[string][]string{"groups": {"admins", "ops"}}
+
+	tests := []struct {
+		rule    string
+		user    UserModel
+		matches bool
+	}{
+		{"claim:groups=ops", user, true},
+		{"claim:groups=dev", user, false},
+		{"claim:department=ops", user, false},
+		{"mfa=totp", user, true},
+		{"mfa=webauthn", user, false},
+		{"created<2025-01-01", user, true},
+		{"created>2025-01-01", user, false},
+		{"created>2024-01-01", user, true},
+		// Users created before creation times were recorded never match
+		{"created<2025-01-01", UserModel{Username: "old"}, false},
+		{"created>2000-01-01", UserModel{Username: "old"}, false},
+	}
+
+	for _, test := range tests {
+		r := mustParseRules(t, test.rule)[0]
+		if r.matches(test.user, claims) != test.matches {
+			t.Errorf("%q matching %s expected %t", test.rule, test.user.Username, test.matches)
+		}
+	}
+}
+
+func TestMembershipGraphResolve(t *testing.T) {
+	graph := membershipGraph{
+		parents: map[string][]string{
+			"group:dev":   {"group:eng"},
+			"group:eng":   {"group:staff"},
+			"group:ops":   {"group:eng", "group:oncall"},
+			"group:staff": {"group:dev"}, // A cycle, which SetGroup prevents, must not loop
+		},
+		rules: map[string][]membershipRule{
+			"group:totp":   mustParseRules(t, "mfa=totp"),
+			"group:admins": mustParseRules(t, "claim:groups=admins", "mfa=webauthn"),
+			"group:ops":    mustParseRules(t, "claim:groups=ops"),
+		},
+	}
+
+	user := UserModel{Username: "tester", MfaType: "totp"}
+	claims := map[string][]string{"groups": {"admins", "ops"}}
+
+	tests := []struct {
+		name     string
+		direct   []string
+		claims   map[string][]string
+		expected []string
+	}{
+		{"nothing", []string{"group:other"}, nil, []string{"group:other", "group:totp"}},
+		// Direct groups first, then rule matches sorted, then the groups containing them in the order found
+		{"nested", []string{"group:dev"}, nil, []string{"group:dev", "group:totp", "group:eng", "group:staff"}},
+		// Every rule must match, so group:admins which also needs webauthn is left out
+		{"rules", nil, claims, []string{"group:ops", "group:totp", "group:eng", "group:oncall", "group:staff", "group:dev"}},
+		// A direct member of a dynamic group is not listed twice
+		{"direct and dynamic", []string{"group:totp"}, nil, []string{"group:totp"}},
+	}
+
+	for _, test := range tests {
+		got := graph.resolve(user, test.claims, test.direct)
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("%s: resolved %v expected %v", test.name, got, test.expected)
+		}
+	}
+
+	direct := []string{"group:dev"}
+	graph.resolve(user, nil, direct)
+	if !slices.Equal(direct, []string{"group:dev"}) {
+		t.Error("resolve modified the direct groups")
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	children := func() map[string][]string {
+		return map[string][]string{
+			"group:a": {"group:b"},
+			"group:b": {"group:c"},
+			"group:d": {"group:c"},
+		}
+	}
+
+	tests := []struct {
+		group   string
+		members []string
+		cycle   bool
+	}{
+		{"group:c", []string{"tester"}, false},
+		{"group:c", []string{"group:a"}, true},
+		{"group:c", []string{"group:c"}, true},
+		{"group:d", []string{"group:a", "group:b"}, false},
+		// Replacing the members of a group drops its old children, so it can stop being part of a cycle
+		{"group:a", []string{"group:d"}, false},
+		{"group:new", []string{"group:a", "group:d"}, false},
+	}
+
+	for _, test := range tests {
+		err := findCycle(test.group, test.members, children())
+		if (err != nil) != test.cycle {
+			t.Errorf("%s with %v: got %v expected cycle %t", test.group, test.members, err, test.cycle)
+		}
+	}
+
+	err := findCycle("group:c", []string{"group:a"}, children())
+	if err == nil || !strings.Contains(err.Error(), "group:c -> group:a -> group:b -> group:c") {
+		t.Error("cycle error did not describe the path: ", err)
+	}
+}
+
+func TestSetGroupRejectsCycles(t *testing.T) {
+	defer RemoveGroup("group:cycle-a")
+	defer RemoveGroup("group:cycle-b")
+
+	if err := SetGroup("group:cycle-a", []string{"group:cycle-b"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetGroup("group:cycle-b", []string{"group:cycle-a"}, false); err == nil {
+		t.Fatal("group was allowed to contain itself")
+	}
+
+	if err := SetGroup("group:cycle-a", []string{"tester"}, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatal("existing group was replaced without overwrite: ", err)
+	}
+}
+
+func TestCheckNestingIsInvalidatedByGroupChanges(t *testing.T) {
+	defer RemoveGroup("group:race-a")
+	defer RemoveGroup("group:race-b")
+
+	unchanged, err := checkNesting("group:race-a", []string{"group:race-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A group written after the check may form a cycle with the checked members, so the write must not go ahead
+	if err := SetGroup("group:race-b", []string{"group:race-a"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := etcd.Txn(context.Background()).If(unchanged).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Succeeded {
+		t.Fatal("nesting check still held after a group was created")
+	}
+
+	if err := SetGroup("group:race-a", []string{"group:race-b"}, false); err == nil {
+		t.Fatal("group was allowed to contain itself")
+	}
+}
+
+func TestResolveUserGroupsFollowsChanges(t *testing.T) {
+	defer RemoveGroup("group:resolve-parent")
+	defer RemoveGroupRules("group:resolve-rule")
+
+	resolved, err := resolveUserGroups("tester", []string{"group:nerds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slices.Contains(resolved, "group:resolve-parent") || slices.Contains(resolved, "group:resolve-rule") {
+		t.Fatal("groups resolved before they existed: ", resolved)
+	}
+
+	if err := SetGroup("group:resolve-parent", []string{"group:nerds"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetGroupRules("group:resolve-rule", []string{"claim:team=blue"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetUserClaims("tester", map[string][]string{"team": {"blue"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserClaims("tester", nil)
+
+	resolved, err = resolveUserGroups("tester", []string{"group:nerds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(resolved, "group:resolve-parent") || !slices.Contains(resolved, "group:resolve-rule") {
+		t.Fatal("cached membership did not follow new groups and rules: ", resolved)
+	}
+
+	// Deleting keys lowers the count under the prefix, so the cached graph is rebuilt even though no key has a newer revision
+	if err := RemoveGroup("group:resolve-parent"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveGroupRules("group:resolve-rule"); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err = resolveUserGroups("tester", []string{"group:nerds"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slices.Contains(resolved, "group:resolve-parent") || slices.Contains(resolved, "group:resolve-rule") {
+		t.Fatal("cached membership kept deleted groups and rules: ", resolved)
+	}
+}
+
+func TestMembershipVersion(t *testing.T) {
+	get := func() membershipVersion {
+		resp, err := etcd.Txn(context.Background()).Then(opLatestModification(GroupsPrefix), opLatestModification(DynamicGroupsPrefix)).Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return membershipVersionFromResponses(resp.Responses[0].GetResponseRange(), resp.Responses[1].GetResponseRange())
+	}
+
+	before := get()
+
+	// Writing the same value still bumps the revision
+	resp, err := etcd.Get(context.Background(), GroupsPrefix+"group:nerds")
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatal("test group is missing: ", err)
+	}
+
+	if _, err := etcd.Put(context.Background(), GroupsPrefix+"group:nerds", string(resp.Kvs[0].Value)); err != nil {
+		t.Fatal(err)
+	}
+
+	after := get()
+	if after == before || after.groups != before.groups || after.groupsRevision <= before.groupsRevision {
+		t.Fatalf("modifying a group did not change the version: %+v -> %+v", before, after)
+	}
+
+	if after.rules != before.rules || after.rulesRevision != before.rulesRevision {
+		t.Fatal("modifying a group changed the rules version")
+	}
+
+}
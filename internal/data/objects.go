@@ -0,0 +1,215 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/NHAS/wag/pkg/control"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/clientv3util"
+)
+
+// Objects are named networks and services that rules refer to as network:<name> and service:<name>, e.g "network:prod-db service:postgres".
+// Policies are stored with the references intact and expanded whenever an effective acl is worked out, so editing an object changes every policy that uses it
+type objectSet map[string][]string
+
+func validateObject(object control.ObjectData) error {
+	kind, name, ok := strings.Cut(object.Object, ":")
+	if !ok || name == "" || strings.ContainsAny(name, " \t:") {
+		return fmt.Errorf("object %q must be named network:<name> or service:<name>", object.Object)
+	}
+
+	if len(object.Entries) == 0 {
+		return fmt.Errorf("object %s has no entries", object.Object)
+	}
+
+	for _, entry := range object.Entries {
+		if len(strings.Fields(entry)) != 1 {
+			return fmt.Errorf("object %s entry %q must be a single value", object.Object, entry)
+		}
+
+		switch kind {
+		case "network":
+			if err := routetypes.ValidateRules(nil, []string{entry}, nil); err != nil {
+				return fmt.Errorf("object %s entry %q is not an address, subnet or domain: %s", object.Object, entry, err)
+			}
+		case "service":
+			if err := routetypes.ValidateService(entry); err != nil {
+				return fmt.Errorf("object %s entry %q is not a service: %s", object.Object, entry, err)
+			}
+		default:
+			return fmt.Errorf("object %q must be named network:<name> or service:<name>", object.Object)
+		}
+	}
+
+	return nil
+}
+
+func SetObject(object control.ObjectData, overwrite bool) error {
+	if err := validateObject(object); err != nil {
+		return err
+	}
+
+	entriesJson, _ := json.Marshal(object.Entries)
+
+	if overwrite {
+		_, err := etcd.Put(context.Background(), ObjectsPrefix+object.Object, string(entriesJson))
+		return err
+	}
+
+	resp, err := etcd.Txn(context.Background()).
+		If(clientv3util.KeyMissing(ObjectsPrefix + object.Object)).
+		Then(clientv3.OpPut(ObjectsPrefix+object.Object, string(entriesJson))).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return errors.New("object already exists")
+	}
+
+	return nil
+}
+
+func GetObjects() (result []control.ObjectData, err error) {
+	resp, err := etcd.Get(context.Background(), ObjectsPrefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get objects from etcd: %s", err)
+	}
+
+	for _, r := range resp.Kvs {
+		var entries []string
+		if err := json.Unmarshal(r.Value, &entries); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal object %q: %s", r.Key, err)
+		}
+
+		result = append(result, control.ObjectData{
+			Object:  string(bytes.TrimPrefix(r.Key, []byte(ObjectsPrefix))),
+			Entries: entries,
+		})
+	}
+
+	return result, nil
+}
+
+// RemoveObject deletes an object, objects that are still referenced by a policy cannot be removed
+func RemoveObject(object string) error {
+	policies, err := GetPolicies()
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		for _, rule := range append(append(append([]string{}, policy.MfaRoutes...), policy.PublicRoutes...), policy.DenyRoutes...) {
+			for _, field := range strings.Fields(rule) {
+				if field == object {
+					return fmt.Errorf("object %s is used by the policy for %s", object, policy.Effects)
+				}
+			}
+		}
+	}
+
+	_, err = etcd.Delete(context.Background(), ObjectsPrefix+object)
+	return err
+}
+
+func getObjects() (objectSet, error) {
+	resp, err := etcd.Get(context.Background(), ObjectsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get objects: %s", err)
+	}
+
+	return objectsFromKvs(resp.Kvs), nil
+}
+
+func objectsFromKvs(kvs []*mvccpb.KeyValue) objectSet {
+	objects := objectSet{}
+	for _, kv := range kvs {
+		var entries []string
+		if err := json.Unmarshal(kv.Value, &entries); err != nil {
+			log.Println("failed to unmarshal object: ", string(kv.Key), err)
+			continue
+		}
+
+		objects[string(bytes.TrimPrefix(kv.Key, []byte(ObjectsPrefix)))] = entries
+	}
+
+	return objects
+}
+
+// expandRule replaces the object references in a rule with their entries, a network reference becomes one rule per entry
+func (o objectSet) expandRule(rule string) ([]string, error) {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return []string{rule}, nil
+	}
+
+	addresses := fields[:1]
+	if strings.HasPrefix(fields[0], "network:") {
+		entries, ok := o[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("rule %q refers to unknown object %s", rule, fields[0])
+		}
+		addresses = entries
+	}
+
+	var services []string
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "service:") {
+			services = append(services, field)
+			continue
+		}
+
+		entries, ok := o[field]
+		if !ok {
+			return nil, fmt.Errorf("rule %q refers to unknown object %s", rule, field)
+		}
+		services = append(services, entries...)
+	}
+
+	result := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, strings.Join(append([]string{address}, services...), " "))
+	}
+
+	return result, nil
+}
+
+func (o objectSet) expandRules(rules []string) (result []string, errs []error) {
+	for _, rule := range rules {
+		expanded, err := o.expandRule(rule)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		result = append(result, expanded...)
+	}
+
+	return result, errs
+}
+
+// expandAcl replaces every object reference in the acl, rules with unknown objects are left out and reported in the error
+func (o objectSet) expandAcl(acl acls.Acl) (acls.Acl, error) {
+	var errs, e []error
+
+	acl.Mfa, e = o.expandRules(acl.Mfa)
+	errs = append(errs, e...)
+
+	acl.Allow, e = o.expandRules(acl.Allow)
+	errs = append(errs, e...)
+
+	acl.Deny, e = o.expandRules(acl.Deny)
+	errs = append(errs, e...)
+
+	return acl, errors.Join(errs...)
+}
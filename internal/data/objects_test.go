@@ -0,0 +1,163 @@
+package data
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func testObjects() objectSet {
+	return objectSet{
+		"network:db":      {"10.0.0.5", "10.0.1.0/24"},
+		"network:single":  {"10.0.2.1"},
+		"service:pg":      {"5432/tcp"},
+		"service:web":     {"80/tcp", "443/tcp"},
+		"service:icmp":    {"icmp/8"},
+		"network:unused":  {"10.9.9.9"},
+		"service:unused":  {"9/udp"},
+		"network:example": {"example.com"},
+	}
+}
+
+func TestExpandRule(t *testing.T) {
+	objects := testObjects()
+
+	tests := []struct {
+		rule     string
+		expected []string
+	}{
+		// Rules without objects are left alone
+		{"10.0.0.1 22/tcp", []string{"10.0.0.1 22/tcp"}},
+		{"10.0.0.1", []string{"10.0.0.1"}},
+		{"", []string{""}},
+		// A network becomes one rule per entry
+		{"network:db", []string{"10.0.0.5", "10.0.1.0/24"}},
+		{"network:db service:pg", []string{"10.0.0.5 5432/tcp", "10.0.1.0/24 5432/tcp"}},
+		// Services are spliced in place, alongside plain services
+		{"10.0.0.1 service:web 22/tcp", []string{"10.0.0.1 80/tcp 443/tcp 22/tcp"}},
+		{"network:single service:web service:icmp", []string{"10.0.2.1 80/tcp 443/tcp icmp/8"}},
+		{"network:example service:web", []string{"example.com 80/tcp 443/tcp"}},
+		// Extra whitespace is normalised
+		{"  network:single   service:pg ", []string{"10.0.2.1 5432/tcp"}},
+	}
+
+	for _, test := range tests {
+		expanded, err := objects.expandRule(test.rule)
+		if err != nil {
+			t.Errorf("%q: %s", test.rule, err)
+			continue
+		}
+
+		if !slices.Equal(expanded, test.expected) {
+			t.Errorf("%q: expanded to %q expected %q", test.rule, expanded, test.expected)
+		}
+	}
+
+	for _, rule := range []string{"network:missing", "10.0.0.1 service:missing", "network:db service:missing"} {
+		if _, err := objects.expandRule(rule); err == nil {
+			t.Errorf("%q: rule referring to an unknown object was expanded", rule)
+		}
+	}
+}
+
+func TestExpandAcl(t *testing.T) {
+	acl, err := testObjects().expandAcl(acls.Acl{
+		Mfa:   []string{"network:db service:pg"},
+		Allow: []string{"10.0.0.1", "network:missing"},
+		Deny:  []string{"network:single service:missing", "network:single 22/tcp"},
+	})
+
+	// Rules with unknown objects are left out rather than failing the whole acl
+	if err == nil {
+		t.Fatal("unknown objects were not reported")
+	}
+
+	if !slices.Equal(acl.Mfa, []string{"10.0.0.5 5432/tcp", "10.0.1.0/24 5432/tcp"}) {
+		t.Fatal("mfa rules were not expanded: ", acl.Mfa)
+	}
+
+	if !slices.Equal(acl.Allow, []string{"10.0.0.1"}) {
+		t.Fatal("allow rules were not expanded: ", acl.Allow)
+	}
+
+	if !slices.Equal(acl.Deny, []string{"10.0.2.1 22/tcp"}) {
+		t.Fatal("deny rules were not expanded: ", acl.Deny)
+	}
+}
+
+func TestValidateObject(t *testing.T) {
+	valid := []control.ObjectData{
+		{Object: "network:db", Entries: []string{"10.0.0.5", "10.0.1.0/24"}},
+		{Object: "service:web", Entries: []string{"80/tcp", "8000-8080/tcp", "icmp/8", "gre"}},
+	}
+
+	for _, object := range valid {
+		if err := validateObject(object); err != nil {
+			t.Errorf("valid object %+v was rejected: %s", object, err)
+		}
+	}
+
+	invalid := []control.ObjectData{
+		{Object: "db", Entries: []string{"10.0.0.5"}},
+		{Object: "network:", Entries: []string{"10.0.0.5"}},
+		{Object: "network:a b", Entries: []string{"10.0.0.5"}},
+		{Object: "host:db", Entries: []string{"10.0.0.5"}},
+		{Object: "network:db"},
+		{Object: "network:db", Entries: []string{"10.0.0.5 22/tcp"}},
+		{Object: "network:db", Entries: []string{"80/tcp"}},
+		{Object: "service:web", Entries: []string{"10.0.0.5"}},
+	}
+
+	for _, object := range invalid {
+		if err := validateObject(object); err == nil {
+			t.Errorf("invalid object %+v was accepted", object)
+		}
+	}
+}
+
+func TestObjectsInEffectiveAcl(t *testing.T) {
+	err := SetObject(control.ObjectData{Object: "network:objtest", Entries: []string{"10.7.0.1", "10.7.0.2"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveObject("network:objtest")
+
+	if err := SetObject(control.ObjectData{Object: "network:objtest", Entries: []string{"10.7.0.3"}}, false); err == nil {
+		t.Fatal("object was replaced without overwrite")
+	}
+
+	err = SetAcl("tag:objtest", acls.Acl{Allow: []string{"network:objtest 443/tcp"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := GetEffectiveDeviceAcl("tester", "", []string{"objtest"})
+	if !slices.Contains(acl.Allow, "10.7.0.1 443/tcp") || !slices.Contains(acl.Allow, "10.7.0.2 443/tcp") {
+		t.Fatal("object was not expanded in the effective acl: ", acl.Allow)
+	}
+
+	if err := RemoveObject("network:objtest"); err == nil {
+		t.Fatal("object used by a policy was removed")
+	}
+
+	// Editing the object changes the policies that use it
+	err = SetObject(control.ObjectData{Object: "network:objtest", Entries: []string{"10.7.0.3"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl = GetEffectiveDeviceAcl("tester", "", []string{"objtest"})
+	if slices.Contains(acl.Allow, "10.7.0.1 443/tcp") || !slices.Contains(acl.Allow, "10.7.0.3 443/tcp") {
+		t.Fatal("object change did not apply to the effective acl: ", acl.Allow)
+	}
+
+	if err := RemoveAcl("tag:objtest"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveObject("network:objtest"); err != nil {
+		t.Fatal("unused object could not be removed: ", err)
+	}
+}
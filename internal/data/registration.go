@@ -6,19 +6,54 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/utils"
 	"github.com/NHAS/wag/pkg/control"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/clientv3util"
 )
 
 func restrationKey(token string) string {
 	return fmt.Sprintf("tokens-%s", token)
 }
 
-func GetRegistrationToken(token string) (username, overwrites string, group []string, err error) {
+// RegistrationLink returns the public registration page for the token, from Webserver.Public.ExternalURL if it is set
+// otherwise the external address and public listen port
+func RegistrationLink(token string) (string, error) {
+	base := config.Values.Webserver.Public.ExternalURL
+	if base == "" {
+		host, err := GetExternalAddress()
+		if err != nil {
+			return "", err
+		}
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		_, port, err := net.SplitHostPort(config.Values.Webserver.Public.ListenAddress)
+		if err != nil {
+			return "", fmt.Errorf("could not get public listen port: %s", err)
+		}
+
+		scheme := "http"
+		if config.Values.Webserver.Public.SupportsTLS() {
+			scheme = "https"
+		}
+
+		base = scheme + "://" + net.JoinHostPort(host, port)
+	}
+
+	return strings.TrimSuffix(base, "/") + "/register?key=" + url.QueryEscape(token), nil
+}
+
+func GetRegistrationToken(token string) (result control.RegistrationResult, err error) {
 
 	minTime := time.After(1 * time.Second)
 
@@ -32,16 +67,11 @@ func GetRegistrationToken(token string) (username, overwrites string, group []st
 		return
 	}
 
-	var result control.RegistrationResult
 	err = json.Unmarshal(response.Kvs[0].Value, &result)
 
 	<-minTime
 
-	if err != nil {
-		return
-	}
-
-	return result.Username, result.Overwrites, result.Groups, nil
+	return
 }
 
 // Returns list of tokens
@@ -109,54 +139,116 @@ func FinaliseRegistration(token string) error {
 }
 
 // Randomly generate a token for a specific username
-func GenerateToken(username, overwrite string, groups []string, uses int) (token string, err error) {
-	token, err = utils.GenerateRandomHex(32)
+func GenerateToken(details control.RegistrationResult) (token string, err error) {
+	details.Token, err = utils.GenerateRandomHex(32)
 	if err != nil {
 		return "", err
 	}
 
-	err = AddRegistrationToken(token, username, overwrite, groups, uses)
-	return
+	err = AddRegistrationToken(details)
+	return details.Token, err
 }
 
 // Add a token to the database to add or overwrite a device for a user, may fail of the token does not meet complexity requirements
-func AddRegistrationToken(token, username, overwrite string, groups []string, uses int) error {
-	if len(token) < 32 {
+func AddRegistrationToken(details control.RegistrationResult) error {
+	if len(details.Token) < 32 {
 		return errors.New("registration token is too short")
 	}
 
-	if !allowedTokenCharacters.Match([]byte(token)) {
+	if !allowedTokenCharacters.Match([]byte(details.Token)) {
 		return errors.New("registration token contains illegal characters (allowed characters a-z A-Z - . _ )")
 	}
 
-	if strings.Contains(username, "-") {
+	if strings.Contains(details.Username, "-") {
 		return errors.New("usernames cannot contain '-' ")
 	}
 
+	if details.Interface != "" {
+		if _, err := config.GetInterface(details.Interface); err != nil {
+			return err
+		}
+	}
+
+	if details.Email != "" {
+		if _, err := mail.ParseAddress(details.Email); err != nil {
+			return fmt.Errorf("registration token email %q is invalid: %s", details.Email, err)
+		}
+	}
+
+	if details.Pool != "" && details.Address != "" {
+		return errors.New("registration token cannot set both an address pool and a static address")
+	}
+
+	if details.Pool != "" {
+		pool, err := GetAddressPool(details.Pool)
+		if err != nil {
+			return err
+		}
+
+		if details.Interface != "" && details.Interface != pool.Interface {
+			return fmt.Errorf("address pool %q is not on interface %q", pool.Name, details.Interface)
+		}
+		details.Interface = pool.Interface
+	}
+
+	if details.Address != "" {
+		ip, err := validDeviceAddress(details.Address)
+		if err != nil {
+			return err
+		}
+
+		if details.NumUses > 1 {
+			return errors.New("registration token with a static address can only be used once")
+		}
+
+		wgInterface := config.InterfaceForAddress(ip.String())
+		if details.Interface != "" && details.Interface != wgInterface.Name {
+			return fmt.Errorf("address %s is not on interface %q", ip, details.Interface)
+		}
+
+		details.Address = ip.String()
+		details.Interface = ""
+		if wgInterface.Name != config.DefaultInterface {
+			details.Interface = wgInterface.Name
+		}
+	}
+
 	var err error
-	if overwrite != "" {
+	if details.Overwrites != "" {
 
-		response, err := etcd.Get(context.Background(), "device-ref-"+overwrite)
+		response, err := etcd.Get(context.Background(), "device-ref-"+details.Overwrites)
 		if err != nil {
 			return err
 		}
 
-		if !bytes.Contains(response.Kvs[0].Value, []byte(username)) {
+		if !bytes.Contains(response.Kvs[0].Value, []byte(details.Username)) {
 			return errors.New("could not find device that this token is intended to overwrite")
 		}
 	}
 
-	result := control.RegistrationResult{
-		Token:      token,
-		Username:   username,
-		Overwrites: overwrite,
-		Groups:     groups,
-		NumUses:    uses,
+	// The link is derived from the token, so is never stored
+	details.Link = ""
+
+	b, _ := json.Marshal(details)
+
+	if details.Pool == "" {
+		_, err = etcd.Put(context.Background(), "tokens-"+details.Token, string(b))
+		return err
 	}
 
-	b, _ := json.Marshal(result)
+	// The pool may be deleted between checking it and adding the token
+	resp, err := etcd.Txn(context.Background()).If(
+		clientv3util.KeyExists(AddressPoolsPrefix + details.Pool),
+	).Then(
+		clientv3.OpPut("tokens-"+details.Token, string(b)),
+	).Commit()
+	if err != nil {
+		return err
+	}
 
-	_, err = etcd.Put(context.Background(), "tokens-"+token, string(b))
+	if !resp.Succeeded {
+		return fmt.Errorf("address pool %q does not exist", details.Pool)
+	}
 
-	return err
+	return nil
 }
@@ -0,0 +1,44 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func TestRegistrationLink(t *testing.T) {
+	previous := config.Values.Webserver.Public.ExternalURL
+	defer func() {
+		config.Values.Webserver.Public.ExternalURL = previous
+	}()
+
+	config.Values.Webserver.Public.ExternalURL = "https://vpn.example.com/"
+
+	link, err := RegistrationLink("abc+def")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link != "https://vpn.example.com/register?key=abc%2Bdef" {
+		t.Fatal("wrong registration link: ", link)
+	}
+}
+
+func TestRegistrationLinkNotStored(t *testing.T) {
+	token := "linktest_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	err := AddRegistrationToken(control.RegistrationResult{Token: token, Username: "linktester", NumUses: 1, Link: "https://attacker.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteRegistrationToken(token)
+
+	registration, err := GetRegistrationToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if registration.Link != "" {
+		t.Fatal("registration link was stored: ", registration.Link)
+	}
+}
@@ -0,0 +1,195 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DeadNodeTimeout is how long a node can go without writing its liveness ping before it is considered dead
+const DeadNodeTimeout = 14 * time.Second
+
+func IsLeader() bool {
+	return etcdServer.Server.Leader() == etcdServer.Server.ID()
+}
+
+// IsServing returns true if the node is able to accept clients, i.e it is not a learner, witness or drained and has pinged recently
+func IsServing(idHex string) (bool, error) {
+	id, err := types.IDFromString(idHex)
+	if err != nil {
+		return false, err
+	}
+
+	member := etcdServer.Server.Cluster().Member(id)
+	if member == nil {
+		return false, errors.New("id is not part of cluster")
+	}
+
+	if member.IsLearner {
+		return false, nil
+	}
+
+	witness, err := IsWitness(idHex)
+	if err != nil || witness {
+		return false, err
+	}
+
+	drained, err := IsDrained(idHex)
+	if err != nil || drained {
+		return false, err
+	}
+
+	lastPing, err := GetLastPing(idHex)
+	if err != nil {
+		// No ping recorded, so we can only assume the node hasnt come up yet
+		return false, nil
+	}
+
+	return lastPing.After(time.Now().Add(-DeadNodeTimeout)), nil
+}
+
+// roamDevices moves authorised devices off nodes that are no longer serving clients, spreading them across the healthy nodes.
+// Only the leader does this, so that multiple nodes are not racing to update the same devices
+func roamDevices() {
+	if !IsLeader() {
+		return
+	}
+
+	policy, err := GetDeviceRoaming()
+	if err != nil {
+		log.Println("unable to get device roaming policy: ", err)
+		return
+	}
+
+	if !policy.Enabled {
+		return
+	}
+
+	healthy, unhealthy := servingNodes()
+	if len(unhealthy) == 0 || len(healthy) == 0 {
+		return
+	}
+
+	roamDevicesFrom(unhealthy, healthy, policy.RequireReauthentication)
+}
+
+// servingNodes splits the cluster members that can serve clients into those that are, and those that are drained or dead
+func servingNodes() (healthy []types.ID, unhealthy map[types.ID]bool) {
+	unhealthy = map[types.ID]bool{}
+
+	for _, member := range GetMembers() {
+		if member.IsLearner {
+			continue
+		}
+
+		witness, err := IsWitness(member.ID.String())
+		if err != nil || witness {
+			continue
+		}
+
+		serving, err := IsServing(member.ID.String())
+		if err != nil {
+			log.Printf("unable to determine if node %s is serving: %s", member.ID, err)
+			continue
+		}
+
+		if serving {
+			healthy = append(healthy, member.ID)
+		} else {
+			unhealthy[member.ID] = true
+		}
+	}
+
+	return healthy, unhealthy
+}
+
+// roamDevicesFrom spreads the authorised devices of the unhealthy nodes across the healthy ones, and returns how many were moved
+func roamDevicesFrom(unhealthy map[types.ID]bool, healthy []types.ID, reauthenticate bool) int {
+	devices, err := GetAllDevices()
+	if err != nil {
+		log.Println("unable to get devices for roaming: ", err)
+		return 0
+	}
+
+	moved := 0
+	for _, device := range devices {
+		if !unhealthy[device.AssociatedNode] || device.Authorised.IsZero() {
+			continue
+		}
+
+		newNode := healthy[moved%len(healthy)]
+		err := RoamDevice(device.Username, device.Address, device.AssociatedNode, newNode, reauthenticate)
+		if err != nil {
+			log.Printf("unable to roam device %s:%s from %s to %s: %s", device.Username, device.Address, device.AssociatedNode, newNode, err)
+			continue
+		}
+
+		moved++
+	}
+
+	if moved > 0 {
+		log.Printf("roamed %d devices from unhealthy nodes to %d healthy nodes", moved, len(healthy))
+	}
+
+	return moved
+}
+
+// RoamDevice changes the node a device is associated with, if the device is still associated with the expected node.
+// The devices session is kept unless reauthenticate is set
+func RoamDevice(username, address string, from, to types.ID, reauthenticate bool) error {
+	wasAuthorised := false
+	err := doSafeUpdate(context.Background(), deviceKey(username, address), false, func(gr *clientv3.GetResponse) (string, error) {
+		if len(gr.Kvs) != 1 {
+			return "", errors.New("user device has multiple keys")
+		}
+
+		var device Device
+		err := json.Unmarshal(gr.Kvs[0].Value, &device)
+		if err != nil {
+			return "", err
+		}
+
+		// The client has already reconnected somewhere else
+		if device.AssociatedNode != from {
+			return "", errors.New("device is no longer associated with node " + from.String())
+		}
+
+		device.AssociatedNode = to
+		wasAuthorised = !device.Authorised.IsZero()
+		if reauthenticate {
+			device.Authorised = time.Time{}
+		}
+
+		b, _ := json.Marshal(device)
+
+		return string(b), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	recordConnectionEvent(ConnectionEvent{
+		Type:     ConnectionRoamed,
+		Username: username,
+		Address:  address,
+		Node:     to.String(),
+		Reason:   "moved from unhealthy node " + from.String(),
+	})
+
+	if reauthenticate && wasAuthorised {
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionDeauthorised,
+			Username: username,
+			Address:  address,
+			Node:     to.String(),
+			Reason:   "roamed to another node, reauthentication required",
+		})
+	}
+
+	return nil
+}
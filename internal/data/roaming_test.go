@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+)
+
+// A node that is not part of the cluster, standing in for one that has died with devices still associated with it
+const deadNode = types.ID(0x1234)
+
+func roamingDevice(t *testing.T, username string, node types.ID, authorised bool) Device {
+	device := historyDevice(t, username)
+
+	device.AssociatedNode = node
+	if authorised {
+		device.Authorised = time.Now()
+	}
+
+	b, err := json.Marshal(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := etcd.Put(context.Background(), deviceKey(username, device.Address), string(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	return device
+}
+
+func setPing(t *testing.T, at time.Time) {
+	_, err := etcd.Put(context.Background(), path.Join(NodeInfo, GetServerID().String(), "ping"), at.Format(time.RFC1123Z))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsServing(t *testing.T) {
+	self := GetServerID().String()
+	defer setPing(t, time.Now())
+
+	setPing(t, time.Now())
+	if serving, err := IsServing(self); err != nil || !serving {
+		t.Fatal("node that pinged recently is not serving: ", err)
+	}
+
+	if err := SetDrained(self, true); err != nil {
+		t.Fatal(err)
+	}
+
+	serving, err := IsServing(self)
+	if err := SetDrained(self, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err != nil || serving {
+		t.Fatal("drained node is serving: ", err)
+	}
+
+	healthy, _ := servingNodes()
+	if len(healthy) != 1 || healthy[0] != GetServerID() {
+		t.Fatal("undrained node was not healthy: ", healthy)
+	}
+
+	// The liveness ping is written every few seconds, one older than the timeout means the node is dead
+	setPing(t, time.Now().Add(-DeadNodeTimeout-time.Second))
+	if serving, err := IsServing(self); err != nil || serving {
+		t.Fatal("node that has not pinged is serving: ", err)
+	}
+
+	if _, err := IsServing(deadNode.String()); err == nil {
+		t.Fatal("node outside the cluster did not return an error")
+	}
+}
+
+func TestRoamDevices(t *testing.T) {
+	const username = "roaming"
+	defer DeleteDevices(username)
+
+	authorised := roamingDevice(t, username, deadNode, true)
+	unauthorised := roamingDevice(t, username, deadNode, false)
+	healthy := roamingDevice(t, username, GetServerID(), true)
+
+	if moved := roamDevicesFrom(map[types.ID]bool{deadNode: true}, []types.ID{GetServerID()}, false); moved != 1 {
+		t.Fatal("expected only the authorised device on the dead node to be moved, moved: ", moved)
+	}
+
+	device, err := GetDeviceByAddress(authorised.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.AssociatedNode != GetServerID() || device.Authorised.IsZero() {
+		t.Fatalf("device was not moved with its session kept: %+v", device)
+	}
+
+	// Unauthorised devices have no session to keep, they are moved when they next connect
+	device, err = GetDeviceByAddress(unauthorised.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.AssociatedNode != deadNode {
+		t.Fatal("unauthorised device was moved")
+	}
+
+	device, err = GetDeviceByAddress(healthy.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.AssociatedNode != GetServerID() || device.Authorised.IsZero() {
+		t.Fatal("device on a healthy node was changed")
+	}
+
+	history, err := GetConnectionHistory(username, authorised.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) == 0 || history[0].Type != ConnectionRoamed {
+		t.Fatal("roaming was not recorded in the devices connection history: ", history)
+	}
+}
+
+func TestRoamDeviceReauthenticate(t *testing.T) {
+	const username = "roaming_reauth"
+	defer DeleteDevices(username)
+
+	device := roamingDevice(t, username, deadNode, true)
+
+	if err := RoamDevice(username, device.Address, GetServerID(), deadNode, true); err == nil {
+		t.Fatal("roamed a device that was not associated with the expected node")
+	}
+
+	if err := RoamDevice(username, device.Address, deadNode, GetServerID(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := GetDeviceByAddress(device.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.AssociatedNode != GetServerID() || !device.Authorised.IsZero() {
+		t.Fatalf("device requiring reauthentication kept its session: %+v", device)
+	}
+
+	history, err := GetConnectionHistory(username, device.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, event := range history {
+		found = found || event.Type == ConnectionDeauthorised
+	}
+
+	if !found {
+		t.Fatal("deauthorisation from roaming was not recorded: ", history)
+	}
+}
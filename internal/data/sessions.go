@@ -0,0 +1,295 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/NHAS/wag/internal/geoip"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// SessionPolicy overrides the cluster wide session timeouts for members of a group, and restricts where they may connect from.
+// A nil timeout uses the cluster wide setting, and -1 disables the timeout
+type SessionPolicy struct {
+	InactivityTimeoutMinutes  *int `json:"inactivity_timeout_minutes,omitempty"`
+	MaxSessionLifetimeMinutes *int `json:"max_session_lifetime_minutes,omitempty"`
+
+	// Sources members may register and authorise from, if both are empty any source is allowed
+	AllowedNetworks  []string `json:"allowed_networks,omitempty"`
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+}
+
+func (sp SessionPolicy) IsEmpty() bool {
+	return sp.InactivityTimeoutMinutes == nil && sp.MaxSessionLifetimeMinutes == nil && !sp.restrictsSource()
+}
+
+func (sp SessionPolicy) restrictsSource() bool {
+	return len(sp.AllowedNetworks) != 0 || len(sp.AllowedCountries) != 0
+}
+
+// allowsSource checks ip against the allowed networks, and its country if the policy restricts countries
+func (sp SessionPolicy) allowsSource(ip net.IP, country func() (string, error)) (bool, error) {
+	for _, network := range sp.AllowedNetworks {
+		_, cidr, err := net.ParseCIDR(normaliseNetwork(network))
+		if err == nil && cidr.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	if len(sp.AllowedCountries) == 0 {
+		return false, nil
+	}
+
+	c, err := country()
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(sp.AllowedCountries, c), nil
+}
+
+func (sp SessionPolicy) Validate() error {
+	if sp.InactivityTimeoutMinutes != nil && (*sp.InactivityTimeoutMinutes == 0 || *sp.InactivityTimeoutMinutes < -1) {
+		return errors.New("inactivity timeout must be a positive number of minutes, or -1 to disable it")
+	}
+
+	if sp.MaxSessionLifetimeMinutes != nil && (*sp.MaxSessionLifetimeMinutes == 0 || *sp.MaxSessionLifetimeMinutes < -1) {
+		return errors.New("max session lifetime must be a positive number of minutes, or -1 to disable it")
+	}
+
+	for _, network := range sp.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(normaliseNetwork(network)); err != nil {
+			return fmt.Errorf("allowed network %q is not an address or cidr", network)
+		}
+	}
+
+	for _, country := range sp.AllowedCountries {
+		if len(country) != 2 || strings.ToUpper(country) != country {
+			return fmt.Errorf("allowed country %q is not an upper case two letter ISO country code", country)
+		}
+	}
+
+	return nil
+}
+
+// SetSessionPolicy sets the session overrides for a group, an empty policy removes them
+func SetSessionPolicy(group string, policy SessionPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	if policy.IsEmpty() {
+		return RemoveSessionPolicy(group)
+	}
+
+	if group == "*" {
+		return errors.New("the default group uses the cluster wide session settings")
+	}
+
+	policyJson, _ := json.Marshal(policy)
+
+	_, err := etcd.Put(context.Background(), SessionPoliciesPrefix+group, string(policyJson))
+	return err
+}
+
+func RemoveSessionPolicy(group string) error {
+	_, err := etcd.Delete(context.Background(), SessionPoliciesPrefix+group)
+	return err
+}
+
+// GetSessionPolicies returns the session overrides of all groups that have them
+func GetSessionPolicies() (map[string]SessionPolicy, error) {
+	resp, err := etcd.Get(context.Background(), SessionPoliciesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session policies: %s", err)
+	}
+
+	result := map[string]SessionPolicy{}
+	for _, r := range resp.Kvs {
+		var policy SessionPolicy
+		err := json.Unmarshal(r.Value, &policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal session policy %q: %s", r.Key, err)
+		}
+
+		result[string(r.Key[len(SessionPoliciesPrefix):])] = policy
+	}
+
+	return result, nil
+}
+
+// normaliseNetwork turns a single address into a cidr
+func normaliseNetwork(network string) string {
+	if strings.Contains(network, "/") {
+		return network
+	}
+
+	if ip := net.ParseIP(network); ip != nil && ip.To4() == nil {
+		return network + "/128"
+	}
+
+	return network + "/32"
+}
+
+// CheckSource returns an error if ip is not an allowed source under the session policies of any of the users groups.
+// If groups is nil the users current group membership is used. Country restrictions fail closed when no geoip database is loaded
+func CheckSource(username string, groups []string, ip net.IP) error {
+	if groups == nil {
+		var err error
+		groups, err = GetUserGroupMembership(username)
+		if err != nil {
+			return err
+		}
+	}
+
+	policies, err := GetSessionPolicies()
+	if err != nil {
+		return err
+	}
+
+	var (
+		location       geoip.Location
+		locationErr    error
+		lookedUpSource bool
+	)
+	country := func() (string, error) {
+		if !lookedUpSource {
+			location, locationErr = geoip.Lookup(ip)
+			lookedUpSource = true
+		}
+		return location.Country, locationErr
+	}
+
+	for _, group := range groups {
+		policy, ok := policies[group]
+		if !ok || !policy.restrictsSource() {
+			continue
+		}
+
+		if ip == nil {
+			return fmt.Errorf("%s restricts sources and the source address of %s is unknown", group, username)
+		}
+
+		allowed, err := policy.allowsSource(ip, country)
+		if err != nil {
+			return fmt.Errorf("could not check %s against the sources allowed by %s: %s", ip, group, err)
+		}
+
+		if !allowed {
+			return fmt.Errorf("%s is not a source allowed by %s", ip, group)
+		}
+	}
+
+	return nil
+}
+
+// shorterTimeout returns the more restrictive of two timeouts in minutes, where -1 is no timeout
+func shorterTimeout(a, b int) int {
+	if a < 0 {
+		return b
+	}
+
+	if b < 0 {
+		return a
+	}
+
+	return min(a, b)
+}
+
+// GetEffectiveSessionTimeouts returns the inactivity timeout and max session lifetime in minutes that apply to a user.
+// Groups with session overrides replace the cluster wide settings, if a user is in several groups with overrides the most restrictive one wins
+func GetEffectiveSessionTimeouts(username string) (inactivityTimeoutMinutes, maxSessionLifetimeMinutes int, err error) {
+
+	txn := etcd.Txn(context.Background())
+	txn.Then(clientv3.OpGet(InactivityTimeoutKey), clientv3.OpGet(SessionLifetimeKey), clientv3.OpGet(MembershipKey+"-"+username))
+	resp, err := txn.Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get session settings for user %s: %s", username, err)
+	}
+
+	for i, setting := range []*int{&inactivityTimeoutMinutes, &maxSessionLifetimeMinutes} {
+		r := resp.Responses[i].GetResponseRange()
+		if r.Count != 1 {
+			return 0, 0, errors.New("cluster wide session settings are not set")
+		}
+
+		if err := json.Unmarshal(r.Kvs[0].Value, setting); err != nil {
+			return 0, 0, fmt.Errorf("failed to unmarshal session setting: %s", err)
+		}
+	}
+
+	// As with policies, users without direct groups may still be in dynamic ones, and a failure to resolve groups falls back to the direct ones
+	var userGroups []string
+	if resp.Responses[2].GetResponseRange().GetCount() != 0 {
+		err = json.Unmarshal(resp.Responses[2].GetResponseRange().Kvs[0].Value, &userGroups)
+		if err != nil {
+			log.Println("failed to decode reverse group mapping: ", err)
+		}
+	}
+
+	userGroups, err = resolveUserGroups(username, userGroups)
+	if err != nil {
+		log.Println("failed to resolve nested and dynamic groups for user", username, "err:", err)
+	}
+
+	if len(userGroups) == 0 {
+		return inactivityTimeoutMinutes, maxSessionLifetimeMinutes, nil
+	}
+
+	var ops []clientv3.Op
+	for _, group := range userGroups {
+		ops = append(ops, clientv3.OpGet(SessionPoliciesPrefix+group))
+	}
+
+	groupsResp, err := etcd.Txn(context.Background()).Then(ops...).Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get session policies for groups: %s", err)
+	}
+
+	var inactivityOverride, lifetimeOverride *int
+	for _, r := range groupsResp.Responses {
+		rr := r.GetResponseRange()
+		if rr.Count == 0 {
+			continue
+		}
+
+		var policy SessionPolicy
+		if err := json.Unmarshal(rr.Kvs[0].Value, &policy); err != nil {
+			log.Println("failed to unmarshal session policy: ", err, string(rr.Kvs[0].Value))
+			continue
+		}
+
+		if policy.InactivityTimeoutMinutes != nil {
+			if inactivityOverride == nil {
+				inactivityOverride = policy.InactivityTimeoutMinutes
+			} else {
+				*inactivityOverride = shorterTimeout(*inactivityOverride, *policy.InactivityTimeoutMinutes)
+			}
+		}
+
+		if policy.MaxSessionLifetimeMinutes != nil {
+			if lifetimeOverride == nil {
+				lifetimeOverride = policy.MaxSessionLifetimeMinutes
+			} else {
+				*lifetimeOverride = shorterTimeout(*lifetimeOverride, *policy.MaxSessionLifetimeMinutes)
+			}
+		}
+	}
+
+	if inactivityOverride != nil {
+		inactivityTimeoutMinutes = *inactivityOverride
+	}
+
+	if lifetimeOverride != nil {
+		maxSessionLifetimeMinutes = *lifetimeOverride
+	}
+
+	return inactivityTimeoutMinutes, maxSessionLifetimeMinutes, nil
+}
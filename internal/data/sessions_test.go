@@ -0,0 +1,156 @@
+package data
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNormaliseNetwork(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":       "10.0.0.1/32",
+		"10.0.0.0/8":     "10.0.0.0/8",
+		"2001:db8::1":    "2001:db8::1/128",
+		"2001:db8::/32":  "2001:db8::/32",
+		"not an address": "not an address/32",
+	}
+
+	for network, expected := range tests {
+		if got := normaliseNetwork(network); got != expected {
+			t.Errorf("normaliseNetwork(%q) = %q, expected %q", network, got, expected)
+		}
+	}
+}
+
+func TestAllowsSource(t *testing.T) {
+	country := func(c string) func() (string, error) {
+		return func() (string, error) {
+			return c, nil
+		}
+	}
+
+	noDatabase := func() (string, error) {
+		return "", errors.New("no geoip database is loaded")
+	}
+
+	tests := []struct {
+		name    string
+		policy  SessionPolicy
+		ip      string
+		country func() (string, error)
+		allowed bool
+		err     bool
+	}{
+		{"in network", SessionPolicy{AllowedNetworks: []string{"10.0.0.0/8"}}, "10.1.2.3", noDatabase, true, false},
+		{"single address", SessionPolicy{AllowedNetworks: []string{"203.0.113.7"}}, "203.0.113.7", noDatabase, true, false},
+		{"outside network", SessionPolicy{AllowedNetworks: []string{"10.0.0.0/8", "203.0.113.7"}}, "203.0.113.8", noDatabase, false, false},
+		{"ipv6", SessionPolicy{AllowedNetworks: []string{"2001:db8::/32"}}, "2001:db8::5", noDatabase, true, false},
+		{"allowed country", SessionPolicy{AllowedCountries: []string{"NZ", "AU"}}, "203.0.113.8", country("AU"), true, false},
+		{"other country", SessionPolicy{AllowedCountries: []string{"NZ"}}, "203.0.113.8", country("US"), false, false},
+		{"unknown country", SessionPolicy{AllowedCountries: []string{"NZ"}}, "203.0.113.8", country(""), false, false},
+		// Networks are checked first, so an allowed network does not need a geoip database
+		{"network before country", SessionPolicy{AllowedNetworks: []string{"10.0.0.0/8"}, AllowedCountries: []string{"NZ"}}, "10.1.2.3", noDatabase, true, false},
+		// Country restrictions fail closed
+		{"no database", SessionPolicy{AllowedNetworks: []string{"10.0.0.0/8"}, AllowedCountries: []string{"NZ"}}, "203.0.113.8", noDatabase, false, true},
+	}
+
+	for _, test := range tests {
+		allowed, err := test.policy.allowsSource(net.ParseIP(test.ip), test.country)
+		if allowed != test.allowed || (err != nil) != test.err {
+			t.Errorf("%s: got allowed %t err %v, expected allowed %t err %t", test.name, allowed, err, test.allowed, test.err)
+		}
+	}
+}
+
+func TestSessionPolicyValidate(t *testing.T) {
+	minutes := func(m int) *int {
+		return &m
+	}
+
+	valid := []SessionPolicy{
+		{},
+		{InactivityTimeoutMinutes: minutes(-1), MaxSessionLifetimeMinutes: minutes(60)},
+		{AllowedNetworks: []string{"10.0.0.0/8", "203.0.113.7", "2001:db8::1"}, AllowedCountries: []string{"NZ"}},
+	}
+
+	for _, policy := range valid {
+		if err := policy.Validate(); err != nil {
+			t.Errorf("valid policy %+v was rejected: %s", policy, err)
+		}
+	}
+
+	invalid := []SessionPolicy{
+		{InactivityTimeoutMinutes: minutes(0)},
+		{MaxSessionLifetimeMinutes: minutes(-2)},
+		{AllowedNetworks: []string{"10.0.0.0/33"}},
+		{AllowedNetworks: []string{"example.com"}},
+		{AllowedCountries: []string{"nz"}},
+		{AllowedCountries: []string{"NZL"}},
+	}
+
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("invalid policy %+v was accepted", policy)
+		}
+	}
+}
+
+func TestShorterTimeout(t *testing.T) {
+	tests := []struct{ a, b, expected int }{
+		{10, 20, 10},
+		{20, 10, 10},
+		{-1, 10, 10},
+		{10, -1, 10},
+		{-1, -1, -1},
+	}
+
+	for _, test := range tests {
+		if got := shorterTimeout(test.a, test.b); got != test.expected {
+			t.Errorf("shorterTimeout(%d, %d) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestTravelSpeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		distance float64
+		elapsed  time.Duration
+		expected float64
+	}{
+		{"one hour", 900, time.Hour, 900},
+		{"half an hour", 450, 30 * time.Minute, 900},
+		{"stationary", 0, time.Hour, 0},
+		// Changes less than a minute apart are treated as a minute, so nearby geoip jitter is not a huge speed
+		{"clamped", 10, time.Second, 600},
+		{"no time", 10, 0, 600},
+	}
+
+	for _, test := range tests {
+		if got := travelSpeedKmh(test.distance, test.elapsed); got < test.expected-1e-6 || got > test.expected+1e-6 {
+			t.Errorf("%s: expected %.0fkm/h got %.0fkm/h", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestCheckSourceFailsClosed(t *testing.T) {
+	err := SetSessionPolicy("group:nerds", SessionPolicy{AllowedCountries: []string{"NZ"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetSessionPolicy("group:nerds", SessionPolicy{})
+
+	// No geoip database is loaded in tests
+	if err := CheckSource("tester", nil, net.ParseIP("203.0.113.8")); err == nil {
+		t.Fatal("country restricted source was allowed without a geoip database")
+	}
+
+	if err := CheckSource("tester", nil, nil); err == nil {
+		t.Fatal("unknown source was allowed by a group that restricts sources")
+	}
+
+	if err := CheckSource("not_a_member", nil, net.ParseIP("203.0.113.8")); err != nil {
+		t.Fatal("user outside the restricted group was checked against it: ", err)
+	}
+}
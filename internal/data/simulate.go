@@ -0,0 +1,384 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/NHAS/wag/pkg/control"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/exp/maps"
+)
+
+// policySnapshot is the policy and group state needed to work out a users effective acl without going back to etcd
+type policySnapshot struct {
+	policies   map[string]acls.Acl
+	membership map[string][]string
+	objects    objectSet
+
+	graph  membershipGraph
+	users  map[string]UserModel
+	claims map[string]map[string][]string
+}
+
+func (ps policySnapshot) clone() policySnapshot {
+	result := policySnapshot{
+		policies:   maps.Clone(ps.policies),
+		membership: map[string][]string{},
+		objects:    ps.objects,
+		graph:      ps.graph.clone(),
+		users:      ps.users,
+		claims:     ps.claims,
+	}
+
+	for username, groups := range ps.membership {
+		result.membership[username] = slices.Clone(groups)
+	}
+
+	return result
+}
+
+// effectiveAcl mirrors getEffectiveAcl, minus the rules that do not depend on policies (the wag server and dns)
+func (ps policySnapshot) effectiveAcl(username, iface string, tags []string) acls.Acl {
+	var (
+		allowSet = map[string]bool{}
+		mfaSet   = map[string]bool{}
+		denySet  = map[string]bool{}
+	)
+
+	effects := []string{"*", username}
+	effects = append(effects, ps.graph.resolve(ps.users[username], ps.claims[username], ps.membership[username])...)
+	for _, tag := range tags {
+		effects = append(effects, "tag:"+tag)
+	}
+
+	for _, e := range effects {
+		acl, ok := ps.policies[e]
+		if !ok || !acl.AppliesTo(iface) {
+			continue
+		}
+
+		// Rules referring to objects that do not exist are ignored, as they are by getEffectiveAcl
+		acl, _ = ps.objects.expandAcl(acl)
+
+		insertMap(allowSet, acl.Allow...)
+		insertMap(mfaSet, acl.Mfa...)
+		insertMap(denySet, acl.Deny...)
+	}
+
+	return acls.Acl{
+		Allow: maps.Keys(allowSet),
+		Mfa:   maps.Keys(mfaSet),
+		Deny:  maps.Keys(denySet),
+	}
+}
+
+// accessSet flattens an acl into the individual networks and ports it covers
+func accessSet(acl acls.Acl) (map[string]control.Access, error) {
+	rules, errs := routetypes.ParseRules(acl.Mfa, acl.Allow, acl.Deny)
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	result := map[string]control.Access{}
+	for _, rule := range rules {
+		for _, key := range rule.Keys {
+			for _, policy := range rule.Values[:rule.NumPolicies] {
+				access := control.Access{
+					Network: key.String(),
+					Ports:   policy.Ports(),
+					Type:    policy.Restriction(),
+				}
+
+				result[access.String()] = access
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// diffAccess compares the acls before and after a change. New deny rules, and mfa or public rules that are removed, are a loss of access
+func diffAccess(before, after acls.Acl) (gained, lost []control.Access, err error) {
+	beforeSet, err := accessSet(before)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	afterSet, err := accessSet(after)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key, access := range afterSet {
+		if _, ok := beforeSet[key]; ok {
+			continue
+		}
+
+		if access.Type == "deny" {
+			lost = append(lost, access)
+		} else {
+			gained = append(gained, access)
+		}
+	}
+
+	for key, access := range beforeSet {
+		if _, ok := afterSet[key]; ok {
+			continue
+		}
+
+		if access.Type == "deny" {
+			gained = append(gained, access)
+		} else {
+			lost = append(lost, access)
+		}
+	}
+
+	sortAccess := func(a []control.Access) {
+		sort.Slice(a, func(i, j int) bool {
+			return a[i].String() < a[j].String()
+		})
+	}
+
+	sortAccess(gained)
+	sortAccess(lost)
+
+	return gained, lost, nil
+}
+
+func getPolicySnapshot() (snapshot policySnapshot, usernames []string, devices []Device, err error) {
+	resp, err := etcd.Txn(context.Background()).Then(
+		clientv3.OpGet(UsersPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(AclsPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(GroupMembershipPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(DevicesPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(ObjectsPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(GroupsPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(DynamicGroupsPrefix, clientv3.WithPrefix()),
+		clientv3.OpGet(UserClaimsPrefix, clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return snapshot, nil, nil, fmt.Errorf("failed to get policy state: %s", err)
+	}
+
+	snapshot = policySnapshot{
+		policies:   map[string]acls.Acl{},
+		membership: map[string][]string{},
+		objects:    objectsFromKvs(resp.Responses[4].GetResponseRange().Kvs),
+		graph:      membershipGraphFromKvs(resp.Responses[5].GetResponseRange().Kvs, resp.Responses[6].GetResponseRange().Kvs),
+		users:      map[string]UserModel{},
+		claims:     map[string]map[string][]string{},
+	}
+
+	for _, r := range resp.Responses[0].GetResponseRange().Kvs {
+		var user UserModel
+		if err := json.Unmarshal(r.Value, &user); err != nil {
+			return snapshot, nil, nil, fmt.Errorf("failed to unmarshal user %q: %s", r.Key, err)
+		}
+		usernames = append(usernames, user.Username)
+		snapshot.users[user.Username] = user
+	}
+
+	for _, r := range resp.Responses[7].GetResponseRange().Kvs {
+		var claims map[string][]string
+		if err := json.Unmarshal(r.Value, &claims); err != nil {
+			return snapshot, nil, nil, fmt.Errorf("failed to unmarshal user claims %q: %s", r.Key, err)
+		}
+		snapshot.claims[strings.TrimPrefix(string(r.Key), UserClaimsPrefix)] = claims
+	}
+
+	for _, r := range resp.Responses[1].GetResponseRange().Kvs {
+		var acl acls.Acl
+		if err := json.Unmarshal(r.Value, &acl); err != nil {
+			return snapshot, nil, nil, fmt.Errorf("failed to unmarshal policy %q: %s", r.Key, err)
+		}
+		snapshot.policies[strings.TrimPrefix(string(r.Key), AclsPrefix)] = acl
+	}
+
+	for _, r := range resp.Responses[2].GetResponseRange().Kvs {
+		var groups []string
+		if err := json.Unmarshal(r.Value, &groups); err != nil {
+			return snapshot, nil, nil, fmt.Errorf("failed to unmarshal group membership %q: %s", r.Key, err)
+		}
+		snapshot.membership[strings.TrimPrefix(string(r.Key), GroupMembershipPrefix)] = groups
+	}
+
+	for _, r := range resp.Responses[3].GetResponseRange().Kvs {
+		var device Device
+		if err := json.Unmarshal(r.Value, &device); err != nil {
+			return snapshot, nil, nil, fmt.Errorf("failed to unmarshal device %q: %s", r.Key, err)
+		}
+		devices = append(devices, device)
+	}
+
+	sort.Strings(usernames)
+
+	return snapshot, usernames, devices, nil
+}
+
+// apply makes the proposed change to the snapshot, checking it the same way SetAcl and SetGroup would
+func (ps policySnapshot) apply(proposed control.PolicySimulation) error {
+	if proposed.Policy != nil {
+		effects := proposed.Policy.Effects
+		if effects == "" {
+			return errors.New("the proposed policy does not say what it effects")
+		}
+
+		if proposed.Remove {
+			delete(ps.policies, effects)
+			return nil
+		}
+
+		policy := acls.Acl{
+			Mfa:        proposed.Policy.MfaRoutes,
+			Allow:      proposed.Policy.PublicRoutes,
+			Deny:       proposed.Policy.DenyRoutes,
+			Interfaces: proposed.Policy.Interfaces,
+		}
+
+		expanded, err := ps.objects.expandAcl(policy)
+		if err != nil {
+			return err
+		}
+
+		if err := routetypes.ValidateRules(expanded.Mfa, expanded.Allow, expanded.Deny); err != nil {
+			return err
+		}
+
+		for _, iface := range policy.Interfaces {
+			if _, err := config.GetInterface(iface); err != nil {
+				return err
+			}
+		}
+
+		ps.policies[effects] = policy
+		return nil
+	}
+
+	group := proposed.Group.Group
+	if !strings.HasPrefix(group, "group:") {
+		return fmt.Errorf("group does not have 'group:' prefix: %s", group)
+	}
+
+	if !proposed.Remove {
+		if _, err := checkNesting(group, proposed.Group.Members); err != nil {
+			return err
+		}
+	}
+
+	isGroup := func(s string) bool {
+		return s == group
+	}
+
+	for username, groups := range ps.membership {
+		ps.membership[username] = slices.DeleteFunc(groups, isGroup)
+	}
+
+	for child, parents := range ps.graph.parents {
+		ps.graph.parents[child] = slices.DeleteFunc(parents, isGroup)
+	}
+	delete(ps.graph.rules, group)
+
+	if proposed.Remove {
+		return nil
+	}
+
+	for _, member := range proposed.Group.Members {
+		if strings.HasPrefix(member, "group:") {
+			ps.graph.parents[member] = append(ps.graph.parents[member], group)
+			continue
+		}
+
+		if !slices.Contains(ps.membership[member], group) {
+			ps.membership[member] = append(ps.membership[member], group)
+		}
+	}
+
+	rules, err := parseMembershipRules(proposed.Group.Rules)
+	if err != nil {
+		return err
+	}
+
+	if len(rules) != 0 {
+		ps.graph.rules[group] = rules
+	}
+
+	return nil
+}
+
+// SimulatePolicyChange reports whose access would change, and how, if the proposed policy or group change was applied.
+// It works from a snapshot of the current policies and group membership, and does not touch the firewall
+func SimulatePolicyChange(proposed control.PolicySimulation) (report control.SimulationReport, err error) {
+	if (proposed.Policy == nil) == (proposed.Group == nil) {
+		return report, errors.New("exactly one of a policy or group must be proposed")
+	}
+
+	current, usernames, devices, err := getPolicySnapshot()
+	if err != nil {
+		return report, err
+	}
+
+	after := current.clone()
+	if err := after.apply(proposed); err != nil {
+		return report, err
+	}
+
+	report.Changes = []control.AccessChange{}
+	report.UsersChecked = len(usernames)
+
+	// Tag policies only apply to the devices with that tag, so they are compared per device rather than per user
+	if proposed.Policy != nil && strings.HasPrefix(proposed.Policy.Effects, "tag:") {
+		tag := strings.TrimPrefix(proposed.Policy.Effects, "tag:")
+
+		sort.Slice(devices, func(i, j int) bool {
+			return devices[i].Username+devices[i].Address < devices[j].Username+devices[j].Address
+		})
+
+		for _, device := range devices {
+			if !slices.Contains(device.Tags, tag) {
+				continue
+			}
+
+			iface := device.GetInterfaceName()
+			gained, lost, err := diffAccess(current.effectiveAcl(device.Username, iface, device.Tags), after.effectiveAcl(device.Username, iface, device.Tags))
+			if err != nil {
+				return report, fmt.Errorf("could not compare access for %s:%s: %s", device.Username, device.Address, err)
+			}
+
+			if len(gained) != 0 || len(lost) != 0 {
+				report.Changes = append(report.Changes, control.AccessChange{
+					Username: device.Username,
+					Device:   device.Address,
+					Gained:   gained,
+					Lost:     lost,
+				})
+			}
+		}
+
+		return report, nil
+	}
+
+	for _, username := range usernames {
+		gained, lost, err := diffAccess(current.effectiveAcl(username, config.DefaultInterface, nil), after.effectiveAcl(username, config.DefaultInterface, nil))
+		if err != nil {
+			return report, fmt.Errorf("could not compare access for %s: %s", username, err)
+		}
+
+		if len(gained) != 0 || len(lost) != 0 {
+			report.Changes = append(report.Changes, control.AccessChange{
+				Username: username,
+				Gained:   gained,
+				Lost:     lost,
+			})
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,487 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/membership"
+)
+
+const (
+	UpgradeKey = "wag-upgrade"
+
+	UpgradeRunning  = "running"
+	UpgradeAborted  = "aborted"
+	UpgradeComplete = "complete"
+
+	UpgradeStageDrain    = "draining"
+	UpgradeStageMigrate  = "migrating sessions"
+	UpgradeStageRestart  = "restarting"
+	UpgradeStageHealth   = "waiting for health"
+	UpgradeStageUndrain  = "undraining"
+	upgradeMigrateWait   = 2 * time.Minute
+	upgradeHealthTimeout = 5 * time.Minute
+)
+
+type UpgradeRequest struct {
+	BinaryPath string
+
+	// Optional, if empty the version reported by the first upgraded node is used
+	TargetVersion string
+}
+
+type UpgradeStatus struct {
+	UpgradeRequest
+
+	State string
+	Stage string
+	Error string `json:",omitempty"`
+
+	Nodes   []string
+	Current int
+
+	// Version and boot ID of the node before it was restarted
+	PreviousVersion string `json:",omitempty"`
+	PreviousBoot    string `json:",omitempty"`
+
+	// Whether the current node was drained by the upgrade rather than by an administrator beforehand
+	DrainedByUpgrade bool `json:",omitempty"`
+
+	Started      time.Time
+	StageStarted time.Time
+}
+
+func (us UpgradeStatus) CurrentNode() string {
+	if us.Current < len(us.Nodes) {
+		return us.Nodes[us.Current]
+	}
+
+	return ""
+}
+
+func restartKey(idHex string) string {
+	return path.Join(NodeInfo, idHex, "restart")
+}
+
+// StartUpgrade begins a rolling upgrade, restarting each node with the binary at request.BinaryPath one at a time.
+// Witnesses are upgraded first as they serve no clients, the current leader is upgraded last
+func StartUpgrade(request UpgradeRequest) error {
+	if request.BinaryPath == "" {
+		return errors.New("no binary path specified")
+	}
+
+	status := UpgradeStatus{
+		UpgradeRequest: request,
+		State:          UpgradeRunning,
+		Stage:          UpgradeStageDrain,
+		Started:        time.Now(),
+		StageStarted:   time.Now(),
+	}
+
+	var (
+		leader    string
+		members   []string
+		witnesses = map[string]bool{}
+		versions  = map[string]bool{}
+	)
+	for _, member := range GetMembers() {
+		if member.IsLearner {
+			return fmt.Errorf("node %s is a learner, promote or remove it before upgrading", member.ID)
+		}
+
+		witness, err := IsWitness(member.ID.String())
+		if err != nil {
+			return err
+		}
+
+		version, err := GetVersion(member.ID.String())
+		if err != nil {
+			return fmt.Errorf("unable to get version of node %s: %s", member.ID, err)
+		}
+		versions[version] = true
+
+		if member.ID == GetLeader() {
+			leader = member.ID.String()
+		}
+
+		witnesses[member.ID.String()] = witness
+		members = append(members, member.ID.String())
+	}
+
+	if len(versions) > 1 {
+		return errors.New("cluster members are running different versions, refusing to start upgrade")
+	}
+
+	status.Nodes = upgradeOrder(members, witnesses, leader)
+	if len(status.Nodes) == 0 {
+		return errors.New("no nodes to upgrade")
+	}
+
+	return doSafeUpdate(context.Background(), UpgradeKey, true, func(gr *clientv3.GetResponse) (string, error) {
+		if len(gr.Kvs) == 1 {
+			var current UpgradeStatus
+			if err := json.Unmarshal(gr.Kvs[0].Value, &current); err == nil && current.State == UpgradeRunning {
+				return "", errors.New("an upgrade is already in progress")
+			}
+		}
+
+		b, err := json.Marshal(status)
+		return string(b), err
+	})
+}
+
+// upgradeOrder returns the order nodes are upgraded in, witnesses first as they serve no clients and the leader last
+func upgradeOrder(members []string, witnesses map[string]bool, leader string) []string {
+	var order, rest []string
+	for _, member := range members {
+		switch {
+		case member == leader:
+		case witnesses[member]:
+			order = append(order, member)
+		default:
+			rest = append(rest, member)
+		}
+	}
+
+	order = append(order, rest...)
+	if leader != "" {
+		order = append(order, leader)
+	}
+
+	return order
+}
+
+func GetUpgradeStatus() (status UpgradeStatus, err error) {
+	status, _, err = getUpgradeStatus()
+	return
+}
+
+// getUpgradeStatus also returns the revision the status was last changed at, which any change to it must be compared against
+func getUpgradeStatus() (status UpgradeStatus, revision int64, err error) {
+	response, err := etcd.Get(context.Background(), UpgradeKey)
+	if err != nil {
+		return UpgradeStatus{}, 0, err
+	}
+
+	if len(response.Kvs) == 0 {
+		return UpgradeStatus{}, 0, errors.New("no upgrade has been run")
+	}
+
+	err = json.Unmarshal(response.Kvs[0].Value, &status)
+	return status, response.Kvs[0].ModRevision, err
+}
+
+func AbortUpgrade(reason string) error {
+	var status UpgradeStatus
+	err := doSafeUpdate(context.Background(), UpgradeKey, false, func(gr *clientv3.GetResponse) (string, error) {
+		err := json.Unmarshal(gr.Kvs[0].Value, &status)
+		if err != nil {
+			return "", err
+		}
+
+		if status.State != UpgradeRunning {
+			return "", errors.New("upgrade is not running")
+		}
+
+		status.State = UpgradeAborted
+		status.Error = reason
+
+		b, err := json.Marshal(status)
+		return string(b), err
+	})
+	if err != nil {
+		return err
+	}
+
+	undrainAfterAbort(status)
+
+	return nil
+}
+
+// GetRestartRequest returns the path of the binary this node has been asked to restart with, if any
+func GetRestartRequest(idHex string) (string, error) {
+	return getString(restartKey(idHex))
+}
+
+// RegisterRestartListener calls f with the new binary path when the upgrade orchestrator signals this node to restart.
+// The request is removed before f is called
+func RegisterRestartListener(f func(binaryPath string)) (string, error) {
+	return RegisterEventListener(restartKey(GetServerID().String()), false, func(key string, current, _ string, et EventType) error {
+		if et == DELETED {
+			return nil
+		}
+
+		_, err := etcd.Delete(context.Background(), key)
+		if err != nil {
+			return fmt.Errorf("failed to acknowledge restart request: %s", err)
+		}
+
+		f(current)
+		return nil
+	})
+}
+
+// progressUpgrade moves the rolling upgrade forward by at most one stage, it is only run by the leader.
+// As all state is kept in etcd, if leadership changes the new leader will continue where the previous one stopped
+func progressUpgrade() {
+	if !IsLeader() {
+		return
+	}
+
+	status, revision, err := getUpgradeStatus()
+	if err != nil || status.State != UpgradeRunning {
+		return
+	}
+
+	node := status.CurrentNode()
+	if node == "" {
+		status.State = UpgradeComplete
+		if err := setUpgradeStatus(status, revision); err != nil {
+			log.Println("unable to complete upgrade: ", err)
+		}
+		return
+	}
+
+	if !slices.ContainsFunc(GetMembers(), func(m *membership.Member) bool { return m.ID.String() == node }) {
+		abortUpgrade(status, revision, fmt.Sprintf("node %s is no longer part of the cluster", node))
+		return
+	}
+
+	// Any other operations are only done if the stage changes, so nothing happens after the upgrade has been aborted
+	nextStage := func(stage string, ops ...clientv3.Op) error {
+		status.Stage = stage
+		status.StageStarted = time.Now()
+
+		err := setUpgradeStatus(status, revision, ops...)
+		if err != nil {
+			log.Printf("unable to move upgrade of %s to stage %q: %s", node, stage, err)
+		}
+		return err
+	}
+
+	witness, err := IsWitness(node)
+	if err != nil {
+		log.Println("upgrade unable to check if node is a witness: ", err)
+		return
+	}
+
+	switch status.Stage {
+	case UpgradeStageDrain:
+		// Witnesses have no sessions to move
+		if witness {
+			nextStage(UpgradeStageRestart)
+			return
+		}
+
+		drained, err := IsDrained(node)
+		if err != nil {
+			log.Println("upgrade unable to check if node is drained: ", err)
+			return
+		}
+
+		if !drained {
+			if err := SetDrained(node, true); err != nil {
+				abortUpgrade(status, revision, fmt.Sprintf("failed to drain node %s: %s", node, err))
+				return
+			}
+			status.DrainedByUpgrade = true
+		}
+
+		// If the upgrade was aborted meanwhile the abort did not know the node had been drained
+		if err := nextStage(UpgradeStageMigrate); err != nil && status.DrainedByUpgrade {
+			undrainAfterAbort(status)
+		}
+
+	case UpgradeStageMigrate:
+		devices, err := GetAllDevices()
+		if err != nil {
+			log.Println("upgrade unable to get devices: ", err)
+			return
+		}
+
+		remaining := 0
+		for _, device := range devices {
+			if device.AssociatedNode.String() == node && !device.Authorised.IsZero() {
+				remaining++
+			}
+		}
+
+		if remaining > 0 && time.Since(status.StageStarted) < upgradeMigrateWait {
+			return
+		}
+
+		if remaining > 0 {
+			log.Printf("upgrade: %d sessions did not migrate from %s, continuing", remaining, node)
+		}
+
+		nextStage(UpgradeStageRestart)
+
+	case UpgradeStageRestart:
+		if node == GetServerID().String() {
+			// We cant restart ourselves while orchestrating, hand over to another node which will then restart us
+			if err := StepDown(); err != nil {
+				log.Println("upgrade: leader could not step down: ", err)
+			}
+			return
+		}
+
+		status.PreviousVersion, err = GetVersion(node)
+		if err != nil {
+			abortUpgrade(status, revision, fmt.Sprintf("unable to get version of %s: %s", node, err))
+			return
+		}
+
+		// Nodes running a version from before boot IDs were recorded will not have one
+		status.PreviousBoot, _ = GetBootID(node)
+
+		d, err := json.Marshal(status.BinaryPath)
+		if err != nil {
+			abortUpgrade(status, revision, fmt.Sprintf("unable to signal %s to restart: %s", node, err))
+			return
+		}
+
+		// The restart is signalled along with the stage change, so an aborted upgrade never restarts a node
+		nextStage(UpgradeStageHealth, clientv3.OpPut(restartKey(node), string(d)))
+
+	case UpgradeStageHealth:
+		if time.Since(status.StageStarted) > upgradeHealthTimeout {
+			abortUpgrade(status, revision, fmt.Sprintf("node %s failed health check after restart", node))
+			return
+		}
+
+		// The node has not yet picked up the restart request
+		if _, err := GetRestartRequest(node); err == nil {
+			return
+		}
+
+		lastPing, err := GetLastPing(node)
+		if err != nil || lastPing.Before(status.StageStarted) || lastPing.Before(time.Now().Add(-DeadNodeTimeout)) {
+			return
+		}
+
+		version, err := GetVersion(node)
+		if err != nil {
+			return
+		}
+
+		boot, _ := GetBootID(node)
+		if !status.restarted(boot, version) {
+			return
+		}
+
+		if status.TargetVersion == "" {
+			status.TargetVersion = version
+		}
+
+		if version != status.TargetVersion {
+			abortUpgrade(status, revision, fmt.Sprintf("version skew, node %s reported %q expected %q", node, version, status.TargetVersion))
+			return
+		}
+
+		nextStage(UpgradeStageUndrain)
+
+	case UpgradeStageUndrain:
+		if status.DrainedByUpgrade {
+			if err := SetDrained(node, false); err != nil {
+				abortUpgrade(status, revision, fmt.Sprintf("failed to undrain node %s: %s", node, err))
+				return
+			}
+		}
+
+		log.Printf("upgrade: node %s upgraded to %s", node, status.TargetVersion)
+
+		status.Current++
+		status.PreviousVersion = ""
+		status.PreviousBoot = ""
+		status.DrainedByUpgrade = false
+		if status.Current >= len(status.Nodes) {
+			status.State = UpgradeComplete
+			status.Stage = ""
+			if err := setUpgradeStatus(status, revision); err != nil {
+				log.Println("unable to complete upgrade: ", err)
+			}
+			return
+		}
+
+		nextStage(UpgradeStageDrain)
+	}
+}
+
+// restarted returns whether the node being upgraded has come back up with the boot ID and version it reported
+func (us UpgradeStatus) restarted(boot, version string) bool {
+	// The restart request is removed just before the node restarts, so it may still be pinging from its old process.
+	// Only a new boot ID, or a new version, shows it has come back up
+	return (boot != "" && boot != us.PreviousBoot) || version != us.PreviousVersion
+}
+
+func abortUpgrade(status UpgradeStatus, revision int64, reason string) {
+	status.State = UpgradeAborted
+	status.Error = reason
+
+	// The upgrade may have already been aborted or moved on by another node, in which case that status stands
+	if err := setUpgradeStatus(status, revision); err != nil {
+		log.Println("unable to abort upgrade: ", err)
+		return
+	}
+
+	log.Println("upgrade aborted: ", reason)
+
+	undrainAfterAbort(status)
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		log.Println("failed to marshal upgrade status: ", err)
+	}
+
+	if err := RaiseError(errors.New("rolling upgrade aborted: "+reason), b); err != nil {
+		log.Println("failed to raise error with cluster: ", err)
+	}
+}
+
+// undrainAfterAbort returns the node that was being upgraded to service, if the upgrade drained it
+func undrainAfterAbort(status UpgradeStatus) {
+	node := status.CurrentNode()
+	if node == "" || !status.DrainedByUpgrade {
+		return
+	}
+
+	if !slices.ContainsFunc(GetMembers(), func(m *membership.Member) bool { return m.ID.String() == node }) {
+		return
+	}
+
+	if err := SetDrained(node, false); err != nil {
+		log.Printf("upgrade unable to undrain %s after abort: %s", node, err)
+	}
+}
+
+var errUpgradeStatusChanged = errors.New("upgrade status was changed by another node")
+
+// setUpgradeStatus writes the status, along with any other operations, only if it has not changed since revision
+func setUpgradeStatus(status UpgradeStatus, revision int64, ops ...clientv3.Op) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upgrade status: %s", err)
+	}
+
+	resp, err := etcd.Txn(context.Background()).If(
+		clientv3.Compare(clientv3.ModRevision(UpgradeKey), "=", revision),
+	).Then(
+		append(ops, clientv3.OpPut(UpgradeKey, string(b)))...,
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("unable to write upgrade status: %s", err)
+	}
+
+	if !resp.Succeeded {
+		return errUpgradeStatusChanged
+	}
+
+	return nil
+}
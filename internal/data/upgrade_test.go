@@ -0,0 +1,109 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUpgradeOrder(t *testing.T) {
+	members := []string{"a", "b", "c", "d", "e"}
+	witnesses := map[string]bool{"c": true, "e": true}
+
+	order := upgradeOrder(members, witnesses, "b")
+	if !slices.Equal(order, []string{"c", "e", "a", "d", "b"}) {
+		t.Fatal("witnesses were not upgraded first and the leader last: ", order)
+	}
+
+	// The leader is only upgraded once even if it is also a witness
+	order = upgradeOrder(members, witnesses, "c")
+	if !slices.Equal(order, []string{"e", "a", "b", "d", "c"}) {
+		t.Fatal("leader that is a witness was not upgraded last: ", order)
+	}
+
+	if order := upgradeOrder(members, nil, ""); !slices.Equal(order, members) {
+		t.Fatal("without a leader or witnesses the member order changed: ", order)
+	}
+}
+
+func TestUpgradeRestarted(t *testing.T) {
+	status := UpgradeStatus{PreviousVersion: "v1", PreviousBoot: "boot-1"}
+
+	tests := []struct {
+		name      string
+		boot      string
+		version   string
+		restarted bool
+	}{
+		// The restart request is removed before the node restarts, so it can still report from its old process
+		{"old process", "boot-1", "v1", false},
+		{"new boot", "boot-2", "v1", true},
+		{"new version", "boot-1", "v2", true},
+		// Versions from before boot IDs were recorded can only be told apart by their version
+		{"no boot id", "", "v1", false},
+		{"no boot id new version", "", "v2", true},
+	}
+
+	for _, test := range tests {
+		if status.restarted(test.boot, test.version) != test.restarted {
+			t.Errorf("%s: expected restarted to be %t", test.name, test.restarted)
+		}
+	}
+}
+
+func TestUpgradeAbort(t *testing.T) {
+	defer etcd.Delete(context.Background(), UpgradeKey)
+
+	// Waiting for a node that has not reported a version, so the leaders upgrade monitor leaves it where it is
+	running := UpgradeStatus{
+		UpgradeRequest: UpgradeRequest{BinaryPath: "/tmp/wag"},
+		State:          UpgradeRunning,
+		Stage:          UpgradeStageHealth,
+		Nodes:          []string{GetServerID().String()},
+		Started:        time.Now(),
+		StageStarted:   time.Now(),
+	}
+
+	if err := setUpgradeStatus(running, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setUpgradeStatus(running, 0); !errors.Is(err, errUpgradeStatusChanged) {
+		t.Fatal("status was created twice: ", err)
+	}
+
+	_, revision, err := getUpgradeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AbortUpgrade("stopped by admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The orchestrator read the status before the abort, moving it on must not undo the abort
+	moved := running
+	moved.Stage = UpgradeStageUndrain
+	if err := setUpgradeStatus(moved, revision); !errors.Is(err, errUpgradeStatusChanged) {
+		t.Fatal("stale stage change was written over the abort: ", err)
+	}
+
+	abortUpgrade(running, revision, "failed health check")
+
+	progressUpgrade()
+
+	status, err := GetUpgradeStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.State != UpgradeAborted || status.Error != "stopped by admin" || status.Stage != UpgradeStageHealth {
+		t.Fatalf("abort was overwritten: %+v", status)
+	}
+
+	if err := AbortUpgrade("again"); err == nil {
+		t.Fatal("aborted an upgrade that was not running")
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"net/mail"
 	"strings"
+	"time"
 
 	"github.com/NHAS/wag/internal/webserver/authenticators/types"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -18,6 +22,12 @@ type UserModel struct {
 	MfaType   string
 	Locked    bool
 	Enforcing bool
+
+	// Zero for users created before this was recorded
+	Created time.Time
+
+	// Where notifications for the user are mailed, set from their registration token or oidc email claim
+	Email string `json:",omitempty"`
 }
 
 func (um *UserModel) GetID() [20]byte {
@@ -26,7 +36,8 @@ func (um *UserModel) GetID() [20]byte {
 
 // IncrementAuthenticationAttempt Make sure that the attempts is always incremented first to stop race condition attacks
 func IncrementAuthenticationAttempt(username, device string) error {
-	return doSafeUpdate(context.Background(), deviceKey(username, device), false, func(gr *clientv3.GetResponse) (value string, err error) {
+	locked := false
+	err := doSafeUpdate(context.Background(), deviceKey(username, device), false, func(gr *clientv3.GetResponse) (value string, err error) {
 
 		if len(gr.Kvs) != 1 {
 			return "", errors.New("invalid number of users")
@@ -43,8 +54,10 @@ func IncrementAuthenticationAttempt(username, device string) error {
 			return "", err
 		}
 
+		locked = false
 		if userDevice.Attempts <= l {
 			userDevice.Attempts++
+			locked = userDevice.Attempts > l
 		}
 
 		b, _ := json.Marshal(userDevice)
@@ -52,6 +65,21 @@ func IncrementAuthenticationAttempt(username, device string) error {
 		return string(b), nil
 
 	})
+	if err != nil {
+		return err
+	}
+
+	// Only the attempt that locked the device is recorded
+	if locked {
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionLocked,
+			Username: username,
+			Address:  device,
+			Reason:   "too many failed authentication attempts",
+		})
+	}
+
+	return nil
 }
 
 func GetAuthenticationDetails(username, device string) (mfa, mfaType string, attempts int, locked bool, err error) {
@@ -117,6 +145,25 @@ func SetUserLock(username string) error {
 		return errors.New("Unable to lock account: " + err.Error())
 	}
 
+	devices, err := GetDevicesByUser(username)
+	if err != nil {
+		log.Printf("%s unable to get devices to record account lock: %s", username, err)
+		return nil
+	}
+
+	for _, device := range devices {
+		if device.Authorised.IsZero() {
+			continue
+		}
+
+		recordConnectionEvent(ConnectionEvent{
+			Type:     ConnectionDeauthorised,
+			Username: username,
+			Address:  device.Address,
+			Reason:   "account locked",
+		})
+	}
+
 	return nil
 }
 
@@ -142,6 +189,43 @@ func SetUserUnlock(username string) error {
 	return nil
 }
 
+// SetUserEmail sets the address notifications for the user are mailed to, the user is only updated if the address has changed
+func SetUserEmail(username, email string) error {
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return fmt.Errorf("invalid email address %q: %s", email, err)
+		}
+	}
+
+	user, err := GetUserData(username)
+	if err != nil {
+		return err
+	}
+
+	if user.Email == email {
+		return nil
+	}
+
+	err = doSafeUpdate(context.Background(), "users-"+username+"-", false, func(gr *clientv3.GetResponse) (string, error) {
+		var result UserModel
+		err := json.Unmarshal(gr.Kvs[0].Value, &result)
+		if err != nil {
+			return "", err
+		}
+
+		result.Email = email
+
+		b, _ := json.Marshal(result)
+
+		return string(b), nil
+	})
+	if err != nil {
+		return errors.New("Unable to set user email: " + err.Error())
+	}
+
+	return nil
+}
+
 // Has the user recorded their MFA details. Always read the latest value from the DB
 func IsEnforcingMFA(username string) bool {
 	userResponse, err := etcd.Get(context.Background(), "users-"+username+"-")
@@ -251,6 +335,11 @@ func DeleteUser(username string) error {
 		return err
 	}
 
+	_, err = etcd.Delete(context.Background(), UserClaimsPrefix+username)
+	if err != nil {
+		return err
+	}
+
 	return DeleteDevices(username)
 }
 
@@ -326,6 +415,7 @@ func CreateUserDataAccount(username string) (UserModel, error) {
 		Username: username,
 		Mfa:      string(types.Unset),
 		MfaType:  string(types.Unset),
+		Created:  time.Now(),
 	}
 	b, _ := json.Marshal(&newUser)
 
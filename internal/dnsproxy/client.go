@@ -0,0 +1,183 @@
+package dnsproxy
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/routetypes"
+)
+
+// How long the policies and group memberships of a device are cached for, so every query doesn't have to go to etcd
+const clientCacheTime = 10 * time.Second
+
+type client struct {
+	username string
+	address  string
+	groups   []string
+
+	routes          []route
+	defaultUpstream []string
+
+	expires time.Time
+
+	// Names already recorded as blocked while this client is cached, so repeated lookups don't flood the devices history
+	blockedLock sync.Mutex
+	blocked     map[string]bool
+}
+
+// route is a prefix from the clients policies. As in the firewall, only the policies of the most specific prefix containing an address apply to it
+type route struct {
+	network   *net.IPNet
+	reachable bool
+}
+
+var (
+	clientsLock sync.Mutex
+	clients     = map[string]*client{}
+
+	// Replaced in tests, which run without a cluster
+	recordConnectionEvent = data.RecordConnectionEvent
+)
+
+func clearClients() {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	clear(clients)
+}
+
+// getClient returns the owner, group membership and reachable routes for the device with address
+func getClient(address net.IP) (*client, error) {
+	clientsLock.Lock()
+	cached, ok := clients[address.String()]
+	clientsLock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	device, err := data.GetDeviceByAddress(address.String())
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := data.GetUserGroupMembership(device.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{
+		username: device.Username,
+		address:  device.Address,
+		groups:   groups,
+		routes:   routesFromAcl(data.GetEffectiveDeviceAcl(device.Username, device.Interface, device.Tags)),
+		expires:  time.Now().Add(clientCacheTime),
+	}
+
+	dns, err := data.GetDNS()
+	if err == nil {
+		for _, server := range dns {
+			c.defaultUpstream = append(c.defaultUpstream, net.JoinHostPort(strings.TrimSuffix(server, "/32"), "53"))
+		}
+	}
+
+	clientsLock.Lock()
+	clients[address.String()] = c
+	clientsLock.Unlock()
+
+	return c, nil
+}
+
+// recordBlocked adds a dns-blocked event to the devices connection history, once per name while the client is cached
+func (c *client) recordBlocked(name string) {
+	c.blockedLock.Lock()
+	if c.blocked == nil {
+		c.blocked = map[string]bool{}
+	}
+
+	recorded := c.blocked[name]
+	c.blocked[name] = true
+	c.blockedLock.Unlock()
+
+	if recorded {
+		return
+	}
+
+	event := data.ConnectionEvent{
+		Type:     data.ConnectionDNSBlocked,
+		Username: c.username,
+		Address:  c.address,
+		Reason:   "dns query for " + name + " only resolved to addresses the device cannot reach",
+	}
+
+	go func() {
+		if err := recordConnectionEvent(event); err != nil {
+			log.Printf("unable to record device (%s:%s) blocked dns query: %s", c.address, c.username, err)
+		}
+	}()
+}
+
+// routesFromAcl works out which prefixes of the acl allow some traffic.
+// A prefix is unreachable if it only has deny policies, or if it denies every port and protocol
+func routesFromAcl(acl acls.Acl) []route {
+	rules, errs := routetypes.ParseRules(acl.Mfa, acl.Allow, acl.Deny)
+	if len(errs) != 0 {
+		log.Println("dns proxy had errors parsing rules: ", errs)
+	}
+
+	// As with the firewall the last rule for a key wins
+	policies := map[routetypes.Key][]routetypes.Policy{}
+	for _, rule := range rules {
+		for _, key := range rule.Keys {
+			policies[key] = rule.Values[:rule.NumPolicies]
+		}
+	}
+
+	var routes []route
+	for key, keyPolicies := range policies {
+		var allows, deniesAll bool
+		for _, policy := range keyPolicies {
+			if !policy.Is(routetypes.DENY) {
+				allows = true
+				continue
+			}
+
+			if policy.Proto == routetypes.ANY && policy.LowerPort == routetypes.ANY && !policy.Is(routetypes.RANGE) {
+				deniesAll = true
+			}
+		}
+
+		routes = append(routes, route{
+			network:   &net.IPNet{IP: key.AsIP(), Mask: net.CIDRMask(int(key.Prefixlen), 32)},
+			reachable: allows && !deniesAll,
+		})
+	}
+
+	return routes
+}
+
+func (c *client) canReach(address net.IP) bool {
+	var (
+		best      *route
+		bestOnes  = -1
+		ipAddress = address.To4()
+	)
+
+	for i := range c.routes {
+		if !c.routes[i].network.Contains(ipAddress) {
+			continue
+		}
+
+		if ones, _ := c.routes[i].network.Mask.Size(); ones > bestOnes {
+			best = &c.routes[i]
+			bestOnes = ones
+		}
+	}
+
+	return best != nil && best.reachable
+}
@@ -0,0 +1,478 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	upstreamTimeout = 2 * time.Second
+	maxUDPSize      = 4096
+	// Largest udp response a client that doesn't advertise an EDNS buffer size will accept
+	minUDPSize = 512
+)
+
+var (
+	serversLock sync.Mutex
+	udpServers  []net.PacketConn
+	tcpServers  []net.Listener
+)
+
+// Start listens for dns queries on the server address of every wireguard interface, does nothing if the proxy is not enabled
+func Start(errChan chan<- error) error {
+	if !config.Values.DNSProxy.Enabled {
+		return nil
+	}
+
+	serversLock.Lock()
+	defer serversLock.Unlock()
+
+	var listening []string
+	for _, iface := range config.AllInterfaces() {
+		address := net.JoinHostPort(iface.ServerAddress.String(), strconv.Itoa(config.Values.DNSProxy.ListenPort))
+
+		udp, err := net.ListenPacket("udp4", address)
+		if err != nil {
+			return fmt.Errorf("unable to listen for dns on %s: %s", address, err)
+		}
+		udpServers = append(udpServers, udp)
+
+		tcp, err := net.Listen("tcp4", address)
+		if err != nil {
+			return fmt.Errorf("unable to listen for dns on %s: %s", address, err)
+		}
+		tcpServers = append(tcpServers, tcp)
+
+		go serveUDP(udp, errChan)
+		go serveTCP(tcp, errChan)
+
+		listening = append(listening, address)
+	}
+
+	log.Println("Started DNS proxy:\n\t\t\t", strings.Join(listening, ", "))
+
+	return nil
+}
+
+func Teardown() {
+	serversLock.Lock()
+	defer serversLock.Unlock()
+
+	if len(udpServers) == 0 && len(tcpServers) == 0 {
+		return
+	}
+
+	for _, udp := range udpServers {
+		udp.Close()
+	}
+
+	for _, tcp := range tcpServers {
+		tcp.Close()
+	}
+
+	udpServers = nil
+	tcpServers = nil
+
+	clearClients()
+
+	log.Println("Stopped DNS proxy")
+}
+
+func serveUDP(conn net.PacketConn, errChan chan<- error) {
+	buff := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				errChan <- fmt.Errorf("dns proxy udp listener failed: %s", err)
+			}
+			return
+		}
+
+		query := make([]byte, n)
+		copy(query, buff[:n])
+
+		go func(addr *net.UDPAddr) {
+			response := handle(query, addr.IP)
+			if response == nil {
+				return
+			}
+
+			conn.WriteTo(truncateUDP(query, response), addr)
+		}(addr.(*net.UDPAddr))
+	}
+}
+
+func serveTCP(l net.Listener, errChan chan<- error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				errChan <- fmt.Errorf("dns proxy tcp listener failed: %s", err)
+			}
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+
+				response := handle(query, conn.RemoteAddr().(*net.TCPAddr).IP)
+				if response == nil {
+					return
+				}
+
+				if err := writeTCPMessage(conn, response); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+func readTCPMessage(conn io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, length)
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func writeTCPMessage(conn io.Writer, msg []byte) error {
+	return binary.Write(conn, binary.BigEndian, append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+}
+
+// handle answers a single query from a wireguard device, returns nil if no response should be sent
+func handle(query []byte, from net.IP) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+
+	if msg.Header.Response {
+		return nil
+	}
+
+	if len(msg.Questions) != 1 || msg.Header.OpCode != 0 {
+		return pack(reply(msg, dnsmessage.RCodeFormatError))
+	}
+
+	client, err := getClient(from)
+	if err != nil {
+		log.Println("unknown", from, "dns query refused:", err)
+		return pack(reply(msg, dnsmessage.RCodeRefused))
+	}
+
+	question := msg.Questions[0]
+	name := config.NormaliseDNSName(question.Name.String())
+
+	response, via, err := resolve(msg, query, name, client)
+	if err != nil {
+		log.Println(client.username, from, "dns query for", name, question.Type, "failed:", err)
+		return pack(reply(msg, dnsmessage.RCodeServerFailure))
+	}
+
+	if config.Values.DNSProxy.EnforceAcls && enforce(&response, client) {
+		client.recordBlocked(name)
+	}
+
+	log.Println(client.username, from, "dns", name, question.Type, "via", via, "->", describe(response))
+
+	return pack(response)
+}
+
+// resolve answers the query from the most specific zone that applies to the client, or forwards it upstream if there is none
+func resolve(msg dnsmessage.Message, query []byte, name string, client *client) (response dnsmessage.Message, via string, err error) {
+
+	zone := matchZone(name, client.groups)
+	if zone == nil {
+		upstream := config.Values.DNSProxy.Upstream
+		if len(upstream) == 0 {
+			upstream = client.defaultUpstream
+		}
+
+		response, err = forward(query, upstream)
+		return response, "upstream", err
+	}
+
+	via = "zone " + zone.Name
+
+	if addresses, ok := zone.Records[name]; ok {
+		response = reply(msg, dnsmessage.RCodeSuccess)
+		response.Header.Authoritative = true
+
+		if msg.Questions[0].Type != dnsmessage.TypeA {
+			return response, via, nil
+		}
+
+		for _, address := range addresses {
+			var a dnsmessage.AResource
+			copy(a.A[:], net.ParseIP(address).To4())
+
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  msg.Questions[0].Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &a,
+			})
+		}
+
+		return response, via, nil
+	}
+
+	if len(zone.Forward) == 0 {
+		response = reply(msg, dnsmessage.RCodeNameError)
+		response.Header.Authoritative = true
+		return response, via, nil
+	}
+
+	response, err = forward(query, zone.Forward)
+	return response, via, err
+}
+
+// matchZone returns the zone with the longest name containing name that applies to a member of groups
+func matchZone(name string, groups []string) *config.DNSZone {
+	var best *config.DNSZone
+	for i := range config.Values.DNSProxy.Zones {
+		zone := &config.Values.DNSProxy.Zones[i]
+
+		if name != zone.Name && !strings.HasSuffix(name, "."+zone.Name) {
+			continue
+		}
+
+		if !zoneAppliesTo(zone, groups) {
+			continue
+		}
+
+		if best == nil || len(zone.Name) > len(best.Name) {
+			best = zone
+		}
+	}
+
+	return best
+}
+
+func zoneAppliesTo(zone *config.DNSZone, groups []string) bool {
+	if len(zone.Groups) == 0 {
+		return true
+	}
+
+	for _, group := range zone.Groups {
+		for _, member := range groups {
+			if group == member {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// enforce removes addresses the client cannot reach, if a name only resolved to unreachable addresses it is answered with NXDOMAIN and enforce returns true.
+// wag is ipv4 only so AAAA records are always removed
+func enforce(response *dnsmessage.Message, client *client) (blocked bool) {
+	var (
+		kept         []dnsmessage.Resource
+		hadAddresses bool
+		reachable    bool
+	)
+
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			hadAddresses = true
+			if client.canReach(net.IP(body.A[:])) {
+				reachable = true
+				kept = append(kept, answer)
+			}
+		case *dnsmessage.AAAAResource:
+		default:
+			kept = append(kept, answer)
+		}
+	}
+
+	response.Answers = kept
+
+	if hadAddresses && !reachable {
+		response.Header.RCode = dnsmessage.RCodeNameError
+		response.Answers = nil
+		return true
+	}
+
+	return false
+}
+
+func forward(query []byte, resolvers []string) (response dnsmessage.Message, err error) {
+	if len(resolvers) == 0 {
+		return response, errors.New("no upstream resolvers configured")
+	}
+
+	for _, resolver := range resolvers {
+		var raw []byte
+		raw, err = exchange("udp", resolver, query)
+		if err != nil {
+			continue
+		}
+
+		err = response.Unpack(raw)
+		if err != nil {
+			continue
+		}
+
+		if response.Header.Truncated {
+			raw, err = exchange("tcp", resolver, query)
+			if err != nil {
+				continue
+			}
+
+			err = response.Unpack(raw)
+			if err != nil {
+				continue
+			}
+		}
+
+		return response, nil
+	}
+
+	return response, err
+}
+
+func exchange(network, resolver string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, resolver, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, maxUDPSize)
+	n, err := conn.Read(buff)
+	if err != nil {
+		return nil, err
+	}
+
+	return buff[:n], nil
+}
+
+// truncateUDP limits a response to the buffer size the query advertised with EDNS, or 512 bytes without it.
+// Oversized responses are sent with only their question and the TC bit set so the client retries over tcp
+func truncateUDP(query, response []byte) []byte {
+	limit := minUDPSize
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err == nil {
+		for _, additional := range msg.Additionals {
+			if additional.Header.Type == dnsmessage.TypeOPT {
+				// The requestors udp payload size is carried in the class field of the OPT record
+				limit = max(minUDPSize, min(int(additional.Header.Class), maxUDPSize))
+			}
+		}
+	}
+
+	if len(response) <= limit {
+		return response
+	}
+
+	var truncated dnsmessage.Message
+	if err := truncated.Unpack(response); err != nil {
+		return nil
+	}
+
+	truncated.Header.Truncated = true
+	truncated.Answers = nil
+	truncated.Authorities = nil
+
+	var opts []dnsmessage.Resource
+	for _, additional := range truncated.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			opts = append(opts, additional)
+		}
+	}
+	truncated.Additionals = opts
+
+	return pack(truncated)
+}
+
+func reply(msg dnsmessage.Message, rcode dnsmessage.RCode) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.Header.ID,
+			Response:           true,
+			RecursionDesired:   msg.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: msg.Questions,
+	}
+}
+
+func pack(msg dnsmessage.Message) []byte {
+	b, err := msg.Pack()
+	if err != nil {
+		log.Println("unable to pack dns response:", err)
+		return nil
+	}
+
+	return b
+}
+
+func describe(response dnsmessage.Message) string {
+	if response.Header.RCode != dnsmessage.RCodeSuccess {
+		return response.Header.RCode.String()
+	}
+
+	var answers []string
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			answers = append(answers, net.IP(body.A[:]).String())
+		case *dnsmessage.CNAMEResource:
+			answers = append(answers, body.CNAME.String())
+		default:
+			answers = append(answers, answer.Header.Type.String())
+		}
+	}
+
+	if len(answers) == 0 {
+		return "no answers"
+	}
+
+	return strings.Join(answers, ",")
+}
@@ -0,0 +1,332 @@
+package dnsproxy
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testZones() []config.DNSZone {
+	return []config.DNSZone{
+		{Name: "example.com", Records: map[string][]string{"www.example.com": {"10.0.0.1"}}},
+		{Name: "corp.example.com", Groups: []string{"group:ops"}, Records: map[string][]string{
+			"db.corp.example.com":     {"10.1.0.5"},
+			"mixed.corp.example.com":  {"10.1.0.5", "10.2.0.5"},
+			"denied.corp.example.com": {"10.1.0.9"},
+		}},
+		{Name: "dev.corp.example.com", Groups: []string{"group:dev"}},
+	}
+}
+
+func TestMatchZone(t *testing.T) {
+	config.Values.DNSProxy.Zones = testZones()
+	defer func() { config.Values.DNSProxy.Zones = nil }()
+
+	tests := []struct {
+		name   string
+		groups []string
+		want   string
+	}{
+		{"www.example.com", nil, "example.com"},
+		{"example.com", nil, "example.com"},
+		{"db.corp.example.com", []string{"group:ops"}, "corp.example.com"},
+		// Split horizon, non members fall through to the less specific zone
+		{"db.corp.example.com", []string{"group:users"}, "example.com"},
+		{"a.dev.corp.example.com", []string{"group:ops", "group:dev"}, "dev.corp.example.com"},
+		{"a.dev.corp.example.com", []string{"group:ops"}, "corp.example.com"},
+		// Only whole labels match
+		{"notexample.com", nil, ""},
+		{"example.org", nil, ""},
+	}
+
+	for _, test := range tests {
+		zone := matchZone(test.name, test.groups)
+
+		got := ""
+		if zone != nil {
+			got = zone.Name
+		}
+
+		if got != test.want {
+			t.Errorf("matchZone(%q, %v) = %q, expected %q", test.name, test.groups, got, test.want)
+		}
+	}
+}
+
+func aRecord(name, address string) dnsmessage.Resource {
+	var a dnsmessage.AResource
+	copy(a.A[:], net.ParseIP(address).To4())
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &a,
+	}
+}
+
+func testClient() *client {
+	return &client{
+		username: "tester",
+		address:  "192.168.1.2",
+		groups:   []string{"group:ops"},
+		routes: routesFromAcl(acls.Acl{
+			Allow: []string{"10.1.0.0/16", "10.3.0.0/16 443/tcp"},
+			Mfa:   []string{"10.4.0.0/16"},
+			Deny:  []string{"10.1.0.9", "10.3.0.7 22/tcp", "10.4.0.0/16 22/tcp", "10.5.0.0/16"},
+		}),
+		expires: time.Now().Add(time.Hour),
+	}
+}
+
+func TestCanReach(t *testing.T) {
+	c := testClient()
+
+	tests := map[string]bool{
+		"10.1.0.5":  true,
+		"10.1.0.9":  false, // denied outright
+		"10.2.0.5":  false, // no policy at all
+		"10.3.0.5":  true,
+		"10.3.0.7":  false, // the /32 bucket only holds a deny, so 443 from the /16 no longer applies
+		"10.4.0.1":  true,  // only port 22 is denied
+		"10.5.0.1":  false, // deny without allow
+		"127.0.0.1": false,
+	}
+
+	for address, want := range tests {
+		if got := c.canReach(net.ParseIP(address)); got != want {
+			t.Errorf("canReach(%s) = %t, expected %t", address, got, want)
+		}
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	c := testClient()
+
+	cname := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("alias.example.com."), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("db.corp.example.com.")},
+	}
+
+	aaaa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("db.corp.example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AAAAResource{},
+	}
+
+	tests := []struct {
+		name      string
+		answers   []dnsmessage.Resource
+		wantRCode dnsmessage.RCode
+		wantKept  int
+	}{
+		{"reachable", []dnsmessage.Resource{aRecord("db.corp.example.com.", "10.1.0.5")}, dnsmessage.RCodeSuccess, 1},
+		{"unreachable", []dnsmessage.Resource{aRecord("x.example.com.", "10.2.0.5")}, dnsmessage.RCodeNameError, 0},
+		{"denied", []dnsmessage.Resource{aRecord("denied.corp.example.com.", "10.1.0.9")}, dnsmessage.RCodeNameError, 0},
+		{"mixed", []dnsmessage.Resource{aRecord("m.example.com.", "10.1.0.5"), aRecord("m.example.com.", "10.2.0.5"), aRecord("m.example.com.", "10.1.0.9")}, dnsmessage.RCodeSuccess, 1},
+		{"cname kept", []dnsmessage.Resource{cname, aRecord("db.corp.example.com.", "10.1.0.5")}, dnsmessage.RCodeSuccess, 2},
+		{"aaaa removed", []dnsmessage.Resource{aaaa, aRecord("db.corp.example.com.", "10.1.0.5")}, dnsmessage.RCodeSuccess, 1},
+		{"no addresses", []dnsmessage.Resource{cname}, dnsmessage.RCodeSuccess, 1},
+		{"empty", nil, dnsmessage.RCodeSuccess, 0},
+	}
+
+	for _, test := range tests {
+		response := dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Answers: test.answers}
+		enforce(&response, c)
+
+		if response.Header.RCode != test.wantRCode || len(response.Answers) != test.wantKept {
+			t.Errorf("%s: got %s with %d answers, expected %s with %d", test.name, response.Header.RCode, len(response.Answers), test.wantRCode, test.wantKept)
+		}
+	}
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestHandle(t *testing.T) {
+	config.Values.DNSProxy.Zones = testZones()
+	config.Values.DNSProxy.EnforceAcls = true
+	defer func() {
+		config.Values.DNSProxy.Zones = nil
+		config.Values.DNSProxy.EnforceAcls = false
+		clearClients()
+	}()
+
+	var (
+		recordedLock sync.Mutex
+		recorded     []data.ConnectionEvent
+		wg           sync.WaitGroup
+	)
+	recordConnectionEvent = func(event data.ConnectionEvent) error {
+		defer wg.Done()
+
+		recordedLock.Lock()
+		defer recordedLock.Unlock()
+
+		recorded = append(recorded, event)
+		return nil
+	}
+	defer func() { recordConnectionEvent = data.RecordConnectionEvent }()
+
+	from := net.ParseIP("192.168.1.2")
+	clientsLock.Lock()
+	clients[from.String()] = testClient()
+	clientsLock.Unlock()
+
+	tests := []struct {
+		name        string
+		query       []byte
+		wantRCode   dnsmessage.RCode
+		wantAnswers []string
+	}{
+		{"zone record", query(t, "db.corp.example.com.", dnsmessage.TypeA), dnsmessage.RCodeSuccess, []string{"10.1.0.5"}},
+		{"case insensitive", query(t, "DB.Corp.Example.com.", dnsmessage.TypeA), dnsmessage.RCodeSuccess, []string{"10.1.0.5"}},
+		{"unreachable addresses removed", query(t, "mixed.corp.example.com.", dnsmessage.TypeA), dnsmessage.RCodeSuccess, []string{"10.1.0.5"}},
+		{"denied address", query(t, "denied.corp.example.com.", dnsmessage.TypeA), dnsmessage.RCodeNameError, nil},
+		{"not in zone", query(t, "missing.corp.example.com.", dnsmessage.TypeA), dnsmessage.RCodeNameError, nil},
+		{"other record types", query(t, "db.corp.example.com.", dnsmessage.TypeMX), dnsmessage.RCodeSuccess, nil},
+		{"outside enforced policy", query(t, "www.example.com.", dnsmessage.TypeA), dnsmessage.RCodeNameError, nil},
+		{"repeated blocked query", query(t, "denied.corp.example.com.", dnsmessage.TypeA), dnsmessage.RCodeNameError, nil},
+	}
+
+	// Only the first lookup of each blocked name is recorded
+	wg.Add(2)
+
+	for _, test := range tests {
+		raw := handle(test.query, from)
+		if raw == nil {
+			t.Errorf("%s: no response", test.name)
+			continue
+		}
+
+		var response dnsmessage.Message
+		if err := response.Unpack(raw); err != nil {
+			t.Errorf("%s: bad response: %s", test.name, err)
+			continue
+		}
+
+		if !response.Header.Response || response.Header.ID != 1234 {
+			t.Errorf("%s: response header does not match query: %+v", test.name, response.Header)
+		}
+
+		var answers []string
+		for _, answer := range response.Answers {
+			if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+				answers = append(answers, net.IP(a.A[:]).String())
+			}
+		}
+
+		if response.Header.RCode != test.wantRCode || len(answers) != len(test.wantAnswers) || (len(answers) > 0 && answers[0] != test.wantAnswers[0]) {
+			t.Errorf("%s: got %s %v, expected %s %v", test.name, response.Header.RCode, answers, test.wantRCode, test.wantAnswers)
+		}
+	}
+
+	wg.Wait()
+
+	var names []string
+	for _, event := range recorded {
+		if event.Type != data.ConnectionDNSBlocked || event.Username != "tester" || event.Address != from.String() {
+			t.Errorf("blocked query recorded with the wrong device or type: %+v", event)
+		}
+		names = append(names, event.Reason)
+	}
+
+	slices.Sort(names)
+	if !slices.Equal(names, []string{
+		"dns query for denied.corp.example.com only resolved to addresses the device cannot reach",
+		"dns query for www.example.com only resolved to addresses the device cannot reach",
+	}) {
+		t.Error("blocked queries were not each recorded once: ", names)
+	}
+}
+
+func TestTruncateUDP(t *testing.T) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, Response: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("big.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+
+	for i := 0; i < 64; i++ {
+		msg.Answers = append(msg.Answers, aRecord("big.example.com.", net.IPv4(10, 0, 0, byte(i)).String()))
+	}
+
+	large, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(large) <= minUDPSize {
+		t.Fatal("test response is not larger than the minimum udp size: ", len(large))
+	}
+
+	truncated := truncateUDP(query(t, "big.example.com.", dnsmessage.TypeA), large)
+
+	var response dnsmessage.Message
+	if err := response.Unpack(truncated); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(truncated) > minUDPSize || !response.Header.Truncated || len(response.Answers) != 0 || len(response.Questions) != 1 || response.Header.ID != 1234 {
+		t.Fatalf("response to a query without EDNS was not truncated (%d bytes): %+v", len(truncated), response.Header)
+	}
+
+	edns := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("big.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	edns.Additionals = append(edns.Additionals, dnsmessage.Resource{Header: opt, Body: &dnsmessage.OPTResource{}})
+
+	ednsQuery, err := edns.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(truncateUDP(ednsQuery, large), large) {
+		t.Fatal("response within the EDNS buffer size was truncated")
+	}
+
+	small := pack(reply(msg, dnsmessage.RCodeNameError))
+	if !slices.Equal(truncateUDP(query(t, "big.example.com.", dnsmessage.TypeA), small), small) {
+		t.Fatal("small response was changed")
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	if handle([]byte{1, 2, 3}, net.ParseIP("192.168.1.2")) != nil {
+		t.Fatal("answered a query that could not be parsed")
+	}
+
+	msg := dnsmessage.Message{Header: dnsmessage.Header{ID: 1, Response: true}}
+	b, _ := msg.Pack()
+	if handle(b, net.ParseIP("192.168.1.2")) != nil {
+		t.Fatal("answered a response, which could be used for reflection")
+	}
+
+	msg = dnsmessage.Message{Header: dnsmessage.Header{ID: 1}}
+	b, _ = msg.Pack()
+
+	var response dnsmessage.Message
+	if err := response.Unpack(handle(b, net.ParseIP("192.168.1.2"))); err != nil || response.Header.RCode != dnsmessage.RCodeFormatError {
+		t.Fatal("query without a question was not a format error: ", response.Header.RCode, err)
+	}
+}
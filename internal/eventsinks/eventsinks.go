@@ -0,0 +1,281 @@
+package eventsinks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+// Event types, sinks can filter on these exactly or by prefix e.g "device.*"
+const (
+	UserCreated  = "user.created"
+	UserDeleted  = "user.deleted"
+	UserLocked   = "user.locked"
+	UserUnlocked = "user.unlocked"
+
+	DeviceCreated      = "device.created"
+	DeviceDeleted      = "device.deleted"
+	DeviceAuthorised   = "device.authorised"
+	DeviceDeauthorised = "device.deauthorised"
+	DeviceLocked       = "device.locked"
+
+	PolicyChanged = "policy.changed"
+	GroupChanged  = "group.changed"
+
+	AccessRequested = "access.requested"
+	AccessGranted   = "access.granted"
+	AccessEnded     = "access.ended"
+
+	SecurityAlert = "security.alert"
+
+	NodeDown  = "node.down"
+	NodeUp    = "node.up"
+	NodeError = "node.error"
+)
+
+var Types = []string{
+	UserCreated, UserDeleted, UserLocked, UserUnlocked,
+	DeviceCreated, DeviceDeleted, DeviceAuthorised, DeviceDeauthorised, DeviceLocked,
+	PolicyChanged, GroupChanged,
+	AccessRequested, AccessGranted, AccessEnded,
+	SecurityAlert,
+	NodeDown, NodeUp, NodeError,
+}
+
+// Event is what is sent to every sink, webhooks and files get it as json and syslog as the message
+type Event struct {
+	// The same on every node that sees the event, and on every attempt to deliver it
+	ID string `json:"id"`
+
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	Message string    `json:"message"`
+
+	Username string `json:"username,omitempty"`
+	Device   string `json:"device,omitempty"`
+
+	// Depends on the type, e.g the policy that changed or the error a node raised
+	Details any `json:"details,omitempty"`
+}
+
+type sink interface {
+	send(ctx context.Context, event Event) error
+	close()
+}
+
+// queuedSink sends events to a sink in the background, so a slow or failing sink does not hold up the others
+type queuedSink struct {
+	name    string
+	filters []string
+
+	// Local sinks get every event this node sees, the rest only get the events this node claims so they are not duplicated by each cluster member
+	local bool
+
+	sink   sink
+	events chan Event
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+const queueSize = 256
+
+var (
+	sinksLock sync.RWMutex
+	sinks     []*queuedSink
+	listeners []string
+	stopNodes chan bool
+)
+
+func matches(pattern, eventType string) bool {
+	if pattern == "*" || pattern == eventType {
+		return true
+	}
+
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasPrefix(eventType, prefix)
+}
+
+func (q *queuedSink) wants(eventType string) bool {
+	if len(q.filters) == 0 {
+		return true
+	}
+
+	for _, filter := range q.filters {
+		if matches(filter, eventType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *queuedSink) run() {
+	defer close(q.done)
+	defer q.sink.close()
+
+	for event := range q.events {
+		if err := q.sink.send(q.ctx, event); err != nil {
+			log.Printf("event sink %s could not send %s event: %s", q.name, event.Type, err)
+		}
+	}
+}
+
+func newSink(c config.EventSink) (sink, error) {
+	switch c.Type {
+	case "webhook":
+		return newWebhook(c), nil
+	case "syslog":
+		return newSyslog(c)
+	case "file":
+		return newFile(c)
+	}
+
+	return nil, fmt.Errorf("unknown event sink type %q", c.Type)
+}
+
+// Start sends events to the sinks in the config, does nothing if there are none
+func Start() error {
+	if len(config.Values.EventSinks) == 0 {
+		return nil
+	}
+
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	var names []string
+	for _, c := range config.Values.EventSinks {
+		for _, filter := range c.Events {
+			known := false
+			for _, eventType := range Types {
+				known = known || matches(filter, eventType)
+			}
+
+			if !known {
+				stop()
+				return fmt.Errorf("event sink %s filter %q does not match any event type", c.Name, filter)
+			}
+		}
+
+		s, err := newSink(c)
+		if err != nil {
+			stop()
+			return fmt.Errorf("unable to start event sink %s: %s", c.Name, err)
+		}
+
+		q := &queuedSink{
+			name:    c.Name,
+			filters: c.Events,
+			local:   c.Type == "file",
+			sink:    s,
+			events:  make(chan Event, queueSize),
+			done:    make(chan bool),
+		}
+		q.ctx, q.cancel = context.WithCancel(context.Background())
+
+		sinks = append(sinks, q)
+		go q.run()
+
+		names = append(names, c.Name)
+	}
+
+	if err := registerListeners(); err != nil {
+		stop()
+		return err
+	}
+
+	stopNodes = make(chan bool)
+	go monitorNodes(stopNodes)
+
+	log.Println("Started event sinks:", strings.Join(names, ", "))
+
+	return nil
+}
+
+func Teardown() {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	if len(sinks) == 0 {
+		return
+	}
+
+	stop()
+
+	log.Println("Stopped event sinks")
+}
+
+// stop expects the caller to hold sinksLock
+func stop() {
+	for _, key := range listeners {
+		if err := data.DeregisterEventListener(key); err != nil {
+			log.Println("unable to deregister event sink listener: ", err)
+		}
+	}
+	listeners = nil
+
+	if stopNodes != nil {
+		close(stopNodes)
+		stopNodes = nil
+	}
+
+	// Events still queued are dropped, other than for file sinks which will write them quickly
+	for _, q := range sinks {
+		q.cancel()
+		close(q.events)
+	}
+
+	for _, q := range sinks {
+		<-q.done
+	}
+
+	sinks = nil
+}
+
+// publish queues the event for every sink that wants it, id must be the same on every node that sees the event
+func publish(event Event, id string) {
+	event.Time = time.Now()
+	event.Node = data.GetServerID().String()
+
+	hash := sha256.Sum256([]byte(event.Type + "\x00" + id))
+	event.ID = hex.EncodeToString(hash[:])
+
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+
+	var claimed *bool
+	for _, q := range sinks {
+		if !q.wants(event.Type) {
+			continue
+		}
+
+		if !q.local {
+			if claimed == nil {
+				ok, err := data.ClaimEvent(event.ID)
+				if err != nil {
+					log.Printf("unable to claim %s event: %s", event.Type, err)
+				}
+				claimed = &ok
+			}
+
+			if !*claimed {
+				continue
+			}
+		}
+
+		select {
+		case q.events <- event:
+		default:
+			log.Printf("event sink %s is not keeping up, dropped %s event", q.name, event.Type)
+		}
+	}
+}
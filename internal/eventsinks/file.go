@@ -0,0 +1,38 @@
+package eventsinks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+// file appends every event this node sees to a local file as one json object per line
+type file struct {
+	f *os.File
+}
+
+func newFile(c config.EventSink) (*file, error) {
+	f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open event file: %s", err)
+	}
+
+	return &file{f: f}, nil
+}
+
+func (f *file) send(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.f.Write(append(line, '\n'))
+	return err
+}
+
+func (f *file) close() {
+	f.f.Close()
+}
@@ -0,0 +1,335 @@
+package eventsinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/data"
+)
+
+// eventID identifies an etcd change the same way on every node, from the key and the value it changed to
+func eventID(key string, value any) string {
+	b, _ := json.Marshal(value)
+	return key + "\x00" + string(b)
+}
+
+// registerListeners expects the caller to hold sinksLock
+func registerListeners() error {
+	key, err := data.RegisterEventListener(data.UsersPrefix, true, userChanges)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.DevicesPrefix, true, deviceChanges)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.AclsPrefix, true, policyChanges)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.GroupsPrefix, true, groupChanges)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.GrantRequestsPrefix, true, accessRequests)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.GrantsPrefix, true, grantChanges)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.SecurityAlerts, true, securityAlerts)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.NodeErrors, true, nodeErrors)
+	if err != nil {
+		return fmt.Errorf("unable to register event sink listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	return nil
+}
+
+func userChanges(key string, current, previous data.UserModel, et data.EventType) error {
+	event := Event{
+		Username: current.Username,
+	}
+
+	switch et {
+	case data.CREATED:
+		event.Type = UserCreated
+		event.Message = fmt.Sprintf("user %s was created", current.Username)
+	case data.DELETED:
+		event.Type = UserDeleted
+		event.Message = fmt.Sprintf("user %s was deleted", current.Username)
+	case data.MODIFIED:
+		if current.Locked == previous.Locked {
+			return nil
+		}
+
+		event.Type = UserUnlocked
+		event.Message = fmt.Sprintf("user %s was unlocked", current.Username)
+		if current.Locked {
+			event.Type = UserLocked
+			event.Message = fmt.Sprintf("user %s was locked", current.Username)
+		}
+	}
+
+	publish(event, eventID(key, current))
+	return nil
+}
+
+func deviceChanges(key string, current, previous data.Device, et data.EventType) error {
+	details := map[string]any{
+		"name":      current.Name,
+		"interface": current.GetInterfaceName(),
+		"node":      current.AssociatedNode.String(),
+	}
+
+	if current.Endpoint != nil {
+		details["endpoint"] = current.Endpoint.String()
+	}
+
+	event := Event{
+		Username: current.Username,
+		Device:   current.Address,
+		Details:  details,
+	}
+
+	switch et {
+	case data.CREATED:
+		event.Type = DeviceCreated
+		event.Message = fmt.Sprintf("device %s was registered for %s", current.Address, current.Username)
+	case data.DELETED:
+		event.Type = DeviceDeleted
+		event.Message = fmt.Sprintf("device %s of %s was deleted", current.Address, current.Username)
+	case data.MODIFIED:
+		lockout, err := data.GetLockout()
+		if err != nil {
+			return fmt.Errorf("cannot get lockout: %s", err)
+		}
+
+		if current.Attempts > lockout && previous.Attempts <= lockout {
+			event.Type = DeviceLocked
+			event.Message = fmt.Sprintf("device %s of %s was locked after %d failed attempts", current.Address, current.Username, current.Attempts)
+			publish(event, eventID(key, current))
+		}
+
+		if current.Authorised.Equal(previous.Authorised) {
+			return nil
+		}
+
+		event.Type = DeviceDeauthorised
+		event.Message = fmt.Sprintf("device %s of %s is no longer authorised", current.Address, current.Username)
+		if !current.Authorised.IsZero() {
+			event.Type = DeviceAuthorised
+			event.Message = fmt.Sprintf("device %s of %s was authorised", current.Address, current.Username)
+		}
+	}
+
+	publish(event, eventID(key, current))
+	return nil
+}
+
+func policyChanges(key string, current, _ acls.Acl, et data.EventType) error {
+	effects := strings.TrimPrefix(key, data.AclsPrefix)
+
+	event := Event{
+		Type:    PolicyChanged,
+		Message: fmt.Sprintf("policy for %s was %s", effects, et),
+		Details: map[string]any{
+			"effects": effects,
+			"change":  et.String(),
+			"policy":  current,
+		},
+	}
+
+	publish(event, eventID(key+"\x00"+et.String(), current))
+	return nil
+}
+
+func groupChanges(key string, current, _ []string, et data.EventType) error {
+	group := strings.TrimPrefix(key, data.GroupsPrefix)
+
+	event := Event{
+		Type:    GroupChanged,
+		Message: fmt.Sprintf("group %s was %s", group, et),
+		Details: map[string]any{
+			"group":   group,
+			"change":  et.String(),
+			"members": current,
+		},
+	}
+
+	publish(event, eventID(key+"\x00"+et.String(), current))
+	return nil
+}
+
+func accessRequests(key string, current, _ data.Grant, et data.EventType) error {
+	if et != data.CREATED {
+		return nil
+	}
+
+	publish(Event{
+		Type:     AccessRequested,
+		Username: current.RequestedBy,
+		Message:  fmt.Sprintf("%s requested access for %s: %s", current.RequestedBy, current.Duration, current.Reason),
+		Details:  current,
+	}, eventID(key, current))
+	return nil
+}
+
+func grantChanges(key string, current, _ data.Grant, et data.EventType) error {
+	event := Event{
+		Details: current,
+	}
+
+	if !strings.HasPrefix(current.Effects, "group:") {
+		event.Username = current.Effects
+	}
+
+	switch et {
+	case data.CREATED:
+		event.Type = AccessGranted
+		event.Message = fmt.Sprintf("%s was granted access by %s until %s: %s", current.Effects, current.ApprovedBy, current.Expires.Format(time.RFC3339), current.Reason)
+	case data.DELETED:
+		event.Type = AccessEnded
+		event.Message = fmt.Sprintf("temporary access for %s ended", current.Effects)
+	default:
+		return nil
+	}
+
+	publish(event, eventID(key+"\x00"+et.String(), current))
+	return nil
+}
+
+func securityAlerts(key string, current, _ data.SecurityAlert, et data.EventType) error {
+	if et != data.CREATED {
+		return nil
+	}
+
+	publish(Event{
+		Type:     SecurityAlert,
+		Username: current.Username,
+		Device:   current.Address,
+		Message:  fmt.Sprintf("device %s of %s was deauthenticated: %s", current.Address, current.Username, current.Reason),
+		Details: map[string]any{
+			"reason": current.Reason,
+			"node":   current.NodeID,
+		},
+	}, eventID(key, current))
+	return nil
+}
+
+func nodeErrors(key string, current, _ data.EventError, et data.EventType) error {
+	if et != data.CREATED {
+		return nil
+	}
+
+	publish(Event{
+		Type:    NodeError,
+		Message: fmt.Sprintf("node %s failed to apply a change: %s", current.NodeID, current.Error),
+		Details: current,
+	}, eventID(key, current))
+	return nil
+}
+
+// monitorNodes sends an event when a cluster member stops pinging, and when it comes back.
+// Every node checks, the last ping of the stopped node makes them agree on the event
+func monitorNodes(stop <-chan bool) {
+	var (
+		serving  = map[string]bool{}
+		lastPing = map[string]time.Time{}
+	)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !data.HasLeader() {
+			continue
+		}
+
+		for _, member := range data.GetMembers() {
+			id := member.ID.String()
+			if member.IsLearner {
+				continue
+			}
+
+			witness, err := data.IsWitness(id)
+			if err != nil || witness {
+				continue
+			}
+
+			drained, err := data.IsDrained(id)
+			if err != nil || drained {
+				delete(serving, id)
+				continue
+			}
+
+			up, err := data.IsServing(id)
+			if err != nil {
+				log.Printf("unable to determine if node %s is serving: %s", id, err)
+				continue
+			}
+
+			wasUp, seen := serving[id]
+			serving[id] = up
+
+			if !seen || up == wasUp {
+				continue
+			}
+
+			details := map[string]any{
+				"node": id,
+				"name": member.Name,
+			}
+
+			if !up {
+				ping, _ := data.GetLastPing(id)
+				lastPing[id] = ping
+				details["last_ping"] = ping
+
+				publish(Event{
+					Type:    NodeDown,
+					Message: fmt.Sprintf("node %s (%s) has not pinged since %s", member.Name, id, ping.Format(time.RFC3339)),
+					Details: details,
+				}, id+"\x00"+ping.String())
+				continue
+			}
+
+			publish(Event{
+				Type:    NodeUp,
+				Message: fmt.Sprintf("node %s (%s) is serving again", member.Name, id),
+				Details: details,
+			}, id+"\x00"+lastPing[id].String())
+			delete(lastPing, id)
+		}
+	}
+}
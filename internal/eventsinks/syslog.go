@@ -0,0 +1,154 @@
+package eventsinks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+const (
+	syslogTimeout = 10 * time.Second
+
+	// RFC5424 allows at most 6 digits of fractional seconds
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+	severityWarning = 4
+	severityNotice  = 5
+)
+
+// syslog sends RFC5424 messages with the event type as the MSGID and the event as json as the MSG.
+// Over tcp and tls messages are framed with their length (RFC5425/RFC6587 octet counting)
+type syslog struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	facility int
+
+	hostname string
+	pid      string
+
+	conn net.Conn
+}
+
+func newSyslog(c config.EventSink) (*syslog, error) {
+	s := &syslog{
+		network:  c.Protocol,
+		address:  c.Address,
+		facility: *c.Facility,
+		hostname: "-",
+		pid:      strconv.Itoa(os.Getpid()),
+	}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		s.hostname = hostname
+	}
+
+	if c.Protocol == "tls" {
+		s.network = "tcp"
+
+		host, _, _ := net.SplitHostPort(c.Address)
+		s.tls = &tls.Config{
+			ServerName: host,
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if c.CACertPath != "" {
+			ca, err := os.ReadFile(c.CACertPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not read ca certificate: %s", err)
+			}
+
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("ca certificate file contained no certificates")
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func severity(eventType string) int {
+	switch eventType {
+	case UserLocked, DeviceLocked, SecurityAlert, NodeDown, NodeError:
+		return severityWarning
+	}
+
+	return severityNotice
+}
+
+func (s *syslog) format(event Event) ([]byte, error) {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("<%d>1 %s %s wag %s %s - ",
+		s.facility*8+severity(event.Type),
+		event.Time.Format(syslogTimeFormat),
+		s.hostname,
+		s.pid,
+		event.Type,
+	)
+
+	message := append([]byte(header), msg...)
+	if s.network == "udp" {
+		return message, nil
+	}
+
+	return append([]byte(strconv.Itoa(len(message))+" "), message...), nil
+}
+
+func (s *syslog) connect() (err error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+
+	if s.tls != nil {
+		s.conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tls)
+	} else {
+		s.conn, err = dialer.Dial(s.network, s.address)
+	}
+
+	return err
+}
+
+// send writes the message, reconnecting once if the connection has been lost since the last event
+func (s *syslog) send(_ context.Context, event Event) error {
+	message, err := s.format(event)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				return fmt.Errorf("could not connect to %s: %s", s.address, err)
+			}
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = s.conn.Write(message); err == nil {
+			return nil
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+func (s *syslog) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,117 @@
+package eventsinks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func testSyslog(t *testing.T, protocol, address string) *syslog {
+	facility := 10
+	s, err := newSyslog(config.EventSink{Protocol: protocol, Address: address, Facility: &facility})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.hostname = "node1"
+	s.pid = "42"
+	return s
+}
+
+func TestSyslogFormat(t *testing.T) {
+	event := Event{ID: "abc", Type: UserLocked, Time: time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC), Username: "tester"}
+
+	message, err := testSyslog(t, "udp", "").format(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// authpriv (10) * 8 + warning (4)
+	header := "<84>1 2024-01-02T03:04:05.123456Z node1 wag 42 user.locked - "
+	if !strings.HasPrefix(string(message), header) {
+		t.Fatalf("message %q did not start with %q", message, header)
+	}
+
+	var got Event
+	if err := json.Unmarshal(message[len(header):], &got); err != nil || got.ID != event.ID || got.Username != event.Username {
+		t.Fatal("message was not the event: ", string(message))
+	}
+
+	notice, err := testSyslog(t, "udp", "").format(Event{Type: UserCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(notice), "<85>1 ") {
+		t.Fatal("event was not sent as a notice: ", string(notice))
+	}
+
+	// Stream transports prefix each message with its length
+	for _, protocol := range []string{"tcp", "tls"} {
+		framed, err := testSyslog(t, protocol, "localhost:6514").format(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := strconv.Itoa(len(message)) + " " + string(message)
+		if string(framed) != expected {
+			t.Errorf("%s message %q expected %q", protocol, framed, expected)
+		}
+	}
+}
+
+func TestSyslogSendTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s := testSyslog(t, "tcp", listener.Addr().String())
+	defer s.close()
+
+	events := []Event{{ID: "1", Type: NodeUp}, {ID: "2", Type: NodeDown}}
+	for _, event := range events {
+		if err := s.send(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Read each frame back using only the length prefix, so messages run together on the stream are still split correctly
+	reader := bufio.NewReader(conn)
+	for _, event := range events {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatal("frame did not start with a length: ", length)
+		}
+
+		message := make([]byte, n)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(message), " "+event.Type+" - ") || !strings.HasSuffix(string(message), "}") {
+			t.Fatalf("frame %q was not the %s event", message, event.Type)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package eventsinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// webhook POSTs each event as json. The X-Wag-Signature header is the hex HMAC-SHA256 of "<X-Wag-Timestamp>.<body>" using the shared secret,
+// so the receiver can check the event came from wag and is recent
+type webhook struct {
+	url         string
+	secret      []byte
+	maxAttempts int
+
+	client *http.Client
+}
+
+func newWebhook(c config.EventSink) *webhook {
+	return &webhook{
+		url:         c.URL,
+		secret:      []byte(c.Secret),
+		maxAttempts: c.MaxAttempts,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+		},
+	}
+}
+
+func (w *webhook) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post returns whether a failed request is worth trying again
+func (w *webhook) post(ctx context.Context, event Event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wag/"+config.Version)
+	req.Header.Set("X-Wag-Event", event.Type)
+	req.Header.Set("X-Wag-Event-Id", event.ID)
+	req.Header.Set("X-Wag-Timestamp", timestamp)
+	req.Header.Set("X-Wag-Signature", w.sign(timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Anything else means the receiver does not want the event, sending it again will not change that
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
+
+// send tries to deliver the event until it succeeds or runs out of attempts, doubling the wait between each attempt
+func (w *webhook) send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, event, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= w.maxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %s", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped after %d attempts: %s", attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+}
+
+func (w *webhook) close() {
+	w.client.CloseIdleConnections()
+}
@@ -0,0 +1,119 @@
+package eventsinks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func TestWebhookSign(t *testing.T) {
+	w := newWebhook(config.EventSink{Secret: "secret"})
+
+	// HMAC-SHA256 of "1700000000.{"id":"1"}" with the key "secret"
+	expected := "sha256=086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"
+	if got := w.sign("1700000000", []byte(`{"id":"1"}`)); got != expected {
+		t.Fatalf("signature %q expected %q", got, expected)
+	}
+
+	if w.sign("1700000001", []byte(`{"id":"1"}`)) == expected {
+		t.Fatal("signature did not cover the timestamp")
+	}
+
+	if newWebhook(config.EventSink{Secret: "other"}).sign("1700000000", []byte(`{"id":"1"}`)) == expected {
+		t.Fatal("signature did not depend on the secret")
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	w := newWebhook(config.EventSink{Secret: "secret", MaxAttempts: 1})
+	defer w.close()
+
+	event := Event{ID: "abc", Type: UserLocked, Message: "locked", Username: "tester"}
+
+	var received atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Header.Get("X-Wag-Signature") != w.sign(r.Header.Get("X-Wag-Timestamp"), body) {
+			t.Error("request signature did not match its body and timestamp")
+		}
+
+		if r.Header.Get("X-Wag-Event") != UserLocked || r.Header.Get("X-Wag-Event-Id") != "abc" {
+			t.Error("event headers were wrong: ", r.Header)
+		}
+
+		var got Event
+		if err := json.Unmarshal(body, &got); err != nil || got.ID != event.ID || got.Username != event.Username {
+			t.Error("body was not the event: ", string(body))
+		}
+
+		received.Store(true)
+	}))
+	defer server.Close()
+
+	w.url = server.URL
+	if err := w.send(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	if !received.Load() {
+		t.Fatal("webhook was not sent")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int32
+	}{
+		// The receiver rejected the event, sending it again will not help
+		{http.StatusBadRequest, 1},
+		{http.StatusServiceUnavailable, 2},
+		{http.StatusTooManyRequests, 2},
+	}
+
+	for _, test := range tests {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			rw.WriteHeader(test.status)
+		}))
+
+		w := newWebhook(config.EventSink{URL: server.URL, MaxAttempts: 2})
+		err := w.send(context.Background(), Event{ID: "abc", Type: NodeUp})
+		w.close()
+		server.Close()
+
+		if err == nil || !strings.Contains(err.Error(), "giving up") {
+			t.Errorf("status %d: expected delivery to fail, got %v", test.status, err)
+		}
+
+		if attempts.Load() != test.attempts {
+			t.Errorf("status %d: made %d attempts expected %d", test.status, attempts.Load(), test.attempts)
+		}
+	}
+}
+
+func TestWebhookStopsWhenCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := newWebhook(config.EventSink{URL: server.URL, MaxAttempts: 5})
+	defer w.close()
+
+	if err := w.send(ctx, Event{ID: "abc", Type: NodeUp}); err == nil {
+		t.Fatal("cancelled delivery succeeded")
+	}
+}
@@ -0,0 +1,121 @@
+// Package geoip resolves the country and approximate location of addresses from a local MaxMind format database
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var ErrNoDatabase = errors.New("no geoip database is loaded")
+
+var (
+	lck sync.RWMutex
+	db  *maxminddb.Reader
+)
+
+// Location of an address, country databases do not have coordinates
+type Location struct {
+	Country        string
+	Latitude       float64
+	Longitude      float64
+	HasCoordinates bool
+}
+
+// Load opens the database at path, replacing any previously loaded database
+func Load(path string) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open geoip database %q: %s", path, err)
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	if db != nil {
+		db.Close()
+	}
+	db = reader
+
+	return nil
+}
+
+func Close() {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+}
+
+func Loaded() bool {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return db != nil
+}
+
+// Lookup returns the location of ip, the country is empty if the database has no entry for it
+func Lookup(ip net.IP) (Location, error) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	if db == nil {
+		return Location{}, ErrNoDatabase
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+		Location struct {
+			Latitude  *float64 `maxminddb:"latitude"`
+			Longitude *float64 `maxminddb:"longitude"`
+		} `maxminddb:"location"`
+	}
+
+	if err := db.Lookup(ip, &record); err != nil {
+		return Location{}, fmt.Errorf("unable to look up %s: %s", ip, err)
+	}
+
+	l := Location{
+		Country: record.Country.ISOCode,
+	}
+
+	if l.Country == "" {
+		l.Country = record.RegisteredCountry.ISOCode
+	}
+
+	if record.Location.Latitude != nil && record.Location.Longitude != nil {
+		l.Latitude, l.Longitude = *record.Location.Latitude, *record.Location.Longitude
+		l.HasCoordinates = true
+	}
+
+	return l, nil
+}
+
+// DistanceKm returns the great circle distance between two locations
+func DistanceKm(a, b Location) float64 {
+	const earthRadiusKm = 6371
+
+	toRadians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+
+	dLat := toRadians(b.Latitude - a.Latitude)
+	dLon := toRadians(b.Longitude - a.Longitude)
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(a.Latitude))*math.Cos(toRadians(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,54 @@
+package geoip
+
+import (
+	"errors"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestDistanceKm(t *testing.T) {
+	london := Location{Latitude: 51.5074, Longitude: -0.1278}
+	paris := Location{Latitude: 48.8566, Longitude: 2.3522}
+	sydney := Location{Latitude: -33.8688, Longitude: 151.2093}
+
+	tests := []struct {
+		name     string
+		a, b     Location
+		expected float64
+	}{
+		{"same place", london, london, 0},
+		{"london to paris", london, paris, 344},
+		{"london to sydney", london, sydney, 16994},
+		// Half way around the equator is the longest possible distance
+		{"antipodes", Location{}, Location{Longitude: 180}, math.Pi * 6371},
+		{"across the date line", Location{Longitude: 179.5}, Location{Longitude: -179.5}, 111},
+	}
+
+	for _, test := range tests {
+		distance := DistanceKm(test.a, test.b)
+		if math.Abs(distance-test.expected) > 1 {
+			t.Errorf("%s: expected %.0fkm got %.0fkm", test.name, test.expected, distance)
+		}
+
+		if math.Abs(distance-DistanceKm(test.b, test.a)) > 1e-9 {
+			t.Errorf("%s: distance depends on direction", test.name)
+		}
+	}
+}
+
+func TestLookupWithoutDatabase(t *testing.T) {
+	Close()
+
+	if Loaded() {
+		t.Fatal("database reported loaded after close")
+	}
+
+	if _, err := Lookup(net.ParseIP("1.1.1.1")); !errors.Is(err, ErrNoDatabase) {
+		t.Fatal("lookup without a database did not return ErrNoDatabase: ", err)
+	}
+
+	if err := Load("/does/not/exist.mmdb"); err == nil || Loaded() {
+		t.Fatal("loading a missing database did not fail")
+	}
+}
@@ -0,0 +1,254 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/utils"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// Templates are plain text, the first line must be "Subject: <subject>" followed by a blank line and then the body
+const (
+	DeviceTemplate       = "device_registered.txt"
+	LockoutTemplate      = "lockout.txt"
+	RegistrationTemplate = "registration_token.txt"
+	DigestTemplate       = "admin_digest.txt"
+)
+
+//go:embed templates/*
+var embeddedTemplates embed.FS
+
+type DeviceData struct {
+	Username string
+	Address  string
+	Name     string
+	Endpoint string
+	Time     time.Time
+	HelpMail string
+}
+
+type LockoutData struct {
+	Username string
+	// Empty if the whole account was locked
+	Device   string
+	HelpMail string
+}
+
+type RegistrationData struct {
+	Username string
+	Link     string
+	Uses     int
+	HelpMail string
+}
+
+type DigestData struct {
+	Notifications []DigestEntry
+	// The management UI, if ManagementUI.ExternalURL is set
+	URL string
+}
+
+type DigestEntry struct {
+	Heading string
+	Message []string
+	Time    time.Time
+	URL     string
+}
+
+// AddressFor returns where to mail a user, their recorded address, their username if it is an address, or their username at Email.UserDomain
+func AddressFor(username string) string {
+	user, err := data.GetUserData(username)
+	if err == nil && user.Email != "" {
+		return user.Email
+	}
+
+	if _, err := mail.ParseAddress(username); err == nil {
+		return username
+	}
+
+	if config.Values.Email.UserDomain != "" {
+		return username + "@" + config.Values.Email.UserDomain
+	}
+
+	return ""
+}
+
+func render(name string, values any) (subject, body string, err error) {
+	var t *template.Template
+
+	custom := filepath.Join(config.Values.Email.TemplatesDirectory, name)
+	if _, statErr := os.Stat(custom); config.Values.Email.TemplatesDirectory != "" && statErr == nil {
+		t, err = template.New(name).ParseFiles(custom)
+	} else {
+		t, err = template.New(name).ParseFS(embeddedTemplates, "templates/"+name)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse email template %s: %s", name, err)
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, values); err != nil {
+		return "", "", fmt.Errorf("could not render email template %s: %s", name, err)
+	}
+
+	header, body, _ := strings.Cut(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n\n")
+	subject, ok := strings.CutPrefix(header, "Subject:")
+	if !ok {
+		return "", "", fmt.Errorf("email template %s must start with a Subject: line followed by a blank line", name)
+	}
+
+	// Values in the subject must not be able to add headers
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	return subject, body, nil
+}
+
+func message(to []string, subject, body string) ([]byte, error) {
+	from, _ := mail.ParseAddress(config.Values.Email.From)
+
+	id, err := utils.GenerateRandomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := "wag"
+	if _, d, ok := strings.Cut(from.Address, "@"); ok {
+		domain = d
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", id, domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+func deliver(to []string, msg []byte) error {
+	settings := config.Values.Email
+
+	host, _, _ := net.SplitHostPort(settings.SMTPServer)
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if settings.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", settings.SMTPServer, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", settings.SMTPServer)
+	}
+	if err != nil {
+		return fmt.Errorf("could not connect to smtp server: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp server did not greet us: %s", err)
+	}
+	defer client.Close()
+
+	if settings.Security == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("could not start tls: %s", err)
+		}
+	}
+
+	// PlainAuth refuses to send credentials without tls, other than to localhost
+	if settings.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", settings.Username, settings.Password, host)); err != nil {
+			return fmt.Errorf("could not authenticate: %s", err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(settings.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("recipient %s refused: %s", recipient, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Send renders the template and mails it to every address in to, it does nothing if email is not configured
+func Send(to []string, templateName string, values any) error {
+	if !config.Values.Email.Enabled() || len(to) == 0 {
+		return nil
+	}
+
+	var recipients []string
+	for _, address := range to {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %s", address, err)
+		}
+		recipients = append(recipients, parsed.Address)
+	}
+
+	subject, body, err := render(templateName, values)
+	if err != nil {
+		return err
+	}
+
+	msg, err := message(recipients, subject, body)
+	if err != nil {
+		return err
+	}
+
+	return deliver(recipients, msg)
+}
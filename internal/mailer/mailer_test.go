@@ -0,0 +1,277 @@
+package mailer
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+func TestMain(m *testing.M) {
+	if err := config.Load("../config/testing_config.json"); err != nil {
+		log.Println("failed to load config: ", err)
+		os.Exit(1)
+	}
+
+	dir, err := os.MkdirTemp("", "wag-mailer-test")
+	if err != nil {
+		log.Println("failed to create test directory: ", err)
+		os.Exit(1)
+	}
+
+	config.Values.Clustering.DatabaseLocation = dir
+	config.Values.Clustering.TLSManagerStorage = filepath.Join(dir, "certificates")
+	// Packages are tested in parallel, so each needs its own ports for etcd and the tls manager
+	config.Values.Clustering.TLSManagerListenURL = "https://localhost:0"
+	config.Values.Clustering.ListenAddresses = []string{"https://localhost:0"}
+
+	err = data.Load(config.Values.DatabaseLocation, "", true)
+	if err != nil {
+		log.Println(err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+
+	data.TearDown()
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer accepts one connection and records the mail it is sent, it speaks just enough smtp for net/smtp
+func smtpServer(t *testing.T) (address string, result chan received) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result = make(chan received, 1)
+
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var got received
+		reader := bufio.NewReader(conn)
+		reply := func(line string) {
+			io.WriteString(conn, line+"\r\n")
+		}
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+
+			command, argument, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(command) {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				got.from = argument
+				reply("250 OK")
+			case "RCPT":
+				got.to = append(got.to, argument)
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+
+				var b strings.Builder
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					if dataLine == ".\r\n" {
+						break
+					}
+					b.WriteString(strings.TrimPrefix(dataLine, "."))
+				}
+				got.data = b.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				result <- got
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), result
+}
+
+func useEmail(t *testing.T, email config.Email) {
+	previous := config.Values.Email
+	config.Values.Email = email
+	t.Cleanup(func() {
+		config.Values.Email = previous
+	})
+}
+
+func readMail(t *testing.T, raw string) (*mail.Message, string) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal("could not parse mail: ", err)
+	}
+
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal("could not decode mail body: ", err)
+	}
+
+	return msg, string(body)
+}
+
+func TestSend(t *testing.T) {
+	address, result := smtpServer(t)
+	useEmail(t, config.Email{SMTPServer: address, Security: "none", From: "Wag <wag@example.com>"})
+
+	err := Send([]string{"Tester <tester@example.com>"}, LockoutTemplate, LockoutData{Username: "tester", HelpMail: "help@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := <-result
+	if sent.from != "FROM:<wag@example.com>" || len(sent.to) != 1 || sent.to[0] != "TO:<tester@example.com>" {
+		t.Fatalf("mail was sent from %q to %q", sent.from, sent.to)
+	}
+
+	msg, body := readMail(t, sent.data)
+	if msg.Header.Get("Subject") != "Your account has been locked" {
+		t.Fatal("wrong subject: ", msg.Header.Get("Subject"))
+	}
+
+	if !strings.HasPrefix(body, "Hello tester,") || !strings.Contains(body, "help@example.com") {
+		t.Fatal("wrong body: ", body)
+	}
+}
+
+func TestSendDisabled(t *testing.T) {
+	useEmail(t, config.Email{})
+
+	if err := Send([]string{"tester@example.com"}, LockoutTemplate, LockoutData{Username: "tester"}); err != nil {
+		t.Fatal("sending with email disabled failed: ", err)
+	}
+}
+
+func TestSubjectHeaderInjection(t *testing.T) {
+	address, result := smtpServer(t)
+	useEmail(t, config.Email{SMTPServer: address, Security: "none", From: "wag@example.com"})
+
+	// Device names are chosen by users
+	err := Send([]string{"tester@example.com"}, LockoutTemplate, LockoutData{Username: "tester", Device: "laptop\r\nBcc: attacker@example.com\r\nX-Injected: yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := <-result
+	if len(sent.to) != 1 {
+		t.Fatal("injected recipient was sent the mail: ", sent.to)
+	}
+
+	msg, _ := readMail(t, sent.data)
+	if _, ok := msg.Header["Bcc"]; ok {
+		t.Fatal("subject added a Bcc header")
+	}
+
+	if _, ok := msg.Header["X-Injected"]; ok {
+		t.Fatal("subject added a header")
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Your device laptop Bcc: attacker@example.com X-Injected: yes has been locked"
+	if subject != expected {
+		t.Fatalf("subject %q expected %q", subject, expected)
+	}
+}
+
+func TestRenderTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	custom := "Subject: Locked out {{.Username}}\n\nCustom body for {{.Username}}\n"
+	if err := os.WriteFile(filepath.Join(dir, LockoutTemplate), []byte(custom), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	useEmail(t, config.Email{TemplatesDirectory: dir})
+
+	subject, body, err := render(LockoutTemplate, LockoutData{Username: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject != "Locked out tester" || body != "Custom body for tester\n" {
+		t.Fatalf("custom template was not used: %q %q", subject, body)
+	}
+
+	// Templates missing from the directory fall back to the built in ones
+	subject, _, err = render(RegistrationTemplate, RegistrationData{Username: "tester", Link: "https://example.com", Uses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject == "" || strings.Contains(subject, "{{") {
+		t.Fatal("built in template was not used: ", subject)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, DeviceTemplate), []byte("No subject line\n\nbody"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := render(DeviceTemplate, DeviceData{}); err == nil {
+		t.Fatal("template without a subject was accepted")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	device := data.Device{Address: "192.168.1.2", Username: "tester", Attempts: 6}
+
+	if !claim("devices-tester-192.168.1.2", device) {
+		t.Fatal("first claim of an email failed")
+	}
+
+	// Another node seeing the same change must not send it again
+	if claim("devices-tester-192.168.1.2", device) {
+		t.Fatal("email was claimed twice")
+	}
+
+	device.Attempts = 7
+	if !claim("devices-tester-192.168.1.2", device) {
+		t.Fatal("a different change to the same key was treated as a duplicate")
+	}
+
+	if !claim("devices-tester-192.168.1.3", device) {
+		t.Fatal("the same change to a different key was treated as a duplicate")
+	}
+}
@@ -0,0 +1,214 @@
+package mailer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+var (
+	listenersLock sync.Mutex
+	listeners     []string
+)
+
+// Start mails users when devices are registered to them, they are locked out or they are sent a registration token.
+// Every node watches for these changes, only the node that claims the change sends the email
+func Start() error {
+	if !config.Values.Email.Enabled() {
+		return nil
+	}
+
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
+	key, err := data.RegisterEventListener(data.RegistrationPrefix, true, registrationChanges)
+	if err != nil {
+		return fmt.Errorf("unable to register email listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.DevicesPrefix, true, deviceChanges)
+	if err != nil {
+		stop()
+		return fmt.Errorf("unable to register email listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	key, err = data.RegisterEventListener(data.UsersPrefix, true, userChanges)
+	if err != nil {
+		stop()
+		return fmt.Errorf("unable to register email listener: %s", err)
+	}
+	listeners = append(listeners, key)
+
+	log.Println("Started email notifications via", config.Values.Email.SMTPServer)
+
+	return nil
+}
+
+func Teardown() {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
+	if len(listeners) == 0 {
+		return
+	}
+
+	stop()
+
+	log.Println("Stopped email notifications")
+}
+
+// stop expects the caller to hold listenersLock
+func stop() {
+	for _, key := range listeners {
+		if err := data.DeregisterEventListener(key); err != nil {
+			log.Println("unable to deregister email listener: ", err)
+		}
+	}
+	listeners = nil
+}
+
+// claim returns whether this node should send the email for the etcd change, so that each email is only sent once by the cluster
+func claim(key string, value any) bool {
+	b, _ := json.Marshal(value)
+	hash := sha256.Sum256([]byte("email\x00" + key + "\x00" + string(b)))
+
+	claimed, err := data.ClaimEvent(hex.EncodeToString(hash[:]))
+	if err != nil {
+		log.Println("unable to claim email: ", err)
+		return false
+	}
+
+	return claimed
+}
+
+func notify(notification, username, templateName string, values any) {
+	address := AddressFor(username)
+	if address == "" {
+		log.Printf("not sending %s email to %s, they have no email address", notification, username)
+		return
+	}
+
+	if err := Send([]string{address}, templateName, values); err != nil {
+		log.Printf("unable to send %s email to %s (%s): %s", notification, username, address, err)
+	}
+}
+
+func registrationChanges(key string, current, _ control.RegistrationResult, et data.EventType) error {
+	if et != data.CREATED || !config.Values.Email.Notifies("registration") {
+		return nil
+	}
+
+	// Tokens without an address are handed out by the admin some other way
+	if current.Email == "" || !claim(key, current) {
+		return nil
+	}
+
+	link, err := data.RegistrationLink(current.Token)
+	if err != nil {
+		return fmt.Errorf("unable to create registration link for %s: %s", current.Username, err)
+	}
+
+	if err := Send([]string{current.Email}, RegistrationTemplate, RegistrationData{
+		Username: current.Username,
+		Link:     link,
+		Uses:     current.NumUses,
+		HelpMail: data.GetHelpMail(),
+	}); err != nil {
+		log.Printf("unable to send registration email to %s (%s): %s", current.Username, current.Email, err)
+	}
+
+	return nil
+}
+
+func deviceChanges(key string, current, previous data.Device, et data.EventType) error {
+	switch et {
+	case data.CREATED:
+	case data.MODIFIED:
+		if current.Publickey != previous.Publickey {
+			break
+		}
+
+		lockout, err := data.GetLockout()
+		if err != nil {
+			return fmt.Errorf("cannot get lockout: %s", err)
+		}
+
+		if current.Attempts <= lockout || previous.Attempts > lockout {
+			return nil
+		}
+
+		if !config.Values.Email.Notifies("lockout") || !claim(key, current) {
+			return nil
+		}
+
+		notify("lockout", current.Username, LockoutTemplate, LockoutData{
+			Username: current.Username,
+			Device:   deviceName(current),
+			HelpMail: data.GetHelpMail(),
+		})
+
+		return nil
+	default:
+		return nil
+	}
+
+	// Created, or re-registered over an existing device with a new key
+	if !config.Values.Email.Notifies("device") || !claim(key, current) {
+		return nil
+	}
+
+	values := DeviceData{
+		Username: current.Username,
+		Address:  current.Address,
+		Name:     current.Name,
+		Time:     current.Created,
+		HelpMail: data.GetHelpMail(),
+	}
+
+	if values.Time.IsZero() {
+		values.Time = time.Now()
+	}
+
+	if current.Endpoint != nil {
+		values.Endpoint = current.Endpoint.IP.String()
+	}
+
+	notify("device", current.Username, DeviceTemplate, values)
+
+	return nil
+}
+
+func userChanges(key string, current, previous data.UserModel, et data.EventType) error {
+	if et != data.MODIFIED || !current.Locked || previous.Locked {
+		return nil
+	}
+
+	if !config.Values.Email.Notifies("lockout") || !claim(key, current) {
+		return nil
+	}
+
+	notify("lockout", current.Username, LockoutTemplate, LockoutData{
+		Username: current.Username,
+		HelpMail: data.GetHelpMail(),
+	})
+
+	return nil
+}
+
+func deviceName(device data.Device) string {
+	if device.Name != "" {
+		return fmt.Sprintf("%s (%s)", device.Name, device.Address)
+	}
+
+	return device.Address
+}
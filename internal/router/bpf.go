@@ -9,6 +9,7 @@ import (
 	"log"
 	"math"
 	"net"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -33,8 +34,8 @@ const (
 
 var (
 
-	//Keep reference to xdpLink, otherwise it may be garbage collected
-	xdpLink       link.Link
+	//Keep reference to xdpLinks, otherwise they may be garbage collected
+	xdpLinks      []link.Link
 	xdpObjects    bpfObjects
 	routesMapSpec *ebpf.MapSpec = &ebpf.MapSpec{
 		Name: "routes_map",
@@ -44,8 +45,8 @@ var (
 		// 4 byte, ipv4 addr;
 		KeySize: 8,
 
-		//policies array
-		ValueSize: 8 * 128,
+		//policies array, the first block of policies for the route
+		ValueSize: 8 * routetypes.MAX_POLICIES,
 
 		// This flag is required for dynamically sized inner maps.
 		// Added in linux 5.10.
@@ -88,6 +89,7 @@ func loadXDP() error {
 	}
 
 	spec.Maps["policies_table"].InnerMap = routesMapSpec
+
 	// Load pre-compiled programs into the kernel.
 	if err = spec.LoadAndAssign(&xdpObjects, nil); err != nil {
 
@@ -125,15 +127,29 @@ func loadXDP() error {
 }
 
 func attachXDP() error {
-	iface, err := net.InterfaceByName(config.Values.Wireguard.DevName)
+	// The same program and maps are shared by all wireguard interfaces, as device addresses cannot overlap
+	for _, wgInterface := range config.AllInterfaces() {
+		l, err := attachXDPToInterface(wgInterface.DevName)
+		if err != nil {
+			return err
+		}
+
+		xdpLinks = append(xdpLinks, l)
+	}
+
+	return nil
+}
+
+func attachXDPToInterface(devName string) (link.Link, error) {
+	iface, err := net.InterfaceByName(devName)
 	if err != nil {
-		return fmt.Errorf("lookup network iface %q: %s", config.Values.Wireguard.DevName, err)
+		return nil, fmt.Errorf("lookup network iface %q: %s", devName, err)
 	}
 
 	//Try multiple times to attach program if the link is temporarily busy (work around for link.Close requiring a sleep)
 	for i := 0; i < 5; i++ {
 		// Attach the program.
-		xdpLink, err = link.AttachXDP(link.XDPOptions{
+		xdpLink, err := link.AttachXDP(link.XDPOptions{
 			Program:   xdpObjects.bpfPrograms.XdpWagFirewall,
 			Interface: iface.Index,
 		})
@@ -143,13 +159,13 @@ func attachXDP() error {
 				time.Sleep(100 * time.Millisecond)
 				continue
 			}
-			return fmt.Errorf("could not attach XDP program: %s", err)
+			return nil, fmt.Errorf("could not attach XDP program: %s", err)
 		}
 
-		return nil
+		return xdpLink, nil
 	}
 
-	return nil
+	return nil, fmt.Errorf("could not attach XDP program to %s: device busy", devName)
 }
 
 func setupXDP(users []data.UserModel, knownDevices []data.Device) error {
@@ -172,6 +188,13 @@ func setupXDP(users []data.UserModel, knownDevices []data.Device) error {
 		if err != nil {
 			return errors.New("xdp setup add device to user: " + err.Error())
 		}
+
+		if isScoped(device) {
+			err := setDeviceTags(device)
+			if err != nil {
+				return errors.New("xdp setup set device tags: " + err.Error())
+			}
+		}
 	}
 
 	return nil
@@ -227,7 +250,7 @@ func isAuthed(address string) bool {
 		return false
 	}
 
-	inactivityTimeoutMinutes, err := data.GetSessionInactivityTimeoutMinutes()
+	inactivityTimeout, err := deviceInactivityTimeout(ip)
 	if err != nil {
 		return false
 	}
@@ -236,7 +259,7 @@ func isAuthed(address string) bool {
 
 	sessionValid := (deviceStruct.sessionExpiry > currentTime || deviceStruct.sessionExpiry == math.MaxUint64)
 
-	sessionActive := ((currentTime-deviceStruct.lastPacketTime) < uint64(inactivityTimeoutMinutes)*60000000000 || inactivityTimeoutMinutes < 0)
+	sessionActive := ((currentTime-deviceStruct.lastPacketTime) < inactivityTimeout || inactivityTimeout == math.MaxUint64)
 
 	return isAccountLocked == 0 && sessionValid && sessionActive
 }
@@ -258,6 +281,10 @@ func xdpRemoveDevice(address string) error {
 		finalError = errors.New(finalError.Error() + "removing from devices table failed: " + deviceTableErr.Error() + " ")
 	}
 
+	if err := removeInactivityOverride(address); err != nil {
+		finalError = errors.New(finalError.Error() + "removing inactivity timeout failed: " + err.Error() + " ")
+	}
+
 	if finalError.Error() == msg {
 		finalError = nil
 	}
@@ -289,7 +316,21 @@ func xdpAddDevice(username, address string, associatedNode uint64) error {
 		return err
 	}
 
-	return xdpObjects.Devices.Put(ip.To4(), deviceStruct.Bytes())
+	err = xdpObjects.Devices.Put(ip.To4(), deviceStruct.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = setInactivityOverride(username, address)
+	if err != nil {
+		// Leave the device out entirely so adding it can be retried, rather than running it with the wrong timeout
+		if deleteErr := xdpObjects.Devices.Delete(ip.To4()); deleteErr != nil {
+			return errors.Join(err, deleteErr)
+		}
+		return err
+	}
+
+	return nil
 }
 
 func SetLockAccount(username string, locked uint32) error {
@@ -310,25 +351,16 @@ func SetLockAccount(username string, locked uint32) error {
 		return err
 	}
 
-	return nil
+	return setTaggedLock(username, locked)
 }
 
 // Takes the LPM table and associates a route to a policy
 func xdpAddRoute(usersRouteTable *ebpf.Map, userAcls acls.Acl) error {
 
-	rules, errs := routetypes.ParseRules(userAcls.Mfa, userAcls.Allow, userAcls.Deny)
-	if len(errs) != 0 {
-		log.Println("Parsing rules for user had errors: ", errs)
-	}
-
-	for _, rule := range rules {
-		for i := range rule.Keys {
-
-			err := usersRouteTable.Put(&rule.Keys[i], &rule.Values)
-			if err != nil {
-				return fmt.Errorf("error putting route key in inner map: %s", err)
-			}
-
+	for key, policies := range desiredPolicies(userAcls) {
+		err := putPolicies(usersRouteTable, key, policies, nil)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -391,46 +423,65 @@ func setSingleUserMap(userid [20]byte, acls acls.Acl) error {
 		userPolicyMaps[userid] = policiesInnerTable
 	}
 
-	mapRef := userPolicyMaps[userid]
-	if err := clearPolicyMap(mapRef); err != nil {
-		return err
-	}
+	return patchPolicyMap(userPolicyMaps[userid], acls)
+}
 
-	if err := xdpAddRoute(mapRef, acls); err != nil {
-		return err
-	}
+// patchPolicyMap diffs the routes currently in an existing policy map against userAcls, and only writes the routes that have changed.
+// This avoids the window where a user has no routes while the map is cleared and repopulated, and is much cheaper when a change only touches a few routes
+func patchPolicyMap(usersRouteTable *ebpf.Map, userAcls acls.Acl) error {
 
-	return nil
-}
+	desired := desiredPolicies(userAcls)
 
-func clearPolicyMap(toClear *ebpf.Map) error {
 	var (
-		lastKey []byte
-		err     error
+		k     routetypes.Key
+		block [routetypes.MAX_POLICIES]routetypes.Policy
+
+		stale    []routetypes.Key
+		previous = map[routetypes.Key][]uint32{}
 	)
 
-	// Due to type inference we cant just set lastKey to nil to get the first key
-	lastKey, err = toClear.NextKeyBytes(nil)
-	if err != nil {
-		return err
-	}
+	iter := usersRouteTable.Iterate()
+	for iter.Next(&k, &block) {
+		policies, chain, err := followChain(block)
+		if err != nil {
+			log.Println("unable to follow policy chain, route will be rewritten: ", err)
+		}
 
-	for {
+		previous[k] = chain
 
-		if lastKey == nil {
-			return nil
+		newPolicies, ok := desired[k]
+		if !ok {
+			stale = append(stale, k)
+			continue
 		}
 
-		err = toClear.Delete(lastKey)
-		if err != nil && errors.Is(err, ebpf.ErrKeyNotExist) {
-			return err
+		if err == nil && slices.Equal(newPolicies, policies) {
+			delete(desired, k)
 		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error iterating policy map: %s", err)
+	}
+
+	// Modifying an lpm trie while iterating it can skip entries, so only change things once we know the full difference
+	for i := range stale {
+		err := usersRouteTable.Delete(&stale[i])
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("error removing route key from inner map: %s", err)
+		}
+
+		releaseChains(previous[stale[i]])
+	}
 
-		lastKey, err = toClear.NextKeyBytes(lastKey)
+	for key, newPolicies := range desired {
+		err := putPolicies(usersRouteTable, key, newPolicies, previous[key])
 		if err != nil {
 			return err
 		}
 	}
+
+	return nil
 }
 
 // I've tried my hardest not to make this stateful. But alas we must cache the user policy maps or things become unreasonbly slow
@@ -449,22 +500,6 @@ func bulkCreateUserMaps(users []data.UserModel) []error {
 	for _, user := range users {
 		userid := sha1.Sum([]byte(user.Username))
 
-		// Fast path, if the user already has a map then just repopulate the map. Since we have "stop" rules at the end of definitions it doesnt matter if other rules were defined
-		// This speeds up things like refresh acls, but not wag start up
-		if policiesInnerTable, ok := userPolicyMaps[userid]; ok {
-
-			if err := clearPolicyMap(policiesInnerTable); err != nil {
-				errors = append(errors, err)
-				continue
-			}
-
-			err := xdpAddRoute(policiesInnerTable, data.GetEffectiveAcl(user.Username))
-
-			if err != nil {
-				errors = append(errors, err)
-			}
-		}
-
 		locked := uint32(0)
 		if user.Locked {
 			locked = 1
@@ -475,6 +510,18 @@ func bulkCreateUserMaps(users []data.UserModel) []error {
 			return []error{err}
 		}
 
+		// Fast path, if the user already has a map then just patch the routes that have changed
+		// This speeds up things like refresh acls, but not wag start up
+		if policiesInnerTable, ok := userPolicyMaps[userid]; ok {
+
+			err := patchPolicyMap(policiesInnerTable, data.GetEffectiveAcl(user.Username))
+			if err != nil {
+				errors = append(errors, err)
+			}
+
+			continue
+		}
+
 		policiesInnerTable, err := ebpf.NewMap(routesMapSpec)
 		if err != nil {
 			return []error{fmt.Errorf("%s creating new map: %s", xdpObjects.PoliciesTable.String(), err)}
@@ -488,6 +535,10 @@ func bulkCreateUserMaps(users []data.UserModel) []error {
 
 	}
 
+	if len(keys) == 0 {
+		return errors
+	}
+
 	n, err := xdpObjects.PoliciesTable.BatchUpdate(keys, values, &ebpf.BatchOptions{
 		Flags: uint64(ebpf.UpdateNoExist),
 	})
@@ -528,8 +579,14 @@ func RemoveUser(username string) error {
 		return errors.New("removing user from policies table failed: " + err.Error())
 	}
 
+	if m, ok := userPolicyMaps[userid]; ok {
+		releaseUserChains(m)
+	}
+
 	delete(userPolicyMaps, userid)
 
+	removeTaggedUser(username)
+
 	for address, publicKey := range usersToAddresses[username] {
 		err = _removePeer(publicKey, address)
 		if err != nil {
@@ -561,7 +618,12 @@ func RefreshConfiguration() []error {
 		return []error{err}
 	}
 
-	return bulkCreateUserMaps(users)
+	errs := bulkCreateUserMaps(users)
+	if err := refreshTaggedAcls(""); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
 }
 
 func SetInactivityTimeout(inactivityTimeoutMinutes int) error {
@@ -572,17 +634,13 @@ func SetInactivityTimeout(inactivityTimeoutMinutes int) error {
 }
 
 func setInactivityTimeout(inactivityTimeoutMinutes int) error {
-	value := uint64(inactivityTimeoutMinutes) * 60000000000
-	if inactivityTimeoutMinutes < 0 {
-		value = math.MaxUint64
-	}
-
-	err := xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), value)
+	err := xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), minutesToNanoseconds(inactivityTimeoutMinutes))
 	if err != nil {
 		return fmt.Errorf("could not set inactivity timeout: %s", err)
 	}
 
-	return nil
+	// Devices with group overrides that now match the cluster wide setting no longer need them, and vice versa
+	return refreshInactivityOverrides()
 }
 
 // Update FW routes for specific user
@@ -595,7 +653,12 @@ func RefreshUserAcls(username string) error {
 
 	acls := data.GetEffectiveAcl(username)
 
-	return setSingleUserMap(userid, acls)
+	err := setSingleUserMap(userid, acls)
+	if err != nil {
+		return err
+	}
+
+	return refreshTaggedAcls(username)
 }
 
 // SetAuthroized correctly sets the timestamps for a device with internal IP address as internalAddress
@@ -608,11 +671,20 @@ func SetAuthorized(internalAddress, username string, node uint64) error {
 	lock.Lock()
 	defer lock.Unlock()
 
+	locked, err := lockedOut(username)
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		return errors.New("cannot authorise devices during a lockdown")
+	}
+
 	var deviceStruct fwentry
 	deviceStruct.lastPacketTime = GetTimeStamp()
 	deviceStruct.associatedNode = node
 
-	maxSession, err := data.GetSessionLifetimeMinutes()
+	_, maxSession, err := data.GetEffectiveSessionTimeouts(username)
 	if err != nil {
 		return err
 	}
@@ -622,7 +694,7 @@ func SetAuthorized(internalAddress, username string, node uint64) error {
 		deviceStruct.sessionExpiry = math.MaxUint64 // If the session timeout is disabled, (<0) then we set to max value
 	}
 
-	deviceStruct.user_id = sha1.Sum([]byte(username))
+	deviceStruct.user_id = deviceIdentity(username, internalAddress)
 
 	return xdpObjects.Devices.Update(net.ParseIP(internalAddress).To4(), deviceStruct.Bytes(), ebpf.UpdateExist)
 }
@@ -729,7 +801,19 @@ func GetRoutes(username string) ([]string, error) {
 	lock.RLock()
 	defer lock.RUnlock()
 
-	userid := sha1.Sum([]byte(username))
+	return getRoutes(sha1.Sum([]byte(username)))
+}
+
+// GetDeviceRoutes returns the routes for a specific device, which may differ from the users routes if the device is tagged
+func GetDeviceRoutes(username, address string) ([]string, error) {
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return getRoutes(deviceIdentity(username, address))
+}
+
+func getRoutes(userid [20]byte) ([]string, error) {
 
 	result := map[string]bool{}
 
@@ -787,6 +871,10 @@ func GetRules() (map[string]FirewallRules, error) {
 		hashToUsername[hex.EncodeToString(hash[:])] = user.Username
 	}
 
+	for id, identity := range taggedIdentities {
+		hashToUsername[hex.EncodeToString(id[:])] = identity.username
+	}
+
 	result := make(map[string]FirewallRules)
 
 	iterateSubmap := func(innerMapID ebpf.MapID) (rules []string, err error) {
@@ -802,12 +890,9 @@ func GetRules() (map[string]FirewallRules, error) {
 		innerIter := innerMap.Iterate()
 
 		for innerIter.Next(&k, &policies) {
-			var actualPolicies []routetypes.Policy
-			for i := range policies {
-				if policies[i].PolicyType == routetypes.STOP {
-					actualPolicies = policies[:i]
-					break
-				}
+			actualPolicies, _, err := followChain(policies)
+			if err != nil {
+				log.Println("[ERROR] Route policies were incomplete: ", k.String(), " err: ", err)
 			}
 
 			rules = append(rules, k.String()+" policy "+fmt.Sprintf("%+v", actualPolicies))
@@ -62,9 +62,14 @@ type bpfProgramSpecs struct {
 type bpfMapSpecs struct {
 	AccountLocked            *ebpf.MapSpec `ebpf:"account_locked"`
 	Devices                  *ebpf.MapSpec `ebpf:"devices"`
+	FlowEvents               *ebpf.MapSpec `ebpf:"flow_events"`
+	FlowSampleRate           *ebpf.MapSpec `ebpf:"flow_sample_rate"`
+	InactivityOverrides      *ebpf.MapSpec `ebpf:"inactivity_overrides"`
 	InactivityTimeoutMinutes *ebpf.MapSpec `ebpf:"inactivity_timeout_minutes"`
 	NodeId                   *ebpf.MapSpec `ebpf:"node_Id"`
 	PoliciesTable            *ebpf.MapSpec `ebpf:"policies_table"`
+	PolicyChains             *ebpf.MapSpec `ebpf:"policy_chains"`
+	TracedDevices            *ebpf.MapSpec `ebpf:"traced_devices"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -88,18 +93,28 @@ func (o *bpfObjects) Close() error {
 type bpfMaps struct {
 	AccountLocked            *ebpf.Map `ebpf:"account_locked"`
 	Devices                  *ebpf.Map `ebpf:"devices"`
+	FlowEvents               *ebpf.Map `ebpf:"flow_events"`
+	FlowSampleRate           *ebpf.Map `ebpf:"flow_sample_rate"`
+	InactivityOverrides      *ebpf.Map `ebpf:"inactivity_overrides"`
 	InactivityTimeoutMinutes *ebpf.Map `ebpf:"inactivity_timeout_minutes"`
 	NodeId                   *ebpf.Map `ebpf:"node_Id"`
 	PoliciesTable            *ebpf.Map `ebpf:"policies_table"`
+	PolicyChains             *ebpf.Map `ebpf:"policy_chains"`
+	TracedDevices            *ebpf.Map `ebpf:"traced_devices"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
 		m.AccountLocked,
 		m.Devices,
+		m.FlowEvents,
+		m.FlowSampleRate,
+		m.InactivityOverrides,
 		m.InactivityTimeoutMinutes,
 		m.NodeId,
 		m.PoliciesTable,
+		m.PolicyChains,
+		m.TracedDevices,
 	)
 }
 
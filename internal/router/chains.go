@@ -0,0 +1,145 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/NHAS/wag/internal/acls"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/cilium/ebpf"
+)
+
+// Routes with more policies than fit in one block of the users LPM trie have the rest stored in the policy_chains map.
+// Each full block ends in a CHAIN policy holding the index of the next block, the indexes are shared between all users.
+// Everything here expects the caller to hold lock
+var (
+	nextChainIndex   uint32
+	freeChainIndexes []uint32
+)
+
+func allocateChainIndex() uint32 {
+	if len(freeChainIndexes) > 0 {
+		index := freeChainIndexes[len(freeChainIndexes)-1]
+		freeChainIndexes = freeChainIndexes[:len(freeChainIndexes)-1]
+		return index
+	}
+
+	nextChainIndex++
+	return nextChainIndex - 1
+}
+
+// releaseChains removes chained blocks that are no longer referenced, so their indexes can be reused
+func releaseChains(indexes []uint32) {
+	for _, index := range indexes {
+		err := xdpObjects.PolicyChains.Delete(index)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Println("unable to remove chained policy block: ", err)
+			continue
+		}
+
+		freeChainIndexes = append(freeChainIndexes, index)
+	}
+}
+
+// releaseUserChains releases every chained block referenced by a users policy map, before the map is removed
+func releaseUserChains(usersRouteTable *ebpf.Map) {
+	var (
+		k     routetypes.Key
+		block [routetypes.MAX_POLICIES]routetypes.Policy
+
+		chains []uint32
+	)
+
+	iter := usersRouteTable.Iterate()
+	for iter.Next(&k, &block) {
+		_, chain, err := followChain(block)
+		if err != nil {
+			log.Println("unable to follow policy chain of removed route: ", err)
+		}
+		chains = append(chains, chain...)
+	}
+
+	if err := iter.Err(); err != nil {
+		log.Println("error iterating removed policy map: ", err)
+	}
+
+	releaseChains(chains)
+}
+
+// followChain returns the policies in a block and every block chained from it, along with the indexes of the chained blocks
+func followChain(block [routetypes.MAX_POLICIES]routetypes.Policy) (policies []routetypes.Policy, chain []uint32, err error) {
+	for {
+		last := block[routetypes.MAX_POLICIES-1]
+		if !last.Is(routetypes.CHAIN) {
+			for i := range block {
+				if block[i].PolicyType == routetypes.STOP {
+					return append(policies, block[:i]...), chain, nil
+				}
+			}
+
+			return append(policies, block[:]...), chain, nil
+		}
+
+		policies = append(policies, block[:routetypes.MAX_POLICIES-1]...)
+
+		if len(chain) >= routetypes.MAX_POLICY_BLOCKS {
+			return policies, chain, errors.New("policy chain is longer than the firewall supports")
+		}
+
+		index := last.ChainIndex()
+		chain = append(chain, index)
+
+		err := xdpObjects.PolicyChains.Lookup(index, &block)
+		if err != nil {
+			return policies, chain, fmt.Errorf("chained policy block %d: %s", index, err)
+		}
+	}
+}
+
+// desiredPolicies parses the acl into the policies for each route, as with the firewall the last rule for a key wins
+func desiredPolicies(userAcls acls.Acl) map[routetypes.Key][]routetypes.Policy {
+	rules, errs := routetypes.ParseRules(userAcls.Mfa, userAcls.Allow, userAcls.Deny)
+	if len(errs) != 0 {
+		log.Println("Parsing rules for user had errors: ", errs)
+	}
+
+	desired := map[routetypes.Key][]routetypes.Policy{}
+	for _, rule := range rules {
+		for _, key := range rule.Keys {
+			desired[key] = rule.Values[:rule.NumPolicies]
+		}
+	}
+
+	return desired
+}
+
+// putPolicies writes the policies for a route, chaining any that do not fit in the first block. previous is the chain the route used before, which is released once the route no longer points at it
+func putPolicies(usersRouteTable *ebpf.Map, key routetypes.Key, policies []routetypes.Policy, previous []uint32) error {
+	blocks := routetypes.SplitPolicies(policies)
+
+	// Write the chained blocks from the end, so the firewall never follows a chain to a block that does not exist yet
+	var chain []uint32
+	for i := len(blocks) - 1; i > 0; i-- {
+		index := allocateChainIndex()
+		chain = append(chain, index)
+
+		err := xdpObjects.PolicyChains.Put(index, &blocks[i])
+		if err != nil {
+			releaseChains(chain)
+			return fmt.Errorf("error putting chained policy block: %s", err)
+		}
+
+		blocks[i-1][routetypes.MAX_POLICIES-1] = routetypes.NewChain(index)
+	}
+
+	err := usersRouteTable.Put(&key, &blocks[0])
+	if err != nil {
+		releaseChains(chain)
+		return fmt.Errorf("error putting route key in inner map: %s", err)
+	}
+
+	releaseChains(previous)
+
+	return nil
+}
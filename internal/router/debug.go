@@ -70,6 +70,9 @@ func createPacket(src, dst net.IP, proto, port int) []byte {
 	case routetypes.ICMP:
 		hdrbytes = append(hdrbytes, pkt.Icmp()...)
 
+	case routetypes.SCTP:
+		hdrbytes = append(hdrbytes, pkt.Sctp()...)
+
 	default:
 		hdrbytes = append(hdrbytes, pkt.Any()...)
 
@@ -126,7 +129,23 @@ func (p *pkthdr) UnpackIcmp(b []byte) {
 func (p *pkthdr) Icmp() []byte {
 	r := make([]byte, 9) // 1 byte over as we need to fake some data
 
-	//icmp isnt parsed, other than proto and length
+	// The port is the icmp type in the upper byte and the code in the lower byte
+	binary.BigEndian.PutUint16(r, p.dst)
+
+	return r
+}
+
+func (p *pkthdr) UnpackSctp(b []byte) {
+	p.pktType = "SCTP"
+	p.src = binary.BigEndian.Uint16(b)
+	p.dst = binary.BigEndian.Uint16(b[2:])
+}
+
+func (p *pkthdr) Sctp() []byte {
+	r := make([]byte, 13) // 1 byte over as we need to fake some data
+
+	binary.BigEndian.PutUint16(r, p.src)
+	binary.BigEndian.PutUint16(r[2:], p.dst)
 
 	return r
 }
@@ -0,0 +1,222 @@
+package router
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+// Policies are attached to effects, which are either a username, a group, a device tag or "*".
+// Rather than recalculating every users policy map when a single acl changes we keep an index from group name to members
+// so only the users that an acl actually applies to are refreshed.
+// Groups with membership rules can match any user, so a policy that depends on one refreshes everybody
+var (
+	groupMembers  = map[string]map[string]bool{}
+	dynamicGroups = map[string]bool{}
+)
+
+func loadGroupDependencies() error {
+	groups, err := data.GetGroups()
+	if err != nil {
+		return fmt.Errorf("unable to load group membership index: %s", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	clear(groupMembers)
+	clear(dynamicGroups)
+	for _, group := range groups {
+		setGroupMembers(group.Group, group.Members)
+		dynamicGroups[group.Group] = len(group.Rules) != 0
+	}
+
+	return nil
+}
+
+func setGroupMembers(group string, members []string) {
+	if len(members) == 0 {
+		delete(groupMembers, group)
+		return
+	}
+
+	groupMembers[group] = map[string]bool{}
+	for _, member := range members {
+		groupMembers[group][member] = true
+	}
+}
+
+// nestedGroups returns the groups listed as members of a group, sorted so they can be compared
+func nestedGroups(members []string) (groups []string) {
+	for _, member := range members {
+		if strings.HasPrefix(member, "group:") {
+			groups = append(groups, member)
+		}
+	}
+	slices.Sort(groups)
+
+	return groups
+}
+
+// affectedUsers returns the users whose effective acl is built from the policy applying to effects, including the members of nested groups.
+// everyone is set if the group contains a dynamic group, as then any user may be a member
+func affectedUsers(effects string) (users []string, everyone bool) {
+	if !strings.HasPrefix(effects, "group:") {
+		return []string{effects}, false
+	}
+
+	seen := map[string]bool{effects: true}
+	groups := []string{effects}
+	for i := 0; i < len(groups); i++ {
+		if dynamicGroups[groups[i]] {
+			return nil, true
+		}
+
+		for member := range groupMembers[groups[i]] {
+			if !strings.HasPrefix(member, "group:") {
+				users = append(users, member)
+				continue
+			}
+
+			if !seen[member] {
+				seen[member] = true
+				groups = append(groups, member)
+			}
+		}
+	}
+
+	return users, false
+}
+
+// dependsOnDynamicGroup returns whether the users a policy applies to can change without the group being edited
+func dependsOnDynamicGroup(effects string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	_, everyone := affectedUsers(effects)
+	return everyone
+}
+
+// refreshAffectedAcls recalculates only the policy maps that depend on the acl for effects
+func refreshAffectedAcls(effects string) error {
+	if effects == "*" || dependsOnDynamicGroup(effects) {
+		return errors.Join(RefreshConfiguration()...)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if tag, ok := strings.CutPrefix(effects, "tag:"); ok {
+		for id, identity := range taggedIdentities {
+			if !slices.Contains(identity.tags, tag) {
+				continue
+			}
+
+			err := setSingleUserMap(id, data.GetEffectiveDeviceAcl(identity.username, identity.iface, identity.tags))
+			if err != nil {
+				return fmt.Errorf("unable to refresh policies for %s tagged %s: %s", identity.username, identity.tags, err)
+			}
+		}
+
+		return nil
+	}
+
+	users, _ := affectedUsers(effects)
+	if err := refreshUsersAcls(users); err != nil {
+		return err
+	}
+
+	// Devices on an interface with a default group are members of it without the user being one
+	for id, identity := range taggedIdentities {
+		if !interfaceGroupAffected(identity.iface, effects) {
+			continue
+		}
+
+		err := setSingleUserMap(id, data.GetEffectiveDeviceAcl(identity.username, identity.iface, identity.tags))
+		if err != nil {
+			return fmt.Errorf("unable to refresh policies for %s on %s: %s", identity.username, identity.iface, err)
+		}
+	}
+
+	return nil
+}
+
+// interfaceGroupAffected returns whether the policy for effects applies through the default group of iface, either directly or because the default group is nested in effects
+func interfaceGroupAffected(iface, effects string) bool {
+	wgInterface, err := config.GetInterface(iface)
+	if err != nil || wgInterface.Name == config.DefaultInterface || wgInterface.DefaultGroup == "" {
+		return false
+	}
+
+	seen := map[string]bool{effects: true}
+	groups := []string{effects}
+	for i := 0; i < len(groups); i++ {
+		if groups[i] == wgInterface.DefaultGroup {
+			return true
+		}
+
+		for member := range groupMembers[groups[i]] {
+			if strings.HasPrefix(member, "group:") && !seen[member] {
+				seen[member] = true
+				groups = append(groups, member)
+			}
+		}
+	}
+
+	return false
+}
+
+// refreshUsersAcls recalculates the policy maps of the given users and their tagged devices, caller must hold lock
+func refreshUsersAcls(users []string) error {
+	var errs []error
+	for _, username := range users {
+		userid := sha1.Sum([]byte(username))
+
+		// Acls can be defined for users that do not exist yet, they will pick it up when they are created
+		if xdpUserExists(userid) != nil {
+			continue
+		}
+
+		err := setSingleUserMap(userid, data.GetEffectiveAcl(username))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to refresh policies for %s: %s", username, err))
+			continue
+		}
+
+		if err := refreshTaggedAcls(username); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// refreshMembers recalculates the acls and inactivity timeouts of users whose groups changed without their membership key changing,
+// or of every user if everyone is set. Caller must hold lock
+func refreshMembers(users []string, everyone bool) error {
+	if everyone {
+		allUsers, err := data.GetAllUsers()
+		if err != nil {
+			return err
+		}
+
+		users = nil
+		for _, user := range allUsers {
+			users = append(users, user.Username)
+		}
+	}
+
+	if len(users) == 0 {
+		return nil
+	}
+
+	slices.Sort(users)
+	users = slices.Compact(users)
+
+	return errors.Join(refreshUsersAcls(users), refreshInactivityOverrides(users...))
+}
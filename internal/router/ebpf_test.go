@@ -9,9 +9,12 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/NHAS/wag/internal/acls"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/routetypes"
@@ -527,6 +530,126 @@ func TestSlidingWindow(t *testing.T) {
 	}
 }
 
+func TestInactivityOverride(t *testing.T) {
+	const (
+		username = "inactivity_override"
+		address  = "192.168.1.241"
+	)
+
+	err := AddUser(username, acls.Acl{Mfa: []string{"9.9.8.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpAddDevice(username, address, uint64(data.GetServerID())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAuthorized(address, username, uint64(data.GetServerID())); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := createPacket(net.ParseIP(address), net.ParseIP("9.9.8.1"), routetypes.TCP, 22)
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_PASS {
+		t.Fatalf("program did not %s packet instead did: %s", result(XDP_PASS), result(value))
+	}
+
+	// An override replaces the cluster wide timeout, a zero override times the device out straight away
+	err = xdpObjects.InactivityOverrides.Put(net.ParseIP(address).To4(), uint64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, err := deviceInactivityTimeout(net.ParseIP(address))
+	if err != nil || timeout != 0 {
+		t.Fatal("device inactivity timeout did not use the override: ", timeout, err)
+	}
+
+	value, _, err = xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_DROP {
+		t.Fatalf("program did not %s packet instead did: %s", result(XDP_DROP), result(value))
+	}
+
+	if IsAuthed(address) {
+		t.Fatal("device is still authorised after its inactivity override expired")
+	}
+
+	if err := removeInactivityOverride(address); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing an override that does not exist is not an error
+	if err := removeInactivityOverride(address); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, err = deviceInactivityTimeout(net.ParseIP(address))
+	if err != nil || timeout != minutesToNanoseconds(config.Values.SessionInactivityTimeoutMinutes) {
+		t.Fatal("device inactivity timeout did not fall back to the cluster wide timeout: ", timeout, err)
+	}
+}
+
+func TestInactivityOverrideTableFull(t *testing.T) {
+	const (
+		username = "inactivity_override_full"
+		address  = "192.168.1.242"
+	)
+
+	err := AddUser(username, acls.Acl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.SetGroup("group:long_inactivity", []string{username}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.RemoveGroup("group:long_inactivity")
+
+	// Differs from the cluster wide timeout so the device needs an override
+	timeout := config.Values.SessionInactivityTimeoutMinutes + 1
+	err = data.SetSessionPolicy("group:long_inactivity", data.SessionPolicy{InactivityTimeoutMinutes: &timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.RemoveSessionPolicy("group:long_inactivity")
+
+	var filler []net.IP
+	defer func() {
+		for _, ip := range filler {
+			xdpObjects.InactivityOverrides.Delete([]byte(ip))
+		}
+	}()
+
+	for i := 0; ; i++ {
+		ip := net.IPv4(10, 254, byte(i/256), byte(i%256)).To4()
+		if err := xdpObjects.InactivityOverrides.Update([]byte(ip), uint64(0), ebpf.UpdateNoExist); err != nil {
+			break
+		}
+		filler = append(filler, ip)
+	}
+
+	err = xdpAddDevice(username, address, uint64(data.GetServerID()))
+	if err == nil || !strings.Contains(err.Error(), "inactivity override table is full") {
+		t.Fatal("adding a device whose override did not fit did not report the table was full: ", err)
+	}
+
+	var deviceBytes []byte
+	if xdpObjects.Devices.Lookup(net.ParseIP(address).To4(), &deviceBytes) == nil {
+		t.Fatal("device was left in the firewall without its inactivity override")
+	}
+}
+
 func TestCompositeRules(t *testing.T) {
 
 	err := SetAuthorized(devices["tester"].Address, devices["tester"].Username, uint64(data.GetServerID()))
@@ -950,6 +1073,61 @@ func TestPortRestrictions(t *testing.T) {
 
 }
 
+func TestIcmpTypesAndSctpPorts(t *testing.T) {
+	const (
+		username = "icmp_sctp"
+		address  = "192.168.1.240"
+	)
+
+	err := AddUser(username, acls.Acl{
+		Allow: []string{"9.9.9.1 icmp/8", "9.9.9.2 icmp/3:4", "9.9.9.3 2905/sctp", "9.9.9.4 icmp", "9.9.9.5 !22/any"},
+		Deny:  []string{"9.9.9.4 icmp/5"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpAddDevice(username, address, uint64(data.GetServerID())); err != nil {
+		t.Fatal(err)
+	}
+
+	device := net.ParseIP(address)
+
+	tests := []struct {
+		dst      string
+		proto    int
+		port     int
+		expected uint32
+	}{
+		{"9.9.9.1", routetypes.ICMP, 8 << 8, XDP_PASS},
+		{"9.9.9.1", routetypes.ICMP, 8<<8 | 1, XDP_PASS},
+		{"9.9.9.1", routetypes.ICMP, 0, XDP_DROP},
+		{"9.9.9.2", routetypes.ICMP, 3<<8 | 4, XDP_PASS},
+		{"9.9.9.2", routetypes.ICMP, 3<<8 | 1, XDP_DROP},
+		{"9.9.9.3", routetypes.SCTP, 2905, XDP_PASS},
+		{"9.9.9.3", routetypes.SCTP, 2906, XDP_DROP},
+		{"9.9.9.3", routetypes.TCP, 2905, XDP_DROP},
+		{"9.9.9.4", routetypes.ICMP, 8 << 8, XDP_PASS},
+		{"9.9.9.4", routetypes.ICMP, 5<<8 | 1, XDP_DROP},
+		// Excluding ports of any protocol does not let through protocols without ports
+		{"9.9.9.5", routetypes.TCP, 80, XDP_PASS},
+		{"9.9.9.5", routetypes.UDP, 22, XDP_DROP},
+		{"9.9.9.5", routetypes.ICMP, 8 << 8, XDP_DROP},
+		{"9.9.9.5", routetypes.ICMP, 0, XDP_DROP},
+	}
+
+	for _, test := range tests {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(device, net.ParseIP(test.dst), test.proto, test.port))
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != test.expected {
+			t.Fatalf("%s proto %d port %d: program did not %s packet instead did: %s", test.dst, test.proto, test.port, result(test.expected), result(value))
+		}
+	}
+}
+
 func TestAgnosticRuleOrdering(t *testing.T) {
 
 	var packets [][]byte
@@ -1091,6 +1269,295 @@ func TestLookupDifferentKeyTypesInMap(t *testing.T) {
 
 }
 
+func TestPatchPolicyMap(t *testing.T) {
+	dumpMap := func(m *ebpf.Map) map[routetypes.Key][routetypes.MAX_POLICIES]routetypes.Policy {
+		result := map[routetypes.Key][routetypes.MAX_POLICIES]routetypes.Policy{}
+
+		var (
+			k        routetypes.Key
+			policies [routetypes.MAX_POLICIES]routetypes.Policy
+		)
+		iter := m.Iterate()
+		for iter.Next(&k, &policies) {
+			result[k] = policies
+		}
+
+		if iter.Err() != nil {
+			t.Fatal("iterating map failed: ", iter.Err())
+		}
+
+		return result
+	}
+
+	before := acls.Acl{
+		Allow: []string{"10.0.0.0/8", "192.168.5.1/32 22/tcp"},
+		Mfa:   []string{"172.16.0.0/16 443/tcp"},
+	}
+
+	after := acls.Acl{
+		Allow: []string{"10.0.0.0/8", "192.168.5.1/32 80/tcp"},
+		Deny:  []string{"10.1.0.0/16"},
+	}
+
+	patched, err := ebpf.NewMap(routesMapSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patched.Close()
+
+	expected, err := ebpf.NewMap(routesMapSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+
+	if err := xdpAddRoute(patched, before); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := patchPolicyMap(patched, after); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpAddRoute(expected, after); err != nil {
+		t.Fatal(err)
+	}
+
+	got, want := dumpMap(patched), dumpMap(expected)
+	if len(got) != len(want) {
+		t.Fatalf("patched map has %d routes expected %d", len(got), len(want))
+	}
+
+	for k, policies := range want {
+		if got[k] != policies {
+			t.Fatalf("route %s was not patched correctly", k.String())
+		}
+	}
+}
+
+func portPolicies(n int) string {
+	ports := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		ports = append(ports, fmt.Sprintf("%d", i))
+	}
+
+	return strings.Join(ports, ",") + "/tcp"
+}
+
+func TestChainedPolicyMap(t *testing.T) {
+	policyMap, err := ebpf.NewMap(routesMapSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer policyMap.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	inUse := func() int {
+		return int(nextChainIndex) - len(freeChainIndexes)
+	}
+	startingChains := inUse()
+
+	for _, n := range []int{300, routetypes.MAX_ROUTE_POLICIES, 5, 200, 0} {
+		acl := acls.Acl{Allow: []string{"10.20.0.0/16 " + portPolicies(n)}}
+		if n == 0 {
+			acl.Allow = nil
+		}
+
+		if err := patchPolicyMap(policyMap, acl); err != nil {
+			t.Fatal(n, " policies: ", err)
+		}
+
+		blocks := 0
+		if n > 0 {
+			var block [routetypes.MAX_POLICIES]routetypes.Policy
+			if err := policyMap.Lookup(routetypes.Key{Prefixlen: 16, IP: [4]byte{10, 20, 0, 0}}, &block); err != nil {
+				t.Fatal(n, " policies: route was not written: ", err)
+			}
+
+			policies, chain, err := followChain(block)
+			if err != nil {
+				t.Fatal(n, " policies: ", err)
+			}
+
+			if len(policies) != n || int(policies[n-1].LowerPort) != n {
+				t.Fatal(n, " policies: chain held ", len(policies), " policies")
+			}
+
+			blocks = len(chain)
+		}
+
+		// Chains from the previous acl must be released once they are replaced
+		if inUse()-startingChains != blocks {
+			t.Fatal(n, " policies: expected ", blocks, " chained blocks in use got: ", inUse()-startingChains)
+		}
+	}
+}
+
+// benchmarkLookupUser sets the policies of a user with a single device, creating both if need be
+func benchmarkLookupUser(b *testing.B, acl acls.Acl) net.IP {
+	b.Helper()
+
+	const (
+		username = "benchmark_lookup"
+		address  = "192.168.1.250"
+	)
+
+	if xdpUserExists(sha1.Sum([]byte(username))) != nil {
+		if err := AddUser(username, acl); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := xdpAddDevice(username, address, uint64(data.GetServerID())); err != nil {
+			b.Fatal(err)
+		}
+
+		return net.ParseIP(address)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := setSingleUserMap(sha1.Sum([]byte(username)), acl); err != nil {
+		b.Fatal(err)
+	}
+
+	return net.ParseIP(address)
+}
+
+func benchmarkPacket(b *testing.B, packet []byte) {
+	b.Helper()
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if value != XDP_PASS {
+		b.Fatal("program did not XDP_PASS packet instead did: ", result(value))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The number of routes a user has should not change the cost of a lookup, as it is a single search of the trie
+func BenchmarkPolicyLookupRoutes(b *testing.B) {
+	for _, routes := range []int{1, 64, 1024} {
+		b.Run(fmt.Sprintf("routes=%d", routes), func(b *testing.B) {
+			var acl acls.Acl
+			for i := 0; i < routes; i++ {
+				acl.Allow = append(acl.Allow, fmt.Sprintf("10.30.%d.%d/32 443/tcp", i/256, i%256))
+			}
+
+			device := benchmarkLookupUser(b, acl)
+			benchmarkPacket(b, createPacket(device, net.IPv4(10, 30, byte((routes-1)/256), byte((routes-1)%256)), routetypes.TCP, 443))
+		})
+	}
+}
+
+// Matching the last policy of a route walks every block chained to it
+func BenchmarkPolicyLookupChained(b *testing.B) {
+	for _, policies := range []int{routetypes.MAX_POLICIES, 8 * (routetypes.MAX_POLICIES - 1), routetypes.MAX_ROUTE_POLICIES} {
+		b.Run(fmt.Sprintf("policies=%d", policies), func(b *testing.B) {
+			device := benchmarkLookupUser(b, acls.Acl{Allow: []string{"10.40.0.1 " + portPolicies(policies)}})
+			benchmarkPacket(b, createPacket(device, net.IPv4(10, 40, 0, 1), routetypes.TCP, policies))
+		})
+	}
+}
+
+func BenchmarkPatchChainedPolicies(b *testing.B) {
+	policyMap, err := ebpf.NewMap(routesMapSpec)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer policyMap.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Alternate the last port, so every iteration rewrites the whole chain
+		acl := acls.Acl{Allow: []string{fmt.Sprintf("10.50.0.0/24 %s 6000%d/tcp", portPolicies(1000), i%2)}}
+
+		if err := patchPolicyMap(policyMap, acl); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+const benchmarkUsers = 250
+
+func addBenchmarkUsers(b *testing.B) {
+	b.Helper()
+
+	for i := 0; i < benchmarkUsers; i++ {
+		username := fmt.Sprintf("benchmark_user_%d", i)
+		if xdpUserExists(sha1.Sum([]byte(username))) == nil {
+			continue
+		}
+
+		_, err := data.CreateUserDataAccount(username)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = AddUser(username, data.GetEffectiveAcl(username))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// changeBenchmarkAcl alternates the acl of a single user, so every iteration has something to write
+func changeBenchmarkAcl(b *testing.B, i int) {
+	b.Helper()
+
+	policy := acls.Acl{
+		Allow: []string{"10.10.0.0/16 443/tcp", "10.11.0.1/32"},
+	}
+	if i%2 == 0 {
+		policy.Mfa = []string{"172.16.0.0/24 22/tcp"}
+	}
+
+	err := data.SetAcl("benchmark_user_0", policy, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkRefreshConfiguration(b *testing.B) {
+	addBenchmarkUsers(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		changeBenchmarkAcl(b, i)
+
+		if errs := RefreshConfiguration(); len(errs) != 0 {
+			b.Fatal(errs)
+		}
+	}
+}
+
+func BenchmarkIncrementalAclRefresh(b *testing.B) {
+	addBenchmarkUsers(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		changeBenchmarkAcl(b, i)
+
+		if err := refreshAffectedAcls("benchmark_user_0"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func getInnerMap(username string, m *ebpf.Map) (*ebpf.Map, error) {
 	var innerMapID ebpf.MapID
 	userid := sha1.Sum([]byte(username))
@@ -1173,9 +1640,23 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	err := data.Load(config.Values.DatabaseLocation, "", true)
+	// Keep the etcd data and cluster certificates out of the source tree
+	dir, err := os.MkdirTemp("", "wag-router-test")
+	if err != nil {
+		log.Println("failed to create test directory: ", err)
+		os.Exit(1)
+	}
+
+	config.Values.Clustering.DatabaseLocation = dir
+	config.Values.Clustering.TLSManagerStorage = filepath.Join(dir, "certificates")
+	// Packages are tested in parallel, so each needs its own ports for etcd and the tls manager
+	config.Values.Clustering.TLSManagerListenURL = "https://localhost:0"
+	config.Values.Clustering.ListenAddresses = []string{"https://localhost:0"}
+
+	err = data.Load(config.Values.DatabaseLocation, "", true)
 	if err != nil {
 		log.Println(err)
+		os.RemoveAll(dir)
 		os.Exit(1)
 	}
 
@@ -1194,6 +1675,7 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	data.TearDown()
+	os.RemoveAll(dir)
 
 	os.Exit(code)
 }
@@ -0,0 +1,421 @@
+package router
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/cilium/ebpf/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+// Flags set on flow events by xdp.c
+const (
+	flowLogged  = 1
+	flowSampled = 2
+	flowInbound = 4
+	flowDevice  = 8
+	flowTraced  = 16
+)
+
+// Flow event from the ring buffer
+type flowevent struct {
+	timestamp uint64
+
+	src_ip [4]byte
+	dst_ip [4]byte
+
+	src_port uint16
+	dst_port uint16
+	proto    uint16
+
+	policy_type  uint16
+	policy_index uint16
+
+	verdict uint8
+	flags   uint8
+	reason  uint8
+
+	user_id [20]byte
+}
+
+func (f flowevent) Size() int {
+	return 52 // 8 + 4 + 4 + 2 + 2 + 2 + 2 + 2 + 1 + 1 + 1 + 20 + 3
+}
+
+func (f *flowevent) Unpack(b []byte) error {
+	if len(b) < f.Size() {
+		return errors.New("flow event is too short")
+	}
+
+	f.timestamp = binary.NativeEndian.Uint64(b[0:8])
+
+	copy(f.src_ip[:], b[8:12])
+	copy(f.dst_ip[:], b[12:16])
+
+	f.src_port = binary.NativeEndian.Uint16(b[16:18])
+	f.dst_port = binary.NativeEndian.Uint16(b[18:20])
+	f.proto = binary.NativeEndian.Uint16(b[20:22])
+
+	f.policy_type = binary.NativeEndian.Uint16(b[22:24])
+	f.policy_index = binary.NativeEndian.Uint16(b[24:26])
+
+	f.verdict = b[26]
+	f.flags = b[27]
+	f.reason = b[28]
+
+	copy(f.user_id[:], b[29:49])
+
+	return nil
+}
+
+// Flow is an aggregate of flow events with the same device, direction, remote address, service, verdict and deciding policy
+type Flow struct {
+	Username string `json:"username"`
+	Device   string `json:"device"`
+
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Protocol    string `json:"protocol"`
+	// The service port the policies were checked against, the destination port for outbound packets and the source port for inbound
+	Port    uint16 `json:"port"`
+	Inbound bool   `json:"inbound"`
+
+	Verdict string `json:"verdict"`
+
+	// The policy that decided the verdict, "none" if no policy matched and the packet was dropped by default
+	Policy      string `json:"policy"`
+	PolicyIndex int    `json:"policy_index"`
+
+	Logged  bool `json:"logged"`
+	Sampled bool `json:"sampled"`
+
+	// Number of events aggregated into this flow, sampled flows represent roughly Events * SampleRate packets
+	Events uint64 `json:"events"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type flowKey struct {
+	device, remote string
+	proto, port    uint16
+	inbound        bool
+	verdict        uint8
+	policyType     uint16
+	policyIndex    uint16
+}
+
+type flowEntry struct {
+	Flow
+
+	// Events already sent to the ipfix collector
+	exported uint64
+
+	src, dst [4]byte
+	proto    uint8
+
+	// Position in flowsRecency
+	recency *list.Element
+}
+
+var (
+	flowsLock  sync.RWMutex
+	flowReader *ringbuf.Reader
+	flows      = map[flowKey]*flowEntry{}
+	// Keys of flows, most recently seen at the front, so the least recently seen flow can be evicted without a scan
+	flowsRecency = list.New()
+	flowsFile    *os.File
+	flowExport   chan bool
+
+	// Difference between the wall clock and the monotonic clock used by bpf_ktime_get_ns
+	monotonicOffset time.Duration
+)
+
+func startFlowLogs(errorChan chan<- error) error {
+	err := xdpObjects.FlowSampleRate.Put(uint32(0), config.Values.FlowLogs.SampleRate)
+	if err != nil {
+		return fmt.Errorf("could not set flow sample rate: %s", err)
+	}
+
+	now, err := monotonicNow()
+	if err != nil {
+		return err
+	}
+	monotonicOffset = time.Duration(time.Now().UnixNano()) - now
+
+	if config.Values.FlowLogs.JSONLinesPath != "" {
+		flowsFile, err = os.OpenFile(config.Values.FlowLogs.JSONLinesPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("could not open flow log file: %s", err)
+		}
+	}
+
+	flowReader, err = ringbuf.NewReader(xdpObjects.FlowEvents)
+	if err != nil {
+		return fmt.Errorf("could not read flow events: %s", err)
+	}
+
+	go func(reader *ringbuf.Reader) {
+		for {
+			record, err := reader.Read()
+			if err != nil {
+				if !errors.Is(err, ringbuf.ErrClosed) {
+					errorChan <- fmt.Errorf("flow log reader failed: %s", err)
+				}
+				return
+			}
+
+			var event flowevent
+			if err := event.Unpack(record.RawSample); err != nil {
+				log.Println("unable to unpack flow event: ", err)
+				continue
+			}
+
+			f := resolveFlow(event)
+
+			if event.flags&(flowLogged|flowSampled) != 0 {
+				recordFlow(f)
+			}
+
+			if event.flags&flowTraced != 0 {
+				publishTrace(f)
+			}
+		}
+	}(flowReader)
+
+	if config.Values.FlowLogs.IPFIXCollector != "" {
+		flowExport = make(chan bool)
+		go exportIPFIX(config.Values.FlowLogs.IPFIXCollector, flowExport)
+	}
+
+	log.Println("Started flow logs, sampling 1 in", config.Values.FlowLogs.SampleRate, "packets (0 is flagged policies only)")
+
+	return nil
+}
+
+func stopFlowLogs() {
+	stopTraces()
+
+	flowsLock.Lock()
+	defer flowsLock.Unlock()
+
+	if flowReader != nil {
+		flowReader.Close()
+		flowReader = nil
+	}
+
+	if flowExport != nil {
+		close(flowExport)
+		flowExport = nil
+	}
+
+	if flowsFile != nil {
+		flowsFile.Close()
+		flowsFile = nil
+	}
+
+	clear(flows)
+	flowsRecency.Init()
+}
+
+// resolvedFlow is a flow event with the device, owner and deciding policy looked up
+type resolvedFlow struct {
+	event flowevent
+
+	inbound        bool
+	device, remote [4]byte
+	port           uint16
+
+	username string
+	policy   string
+	seen     time.Time
+}
+
+func resolveFlow(event flowevent) (f resolvedFlow) {
+	f.event = event
+	f.inbound = event.flags&flowInbound != 0
+
+	// Traced packets may not belong to a known device, in which case the traced address is the device
+	if event.flags&flowDevice == 0 && isTracing(net.IP(event.dst_ip[:]).String()) {
+		f.inbound = true
+	}
+
+	f.device, f.remote, f.port = event.src_ip, event.dst_ip, event.dst_port
+	if f.inbound {
+		f.device, f.remote, f.port = event.dst_ip, event.src_ip, event.src_port
+	}
+
+	lock.RLock()
+	f.username = addressesToUsers[net.IP(f.device[:]).String()]
+	f.policy = describeFlowPolicy(event, f.remote)
+	lock.RUnlock()
+
+	f.seen = time.Unix(0, int64(event.timestamp)).Add(monotonicOffset)
+
+	return f
+}
+
+func recordFlow(f resolvedFlow) {
+	event := f.event
+
+	key := flowKey{
+		device:      net.IP(f.device[:]).String(),
+		remote:      net.IP(f.remote[:]).String(),
+		proto:       event.proto,
+		port:        f.port,
+		inbound:     f.inbound,
+		verdict:     event.verdict,
+		policyType:  event.policy_type,
+		policyIndex: event.policy_index,
+	}
+
+	flowsLock.Lock()
+	defer flowsLock.Unlock()
+
+	entry, ok := flows[key]
+	if !ok {
+		verdict := "dropped"
+		if event.verdict == XDP_PASS {
+			verdict = "allow"
+		}
+
+		entry = &flowEntry{
+			Flow: Flow{
+				Username:    f.username,
+				Device:      key.device,
+				Source:      net.IP(event.src_ip[:]).String(),
+				Destination: net.IP(event.dst_ip[:]).String(),
+				Protocol:    protocolName(event.proto),
+				Port:        f.port,
+				Inbound:     f.inbound,
+				Verdict:     verdict,
+				Policy:      f.policy,
+				PolicyIndex: int(event.policy_index),
+				FirstSeen:   f.seen,
+			},
+			src:   event.src_ip,
+			dst:   event.dst_ip,
+			proto: uint8(event.proto),
+		}
+
+		evictOldestFlow()
+		flows[key] = entry
+		entry.recency = flowsRecency.PushFront(key)
+	} else {
+		flowsRecency.MoveToFront(entry.recency)
+	}
+
+	entry.Events++
+	entry.LastSeen = f.seen
+	entry.Logged = entry.Logged || event.flags&flowLogged != 0
+	entry.Sampled = entry.Sampled || event.flags&flowSampled != 0
+
+	if flowsFile != nil {
+		line := entry.Flow
+		line.Events = 1
+		line.FirstSeen = f.seen
+
+		b, _ := json.Marshal(line)
+		if _, err := flowsFile.Write(append(b, '\n')); err != nil {
+			log.Println("unable to write flow log: ", err)
+		}
+	}
+}
+
+// describeFlowPolicy finds the policy at the index the firewall reported, caller must hold lock
+func describeFlowPolicy(event flowevent, remote [4]byte) string {
+	if event.policy_type == routetypes.STOP {
+		return "none"
+	}
+
+	description := (&routetypes.Policy{PolicyType: event.policy_type}).String()
+
+	policyMap, ok := userPolicyMaps[event.user_id]
+	if !ok {
+		return description
+	}
+
+	var block [routetypes.MAX_POLICIES]routetypes.Policy
+	err := policyMap.Lookup(routetypes.Key{Prefixlen: 32, IP: remote}, &block)
+	if err != nil {
+		return description
+	}
+
+	// The index counts policies across chained blocks, skipping the chain slots
+	policies, _, err := followChain(block)
+	if err != nil || int(event.policy_index) >= len(policies) {
+		return description
+	}
+
+	// The policies may have changed since the packet was seen
+	if policies[event.policy_index].PolicyType != event.policy_type {
+		return description
+	}
+
+	return policies[event.policy_index].String()
+}
+
+// evictOldestFlow removes the least recently seen flow if the log is full, caller must hold flowsLock
+func evictOldestFlow() {
+	if len(flows) < config.Values.FlowLogs.Size {
+		return
+	}
+
+	oldest := flowsRecency.Back()
+	if oldest == nil {
+		return
+	}
+
+	delete(flows, flowsRecency.Remove(oldest).(flowKey))
+}
+
+// monotonicNow returns the clock used by bpf_ktime_get_ns
+func monotonicNow() (time.Duration, error) {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return 0, fmt.Errorf("could not get monotonic clock: %s", err)
+	}
+
+	return time.Duration(now.Nano()), nil
+}
+
+// GetFlows returns the flows seen by this node, most recent first
+func GetFlows() []Flow {
+	flowsLock.RLock()
+	defer flowsLock.RUnlock()
+
+	result := make([]Flow, 0, len(flows))
+	for _, f := range flows {
+		result = append(result, f.Flow)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+
+	return result
+}
+
+func protocolName(proto uint16) string {
+	switch proto {
+	case routetypes.TCP:
+		return "tcp"
+	case routetypes.UDP:
+		return "udp"
+	case routetypes.ICMP:
+		return "icmp"
+	}
+
+	return fmt.Sprintf("%d", proto)
+}
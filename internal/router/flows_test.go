@@ -0,0 +1,66 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func testFlow(remote byte, seen time.Time) resolvedFlow {
+	f := resolvedFlow{
+		inbound:  false,
+		device:   [4]byte{192, 168, 1, 2},
+		remote:   [4]byte{10, 0, 0, remote},
+		port:     443,
+		username: "toaster",
+		policy:   "none",
+		seen:     seen,
+	}
+
+	f.event.src_ip = f.device
+	f.event.dst_ip = f.remote
+	f.event.dst_port = f.port
+	f.event.proto = 6
+	f.event.flags = flowSampled | flowDevice
+
+	return f
+}
+
+func TestFlowEvictsLeastRecentlySeen(t *testing.T) {
+	previousSize := config.Values.FlowLogs.Size
+	config.Values.FlowLogs.Size = 3
+	defer func() {
+		config.Values.FlowLogs.Size = previousSize
+
+		flowsLock.Lock()
+		clear(flows)
+		flowsRecency.Init()
+		flowsLock.Unlock()
+	}()
+
+	now := time.Now()
+	recordFlow(testFlow(1, now))
+	recordFlow(testFlow(2, now.Add(time.Second)))
+	recordFlow(testFlow(3, now.Add(2*time.Second)))
+
+	// Seeing the first flow again makes the second the least recently seen
+	recordFlow(testFlow(1, now.Add(3*time.Second)))
+	recordFlow(testFlow(4, now.Add(4*time.Second)))
+
+	result := GetFlows()
+	if len(result) != 3 || flowsRecency.Len() != 3 {
+		t.Fatalf("expected the flow log to be limited to 3 flows, got %d (%d tracked)", len(result), flowsRecency.Len())
+	}
+
+	expected := []string{"10.0.0.4", "10.0.0.1", "10.0.0.3"}
+	for i, f := range result {
+		if f.Destination != expected[i] {
+			t.Fatalf("expected flows to %v, most recent first, got %s at %d", expected, f.Destination, i)
+		}
+	}
+
+	if result[1].Events != 2 {
+		t.Fatalf("expected the repeated flow to be aggregated, got %d events", result[1].Events)
+	}
+}
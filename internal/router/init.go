@@ -21,6 +21,9 @@ var (
 	Verifier = NewChallenger()
 )
 
+// Wireguards reject after time, a session that has not handshaked for this long has ended
+const newConnectionGap = 3 * time.Minute
+
 func Setup(errorChan chan<- error, iptables bool) (err error) {
 
 	initialUsers, knownDevices, err := data.GetInitialData()
@@ -51,17 +54,33 @@ func Setup(errorChan chan<- error, iptables bool) (err error) {
 		}
 	}()
 
+	err = loadGroupDependencies()
+	if err != nil {
+		return err
+	}
+
+	err = loadLockdown()
+	if err != nil {
+		return err
+	}
+
+	err = startFlowLogs(errorChan)
+	if err != nil {
+		return err
+	}
+
 	handleEvents(errorChan)
 
 	go func() {
 		ourPeerAddresses := make(map[string]string)
+		lastHandshakes := make(map[string]time.Time)
 		for {
 
 			select {
 			case <-cancel:
 				return
 			case <-time.After(500 * time.Millisecond):
-				dev, err := ctrl.Device(config.Values.Wireguard.DevName)
+				peers, err := listPeers()
 				if err != nil {
 					errorChan <- fmt.Errorf("endpoint watcher: %s", err)
 					return
@@ -72,7 +91,7 @@ func Setup(errorChan chan<- error, iptables bool) (err error) {
 					errorChan <- fmt.Errorf("endpoint watcher: failed to retrieve devices from etcd: %s", err)
 					return
 				}
-				for _, p := range dev.Peers {
+				for _, p := range peers {
 
 					if len(p.AllowedIPs) != 1 {
 						log.Println("Warning, peer ", p.PublicKey.String(), " len(p.AllowedIPs) != 1, which is not supported")
@@ -85,6 +104,26 @@ func Setup(errorChan chan<- error, iptables bool) (err error) {
 						continue
 					}
 
+					// Wireguard handshakes every two minutes while a session is in use, so only a handshake after a longer gap is a new connection
+					previousHandshake, seen := lastHandshakes[device.Address]
+					lastHandshakes[device.Address] = p.LastHandshakeTime
+					if seen && !p.LastHandshakeTime.IsZero() && p.LastHandshakeTime.Sub(previousHandshake) > newConnectionGap {
+						event := data.ConnectionEvent{
+							Time:     p.LastHandshakeTime,
+							Type:     data.ConnectionHandshake,
+							Username: device.Username,
+							Address:  device.Address,
+						}
+
+						if p.Endpoint != nil {
+							event.Endpoint = p.Endpoint.String()
+						}
+
+						if err := data.RecordConnectionEvent(event); err != nil {
+							log.Printf("unable to record device (%s:%s) handshake: %s", device.Address, device.Username, err)
+						}
+					}
+
 					// If the peer endpoint has become empty (due to peer roaming) or if we dont have a record of it, set the map
 					if _, ok := ourPeerAddresses[device.Address]; !ok || p.Endpoint == nil {
 						ourPeerAddresses[device.Address] = p.Endpoint.String()
@@ -132,6 +171,8 @@ func TearDown(force bool) {
 		cancel <- true
 	}
 
+	stopFlowLogs()
+
 	log.Println("Removing wireguard device")
 	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
 	if err != nil {
@@ -140,6 +181,13 @@ func TearDown(force bool) {
 	}
 	defer conn.Close()
 
+	for _, iface := range config.Values.Wireguard.Interfaces {
+		err = delWg(conn, iface.DevName)
+		if err != nil {
+			log.Println("Unable to remove wireguard device", iface.DevName, "delete failed: ", err.Error())
+		}
+	}
+
 	err = delWg(conn, config.Values.Wireguard.DevName)
 	if err != nil {
 		log.Println("Unable to remove wireguard device, delete failed: ", err.Error())
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+const (
+	flowExportInterval = 10 * time.Second
+
+	ipfixVersion    = 10
+	ipfixTemplateID = 256
+
+	// Keep messages under the common tunnel mtu
+	ipfixMaxMessage = 1400
+)
+
+// Information elements (https://www.iana.org/assignments/ipfix/ipfix.xhtml) and their lengths, 65535 is variable length
+var ipfixTemplate = []struct {
+	id, length uint16
+}{
+	{8, 4},       // sourceIPv4Address
+	{12, 4},      // destinationIPv4Address
+	{4, 1},       // protocolIdentifier
+	{7, 2},       // sourceTransportPort
+	{11, 2},      // destinationTransportPort
+	{2, 8},       // packetDeltaCount
+	{152, 8},     // flowStartMilliseconds
+	{153, 8},     // flowEndMilliseconds
+	{89, 1},      // forwardingStatus
+	{371, 65535}, // userName
+}
+
+// exportIPFIX periodically sends flows with new events to the collector until stop is closed
+func exportIPFIX(collector string, stop <-chan bool) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		log.Println("unable to connect to ipfix collector: ", err)
+		return
+	}
+	defer conn.Close()
+
+	var sequence uint32
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(flowExportInterval):
+		}
+
+		for _, message := range ipfixMessages(&sequence) {
+			if _, err := conn.Write(message); err != nil {
+				log.Println("unable to send flows to ipfix collector: ", err)
+				break
+			}
+		}
+	}
+}
+
+// ipfixMessages encodes every flow that has had events since the last export, each message carries the template as the transport is udp
+func ipfixMessages(sequence *uint32) (messages [][]byte) {
+	flowsLock.Lock()
+	defer flowsLock.Unlock()
+
+	var (
+		records [][]byte
+		now     = time.Now()
+	)
+
+	for _, f := range flows {
+		if f.Events == f.exported {
+			continue
+		}
+
+		records = append(records, ipfixRecord(f))
+		f.exported = f.Events
+	}
+
+	template := ipfixTemplateSet()
+
+	for len(records) > 0 {
+		dataSet := binary.BigEndian.AppendUint16(nil, ipfixTemplateID)
+		dataSet = binary.BigEndian.AppendUint16(dataSet, 0)
+
+		count := 0
+		for _, record := range records {
+			if 16+len(template)+len(dataSet)+len(record) > ipfixMaxMessage && count > 0 {
+				break
+			}
+
+			dataSet = append(dataSet, record...)
+			count++
+		}
+		records = records[count:]
+
+		binary.BigEndian.PutUint16(dataSet[2:], uint16(len(dataSet)))
+
+		message := binary.BigEndian.AppendUint16(nil, ipfixVersion)
+		message = binary.BigEndian.AppendUint16(message, uint16(16+len(template)+len(dataSet)))
+		message = binary.BigEndian.AppendUint32(message, uint32(now.Unix()))
+		message = binary.BigEndian.AppendUint32(message, *sequence)
+		message = binary.BigEndian.AppendUint32(message, uint32(data.GetServerID()))
+
+		message = append(message, template...)
+		message = append(message, dataSet...)
+
+		*sequence += uint32(count)
+
+		messages = append(messages, message)
+	}
+
+	return
+}
+
+func ipfixTemplateSet() []byte {
+	set := binary.BigEndian.AppendUint16(nil, 2)
+	set = binary.BigEndian.AppendUint16(set, uint16(4+4+4*len(ipfixTemplate)))
+
+	set = binary.BigEndian.AppendUint16(set, ipfixTemplateID)
+	set = binary.BigEndian.AppendUint16(set, uint16(len(ipfixTemplate)))
+
+	for _, field := range ipfixTemplate {
+		set = binary.BigEndian.AppendUint16(set, field.id)
+		set = binary.BigEndian.AppendUint16(set, field.length)
+	}
+
+	return set
+}
+
+func ipfixRecord(f *flowEntry) []byte {
+	record := append([]byte{}, f.src[:]...)
+	record = append(record, f.dst[:]...)
+	record = append(record, f.proto)
+
+	// Flows are aggregated on the service port, so the ephemeral port is not known
+	var srcPort, dstPort uint16 = 0, f.Port
+	if f.Inbound {
+		srcPort, dstPort = f.Port, 0
+	}
+
+	record = binary.BigEndian.AppendUint16(record, srcPort)
+	record = binary.BigEndian.AppendUint16(record, dstPort)
+
+	record = binary.BigEndian.AppendUint64(record, f.Events-f.exported)
+	record = binary.BigEndian.AppendUint64(record, uint64(f.FirstSeen.UnixMilli()))
+	record = binary.BigEndian.AppendUint64(record, uint64(f.LastSeen.UnixMilli()))
+
+	// RFC 7270 forwarding status, 64 forwarded and 128 dropped with an unknown reason
+	status := byte(128)
+	if f.Verdict == "allow" {
+		status = 64
+	}
+	record = append(record, status)
+
+	username := f.Username
+	if len(username) > 254 {
+		username = username[:254]
+	}
+	record = append(record, byte(len(username)))
+	record = append(record, username...)
+
+	return record
+}
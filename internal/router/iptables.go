@@ -3,6 +3,7 @@ package router
 import (
 	"errors"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/NHAS/wag/internal/config"
@@ -16,8 +17,6 @@ func setupIptables() error {
 		return err
 	}
 
-	devName := config.Values.Wireguard.DevName
-
 	//So. This to the average person will look like we say "Hey server forward anything and everything from the wireguard interface"
 	//And without the xdp ebpf program it would be, however if you look at xdp.c you can see that we can manipulate maps of addresses for each user
 	//This then controls whether the packet is dropped, but we still need iptables to do the higher level routing stuffs
@@ -32,7 +31,35 @@ func setupIptables() error {
 		return err
 	}
 
-	err = ipt.Append("filter", "FORWARD", "-i", devName, "-j", "ACCEPT")
+	interfaces := config.AllInterfaces()
+
+	// Interfaces are isolated network segments, so never forward between them even if a policy would allow it
+	for _, from := range interfaces {
+		for _, to := range interfaces {
+			if from.DevName == to.DevName {
+				continue
+			}
+
+			err = ipt.Append("filter", "FORWARD", "-i", from.DevName, "-o", to.DevName, "-j", "DROP")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, iface := range interfaces {
+		err = setupInterfaceIptables(ipt, iface.DevName, iface.Range.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setupInterfaceIptables(ipt *iptables.IPTables, devName, subnet string) error {
+
+	err := ipt.Append("filter", "FORWARD", "-i", devName, "-j", "ACCEPT")
 	if err != nil {
 		return err
 	}
@@ -44,7 +71,7 @@ func setupIptables() error {
 
 	shouldNAT := config.Values.NAT == nil || (config.Values.NAT != nil && *config.Values.NAT)
 	if shouldNAT {
-		err = ipt.Append("nat", "POSTROUTING", "-s", config.Values.Wireguard.Range.String(), "-j", "MASQUERADE")
+		err = ipt.Append("nat", "POSTROUTING", "-s", subnet, "-j", "MASQUERADE")
 		if err != nil {
 			return err
 		}
@@ -80,6 +107,16 @@ func setupIptables() error {
 		}
 	}
 
+	if config.Values.DNSProxy.Enabled {
+		port := strconv.Itoa(config.Values.DNSProxy.ListenPort)
+		for _, proto := range []string{"udp", "tcp"} {
+			err = ipt.Append("filter", "INPUT", "-m", proto, "-p", proto, "-i", devName, "--dport", port, "-j", "ACCEPT")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	err = ipt.Append("filter", "INPUT", "-p", "icmp", "-i", devName, "-j", "ACCEPT")
 	if err != nil {
 		return err
@@ -112,20 +149,43 @@ func teardownIptables() {
 		log.Println("Unable to clean up firewall rules: ", err)
 	}
 
+	interfaces := config.AllInterfaces()
+	for _, from := range interfaces {
+		for _, to := range interfaces {
+			if from.DevName == to.DevName {
+				continue
+			}
+
+			err = ipt.Delete("filter", "FORWARD", "-i", from.DevName, "-o", to.DevName, "-j", "DROP")
+			if err != nil {
+				log.Println("Unable to clean up firewall rules: ", err)
+			}
+		}
+	}
+
+	for _, iface := range interfaces {
+		teardownInterfaceIptables(ipt, iface.DevName, iface.Range.String())
+	}
+
+	log.Println("Firewall rules removed.")
+}
+
+func teardownInterfaceIptables(ipt *iptables.IPTables, devName, subnet string) {
+
 	//Setup the links to the new chains
-	err = ipt.Delete("filter", "FORWARD", "-i", config.Values.Wireguard.DevName, "-j", "ACCEPT")
+	err := ipt.Delete("filter", "FORWARD", "-i", devName, "-j", "ACCEPT")
 	if err != nil {
 		log.Println("Unable to clean up firewall rules: ", err)
 	}
 
-	err = ipt.Delete("filter", "FORWARD", "-o", config.Values.Wireguard.DevName, "-j", "ACCEPT")
+	err = ipt.Delete("filter", "FORWARD", "-o", devName, "-j", "ACCEPT")
 	if err != nil {
 		log.Println("Unable to clean up firewall rules: ", err)
 	}
 
 	shouldNAT := config.Values.NAT == nil || (config.Values.NAT != nil && *config.Values.NAT)
 	if shouldNAT {
-		err = ipt.Delete("nat", "POSTROUTING", "-s", config.Values.Wireguard.Range.String(), "-j", "MASQUERADE")
+		err = ipt.Delete("nat", "POSTROUTING", "-s", subnet, "-j", "MASQUERADE")
 		if err != nil {
 			log.Println("Unable to clean up firewall rules: ", err)
 		}
@@ -133,7 +193,7 @@ func teardownIptables() {
 
 	if config.Values.NumberProxies == 0 {
 		//Allow input to authorize web server on the tunnel
-		err = ipt.Delete("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", config.Values.Wireguard.DevName, "--dport", config.Values.Webserver.Tunnel.Port, "-j", "ACCEPT")
+		err = ipt.Delete("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", devName, "--dport", config.Values.Webserver.Tunnel.Port, "-j", "ACCEPT")
 		if err != nil {
 			log.Println("Unable to clean up firewall rules: ", err)
 		}
@@ -141,7 +201,7 @@ func teardownIptables() {
 		// Open port 80 to allow http redirection
 		if config.Values.Webserver.Tunnel.SupportsTLS() {
 			//Allow input to authorize web server on the tunnel (http -> https redirect), if we're not behind a proxy
-			err = ipt.Delete("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", config.Values.Wireguard.DevName, "--dport", "80", "-j", "ACCEPT")
+			err = ipt.Delete("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", devName, "--dport", "80", "-j", "ACCEPT")
 			if err != nil {
 				log.Println("Unable to clean up firewall rules: ", err)
 			}
@@ -154,26 +214,34 @@ func teardownIptables() {
 			log.Println(port + " is not in a valid port format. E.g 80/tcp, 100-200/tcp")
 		}
 
-		err = ipt.Delete("filter", "INPUT", "-m", parts[1], "-p", parts[1], "-i", config.Values.Wireguard.DevName, "--dport", strings.Replace(parts[0], "-", ":", 1), "-j", "ACCEPT")
+		err = ipt.Delete("filter", "INPUT", "-m", parts[1], "-p", parts[1], "-i", devName, "--dport", strings.Replace(parts[0], "-", ":", 1), "-j", "ACCEPT")
 		if err != nil {
 			log.Println("unable to cleanup custom defined port", port, ":", err)
 		}
 	}
 
-	err = ipt.Delete("filter", "INPUT", "-p", "icmp", "-i", config.Values.Wireguard.DevName, "-j", "ACCEPT")
+	if config.Values.DNSProxy.Enabled {
+		port := strconv.Itoa(config.Values.DNSProxy.ListenPort)
+		for _, proto := range []string{"udp", "tcp"} {
+			err = ipt.Delete("filter", "INPUT", "-m", proto, "-p", proto, "-i", devName, "--dport", port, "-j", "ACCEPT")
+			if err != nil {
+				log.Println("Unable to clean up firewall rules: ", err)
+			}
+		}
+	}
+
+	err = ipt.Delete("filter", "INPUT", "-p", "icmp", "-i", devName, "-j", "ACCEPT")
 	if err != nil {
 		log.Println("Unable to clean up firewall rules: ", err)
 	}
 
-	err = ipt.Delete("filter", "INPUT", "-i", config.Values.Wireguard.DevName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	err = ipt.Delete("filter", "INPUT", "-i", devName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
 	if err != nil {
 		log.Println("Unable to clean up firewall rules: ", err)
 	}
 
-	err = ipt.Delete("filter", "INPUT", "-i", config.Values.Wireguard.DevName, "-j", "DROP")
+	err = ipt.Delete("filter", "INPUT", "-i", devName, "-j", "DROP")
 	if err != nil {
 		log.Println("Unable to clean up firewall rules: ", err)
 	}
-
-	log.Println("Firewall rules removed.")
 }
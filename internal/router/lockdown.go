@@ -0,0 +1,95 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+// The lockdown this node is enforcing, nil if there is none. Guarded by lock
+var currentLockdown *data.Lockdown
+
+func loadLockdown() error {
+	lockdown, ok, err := data.GetLockdown()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Devices start deauthenticated, so only new authorisations need blocking
+	currentLockdown = &lockdown
+
+	log.Printf("cluster is in lockdown until %s: %s", lockdown.Expires.Format("2006-01-02 15:04:05"), lockdown.Reason)
+
+	return nil
+}
+
+// lockedOut returns whether the user has lost access to mfa routes due to a lockdown, caller must hold lock
+func lockedOut(username string) (bool, error) {
+	if currentLockdown == nil || !currentLockdown.Active() {
+		return false, nil
+	}
+
+	// Exemptions can come through nested and dynamic groups, which only the resolved membership has
+	groups, err := data.GetUserGroupMembership(username)
+	if err != nil {
+		return true, fmt.Errorf("failed to get group membership for %s: %s", username, err)
+	}
+
+	return !currentLockdown.Exempt(groups), nil
+}
+
+// applyLockdown deauthenticates every device on this node that does not belong to an exempt user
+func applyLockdown(lockdown, previous data.Lockdown) error {
+	lock.Lock()
+
+	currentLockdown = &lockdown
+
+	var errs []error
+	for username, addresses := range usersToAddresses {
+		// Devices of users whose membership could not be found are deauthenticated, as they are not known to be exempt
+		locked, err := lockedOut(username)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if !locked {
+			continue
+		}
+
+		for address := range addresses {
+			if err := _deauthenticate(address); err != nil {
+				errs = append(errs, fmt.Errorf("unable to deauthenticate %s:%s: %s", username, address, err))
+			}
+		}
+	}
+
+	lock.Unlock()
+
+	// Public routes are removed from the policies of users that are not exempt, see data.GetEffectiveAcl
+	if lockdown.BlockPublic || previous.BlockPublic {
+		errs = append(errs, RefreshConfiguration()...)
+	}
+
+	return errors.Join(errs...)
+}
+
+func liftLockdown(previous data.Lockdown) error {
+	lock.Lock()
+	currentLockdown = nil
+	lock.Unlock()
+
+	if previous.BlockPublic {
+		return errors.Join(RefreshConfiguration()...)
+	}
+
+	return nil
+}
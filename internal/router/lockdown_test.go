@@ -0,0 +1,47 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func TestLockedOutNestedExemption(t *testing.T) {
+	// tester is only a direct member of group:responders, which is itself a member of the exempt group
+	err := data.SetGroup("group:responders", []string{"tester"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.RemoveGroup("group:responders")
+
+	err = data.SetGroup("group:oncall", []string{"group:responders"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.RemoveGroup("group:oncall")
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	currentLockdown = &data.Lockdown{Expires: time.Now().Add(time.Hour), ExemptGroups: []string{"group:oncall"}}
+	defer func() { currentLockdown = nil }()
+
+	locked, err := lockedOut("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if locked {
+		t.Fatal("user exempt through a nested group was locked out")
+	}
+
+	locked, err = lockedOut("not_a_member")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !locked {
+		t.Fatal("user outside the exempt groups was not locked out")
+	}
+}
@@ -113,12 +113,12 @@ func (c *Challenger) Challenge(address string) error {
 		return fmt.Errorf("failed to get device address for ws challenge: %s", err)
 	}
 
-	maxLifetimeMinutes, err := data.GetSessionLifetimeMinutes()
+	_, maxLifetimeMinutes, err := data.GetEffectiveSessionTimeouts(deviceDetails.Username)
 	if err != nil {
 		return fmt.Errorf("failed max lifetime: %s", err)
 	}
 
-	if time.Now().After(deviceDetails.Authorised.Add(time.Duration(maxLifetimeMinutes) * time.Minute)) {
+	if maxLifetimeMinutes >= 0 && time.Now().After(deviceDetails.Authorised.Add(time.Duration(maxLifetimeMinutes)*time.Minute)) {
 		return fmt.Errorf("challenge came from expired session")
 	}
 
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+func minutesToNanoseconds(minutes int) uint64 {
+	if minutes < 0 {
+		return math.MaxUint64
+	}
+
+	return uint64(minutes) * 60000000000
+}
+
+// setInactivityOverride sets the inactivity timeout of a device if its owners groups override the cluster wide setting, caller must hold lock
+func setInactivityOverride(username, address string) error {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return fmt.Errorf("%q is not an ipv4 address", address)
+	}
+
+	inactivityTimeoutMinutes, _, err := data.GetEffectiveSessionTimeouts(username)
+	if err != nil {
+		return err
+	}
+
+	globalInactivityTimeoutMinutes, err := data.GetSessionInactivityTimeoutMinutes()
+	if err != nil {
+		return err
+	}
+
+	if inactivityTimeoutMinutes == globalInactivityTimeoutMinutes {
+		return removeInactivityOverride(address)
+	}
+
+	err = xdpObjects.InactivityOverrides.Put([]byte(ip), minutesToNanoseconds(inactivityTimeoutMinutes))
+	if errors.Is(err, unix.E2BIG) {
+		// Otherwise the device would silently fall back to the cluster wide timeout, which may be longer than its groups allow
+		return fmt.Errorf("inactivity override table is full (%d entries), cannot apply group session policy to %s", xdpObjects.InactivityOverrides.MaxEntries(), address)
+	}
+
+	return err
+}
+
+func removeInactivityOverride(address string) error {
+	err := xdpObjects.InactivityOverrides.Delete([]byte(net.ParseIP(address).To4()))
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// refreshInactivityOverrides recalculates the device inactivity timeouts of usernames, or of every user if none are given. Caller must hold lock
+func refreshInactivityOverrides(usernames ...string) error {
+	if len(usernames) == 0 {
+		for username := range usersToAddresses {
+			usernames = append(usernames, username)
+		}
+	}
+
+	var errs []error
+	for _, username := range usernames {
+		for address := range usersToAddresses[username] {
+			if err := setInactivityOverride(username, address); err != nil {
+				errs = append(errs, fmt.Errorf("unable to set inactivity timeout for %s:%s: %s", username, address, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RefreshSessionPolicy updates the inactivity timeouts of the devices owned by members of group
+func RefreshSessionPolicy(group string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	members, everyone := affectedUsers(group)
+	if everyone {
+		return refreshInactivityOverrides()
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	return refreshInactivityOverrides(members...)
+}
+
+// RefreshUserSessionPolicy updates the inactivity timeouts of a users devices after their group membership changes
+func RefreshUserSessionPolicy(username string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return refreshInactivityOverrides(username)
+}
+
+// deviceInactivityTimeout returns the inactivity timeout in nano seconds the firewall applies to a device
+func deviceInactivityTimeout(ip net.IP) (uint64, error) {
+	var timeout uint64
+	if xdpObjects.InactivityOverrides.Lookup([]byte(ip.To4()), &timeout) == nil {
+		return timeout, nil
+	}
+
+	inactivityTimeoutMinutes, err := data.GetSessionInactivityTimeoutMinutes()
+	if err != nil {
+		return 0, err
+	}
+
+	return minutesToNanoseconds(inactivityTimeoutMinutes), nil
+}
@@ -1,8 +1,10 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
@@ -50,6 +52,42 @@ func handleEvents(errorChan chan<- error) {
 		return
 	}
 
+	_, err = data.RegisterEventListener(data.SessionPoliciesPrefix, true, sessionPolicyChanges)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	_, err = data.RegisterEventListener(data.LockdownKey, false, lockdownChanges)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	_, err = data.RegisterEventListener(data.ObjectsPrefix, true, objectChanges)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	_, err = data.RegisterEventListener(data.DynamicGroupsPrefix, true, dynamicGroupChanges)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	_, err = data.RegisterEventListener(data.UserClaimsPrefix, true, claimsChanges)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	_, err = data.RegisterEventListener(data.GrantsPrefix, true, grantChanges)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
 }
 
 func inactivityTimeoutChanges(_ string, current, _ int, et data.EventType) error {
@@ -85,6 +123,13 @@ func deviceChanges(_ string, current, previous data.Device, et data.EventType) e
 
 		log.Println("added peer: ", current.Address)
 
+		if isScoped(current) {
+			err := SetDeviceTags(current)
+			if err != nil {
+				return fmt.Errorf("unable to set device tags: %s: err: %s", current.Address, err)
+			}
+		}
+
 	case data.MODIFIED:
 		if current.Publickey != previous.Publickey {
 			key, _ := wgtypes.ParseKey(current.Publickey)
@@ -95,6 +140,14 @@ func deviceChanges(_ string, current, previous data.Device, et data.EventType) e
 			log.Println("replaced peer public key: ", current.Address)
 		}
 
+		if !slices.Equal(current.Tags, previous.Tags) {
+			err := SetDeviceTags(current)
+			if err != nil {
+				return fmt.Errorf("failed to change device tags: %s", err)
+			}
+			log.Printf("changed device (%s:%s) tags: %v -> %v", current.Address, current.Username, previous.Tags, current.Tags)
+		}
+
 		lockout, err := data.GetLockout()
 		if err != nil {
 			return fmt.Errorf("cannot get lockout: %s", err)
@@ -174,16 +227,37 @@ func deviceChanges(_ string, current, previous data.Device, et data.EventType) e
 	return nil
 }
 
+// refreshUserGroups applies the policies and session settings of the groups a user is in, after something that decides their membership changed
+func refreshUserGroups(username string) error {
+	err := RefreshUserAcls(username)
+	if err != nil {
+		log.Printf("failed to refresh acls for user %s: %s", username, err)
+		return fmt.Errorf("could not refresh acls: %s", err)
+	}
+
+	err = RefreshUserSessionPolicy(username)
+	if err != nil {
+		log.Printf("failed to refresh session policy for user %s: %s", username, err)
+		return fmt.Errorf("could not refresh session policy: %s", err)
+	}
+
+	return nil
+}
+
 func membershipChanges(key string, _, _ []string, et data.EventType) error {
-	username := strings.TrimPrefix(key, data.GroupMembershipPrefix)
+	switch et {
+	case data.CREATED, data.MODIFIED:
+		return refreshUserGroups(strings.TrimPrefix(key, data.GroupMembershipPrefix))
+	}
+
+	return nil
+}
 
+// claimsChanges re-evaluates the dynamic groups of a user when the claims they signed in with change
+func claimsChanges(key string, _, _ map[string][]string, et data.EventType) error {
 	switch et {
 	case data.CREATED, data.MODIFIED:
-		err := RefreshUserAcls(username)
-		if err != nil {
-			log.Printf("failed to refresh acls for user %s: %s", username, err)
-			return fmt.Errorf("could not refresh acls: %s", err)
-		}
+		return refreshUserGroups(strings.TrimPrefix(key, data.UserClaimsPrefix))
 	}
 
 	return nil
@@ -220,6 +294,13 @@ func userChanges(_ string, current, previous data.UserModel, et data.EventType)
 			}
 		}
 
+		// Dynamic groups may match on the mfa type
+		if current.MfaType != previous.MfaType {
+			if err := refreshUserGroups(current.Username); err != nil {
+				return err
+			}
+		}
+
 		if current.Mfa != previous.Mfa || current.MfaType != previous.MfaType ||
 			!current.Enforcing || types.MFA(current.MfaType) == types.Unset {
 			err := DeauthenticateAllDevices(current.Username)
@@ -234,13 +315,14 @@ func userChanges(_ string, current, previous data.UserModel, et data.EventType)
 	return nil
 }
 
-func aclsChanges(_ string, _, _ acls.Acl, et data.EventType) error {
-	// TODO refresh the users that the acl applies to as a potential performance improvement
+func aclsChanges(key string, _, _ acls.Acl, et data.EventType) error {
 	switch et {
 	case data.CREATED, data.DELETED, data.MODIFIED:
-		err := RefreshConfiguration()
+		effects := strings.TrimPrefix(key, data.AclsPrefix)
+
+		err := refreshAffectedAcls(effects)
 		if err != nil {
-			return fmt.Errorf("failed to refresh configuration: %s", err)
+			return fmt.Errorf("failed to refresh acls for %s: %s", effects, err)
 		}
 
 	}
@@ -248,17 +330,136 @@ func aclsChanges(_ string, _, _ acls.Acl, et data.EventType) error {
 	return nil
 }
 
-func groupChanges(_ string, current, _ []string, et data.EventType) error {
+// grantChanges applies temporary access when it is granted, and removes it when the grant expires or is revoked
+func grantChanges(_ string, current, _ data.Grant, et data.EventType) error {
 	switch et {
 	case data.CREATED, data.DELETED, data.MODIFIED:
+		// The previous value of a deleted key is passed as current
+		err := refreshAffectedAcls(current.Effects)
+		if err != nil {
+			return fmt.Errorf("failed to refresh acls for %s after grant %s changed: %s", current.Effects, current.ID, err)
+		}
 
-		for _, username := range current {
-			err := RefreshUserAcls(username)
-			if err != nil {
-				return fmt.Errorf("failed to refresh acls for user %s: %s", username, err)
-			}
+		if et == data.DELETED {
+			log.Printf("temporary access for %s ended (grant %s)", current.Effects, current.ID)
+		} else {
+			log.Printf("temporary access granted to %s by %s until %s (grant %s)", current.Effects, current.ApprovedBy, current.Expires.Format(time.RFC3339), current.ID)
+		}
+	}
+
+	return nil
+}
+
+func objectChanges(key string, _, _ []string, et data.EventType) error {
+	switch et {
+	case data.CREATED, data.DELETED, data.MODIFIED:
+		// Any policy may refer to the object, so every users policies are recalculated
+		errs := RefreshConfiguration()
+		if len(errs) != 0 {
+			return fmt.Errorf("failed to refresh acls after %s changed: %s", strings.TrimPrefix(key, data.ObjectsPrefix), errors.Join(errs...))
+		}
+
+		log.Printf("object %s changed", strings.TrimPrefix(key, data.ObjectsPrefix))
+	}
+
+	return nil
+}
+
+func lockdownChanges(_ string, current, previous data.Lockdown, et data.EventType) error {
+
+	switch et {
+	case data.CREATED, data.MODIFIED:
+		err := applyLockdown(current, previous)
+		if err != nil {
+			return fmt.Errorf("failed to apply lockdown: %s", err)
+		}
+
+		log.Printf("cluster lockdown started by %s until %s, exempt groups: %v, reason: %s", current.By, current.Expires.Format("2006-01-02 15:04:05"), current.ExemptGroups, current.Reason)
+
+	case data.DELETED:
+		// The previous value of a deleted key is passed as current
+		err := liftLockdown(current)
+		if err != nil {
+			return fmt.Errorf("failed to lift lockdown: %s", err)
+		}
+
+		log.Println("cluster lockdown lifted")
+	}
+
+	return nil
+}
+
+func sessionPolicyChanges(key string, _, _ data.SessionPolicy, et data.EventType) error {
+	group := strings.TrimPrefix(key, data.SessionPoliciesPrefix)
+
+	switch et {
+	case data.CREATED, data.DELETED, data.MODIFIED:
+		// Lifetimes are applied when a device authorises, so only the inactivity timeouts of existing sessions change
+		err := RefreshSessionPolicy(group)
+		if err != nil {
+			return fmt.Errorf("failed to refresh session policy for %s: %s", group, err)
 		}
 
+		log.Printf("session policy for %s changed", group)
 	}
+
+	return nil
+}
+
+func groupChanges(key string, current, previous []string, et data.EventType) error {
+	group := strings.TrimPrefix(key, data.GroupsPrefix)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	before, everyoneBefore := affectedUsers(group)
+
+	// Users that are added or removed from a group have their membership key changed, which refreshes their acls (see membershipChanges)
+	// so here we only need to keep the index of which users an acl applies to up to date
+	switch et {
+	case data.CREATED, data.MODIFIED:
+		setGroupMembers(group, current)
+	case data.DELETED:
+		// The previous value of a deleted key is passed as current
+		previous, current = current, nil
+		setGroupMembers(group, nil)
+	}
+
+	// Except for the members of nested groups, which gain or lose this group without their membership key changing
+	if slices.Equal(nestedGroups(previous), nestedGroups(current)) {
+		return nil
+	}
+
+	after, everyoneAfter := affectedUsers(group)
+
+	err := refreshMembers(append(before, after...), everyoneBefore || everyoneAfter)
+	if err != nil {
+		return fmt.Errorf("failed to refresh members of groups nested in %s: %s", group, err)
+	}
+
+	return nil
+}
+
+// dynamicGroupChanges keeps track of which groups have membership rules, as changing them may add or remove any user
+func dynamicGroupChanges(key string, _, _ []string, et data.EventType) error {
+	group := strings.TrimPrefix(key, data.DynamicGroupsPrefix)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	switch et {
+	case data.CREATED, data.MODIFIED:
+		dynamicGroups[group] = true
+	case data.DELETED:
+		delete(dynamicGroups, group)
+	}
+
+	err := refreshMembers(nil, true)
+	if err != nil {
+		return fmt.Errorf("failed to refresh members of %s: %s", group, err)
+	}
+
+	log.Printf("membership rules for %s changed", group)
+
 	return nil
 }
@@ -0,0 +1,208 @@
+package router
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/cilium/ebpf"
+)
+
+// The xdp firewall looks up the account lock and policies of a device by the user_id field in the device entry.
+// Tagged devices, and devices on additional wireguard interfaces, can have different policies to the other devices of the same user,
+// so instead of the users id they are given an identity made from the username, interface and set of tags, which has its own (mirrored) lock entry and policy map.
+// Untagged devices on the default interface keep the plain users id
+type taggedIdentity struct {
+	username string
+	iface    string
+	tags     []string
+}
+
+var (
+	// address -> policy identity, only contains tagged devices or those on additional interfaces
+	deviceIdentities = map[string][20]byte{}
+
+	taggedIdentities = map[[20]byte]taggedIdentity{}
+)
+
+func isScoped(device data.Device) bool {
+	return len(device.Tags) > 0 || device.GetInterfaceName() != config.DefaultInterface
+}
+
+func policyIdentity(username, iface string, tags []string) [20]byte {
+	if iface == "" || iface == config.DefaultInterface {
+		if len(tags) == 0 {
+			return sha1.Sum([]byte(username))
+		}
+
+		// Tags are sorted when stored, so the same set of tags will always produce the same identity
+		return sha1.Sum([]byte(username + "\x00" + strings.Join(tags, ",")))
+	}
+
+	return sha1.Sum([]byte(username + "\x00" + iface + "\x00" + strings.Join(tags, ",")))
+}
+
+// deviceIdentity returns the id that should be written to the device entry for address
+func deviceIdentity(username, address string) [20]byte {
+	if id, ok := deviceIdentities[address]; ok {
+		return id
+	}
+
+	return sha1.Sum([]byte(username))
+}
+
+// SetDeviceTags moves a device to the policies for its current set of tags and interface
+func SetDeviceTags(device data.Device) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return setDeviceTags(device)
+}
+
+func setDeviceTags(device data.Device) error {
+	ip := net.ParseIP(device.Address)
+	if ip == nil || ip.To4() == nil {
+		return errors.New("device address " + device.Address + " is not an ipv4 address")
+	}
+
+	newId := policyIdentity(device.Username, device.Interface, device.Tags)
+	if isScoped(device) {
+		if _, ok := taggedIdentities[newId]; !ok {
+			var locked uint32
+			err := xdpObjects.AccountLocked.Lookup(sha1.Sum([]byte(device.Username)), &locked)
+			if err != nil {
+				return fmt.Errorf("user %s does not exist in firewall: %s", device.Username, err)
+			}
+
+			err = xdpObjects.AccountLocked.Put(newId, locked)
+			if err != nil {
+				return err
+			}
+
+			err = setSingleUserMap(newId, data.GetEffectiveDeviceAcl(device.Username, device.Interface, device.Tags))
+			if err != nil {
+				return err
+			}
+
+			taggedIdentities[newId] = taggedIdentity{username: device.Username, iface: device.Interface, tags: device.Tags}
+		}
+
+		deviceIdentities[device.Address] = newId
+	} else {
+		delete(deviceIdentities, device.Address)
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(ip.To4())
+	if err != nil {
+		return err
+	}
+
+	var deviceStruct fwentry
+	err = deviceStruct.Unpack(deviceBytes)
+	if err != nil {
+		return err
+	}
+
+	// Keep the session, only the policies change
+	deviceStruct.user_id = newId
+
+	err = xdpObjects.Devices.Update(ip.To4(), deviceStruct.Bytes(), ebpf.UpdateExist)
+	if err != nil {
+		return err
+	}
+
+	removeUnusedIdentities(device.Username)
+
+	return nil
+}
+
+func removeDeviceIdentity(address string) {
+	id, ok := deviceIdentities[address]
+	if !ok {
+		return
+	}
+
+	delete(deviceIdentities, address)
+	removeUnusedIdentities(taggedIdentities[id].username)
+}
+
+func removeUnusedIdentities(username string) {
+	inUse := map[[20]byte]bool{}
+	for _, id := range deviceIdentities {
+		inUse[id] = true
+	}
+
+	for id, identity := range taggedIdentities {
+		if identity.username != username || inUse[id] {
+			continue
+		}
+
+		removeIdentity(id)
+	}
+}
+
+func removeIdentity(id [20]byte) {
+	err := xdpObjects.PoliciesTable.Delete(id)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		log.Println("unable to remove tagged device policies: ", err)
+	}
+
+	err = xdpObjects.AccountLocked.Delete(id)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		log.Println("unable to remove tagged device lock entry: ", err)
+	}
+
+	if m, ok := userPolicyMaps[id]; ok {
+		releaseUserChains(m)
+		m.Close()
+		delete(userPolicyMaps, id)
+	}
+
+	delete(taggedIdentities, id)
+}
+
+// refreshTaggedAcls recalculates the policies of tagged devices, if username is empty all tagged devices are refreshed
+func refreshTaggedAcls(username string) error {
+	for id, identity := range taggedIdentities {
+		if username != "" && identity.username != username {
+			continue
+		}
+
+		err := setSingleUserMap(id, data.GetEffectiveDeviceAcl(identity.username, identity.iface, identity.tags))
+		if err != nil {
+			return fmt.Errorf("unable to refresh policies for %s tagged %s: %s", identity.username, identity.tags, err)
+		}
+	}
+
+	return nil
+}
+
+func setTaggedLock(username string, locked uint32) error {
+	for id, identity := range taggedIdentities {
+		if identity.username != username {
+			continue
+		}
+
+		err := xdpObjects.AccountLocked.Put(id, &locked)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeTaggedUser(username string) {
+	for address, id := range deviceIdentities {
+		if taggedIdentities[id].username == username {
+			delete(deviceIdentities, address)
+		}
+	}
+
+	removeUnusedIdentities(username)
+}
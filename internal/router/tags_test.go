@@ -0,0 +1,52 @@
+package router
+
+import (
+	"crypto/sha1"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func TestPolicyIdentity(t *testing.T) {
+	plain := sha1.Sum([]byte("toaster"))
+
+	if policyIdentity("toaster", "", nil) != plain || policyIdentity("toaster", config.DefaultInterface, nil) != plain {
+		t.Fatal("untagged devices on the default interface must use the users own id so they share the users lock and policies")
+	}
+
+	tagged := policyIdentity("toaster", "", []string{"a", "b"})
+	if tagged == plain {
+		t.Fatal("tagged device shares the users identity")
+	}
+
+	if tagged != policyIdentity("toaster", config.DefaultInterface, []string{"a", "b"}) {
+		t.Fatal("same tags on the default interface gave different identities")
+	}
+
+	if tagged == policyIdentity("toaster", "", []string{"a"}) || tagged == policyIdentity("tester", "", []string{"a", "b"}) {
+		t.Fatal("different tags or users share an identity")
+	}
+
+	// Joining tags with a separator that cannot appear in a username stops "ab" + "c" colliding with "a" + "bc"
+	if policyIdentity("ab", "", []string{"c"}) == policyIdentity("a", "", []string{"bc"}) {
+		t.Fatal("username and tags collided")
+	}
+
+	if policyIdentity("toaster", "wg1", nil) == plain || policyIdentity("toaster", "wg1", nil) == policyIdentity("toaster", "wg2", nil) {
+		t.Fatal("devices on additional interfaces must have their own identity per interface")
+	}
+}
+
+func TestDeviceIdentityFallsBackToUser(t *testing.T) {
+	scoped := policyIdentity("toaster", "", []string{"printer"})
+	deviceIdentities["10.254.0.1"] = scoped
+	defer delete(deviceIdentities, "10.254.0.1")
+
+	if deviceIdentity("toaster", "10.254.0.1") != scoped {
+		t.Fatal("scoped device did not use its identity")
+	}
+
+	if deviceIdentity("toaster", "10.254.0.2") != sha1.Sum([]byte("toaster")) {
+		t.Fatal("unscoped device did not use the users id")
+	}
+}
@@ -0,0 +1,242 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTraceDuration = time.Minute
+	MaxTraceDuration     = 10 * time.Minute
+
+	// Size of the traced_devices map in xdp.c
+	maxTraces = 64
+)
+
+// Reasons reported by xdp.c for a verdict
+var traceReasons = map[uint8]string{
+	0:  "unknown",
+	1:  "allowed by public policy",
+	2:  "allowed by mfa policy",
+	3:  "unknown device",
+	4:  "unknown account",
+	5:  "no matching policy",
+	6:  "denied",
+	7:  "session on another node",
+	8:  "account locked",
+	9:  "inactivity timeout",
+	10: "no session",
+	11: "session expired",
+}
+
+// TraceEvent is the verdict for a single packet to or from a traced device
+type TraceEvent struct {
+	Time     time.Time `json:"time"`
+	Device   string    `json:"device"`
+	Username string    `json:"username"`
+
+	Source          string `json:"source"`
+	SourcePort      uint16 `json:"source_port"`
+	Destination     string `json:"destination"`
+	DestinationPort uint16 `json:"destination_port"`
+	Protocol        string `json:"protocol"`
+	Inbound         bool   `json:"inbound"`
+
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+	Policy  string `json:"policy"`
+}
+
+var (
+	tracesLock       sync.RWMutex
+	traces           = map[string]*time.Timer{}
+	traceEnds        = map[string]time.Time{}
+	traceSubscribers = map[int]chan<- TraceEvent{}
+	nextSubscriber   int
+)
+
+// StartTrace emits the verdict of every packet to or from address on this node until the trace ends, starting a trace that is already running extends it
+func StartTrace(address string, duration time.Duration) (until time.Time, err error) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return until, fmt.Errorf("%q is not an ipv4 address", address)
+	}
+	address = ip.String()
+
+	if duration <= 0 {
+		duration = DefaultTraceDuration
+	}
+
+	if duration > MaxTraceDuration {
+		return until, fmt.Errorf("trace duration cannot be longer than %s", MaxTraceDuration)
+	}
+
+	tracesLock.Lock()
+	defer tracesLock.Unlock()
+
+	if _, ok := traces[address]; !ok && len(traces) >= maxTraces {
+		return until, fmt.Errorf("cannot trace more than %d devices at once", maxTraces)
+	}
+
+	now, err := monotonicNow()
+	if err != nil {
+		return until, err
+	}
+
+	err = xdpObjects.TracedDevices.Put([]byte(ip), uint64(now+duration))
+	if err != nil {
+		return until, fmt.Errorf("could not start trace: %s", err)
+	}
+
+	if timer, ok := traces[address]; ok {
+		timer.Stop()
+	}
+
+	traces[address] = time.AfterFunc(duration, func() {
+		tracesLock.Lock()
+		defer tracesLock.Unlock()
+
+		endTrace(address)
+	})
+
+	until = time.Now().Add(duration)
+	traceEnds[address] = until
+
+	log.Println("started packet trace of", address, "until", until.Format(time.RFC3339))
+
+	return until, nil
+}
+
+// StopTrace ends the trace of address early
+func StopTrace(address string) error {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return fmt.Errorf("%q is not an ipv4 address", address)
+	}
+
+	tracesLock.Lock()
+	defer tracesLock.Unlock()
+
+	timer, ok := traces[ip.String()]
+	if !ok {
+		return fmt.Errorf("%s is not being traced", ip.String())
+	}
+	timer.Stop()
+
+	endTrace(ip.String())
+
+	return nil
+}
+
+// endTrace removes the trace from the firewall, caller must hold tracesLock
+func endTrace(address string) {
+	delete(traces, address)
+	delete(traceEnds, address)
+
+	err := xdpObjects.TracedDevices.Delete([]byte(net.ParseIP(address).To4()))
+	if err != nil {
+		log.Println("unable to remove trace of", address, "from firewall: ", err)
+	}
+
+	log.Println("packet trace of", address, "ended")
+}
+
+func stopTraces() {
+	tracesLock.Lock()
+	defer tracesLock.Unlock()
+
+	for address, timer := range traces {
+		timer.Stop()
+		endTrace(address)
+	}
+
+	for id, subscriber := range traceSubscribers {
+		close(subscriber)
+		delete(traceSubscribers, id)
+	}
+}
+
+// ActiveTraces returns the traced device addresses on this node and when their traces end
+func ActiveTraces() map[string]time.Time {
+	tracesLock.RLock()
+	defer tracesLock.RUnlock()
+
+	result := make(map[string]time.Time, len(traceEnds))
+	for address, until := range traceEnds {
+		result[address] = until
+	}
+
+	return result
+}
+
+func isTracing(address string) bool {
+	tracesLock.RLock()
+	defer tracesLock.RUnlock()
+
+	_, ok := traces[address]
+	return ok
+}
+
+// SubscribeTraces returns a channel that receives the events of all traces on this node until unsubscribe is called.
+// Events are dropped rather than blocking the firewall if the subscriber is not keeping up
+func SubscribeTraces() (events <-chan TraceEvent, unsubscribe func()) {
+	tracesLock.Lock()
+	defer tracesLock.Unlock()
+
+	c := make(chan TraceEvent, 100)
+
+	id := nextSubscriber
+	nextSubscriber++
+
+	traceSubscribers[id] = c
+
+	return c, func() {
+		tracesLock.Lock()
+		defer tracesLock.Unlock()
+
+		if _, ok := traceSubscribers[id]; ok {
+			delete(traceSubscribers, id)
+			close(c)
+		}
+	}
+}
+
+func publishTrace(f resolvedFlow) {
+	verdict := "dropped"
+	if f.event.verdict == XDP_PASS {
+		verdict = "allow"
+	}
+
+	reason, ok := traceReasons[f.event.reason]
+	if !ok {
+		reason = fmt.Sprintf("unknown(%d)", f.event.reason)
+	}
+
+	event := TraceEvent{
+		Time:            f.seen,
+		Device:          net.IP(f.device[:]).String(),
+		Username:        f.username,
+		Source:          net.IP(f.event.src_ip[:]).String(),
+		SourcePort:      f.event.src_port,
+		Destination:     net.IP(f.event.dst_ip[:]).String(),
+		DestinationPort: f.event.dst_port,
+		Protocol:        protocolName(f.event.proto),
+		Inbound:         f.inbound,
+		Verdict:         verdict,
+		Reason:          reason,
+		Policy:          f.policy,
+	}
+
+	tracesLock.RLock()
+	defer tracesLock.RUnlock()
+
+	for _, subscriber := range traceSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
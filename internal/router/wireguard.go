@@ -46,12 +46,27 @@ func (msg *IfAddrmsg) Serialize() []byte {
 	return (*(*[unix.SizeofIfAddrmsg]byte)(unsafe.Pointer(msg)))[:]
 }
 
+// devNameFor returns the wireguard device that the peer with address is attached to
+func devNameFor(address string) string {
+	return config.InterfaceForAddress(address).DevName
+}
+
 func setupWireguard(devices []data.Device) error {
 	lock.Lock()
 	defer lock.Unlock()
 
 	var c wgtypes.Config
 
+	// Additional interfaces are always created by wag
+	extraConfigs := map[string]*wgtypes.Config{}
+	for _, iface := range config.Values.Wireguard.Interfaces {
+		ic, err := createInterface(iface)
+		if err != nil {
+			return err
+		}
+		extraConfigs[iface.DevName] = ic
+	}
+
 	if !config.Values.Wireguard.External {
 
 		conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
@@ -117,6 +132,11 @@ func setupWireguard(devices []data.Device) error {
 		usersToAddresses[device.Username] = addressesMap
 		addressesToUsers[device.Address] = device.Username
 
+		if ic, ok := extraConfigs[devNameFor(device.Address)]; ok {
+			ic.Peers = append(ic.Peers, pc)
+			continue
+		}
+
 		c.Peers = append(c.Peers, pc)
 	}
 
@@ -132,19 +152,58 @@ func setupWireguard(devices []data.Device) error {
 
 	}
 
+	for devName, ic := range extraConfigs {
+		err = ctrl.ConfigureDevice(devName, *ic)
+		if err != nil {
+			return fmt.Errorf("cannot configure wireguard device %s: err: %s", devName, err)
+		}
+	}
+
 	return nil
 }
 
-func ServerDetails() (key wgtypes.Key, port int, err error) {
+// createInterface creates the wireguard device for an additional interface, and returns its base configuration
+func createInterface(iface config.WireguardInterface) (*wgtypes.Config, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to netlink: err: %s", err)
+	}
+	defer conn.Close()
+
+	network := net.IPNet{
+		IP:   iface.ServerAddress.To4()[:4],
+		Mask: iface.Range.Mask,
+	}
+
+	err = addWg(conn, iface.DevName, network, iface.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wireguard device for interface %s: err: %s", iface.Name, err)
+	}
+
+	key, err := wgtypes.ParseKey(iface.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse wireguard private key for interface %s: err: %s", iface.Name, err)
+	}
+
+	port := iface.ListenPort
+
+	return &wgtypes.Config{
+		PrivateKey: &key,
+		ListenPort: &port,
+	}, nil
+}
+
+// ServerDetails returns the public key and listen port of the wireguard device devName
+func ServerDetails(devName string) (key wgtypes.Key, port int, err error) {
 	ctr, err := wgctrl.New()
 	if err != nil {
 		return key, port, fmt.Errorf("cannot start wireguard control %v", err)
 	}
 	defer ctr.Close()
 
-	dev, err := ctr.Device(config.Values.Wireguard.DevName)
+	dev, err := ctr.Device(devName)
 	if err != nil {
-		return key, port, fmt.Errorf("unable to start wireguard-ctrl on device with name %s: %v", config.Values.Wireguard.DevName, err)
+		return key, port, fmt.Errorf("unable to start wireguard-ctrl on device with name %s: %v", devName, err)
 	}
 
 	return dev.PublicKey, dev.ListenPort, nil
@@ -172,7 +231,7 @@ func _removePeer(publickey, address string) error {
 	})
 
 	// Try all removals, if any work then the device is effectively blocked
-	err1 := ctrl.ConfigureDevice(config.Values.Wireguard.DevName, c)
+	err1 := ctrl.ConfigureDevice(devNameFor(address), c)
 	err2 := xdpRemoveDevice(address)
 
 	if err1 != nil {
@@ -183,6 +242,8 @@ func _removePeer(publickey, address string) error {
 		return err1
 	}
 
+	removeDeviceIdentity(address)
+
 	user := addressesToUsers[address]
 	addr := usersToAddresses[user]
 	delete(addr, address)
@@ -209,7 +270,7 @@ func ReplacePeer(device data.Device, newPublicKey wgtypes.Key) error {
 		Remove:    true,
 	})
 
-	err = ctrl.ConfigureDevice(config.Values.Wireguard.DevName, c)
+	err = ctrl.ConfigureDevice(devNameFor(device.Address), c)
 	if err != nil {
 		return err
 	}
@@ -227,7 +288,7 @@ func ReplacePeer(device data.Device, newPublicKey wgtypes.Key) error {
 		},
 	}
 
-	err = ctrl.ConfigureDevice(config.Values.Wireguard.DevName, c)
+	err = ctrl.ConfigureDevice(devNameFor(device.Address), c)
 	if err != nil {
 		return err
 	}
@@ -255,7 +316,7 @@ func setPeerEndpoint(device data.Device, endpoint *net.UDPAddr) error {
 		},
 	}
 
-	err = ctrl.ConfigureDevice(config.Values.Wireguard.DevName, c)
+	err = ctrl.ConfigureDevice(devNameFor(device.Address), c)
 	if err != nil {
 		return err
 	}
@@ -268,12 +329,21 @@ func ListPeers() ([]wgtypes.Peer, error) {
 	lock.Lock()
 	defer lock.Unlock()
 
-	dev, err := ctrl.Device(config.Values.Wireguard.DevName)
-	if err != nil {
-		return nil, err
+	return listPeers()
+}
+
+// listPeers returns the peers of all wireguard interfaces
+func listPeers() (peers []wgtypes.Peer, err error) {
+	for _, iface := range config.AllInterfaces() {
+		dev, err := ctrl.Device(iface.DevName)
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, dev.Peers...)
 	}
 
-	return dev.Peers, err
+	return peers, nil
 }
 
 // AddPeer adds the device to wireguard
@@ -307,7 +377,7 @@ func AddPeer(public wgtypes.Key, username, addresss, presharedKey string, node u
 		return err
 	}
 
-	err = ctrl.ConfigureDevice(config.Values.Wireguard.DevName, c)
+	err = ctrl.ConfigureDevice(devNameFor(addresss), c)
 	if err != nil {
 		return err
 	}
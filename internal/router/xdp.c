@@ -139,6 +139,8 @@ A massive oversimplifcation of what is in this file.
 */
 
 #define MAX_POLICIES 128
+#define MAX_POLICY_BLOCKS 32   // Number of blocks of policies followed for a single route
+#define MAX_POLICY_CHAINS 65536 // Number of overflow blocks shared between all users
 #define MAX_MAP_ENTRIES 1024
 #define MAX_USERID_LENGTH 20 // Length of sha1 hash
 
@@ -150,6 +152,31 @@ A massive oversimplifcation of what is in this file.
 #define RANGE 8   // Port & protocol range e.g 22-2000
 #define SINGLE 16 // Single port & protocol
 #define DENY 32   // Deny flag
+#define LOG 64    // Emit a flow event whenever this policy matches
+#define CHAIN 128 // Last slot of a full block, lower_port and upper_port are the index of the next block in policy_chains
+
+// Flags set on flow events
+#define FLOW_LOGGED 1  // Matched a policy with the LOG flag
+#define FLOW_SAMPLED 2 // Randomly sampled
+#define FLOW_INBOUND 4 // The device is the destination of the packet
+#define FLOW_DEVICE 8  // The packet belonged to a known device
+#define FLOW_TRACED 16 // The device is being traced
+
+// Why a verdict was reached, reported in flow events
+#define REASON_NONE 0
+#define REASON_PUBLIC 1         // Allowed by a public policy
+#define REASON_AUTHORISED 2     // Allowed by an mfa policy with a valid session
+#define REASON_UNKNOWN_DEVICE 3 // Neither address is a device
+#define REASON_NO_ACCOUNT 4     // Device belongs to an account the firewall does not know
+#define REASON_NOT_MATCHED 5    // No policy matched
+#define REASON_DENIED 6         // Matched a deny policy
+#define REASON_WRONG_NODE 7     // Device session is associated with another cluster node
+#define REASON_LOCKED 8         // Account is locked
+#define REASON_INACTIVE 9       // Session timed out from inactivity
+#define REASON_NO_SESSION 10    // Device has not authorised
+#define REASON_EXPIRED 11       // Session lifetime exceeded
+
+#define FLOW_EVENTS_SIZE (256 * 1024)
 
 struct bpf_map_def
 {
@@ -291,6 +318,14 @@ struct icmphdr
     } un;
 };
 
+struct sctphdr
+{
+    __be16 source;
+    __be16 dest;
+    __be32 vtag;
+    __u32 checksum;
+};
+
 struct ip
 {
     __u32 src_ip;
@@ -300,6 +335,9 @@ struct ip
     __u16 dst_port;
 
     __u32 proto;
+
+    // ICMP type in the upper byte and code in the lower byte, only compared against ICMP policies
+    __u16 icmp_type_code;
 };
 
 struct device
@@ -353,6 +391,12 @@ struct policy
     __u16 upper_port;
 } __attribute__((__packed__));
 
+// One block of policies, either the value of a route in a users LPM trie or an entry of policy_chains
+struct policy_block
+{
+    struct policy policies[MAX_POLICIES];
+};
+
 // Hahed username to LPM trie, value size *has* to be u32 as this is a HASH of MAPS
 struct bpf_map_def SEC("maps") policies_table = {
     .type = BPF_MAP_TYPE_HASH_OF_MAPS,
@@ -362,6 +406,15 @@ struct bpf_map_def SEC("maps") policies_table = {
     .map_flags = 0,
 };
 
+// Overflow blocks of policies for routes with more than MAX_POLICIES, keyed by the index in a CHAIN policy
+struct bpf_map_def SEC("maps") policy_chains = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_POLICY_CHAINS,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(struct policy) * MAX_POLICIES,
+    .map_flags = BPF_F_NO_PREALLOC,
+};
+
 // end user
 
 // A single variable in nano seconds
@@ -373,6 +426,15 @@ struct bpf_map_def SEC("maps") inactivity_timeout_minutes = {
     .map_flags = 0,
 };
 
+// Device addresses whose users have a group session policy, to their inactivity timeout in nano seconds. Overrides inactivity_timeout_minutes
+struct bpf_map_def SEC("maps") inactivity_overrides = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .map_flags = 0,
+};
+
 // A single variable that contains the node ID
 struct bpf_map_def SEC("maps") node_Id = {
     .type = BPF_MAP_TYPE_ARRAY,
@@ -382,6 +444,57 @@ struct bpf_map_def SEC("maps") node_Id = {
     .map_flags = 0,
 };
 
+// A single variable, emit a flow event for 1 in N packets that reach the policy check. 0 disables sampling
+struct bpf_map_def SEC("maps") flow_sample_rate = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .max_entries = 1,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u32),
+    .map_flags = 0,
+};
+
+// Device addresses being traced, to the time in nano seconds the trace ends
+struct bpf_map_def SEC("maps") traced_devices = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = 64,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .map_flags = 0,
+};
+
+// Flow events for sampled packets, packets matching a policy with the LOG flag and traced devices, consumed by flows.go
+struct bpf_map_def SEC("maps") flow_events = {
+    .type = BPF_MAP_TYPE_RINGBUF,
+    .max_entries = FLOW_EVENTS_SIZE,
+    .key_size = 0,
+    .value_size = 0,
+    .map_flags = 0,
+};
+
+struct flow_event
+{
+    __u64 timestamp;
+
+    __u32 src_ip;
+    __u32 dst_ip;
+
+    __u16 src_port;
+    __u16 dst_port;
+    __u16 proto;
+
+    // The policy that decided the verdict, policy_type is STOP if no policy matched
+    __u16 policy_type;
+    __u16 policy_index;
+
+    __u8 verdict;
+    __u8 flags;
+    __u8 reason;
+
+    char user_id[MAX_USERID_LENGTH];
+
+    __u8 pad[3];
+} __attribute__((__packed__));
+
 /*
 Attempt to parse the IPv4 source address from the packet.
 Returns 0 if there is no IPv4 header field; otherwise returns non-zero.
@@ -413,6 +526,7 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
     ip_info->proto = ip->protocol;
     ip_info->dst_port = 0;
     ip_info->src_port = 0;
+    ip_info->icmp_type_code = 0;
 
     __u64 ip_header_length = (ip->ihl * 4);
     if (ip_header_length > MAX_PACKET_OFF)
@@ -459,6 +573,22 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
 
         break;
     }
+
+    case IPPROTO_SCTP:
+    {
+
+        struct sctphdr *sctph = (data + ip_header_length);
+
+        if (sctph + 1 > (struct sctphdr *)data_end)
+        {
+            return 0;
+        }
+
+        ip_info->dst_port = sctph->dest;
+        ip_info->src_port = sctph->source;
+
+        break;
+    }
     case IPPROTO_ICMP:
     {
         struct icmphdr *icmph = (data + ip_header_length);
@@ -468,6 +598,8 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
             return 0;
         }
 
+        ip_info->icmp_type_code = ((__u16)icmph->type << 8) | icmph->code;
+
         break;
     }
     }
@@ -479,11 +611,157 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
     return 1;
 }
 
-static __always_inline int conntrack(struct ip *ip_info)
+// Records the policy that made the decision in the flow event
+static __always_inline void flow_match(struct flow_event *event, struct policy *policy, __u16 index)
+{
+    event->policy_type = policy->policy_type;
+    event->policy_index = index;
+}
+
+// Returns REASON_AUTHORISED if the device has a valid session on this node, otherwise the reason it does not
+static __always_inline __u8 session_reason(struct device *current_device, __u64 node_id, __u32 isAccountLocked, __u8 isTimedOut, __u64 currentTime)
+{
+    if (node_id != current_device->associatedNode)
+    {
+        return REASON_WRONG_NODE;
+    }
+
+    if (isAccountLocked)
+    {
+        return REASON_LOCKED;
+    }
+
+    if (isTimedOut)
+    {
+        return REASON_INACTIVE;
+    }
+
+    if (current_device->sessionExpiry == 0)
+    {
+        return REASON_NO_SESSION;
+    }
+
+    // If either max session lifetime is disabled, or it is before the max lifetime of the session
+    if (current_device->sessionExpiry != __UINT64_MAX__ && currentTime >= current_device->sessionExpiry)
+    {
+        return REASON_EXPIRED;
+    }
+
+    return REASON_AUTHORISED;
+}
+
+// The packet being matched against a route's policies, and the result of the search so far
+struct policy_search
+{
+    __u16 proto;
+    __u16 port;
+    __u16 icmp_type_code;
+
+    // Reason a mfa policy would give, as the session does not change while searching
+    __u8 session;
+
+    __u8 decision;
+    __u8 chained;
+    __u32 next_block;
+
+    // Index of the policy across all blocks, reported in flow events
+    __u16 index;
+} __attribute__((__packed__));
+
+/*
+Search one block of policies, returns non-zero if the search has reached a verdict.
+If the block is full and chains to another, search->chained is set and search->next_block holds the index of the next block in policy_chains.
+This is a global function so the verifier checks it once, rather than once for every block a route may have
+*/
+__attribute__((noinline)) int search_block(struct policy_block *block, struct policy_search *search, struct flow_event *event)
+{
+    if (block == NULL || search == NULL || event == NULL)
+    {
+        return 1;
+    }
+
+    for (__u16 i = 0; i < MAX_POLICIES; i++, search->index++)
+    {
+        struct policy policy = block->policies[i];
+
+        // The chain slot is not a policy, so it does not count towards the index reported in flow events
+        if (policy.policy_type == CHAIN)
+        {
+            search->chained = 1;
+            search->next_block = policy.lower_port | ((__u32)policy.upper_port << 16);
+            return 0;
+        }
+
+        // As the array is static in size, we want to be able to terminate the search asap
+        if (policy.policy_type == STOP)
+        {
+            if (!search->decision)
+            {
+                event->reason = REASON_NOT_MATCHED;
+            }
+            return 1;
+        }
+
+        // ICMP policies match on the type and code instead of a port, every other policy sees ICMP as port 0
+        __u16 policy_port = search->port;
+        if (policy.proto == IPPROTO_ICMP && search->proto == IPPROTO_ICMP)
+        {
+            policy_port = search->icmp_type_code;
+        }
+
+        //      ANY = 0
+        //      If we match the protocol,
+        //      If type is SINGLE and the port is either any, or equal
+        //      OR
+        //      If type is RANGE and the port is within bounds
+        if ((policy.proto == ANY || policy.proto == search->proto) &&
+            ((policy.policy_type & SINGLE && (policy.lower_port == ANY || policy.lower_port == policy_port)) ||
+             (policy.policy_type & RANGE && (policy.lower_port <= policy_port && policy.upper_port >= policy_port))))
+        {
+
+            if (policy.policy_type & DENY)
+            {
+                // Deny rules take precedence over everything
+                flow_match(event, &policy, search->index);
+                event->reason = REASON_DENIED;
+                search->decision = 0;
+                return 1;
+            }
+            else if (policy.policy_type & PUBLIC)
+            {
+                // If a public route matches, it may still be overriden by a MFA or a Deny policy so we have to check all policies
+                search->decision = 1;
+                flow_match(event, &policy, search->index);
+                event->reason = REASON_PUBLIC;
+            }
+            else
+            {
+                // MFA restrictions take precedence over public rules, so if we match an MFA policy under this route
+                // Then we can fail/succeed fast
+
+                // If device does not belong to a locked account, the device itself isnt locked and if it isnt timed out
+                event->reason = search->session;
+                search->decision = search->session == REASON_AUTHORISED;
+
+                flow_match(event, &policy, search->index);
+
+                if (!search->decision)
+                {
+                    return 1;
+                }
+            }
+        }
+    }
+
+    return 0;
+}
+
+static __always_inline int conntrack(struct ip *ip_info, struct flow_event *event)
 {
 
     __u32 address = ip_info->dst_ip;
     __u16 port = ip_info->dst_port;
+    __u32 device_address = ip_info->src_ip;
 
     // Determine which address is our device
     struct device *current_device = bpf_map_lookup_elem(&devices, &ip_info->src_ip);
@@ -492,20 +770,28 @@ static __always_inline int conntrack(struct ip *ip_info)
         current_device = bpf_map_lookup_elem(&devices, &ip_info->dst_ip);
         if (current_device == NULL)
         {
+            event->reason = REASON_UNKNOWN_DEVICE;
             return 0;
         }
 
         // Our device is the dst, so what we need to check in the firewall is the src
         address = ip_info->src_ip;
         port = ip_info->src_port;
+        device_address = ip_info->dst_ip;
+
+        event->flags |= FLOW_INBOUND;
     }
 
+    event->flags |= FLOW_DEVICE;
+    __builtin_memcpy(event->user_id, current_device->user_id, MAX_USERID_LENGTH);
+
     port = bpf_ntohs(port);
 
     // Check if the account exists
     __u32 *isAccountLocked = bpf_map_lookup_elem(&account_locked, current_device->user_id);
     if (isAccountLocked == NULL)
     {
+        event->reason = REASON_NO_ACCOUNT;
         return 0;
     }
 
@@ -525,6 +811,12 @@ static __always_inline int conntrack(struct ip *ip_info)
         return 0;
     }
 
+    __u64 *inactivity_override = bpf_map_lookup_elem(&inactivity_overrides, &device_address);
+    if (inactivity_override != NULL)
+    {
+        inactivity_timeout = inactivity_override;
+    }
+
     __u64 currentTime = bpf_ktime_get_ns();
 
     // If the inactivity timeout is not disabled and users session has timed out
@@ -542,6 +834,7 @@ static __always_inline int conntrack(struct ip *ip_info)
     struct policy *applicable_policies = (user_policies != NULL) ? bpf_map_lookup_elem(user_policies, &key) : NULL;
     if (applicable_policies == NULL)
     {
+        event->reason = REASON_NOT_MATCHED;
         return 0;
     }
 
@@ -551,57 +844,101 @@ static __always_inline int conntrack(struct ip *ip_info)
         current_device->lastPacketTime = currentTime;
     }
 
-    int decision = 0;
-    for (__u16 i = 0; i < MAX_POLICIES; i++)
-    {
-
-        __u32 key = i;
-        struct policy policy = *(applicable_policies + key);
+    struct policy_search search = {0};
+    search.proto = ip_info->proto;
+    search.port = port;
+    search.icmp_type_code = ip_info->icmp_type_code;
+    search.session = session_reason(current_device, *current_node_id, *isAccountLocked, isTimedOut, currentTime);
 
-        // As the array is static in size, we want to be able to terminate the search asap
-        if (policy.policy_type == STOP)
+    // Routes with more policies than fit in one block are chained, the last slot of a full block points at the next block.
+    // The blocks are only followed for the route that matched, so the lookup is still a single search of the trie
+    struct policy_block *block = (struct policy_block *)applicable_policies;
+    for (__u16 i = 0; i < MAX_POLICY_BLOCKS && block != NULL; i++)
+    {
+        search.chained = 0;
+        if (search_block(block, &search, event))
         {
-            return decision;
+            return search.decision;
         }
 
-        //      ANY = 0
-        //      If we match the protocol,
-        //      If type is SINGLE and the port is either any, or equal
-        //      OR
-        //      If type is RANGE and the port is within bounds
-        if ((policy.proto == ANY || policy.proto == ip_info->proto) &&
-            ((policy.policy_type & SINGLE && (policy.lower_port == ANY || policy.lower_port == port)) ||
-             (policy.policy_type & RANGE && (policy.lower_port <= port && policy.upper_port >= port))))
+        if (!search.chained)
         {
+            break;
+        }
 
-            if (policy.policy_type & DENY)
-            {
-                // Deny rules take precedence over everything
-                return 0;
-            }
-            else if (policy.policy_type & PUBLIC)
-            {
-                // If a public route matches, it may still be overriden by a MFA or a Deny policy so we have to check all policies
-                decision = 1;
-            }
-            else
-            {
-                // MFA restrictions take precedence over public rules, so if we match an MFA policy under this route
-                // Then we can fail/succeed fast
+        block = bpf_map_lookup_elem(&policy_chains, &search.next_block);
+    }
 
-                // If device does not belong to a locked account, the device itself isnt locked and if it isnt timed out
-                decision = (*current_node_id == current_device->associatedNode && !*isAccountLocked && !isTimedOut && current_device->sessionExpiry != 0 &&
-                        // If either max session lifetime is disabled, or it is before the max lifetime of the session
-                        (current_device->sessionExpiry == __UINT64_MAX__ || currentTime < current_device->sessionExpiry));
+    if (!search.decision)
+    {
+        event->reason = REASON_NOT_MATCHED;
+    }
+    return search.decision;
+}
 
-                if(!decision) {
-                    return 0;
-                }
-            }
-        }
+// Returns whether either address of the packet is a device with an active trace
+static __always_inline int is_traced(struct ip *ip_info, __u64 now)
+{
+    __u64 *until = bpf_map_lookup_elem(&traced_devices, &ip_info->src_ip);
+    if (until == NULL)
+    {
+        until = bpf_map_lookup_elem(&traced_devices, &ip_info->dst_ip);
     }
 
-    return 0;
+    return until != NULL && now < *until;
+}
+
+// Emit a flow event if the packet belongs to a traced device, or belonged to a device and either matched a policy with the LOG flag or was sampled
+static __always_inline void emit_flow(struct ip *ip_info, struct flow_event *event, int decision)
+{
+    __u64 now = bpf_ktime_get_ns();
+
+    if (is_traced(ip_info, now))
+    {
+        event->flags |= FLOW_TRACED;
+    }
+
+    // Untraced packets without a device have nobody to attribute the flow to
+    if (!(event->flags & (FLOW_DEVICE | FLOW_TRACED)))
+    {
+        return;
+    }
+
+    if (event->policy_type & LOG)
+    {
+        event->flags |= FLOW_LOGGED;
+    }
+
+    __u32 index = 0;
+    __u32 *sample_rate = bpf_map_lookup_elem(&flow_sample_rate, &index);
+    if ((event->flags & FLOW_DEVICE) && sample_rate != NULL && *sample_rate != 0 && (bpf_get_prandom_u32() % *sample_rate) == 0)
+    {
+        event->flags |= FLOW_SAMPLED;
+    }
+
+    if (!(event->flags & (FLOW_LOGGED | FLOW_SAMPLED | FLOW_TRACED)))
+    {
+        return;
+    }
+
+    struct flow_event *output = bpf_ringbuf_reserve(&flow_events, sizeof(struct flow_event), 0);
+    if (output == NULL)
+    {
+        // Buffer is full, the consumer is behind so drop the event rather than the packet
+        return;
+    }
+
+    *output = *event;
+
+    output->timestamp = now;
+    output->src_ip = ip_info->src_ip;
+    output->dst_ip = ip_info->dst_ip;
+    output->src_port = bpf_ntohs(ip_info->src_port);
+    output->dst_port = bpf_ntohs(ip_info->dst_port);
+    output->proto = ip_info->proto;
+    output->verdict = decision ? XDP_PASS : XDP_DROP;
+
+    bpf_ringbuf_submit(output, 0);
 }
 
 SEC("xdp")
@@ -613,7 +950,12 @@ int xdp_wag_firewall(struct xdp_md *ctx)
         return XDP_DROP;
     }
 
-    if (conntrack(&ip_info))
+    struct flow_event event = {0};
+    int decision = conntrack(&ip_info, &event);
+
+    emit_flow(&ip_info, &event, decision);
+
+    if (decision)
     {
         return XDP_PASS;
     }
@@ -53,7 +53,15 @@ func lookupProtocol(t uint16) string {
 		return "udp"
 	case ICMP:
 		return "icmp"
+	case SCTP:
+		return "sctp"
+	case GRE:
+		return "gre"
+	case ESP:
+		return "esp"
+	case AH:
+		return "ah"
 	default:
-		return fmt.Sprintf("unknown(%d)", t)
+		return fmt.Sprintf("proto:%d", t)
 	}
 }
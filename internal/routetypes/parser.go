@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"sort"
 	"strconv"
@@ -15,14 +16,53 @@ import (
 	"time"
 )
 
+/*
+Rule grammar, fields are separated by whitespace and keywords are case insensitive
+
+	rule      = address *( service / "log" )        ; no services is the same as any/any
+	address   = ipv4 / ipv4 "/" prefix / domain
+	service   = [ "!" ] port-list "/" transport        ; "!" matches every port of the transport except those listed
+	          / "icmp" [ "/" icmp-type [ ":" icmp-code ] ]
+	          / protocol
+	          / "proto:" 0-255                        ; any ip protocol by number, e.g proto:47
+	port-list = port-item *( "," port-item )
+	port-item = port / port "-" port                  ; ports are 0-65535, a single port of 0 is any port
+	transport = "tcp" / "udp" / "sctp" / "any"
+	protocol  = "icmp" / "tcp" / "udp" / "sctp" / "gre" / "esp" / "ah"   ; every port of the protocol
+	icmp-type = 0-255
+	icmp-code = 0-255
+
+Examples: `10.0.0.1 22,80,443/tcp`, `10.0.0.0/24 !22/tcp`, `10.0.0.1 icmp/8`, `10.0.0.1 gre esp proto:115`
+*/
+
 const (
+	// The number of policies in a block, a route with more policies than this is split over several blocks linked by a CHAIN policy
 	MAX_POLICIES = 128
-
-	ICMP = 1  // Internet Control Message
-	TCP  = 6  // Transmission Control
-	UDP  = 17 // User Datagram
+	// The number of blocks the firewall will follow for a single route
+	MAX_POLICY_BLOCKS = 32
+	// The most policies a single route can have
+	MAX_ROUTE_POLICIES = MAX_POLICY_BLOCKS*(MAX_POLICIES-1) + 1
+
+	ICMP = 1   // Internet Control Message
+	TCP  = 6   // Transmission Control
+	UDP  = 17  // User Datagram
+	GRE  = 47  // Generic Routing Encapsulation
+	ESP  = 50  // Encapsulating Security Payload
+	AH   = 51  // Authentication Header
+	SCTP = 132 // Stream Control Transmission
 )
 
+// Protocols that can be named on their own in a rule, matching every port
+var protocolNumbers = map[string]uint16{
+	"icmp": ICMP,
+	"tcp":  TCP,
+	"udp":  UDP,
+	"sctp": SCTP,
+	"gre":  GRE,
+	"esp":  ESP,
+	"ah":   AH,
+}
+
 type Rule struct {
 	//We may have multiple keys in the instance where a domain with multiple A/AAA records is passed in
 	Keys []Key
@@ -130,17 +170,12 @@ func ParseRules(mfa, public, deny []string) (result []Rule, errs []error) {
 	}
 
 	for i := range result {
-		if len(result[i].Values) > MAX_POLICIES {
-			errs = append(errs, errors.New("number of policies defined was greather than max"))
+		if len(result[i].Values) > MAX_ROUTE_POLICIES {
+			errs = append(errs, fmt.Errorf("number of policies defined for %s was greater than max (%d > %d)", result[i].Keys[0].String(), len(result[i].Values), MAX_ROUTE_POLICIES))
 			return nil, errs
 		}
 
-		temp := make([]Policy, 0, MAX_POLICIES)
-		temp = append(temp, result[i].Values...)
-
 		result[i].NumPolicies = len(result[i].Values)
-
-		result[i].Values = temp[:cap(temp)]
 	}
 
 	// Dont add a cache entry if there was an error parsing
@@ -195,7 +230,16 @@ func parseRule(restrictionType PolicyType, rule string) (rules Rule, err error)
 
 	rules.Values = []Policy{}
 
-	if len(ruleParts) == 1 {
+	// The "log" keyword can appear anywhere after the address and flags every policy of the rule
+	services := ruleParts[1:]
+	for i := len(services) - 1; i >= 0; i-- {
+		if strings.ToLower(services[i]) == "log" {
+			restrictionType |= LOG
+			services = append(services[:i], services[i+1:]...)
+		}
+	}
+
+	if len(services) == 0 {
 		// If the user has only defined one address and no ports this counts as an any/any rule
 
 		rules.Values = append(rules.Values, Policy{
@@ -206,15 +250,17 @@ func parseRule(restrictionType PolicyType, rule string) (rules Rule, err error)
 
 	} else {
 
-		for _, field := range ruleParts[1:] {
-			policy, err := parseService(field)
+		for _, field := range services {
+			policies, err := parseService(field)
 			if err != nil {
 				return rules, err
 			}
 
-			policy.PolicyType = uint16(restrictionType) | policy.PolicyType
+			for _, policy := range policies {
+				policy.PolicyType = uint16(restrictionType) | policy.PolicyType
 
-			rules.Values = append(rules.Values, policy)
+				rules.Values = append(rules.Values, policy)
+			}
 		}
 	}
 
@@ -258,42 +304,127 @@ func ValidateRules(mfa, public, deny []string) error {
 	return errors.New(str)
 }
 
-func parseService(service string) (Policy, error) {
+// ValidateService checks a single service field of a rule, e.g 443/tcp, 22,80/tcp, icmp/8 or gre
+func ValidateService(service string) error {
+	_, err := parseService(service)
+	return err
+}
+
+// parseService parses a single service field of a rule, see the grammar at the top of this file.
+// A field may expand to several policies, e.g a port list or an exclusion
+func parseService(service string) ([]Policy, error) {
+	service = strings.ToLower(service)
+
+	if number, ok := strings.CutPrefix(service, "proto:"); ok {
+		proto, err := strconv.ParseUint(number, 10, 8)
+		if err != nil {
+			return nil, errors.New("could not convert protocol number: " + service)
+		}
+
+		return []Policy{
+			{
+				PolicyType: SINGLE,
+				Proto:      uint16(proto),
+				LowerPort:  ANY,
+			},
+		}, nil
+	}
+
 	parts := strings.Split(service, "/")
 	if len(parts) == 1 {
-		// are declarations like `icmp` which dont have a port
-		switch parts[0] {
-		case "icmp":
+		// are declarations like `icmp` or `gre` which dont have a port
+		proto, ok := protocolNumbers[parts[0]]
+		if !ok {
+			return nil, errors.New("malformed port/service declaration: " + service)
+		}
 
-			return Policy{
+		return []Policy{
+			{
 				PolicyType: SINGLE,
-				Proto:      ICMP,
-				LowerPort:  0,
-			}, nil
+				Proto:      proto,
+				LowerPort:  ANY,
+			},
+		}, nil
+	}
 
+	if len(parts) != 2 {
+		return nil, errors.New("malformed port/service declaration: " + service)
+	}
+
+	if parts[0] == "icmp" {
+		policy, err := parseIcmpType(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return []Policy{policy}, nil
+	}
+
+	ports, exclude := strings.CutPrefix(parts[0], "!")
+
+	var policies []Policy
+	for _, port := range strings.Split(ports, ",") {
+		var (
+			policy Policy
+			err    error
+		)
+
+		portRange := strings.Split(port, "-")
+		switch len(portRange) {
+		case 1:
+			policy, err = parseSinglePort(portRange[0], parts[1])
+		case 2:
+			policy, err = parsePortRange(portRange[0], portRange[1], parts[1])
 		default:
-			return Policy{}, errors.New("malformed port/service declaration: " + service)
+			err = errors.New("malformed port range: " + port)
+		}
+
+		if err != nil {
+			return nil, err
 		}
 
+		policies = append(policies, policy)
 	}
 
-	portRange := strings.Split(parts[0], "-")
-	proto := strings.ToLower(parts[1])
-	if len(portRange) == 1 {
-		br, err := parseSinglePort(parts[0], proto)
-		return br, err
+	if exclude {
+		return excludePorts(policies)
 	}
 
-	return parsePortRange(portRange[0], portRange[1], proto)
+	return policies, nil
+}
+
+// portProtocol returns the protocol number of a protocol that can have ports in rules
+func portProtocol(proto string) (uint16, error) {
+	switch proto {
+	case "any":
+		return ANY, nil
+	case "tcp":
+		return TCP, nil
+	case "udp":
+		return UDP, nil
+	case "sctp":
+		return SCTP, nil
+	}
+
+	return 0, errors.New("unknown service: " + proto)
+}
+
+func parsePort(port string) (uint16, error) {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, errors.New("could not convert port defintion to number: " + port)
+	}
+
+	return uint16(number), nil
 }
 
 func parsePortRange(lowerPort, upperPort, proto string) (Policy, error) {
-	lowerPortNum, err := strconv.Atoi(lowerPort)
+	lowerPortNum, err := parsePort(lowerPort)
 	if err != nil {
 		return Policy{}, errors.New("could not convert lower port defintion to number: " + lowerPort)
 	}
 
-	upperPortNum, err := strconv.Atoi(upperPort)
+	upperPortNum, err := parsePort(upperPort)
 	if err != nil {
 		return Policy{}, errors.New("could not convert upper port defintion to number: " + upperPort)
 	}
@@ -302,67 +433,127 @@ func parsePortRange(lowerPort, upperPort, proto string) (Policy, error) {
 		return Policy{}, errors.New("lower port cannot be higher than upper power: lower: " + lowerPort + " upper: " + upperPort)
 	}
 
-	switch proto {
-	case "any":
+	service, err := portProtocol(proto)
+	if err != nil {
+		return Policy{}, err
+	}
 
-		return Policy{
-			PolicyType: RANGE,
-			Proto:      ANY,
+	return Policy{
+		PolicyType: RANGE,
 
-			LowerPort: uint16(lowerPortNum),
-			UpperPort: uint16(upperPortNum),
-		}, nil
+		Proto:     service,
+		LowerPort: lowerPortNum,
+		UpperPort: upperPortNum,
+	}, nil
+}
 
-	case "tcp", "udp":
+func parseSinglePort(port, proto string) (Policy, error) {
+	portNumber, err := parsePort(port)
+	if err != nil {
+		return Policy{}, err
+	}
 
-		service := TCP
-		if proto == "udp" {
-			service = UDP
-		}
+	service, err := portProtocol(proto)
+	if err != nil {
+		return Policy{}, errors.New("unknown service: " + port + "/" + proto)
+	}
 
-		return Policy{
-			PolicyType: RANGE,
+	return Policy{
+		PolicyType: SINGLE,
+		Proto:      service,
+		LowerPort:  portNumber,
+	}, nil
+}
 
-			Proto:     uint16(service),
-			LowerPort: uint16(lowerPortNum),
-			UpperPort: uint16(upperPortNum),
-		}, nil
+// parseIcmpType parses `type` or `type:code`. The firewall compares icmp policies against the type in the upper byte and the code in the lower byte of the port
+func parseIcmpType(typeCode string) (Policy, error) {
+	icmpType, icmpCode, hasCode := strings.Cut(typeCode, ":")
+
+	t, err := strconv.ParseUint(icmpType, 10, 8)
+	if err != nil {
+		return Policy{}, errors.New("could not convert icmp type to number: " + icmpType)
+	}
+
+	policy := Policy{
+		PolicyType: RANGE,
+		Proto:      ICMP,
+		LowerPort:  uint16(t) << 8,
+		UpperPort:  uint16(t)<<8 | 0xff,
 	}
 
-	return Policy{}, errors.New("unknown service: " + proto)
+	if hasCode {
+		c, err := strconv.ParseUint(icmpCode, 10, 8)
+		if err != nil {
+			return Policy{}, errors.New("could not convert icmp code to number: " + icmpCode)
+		}
 
+		policy.LowerPort |= uint16(c)
+		policy.UpperPort = policy.LowerPort
+	}
+
+	return policy, nil
 }
 
-func parseSinglePort(port, proto string) (Policy, error) {
-	portNumber, err := strconv.Atoi(port)
-	if err != nil {
-		return Policy{}, errors.New("could not convert port defintion to number: " + port)
+// excludePorts returns range policies covering every port of the protocol that is not matched by policies
+func excludePorts(policies []Policy) ([]Policy, error) {
+	type portRange struct {
+		lower, upper int
 	}
 
-	switch proto {
-	case "any":
+	var excluded []portRange
+	for _, policy := range policies {
+		switch {
+		case policy.Is(RANGE):
+			excluded = append(excluded, portRange{int(policy.LowerPort), int(policy.UpperPort)})
+		case policy.LowerPort == ANY:
+			// A single port of 0 matches every port
+			excluded = append(excluded, portRange{0, math.MaxUint16})
+		default:
+			excluded = append(excluded, portRange{int(policy.LowerPort), int(policy.LowerPort)})
+		}
+	}
 
-		return Policy{
-			PolicyType: SINGLE,
-			Proto:      ANY,
-			LowerPort:  uint16(portNumber),
-		}, nil
+	sort.Slice(excluded, func(i, j int) bool {
+		return excluded[i].lower < excluded[j].lower
+	})
+
+	var (
+		result []Policy
+		next   = 0
+	)
 
-	case "tcp", "udp":
+	// The firewall sees protocols without ports, such as icmp and gre, as port 0. So that every port of any protocol does not also match those, port 0 is left out
+	if policies[0].Proto == ANY {
+		next = 1
+	}
 
-		service := TCP
-		if proto == "udp" {
-			service = UDP
+	for _, r := range excluded {
+		if r.lower > next {
+			result = append(result, Policy{
+				PolicyType: RANGE,
+				Proto:      policies[0].Proto,
+				LowerPort:  uint16(next),
+				UpperPort:  uint16(r.lower - 1),
+			})
 		}
 
-		return Policy{
-			PolicyType: SINGLE,
-			Proto:      uint16(service),
-			LowerPort:  uint16(portNumber),
-		}, nil
+		next = max(next, r.upper+1)
+	}
+
+	if next <= math.MaxUint16 {
+		result = append(result, Policy{
+			PolicyType: RANGE,
+			Proto:      policies[0].Proto,
+			LowerPort:  uint16(next),
+			UpperPort:  math.MaxUint16,
+		})
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("exclusion leaves no ports")
 	}
 
-	return Policy{}, errors.New("unknown service: " + port + "/" + proto)
+	return result, nil
 }
 
 type cacheEntry struct {
@@ -430,3 +621,18 @@ func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 		},
 	}, nil
 }
+
+// SplitPolicies divides the policies of a route into the blocks the firewall reads.
+// Every block but the last leaves its final slot empty for the CHAIN policy that points at the next block
+func SplitPolicies(policies []Policy) (blocks [][MAX_POLICIES]Policy) {
+	for {
+		var block [MAX_POLICIES]Policy
+		if len(policies) <= MAX_POLICIES {
+			copy(block[:], policies)
+			return append(blocks, block)
+		}
+
+		policies = policies[copy(block[:MAX_POLICIES-1], policies):]
+		blocks = append(blocks, block)
+	}
+}
@@ -3,6 +3,7 @@ package routetypes
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -275,6 +276,65 @@ func TestParsePortRange(t *testing.T) {
 
 }
 
+func TestParseLogFlag(t *testing.T) {
+	br, err := parseRule(PUBLIC, "1.5.1.5 22/tcp log 53/udp")
+	if err != nil {
+		t.Fatal("failed to parse 1.5.1.5", err)
+	}
+
+	if len(br.Values) != 2 {
+		t.Fatal("expected to define 2 policies for key got: ", len(br.Values))
+	}
+
+	expectedValue := Policy{
+		PolicyType: PUBLIC | LOG | SINGLE,
+		LowerPort:  22,
+		Proto:      TCP,
+	}
+
+	if err := checkPolicy(br.Values[0], expectedValue); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedValue = Policy{
+		PolicyType: PUBLIC | LOG | SINGLE,
+		LowerPort:  53,
+		Proto:      UDP,
+	}
+
+	if err := checkPolicy(br.Values[1], expectedValue); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err = parseRule(DENY, "1.6.1.6 log")
+	if err != nil {
+		t.Fatal("failed to parse 1.6.1.6", err)
+	}
+
+	expectedValue = Policy{
+		PolicyType: DENY | LOG | SINGLE,
+		LowerPort:  ANY,
+		Proto:      ANY,
+	}
+
+	if len(br.Values) != 1 {
+		t.Fatal("expected log only rule to be an any/any rule got: ", len(br.Values))
+	}
+
+	if err := checkPolicy(br.Values[0], expectedValue); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err = parseRule(0, "1.7.1.7 22/tcp")
+	if err != nil {
+		t.Fatal("failed to parse 1.7.1.7", err)
+	}
+
+	if br.Values[0].Is(LOG) {
+		t.Fatal("rule without log keyword had log flag set")
+	}
+}
+
 func TestParseDomainRules(t *testing.T) {
 	_, err := parseRule(0, "google.com 443/tcp")
 	if err != nil {
@@ -403,3 +463,211 @@ func TestParseRulesDuplicates(t *testing.T) {
 	}
 
 }
+
+func TestParseExtendedServices(t *testing.T) {
+
+	rules := []struct {
+		rule     string
+		expected []Policy
+	}{
+		{
+			rule: "2.1.1.1 22,80,443/tcp",
+			expected: []Policy{
+				{PolicyType: SINGLE, Proto: TCP, LowerPort: 22},
+				{PolicyType: SINGLE, Proto: TCP, LowerPort: 80},
+				{PolicyType: SINGLE, Proto: TCP, LowerPort: 443},
+			},
+		},
+		{
+			rule: "2.1.1.2 53,8000-8010/udp",
+			expected: []Policy{
+				{PolicyType: SINGLE, Proto: UDP, LowerPort: 53},
+				{PolicyType: RANGE, Proto: UDP, LowerPort: 8000, UpperPort: 8010},
+			},
+		},
+		{
+			rule: "2.1.1.3 gre esp ah",
+			expected: []Policy{
+				{PolicyType: SINGLE, Proto: GRE},
+				{PolicyType: SINGLE, Proto: ESP},
+				{PolicyType: SINGLE, Proto: AH},
+			},
+		},
+		{
+			rule: "2.1.1.4 proto:115 PROTO:4",
+			expected: []Policy{
+				{PolicyType: SINGLE, Proto: 115},
+				{PolicyType: SINGLE, Proto: 4},
+			},
+		},
+		{
+			rule: "2.1.1.5 sctp 2905/sctp",
+			expected: []Policy{
+				{PolicyType: SINGLE, Proto: SCTP},
+				{PolicyType: SINGLE, Proto: SCTP, LowerPort: 2905},
+			},
+		},
+		{
+			rule: "2.1.1.6 icmp/8 icmp/3:4",
+			expected: []Policy{
+				{PolicyType: RANGE, Proto: ICMP, LowerPort: 8 << 8, UpperPort: 8<<8 | 0xff},
+				{PolicyType: RANGE, Proto: ICMP, LowerPort: 3<<8 | 4, UpperPort: 3<<8 | 4},
+			},
+		},
+		{
+			rule: "2.1.1.7 icmp/0:0",
+			expected: []Policy{
+				{PolicyType: RANGE, Proto: ICMP, LowerPort: 0, UpperPort: 0},
+			},
+		},
+		{
+			rule: "2.1.1.8 !22/tcp",
+			expected: []Policy{
+				{PolicyType: RANGE, Proto: TCP, LowerPort: 0, UpperPort: 21},
+				{PolicyType: RANGE, Proto: TCP, LowerPort: 23, UpperPort: 65535},
+			},
+		},
+		{
+			rule: "2.1.1.9 !443,0-1023,1000-2000/any",
+			expected: []Policy{
+				{PolicyType: RANGE, Proto: ANY, LowerPort: 2001, UpperPort: 65535},
+			},
+		},
+		{
+			rule: "2.1.1.10 !65535/udp",
+			expected: []Policy{
+				{PolicyType: RANGE, Proto: UDP, LowerPort: 0, UpperPort: 65534},
+			},
+		},
+		{
+			rule: "2.1.1.11 !22/any",
+			expected: []Policy{
+				{PolicyType: RANGE, Proto: ANY, LowerPort: 1, UpperPort: 21},
+				{PolicyType: RANGE, Proto: ANY, LowerPort: 23, UpperPort: 65535},
+			},
+		},
+	}
+
+	for _, r := range rules {
+		br, err := parseRule(0, r.rule)
+		if err != nil {
+			t.Fatal("failed to parse ", r.rule, " err: ", err)
+		}
+
+		if len(br.Values) != len(r.expected) {
+			t.Fatal(r.rule, " expected to define ", len(r.expected), " policies got: ", len(br.Values), " ", br.Values)
+		}
+
+		for i := range r.expected {
+			if err := checkPolicy(br.Values[i], r.expected[i]); err != nil {
+				t.Fatal(r.rule, ": ", err)
+			}
+		}
+	}
+}
+
+func TestParseExtendedMalformed(t *testing.T) {
+
+	rules := []string{
+		"1.1.1.1 70000/tcp",
+		"1.1.1.1 22,/tcp",
+		"1.1.1.1 1-2-3/tcp",
+		"1.1.1.1 22/gre",
+		"1.1.1.1 igmp",
+		"1.1.1.1 proto:256",
+		"1.1.1.1 proto:",
+		"1.1.1.1 icmp/256",
+		"1.1.1.1 icmp/8:256",
+		"1.1.1.1 icmp/a",
+		"1.1.1.1 !0/tcp",
+		"1.1.1.1 !0-65535/tcp",
+		"1.1.1.1 22/tcp/udp",
+	}
+
+	for _, rule := range rules {
+		if _, err := parseRule(0, rule); err == nil {
+			t.Fatal("should fail to parse: ", rule)
+		}
+	}
+}
+
+func portList(n int) string {
+	ports := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		ports = append(ports, fmt.Sprintf("%d", i))
+	}
+
+	return strings.Join(ports, ",") + "/tcp"
+}
+
+func TestParseRulesManyPolicies(t *testing.T) {
+
+	result, errs := ParseRules(nil, []string{"3.1.1.1 " + portList(300)}, nil)
+	if len(errs) != 0 {
+		t.Fatal("failed to parse rule with more policies than fit in a block: ", errs)
+	}
+
+	if len(result) != 1 || result[0].NumPolicies != 300 {
+		t.Fatal("expected one route with 300 policies got: ", len(result))
+	}
+
+	_, errs = ParseRules(nil, []string{"3.1.1.2 " + portList(MAX_ROUTE_POLICIES+1)}, nil)
+	if len(errs) == 0 {
+		t.Fatal("should fail to parse a route with more policies than the firewall can follow")
+	}
+}
+
+func TestSplitPolicies(t *testing.T) {
+
+	sizes := []struct {
+		policies, blocks int
+	}{
+		{0, 1},
+		{1, 1},
+		{MAX_POLICIES, 1},
+		{MAX_POLICIES + 1, 2},
+		{2*(MAX_POLICIES-1) + 1, 2},
+		{2*(MAX_POLICIES-1) + 2, 3},
+		{MAX_ROUTE_POLICIES, MAX_POLICY_BLOCKS},
+	}
+
+	for _, size := range sizes {
+		policies := make([]Policy, size.policies)
+		for i := range policies {
+			policies[i] = Policy{PolicyType: SINGLE, Proto: TCP, LowerPort: uint16(i + 1)}
+		}
+
+		blocks := SplitPolicies(policies)
+		if len(blocks) != size.blocks {
+			t.Fatal(size.policies, " policies expected ", size.blocks, " blocks got: ", len(blocks))
+		}
+
+		var joined []Policy
+		for i, block := range blocks {
+			if i != len(blocks)-1 {
+				if block[MAX_POLICIES-1].PolicyType != STOP {
+					t.Fatal("the chain slot of block ", i, " was not left empty")
+				}
+				joined = append(joined, block[:MAX_POLICIES-1]...)
+				continue
+			}
+
+			for _, policy := range block {
+				if policy.PolicyType == STOP {
+					break
+				}
+				joined = append(joined, policy)
+			}
+		}
+
+		if len(joined) != len(policies) {
+			t.Fatal(size.policies, " policies were not all kept when split, got: ", len(joined))
+		}
+
+		for i := range policies {
+			if joined[i] != policies[i] {
+				t.Fatal("policy ", i, " was out of order after split")
+			}
+		}
+	}
+}
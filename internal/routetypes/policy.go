@@ -17,6 +17,9 @@ const (
 	SINGLE
 
 	DENY // Deny flag which is additional to RANGE/SINGLE types
+	LOG  // Log flag, the firewall emits a flow event whenever the policy matches
+
+	CHAIN // Special directive in the last slot of a full block, the ports hold the index of the next block of policies
 )
 
 // Format
@@ -68,22 +71,84 @@ func (r *Policy) Unpack(b []byte) error {
 	return nil
 }
 
-func (r Policy) String() string {
+// NewChain returns the policy that links a block of policies to the next block, stored at index in the policy chains map
+func NewChain(index uint32) Policy {
+	return Policy{
+		PolicyType: uint16(CHAIN),
+		LowerPort:  uint16(index),
+		UpperPort:  uint16(index >> 16),
+	}
+}
 
-	restrictionType := "mfa"
+// ChainIndex returns the index of the next block of policies, only meaningful if the policy is a CHAIN
+func (r Policy) ChainIndex() uint32 {
+	return uint32(r.LowerPort) | uint32(r.UpperPort)<<16
+}
 
-	if r.Is(PUBLIC) {
-		restrictionType = "public"
+// HasPorts returns whether the policies protocol has ports the firewall can match on
+func (r Policy) HasPorts() bool {
+	switch r.Proto {
+	case ANY, TCP, UDP, SCTP:
+		return true
 	}
 
+	return false
+}
+
+// Restriction returns the kind of rule the policy was parsed from, mfa, public or deny
+func (r Policy) Restriction() string {
 	if r.Is(DENY) {
-		restrictionType = "deny"
+		return "deny"
+	}
+
+	if r.Is(PUBLIC) {
+		return "public"
+	}
+
+	return "mfa"
+}
+
+// Ports returns the ports and protocol the policy matches in rule syntax, e.g 443/tcp, 8000-8010/udp, icmp/8 or any/any
+func (r Policy) Ports() string {
+	if r.Proto == ICMP && r.Is(RANGE) {
+		if r.LowerPort == r.UpperPort {
+			return fmt.Sprintf("icmp/%d:%d", r.LowerPort>>8, r.LowerPort&0xff)
+		}
+		return fmt.Sprintf("icmp/%d", r.LowerPort>>8)
+	}
+
+	if r.Is(RANGE) {
+		return fmt.Sprintf("%d-%d/%s", r.LowerPort, r.UpperPort, lookupProtocol(r.Proto))
+	}
+
+	if !r.HasPorts() {
+		return lookupProtocol(r.Proto)
+	}
+
+	port := fmt.Sprintf("%d", r.LowerPort)
+	if r.LowerPort == 0 {
+		port = "any"
+	}
+
+	return port + "/" + lookupProtocol(r.Proto)
+}
+
+func (r Policy) String() string {
+
+	restrictionType := r.Restriction()
+
+	if r.Is(LOG) {
+		restrictionType += ",log"
 	}
 
 	if r.Is(STOP) {
 		return "stop"
 	}
 
+	if r.Is(CHAIN) {
+		return fmt.Sprintf("chain(%d)", r.ChainIndex())
+	}
+
 	if r.Is(SINGLE) {
 		port := fmt.Sprintf("%d", r.LowerPort)
 		if r.LowerPort == 0 {
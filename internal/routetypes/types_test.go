@@ -68,3 +68,53 @@ func TestKeyMarshalAndUnmarshal(t *testing.T) {
 	}
 
 }
+
+func TestPolicyPortsAndRestriction(t *testing.T) {
+
+	rules := []struct {
+		rule        string
+		restriction PolicyType
+		ports       string
+		kind        string
+	}{
+		{"1.1.1.1", 0, "any/any", "mfa"},
+		{"1.1.1.1 443/tcp", PUBLIC, "443/tcp", "public"},
+		{"1.1.1.1 8000-8010/udp", DENY, "8000-8010/udp", "deny"},
+		{"1.1.1.1 icmp", 0, "icmp", "mfa"},
+		{"1.1.1.1 53/any log", PUBLIC, "53/any", "public"},
+		{"1.1.1.1 icmp/8", 0, "icmp/8", "mfa"},
+		{"1.1.1.1 icmp/3:4", DENY, "icmp/3:4", "deny"},
+		{"1.1.1.1 gre", 0, "gre", "mfa"},
+		{"1.1.1.1 proto:115", 0, "proto:115", "mfa"},
+		{"1.1.1.1 2905/sctp", 0, "2905/sctp", "mfa"},
+	}
+
+	for _, r := range rules {
+		parsed, err := parseRule(r.restriction, r.rule)
+		if err != nil {
+			t.Fatal("failed to parse rule: ", r.rule, " err: ", err)
+		}
+
+		if parsed.Values[0].Ports() != r.ports {
+			t.Fatal("incorrect ports for rule: ", r.rule, " expected: ", r.ports, " got: ", parsed.Values[0].Ports())
+		}
+
+		if parsed.Values[0].Restriction() != r.kind {
+			t.Fatal("incorrect restriction for rule: ", r.rule, " expected: ", r.kind, " got: ", parsed.Values[0].Restriction())
+		}
+	}
+}
+
+func TestChainPolicy(t *testing.T) {
+
+	for _, index := range []uint32{0, 1, 65535, 65536, 1<<32 - 1} {
+		chain := NewChain(index)
+		if !chain.Is(CHAIN) || chain.Is(STOP) {
+			t.Fatal("chain policy had incorrect type: ", chain.PolicyType)
+		}
+
+		if chain.ChainIndex() != index {
+			t.Fatal("chain index did not round trip: expected: ", index, " got: ", chain.ChainIndex())
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/NHAS/wag/internal/config"
@@ -15,22 +16,37 @@ import (
 
 func TestMain(m *testing.M) {
 
-	err := setupWgTest()
+	// Keep the etcd data and cluster certificates out of the source tree
+	dir, err := os.MkdirTemp("", "wag-users-test")
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+
+	err = setupWgTest(dir)
+	if err != nil {
+		log.Println(err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
 	code := m.Run()
 	data.TearDown()
+	os.RemoveAll(dir)
 
 	os.Exit(code)
 }
 
-func setupWgTest() error {
+func setupWgTest(dir string) error {
 	if err := config.Load("../../config/testing_config2.json"); err != nil {
 		return err
 	}
 
+	config.Values.Clustering.DatabaseLocation = dir
+	config.Values.Clustering.TLSManagerStorage = filepath.Join(dir, "certificates")
+	// Packages are tested in parallel, so each needs its own ports for etcd and the tls manager
+	config.Values.Clustering.TLSManagerListenURL = "https://localhost:0"
+	config.Values.Clustering.ListenAddresses = []string{"https://localhost:0"}
+
 	m, err := wgtypes.GenerateKey()
 	if err != nil {
 		return err
@@ -7,6 +7,7 @@ import (
 
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/webserver/authenticators/types"
+	"github.com/NHAS/wag/pkg/control"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -58,7 +59,13 @@ func (u *user) GetDevicePresharedKey(address string) (presharedKey string, err e
 
 func (u *user) AddDevice(publickey wgtypes.Key) (device data.Device, err error) {
 
-	return data.AddDevice(u.Username, publickey.String())
+	return data.AddDevice(u.Username, publickey.String(), control.RegistrationResult{})
+}
+
+// RegisterDevice adds a device with the interface and address allocation set by the registration token that was used to create it
+func (u *user) RegisterDevice(publickey wgtypes.Key, registration control.RegistrationResult) (device data.Device, err error) {
+
+	return data.AddDevice(u.Username, publickey.String(), registration)
 }
 
 func (u *user) DeleteDevice(address string) (err error) {
@@ -143,7 +150,7 @@ func (u *user) Authenticate(device, mfaType string, authenticator types.Authenti
 		}
 	}
 
-	challenge, err := data.AuthoriseDevice(u.Username, device)
+	challenge, err := data.AuthoriseDevice(u.Username, device, mfaType)
 	if err != nil {
 		return "", fmt.Errorf("%s %s unable to reset number of mfa attempts: %s", u.Username, device, err)
 	}
@@ -151,8 +158,8 @@ func (u *user) Authenticate(device, mfaType string, authenticator types.Authenti
 	return challenge, nil
 }
 
-func (u *user) Deauthenticate(device string) error {
-	return data.DeauthenticateDevice(device)
+func (u *user) Deauthenticate(device, reason string) error {
+	return data.DeauthenticateDevice(device, reason)
 }
 
 func (u *user) MFA() (string, error) {
@@ -212,6 +212,21 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 				return errors.New("user is not associated with device")
 			}
 
+			claims, err := ruleClaims(tokens.IDTokenClaims)
+			if err != nil {
+				return err
+			}
+
+			if err := data.SetUserClaims(username, claims); err != nil {
+				return fmt.Errorf("failed to record claims: %s", err)
+			}
+
+			if email := info.GetEmail(); email != "" {
+				if err := data.SetUserEmail(username, email); err != nil {
+					log.Println(username, "could not record email address from oidc:", err)
+				}
+			}
+
 			return data.SetUserGroupMembership(username, groups)
 		})
 
@@ -262,3 +277,27 @@ func (o *Oidc) MFAPromptUI(w http.ResponseWriter, r *http.Request, _, _ string)
 func (o *Oidc) RegistrationUI(w http.ResponseWriter, r *http.Request, _, _ string) {
 	o.RegistrationAPI(w, r)
 }
+
+// ruleClaims collects the string and string list claims that group membership rules refer to, other claims are not stored
+func ruleClaims(idToken oidc.IDTokenClaims) (map[string][]string, error) {
+	names, err := data.GetRuleClaims()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string][]string{}
+	for _, name := range names {
+		switch value := idToken.GetClaim(name).(type) {
+		case string:
+			claims[name] = []string{value}
+		case []interface{}:
+			for _, v := range value {
+				if s, ok := v.(string); ok {
+					claims[name] = append(claims[name], s)
+				}
+			}
+		}
+	}
+
+	return claims, nil
+}
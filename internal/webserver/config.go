@@ -0,0 +1,159 @@
+package webserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/resources"
+)
+
+// deviceInterface builds the wireguard config for a device from the current policies that apply to it
+func deviceInterface(device data.Device, privateKey, presharedKey string) (resources.Interface, error) {
+
+	acl := data.GetEffectiveDeviceAcl(device.Username, device.Interface, device.Tags)
+
+	wgInterface, err := config.GetInterface(device.Interface)
+	if err != nil {
+		return resources.Interface{}, err
+	}
+
+	wgPublicKey, wgPort, err := router.ServerDetails(wgInterface.DevName)
+	if err != nil {
+		return resources.Interface{}, fmt.Errorf("unable access wireguard device: %s", err)
+	}
+
+	dnsWithOutSubnet := slices.Clone(wgInterface.DNS)
+	if config.Values.DNSProxy.Enabled {
+		dnsWithOutSubnet = []string{wgInterface.ServerAddress.String()}
+	} else if wgInterface.Name == config.DefaultInterface || len(dnsWithOutSubnet) == 0 {
+		dnsWithOutSubnet, err = data.GetDNS()
+		if err != nil {
+			return resources.Interface{}, fmt.Errorf("unable get dns: %s", err)
+		}
+	}
+
+	for i := 0; i < len(dnsWithOutSubnet); i++ {
+		dnsWithOutSubnet[i] = strings.TrimSuffix(dnsWithOutSubnet[i], "/32")
+	}
+
+	routes, err := routetypes.AclsToRoutes(append(acl.Allow, acl.Mfa...))
+	if err != nil {
+		return resources.Interface{}, fmt.Errorf("unable access parse acls to produce routes: %s", err)
+	}
+
+	externalAddress, err := data.GetExternalAddress()
+	if err != nil {
+		return resources.Interface{}, fmt.Errorf("unable to get server external address from datastore: %s", err)
+	}
+
+	// Every interface listens on its own port, so any port in the external address is replaced with the port of the devices interface
+	if host, _, err := net.SplitHostPort(externalAddress); err == nil {
+		externalAddress = host
+	}
+	externalAddress = net.JoinHostPort(externalAddress, strconv.Itoa(wgPort))
+
+	return resources.Interface{
+		ClientPrivateKey:   privateKey,
+		ClientAddress:      device.Address,
+		ClientPresharedKey: presharedKey,
+		ServerAddress:      externalAddress,
+		ServerPublicKey:    wgPublicKey.String(),
+		CapturedAddresses:  routes,
+		DNS:                dnsWithOutSubnet,
+	}, nil
+}
+
+// configVersion identifies the contents of a config, ignoring the private key (which the server may not know) and route ordering
+func configVersion(wgInterface resources.Interface) string {
+	wgInterface.ClientPrivateKey = ""
+
+	wgInterface.CapturedAddresses = slices.Clone(wgInterface.CapturedAddresses)
+	slices.Sort(wgInterface.CapturedAddresses)
+
+	b, _ := json.Marshal(wgInterface)
+	hash := sha256.Sum256(b)
+
+	return hex.EncodeToString(hash[:16])
+}
+
+func renderInterface(out io.Writer, wgInterface *resources.Interface) error {
+	return resources.RenderWithFuncs("interface.tmpl", out, wgInterface, template.FuncMap{
+		"StringsJoin": strings.Join,
+		"Unescape":    func(s string) template.HTML { return template.HTML(s) },
+	})
+}
+
+// deviceConfig re-renders the wireguard config for the requesting device so that AllowedIPs can follow policy changes made after registration.
+// The private key is never known to the server so is not included, clients should merge the result with their existing config.
+// The version is sent as an ETag, so clients can poll with If-None-Match and will get 304 Not Modified until something changes
+func deviceConfig(w http.ResponseWriter, r *http.Request) {
+	remoteAddress := utils.GetIPFromRequest(r)
+
+	if !router.IsAuthed(remoteAddress.String()) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(remoteAddress)
+	if err != nil {
+		log.Println("unknown", remoteAddress, "Could not find user: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	device, err := user.GetDevice(remoteAddress.String())
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "Could not find device: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	wireguardInterface, err := deviceInterface(device, "", device.PresharedKey)
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "unable to generate wireguard config: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	version := configVersion(wireguardInterface)
+	if version != device.ConfigVersion {
+		err = data.SetDeviceConfigVersion(user.Username, device.Address, version)
+		if err != nil {
+			log.Println(user.Username, remoteAddress, "unable to record device config version: ", err)
+		}
+	}
+
+	etag := `"` + version + `"`
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+data.GetWireguardConfigName())
+	w.Header().Set("Content-Type", "text/plain")
+
+	err = renderInterface(w, &wireguardInterface)
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "failed to execute template to generate wireguard config:", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+}
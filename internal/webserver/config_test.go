@@ -0,0 +1,76 @@
+package webserver
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/wag/internal/webserver/resources"
+)
+
+func testInterface() resources.Interface {
+	return resources.Interface{
+		ClientPrivateKey:   "private",
+		ClientAddress:      "192.168.1.2",
+		ClientPresharedKey: "preshared",
+		ServerAddress:      "vpn.example.com:53230",
+		ServerPublicKey:    "public",
+		CapturedAddresses:  []string{"10.0.0.0/8", "1.1.1.1/32", "192.168.1.1/32"},
+		DNS:                []string{"1.1.1.1"},
+	}
+}
+
+func TestConfigVersionIgnoresPrivateKeyAndRouteOrder(t *testing.T) {
+	base := testInterface()
+	version := configVersion(base)
+
+	withoutKey := testInterface()
+	withoutKey.ClientPrivateKey = ""
+	if configVersion(withoutKey) != version {
+		t.Fatal("the refresh endpoint does not know the private key, so it must not change the version")
+	}
+
+	reordered := testInterface()
+	slices.Reverse(reordered.CapturedAddresses)
+	if configVersion(reordered) != version {
+		t.Fatal("route order changed the version")
+	}
+
+	if !slices.Equal(reordered.CapturedAddresses, []string{"192.168.1.1/32", "1.1.1.1/32", "10.0.0.0/8"}) {
+		t.Fatal("configVersion sorted the callers routes in place")
+	}
+}
+
+func TestConfigVersionChangesWithContents(t *testing.T) {
+	version := configVersion(testInterface())
+
+	changes := map[string]func(*resources.Interface){
+		"route added":      func(i *resources.Interface) { i.CapturedAddresses = append(i.CapturedAddresses, "8.8.8.8/32") },
+		"route removed":    func(i *resources.Interface) { i.CapturedAddresses = i.CapturedAddresses[1:] },
+		"dns":              func(i *resources.Interface) { i.DNS = []string{"9.9.9.9"} },
+		"server key":       func(i *resources.Interface) { i.ServerPublicKey = "rotated" },
+		"server address":   func(i *resources.Interface) { i.ServerAddress = "vpn.example.com:53231" },
+		"preshared key":    func(i *resources.Interface) { i.ClientPresharedKey = "rotated" },
+		"client addresses": func(i *resources.Interface) { i.ClientAddress = "192.168.1.3" },
+	}
+
+	for name, change := range changes {
+		changed := testInterface()
+		change(&changed)
+
+		if configVersion(changed) == version {
+			t.Errorf("%s did not change the version", name)
+		}
+	}
+}
+
+func TestConfigVersionIsStable(t *testing.T) {
+	if configVersion(testInterface()) != configVersion(testInterface()) {
+		t.Fatal("same config gave different versions")
+	}
+
+	// Sent as an ETag, so it must be short and not need quoting
+	if v := configVersion(testInterface()); len(v) != 32 || strings.ContainsAny(v, `" `) {
+		t.Fatal("unexpected version format: ", v)
+	}
+}
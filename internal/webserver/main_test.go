@@ -0,0 +1,44 @@
+package webserver
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+func TestMain(m *testing.M) {
+	if err := config.Load("../config/testing_config.json"); err != nil {
+		log.Println("failed to load config: ", err)
+		os.Exit(1)
+	}
+
+	dir, err := os.MkdirTemp("", "wag-webserver-test")
+	if err != nil {
+		log.Println("failed to create test directory: ", err)
+		os.Exit(1)
+	}
+
+	config.Values.Clustering.DatabaseLocation = dir
+	config.Values.Clustering.TLSManagerStorage = filepath.Join(dir, "certificates")
+	// Packages are tested in parallel, so each needs its own ports for etcd and the tls manager
+	config.Values.Clustering.TLSManagerListenURL = "https://localhost:0"
+	config.Values.Clustering.ListenAddresses = []string{"https://localhost:0"}
+
+	err = data.Load(config.Values.DatabaseLocation, "", true)
+	if err != nil {
+		log.Println(err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+
+	data.TearDown()
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
@@ -0,0 +1,64 @@
+package webserver
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/resources"
+)
+
+// platform guesses which wireguard client instructions to show first
+func platform(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+
+	switch {
+	case strings.Contains(userAgent, "android"):
+		return "android"
+	case strings.Contains(userAgent, "iphone"), strings.Contains(userAgent, "ipad"):
+		return "ios"
+	case strings.Contains(userAgent, "windows"):
+		return "windows"
+	case strings.Contains(userAgent, "mac os"), strings.Contains(userAgent, "macintosh"):
+		return "macos"
+	}
+
+	return "linux"
+}
+
+// registrationPage is where registration links lead, it explains how to install wireguard and then registers the device with /register_device.
+// Opening the page does not use the token, so links opened by mail scanners or previews still work
+func registrationPage(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := utils.GetIPFromRequest(r)
+
+	// The page and the config it leads to contain secrets, they must not be cached or leak the key to other sites
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	page := resources.RegistrationPage{
+		Key:        r.URL.Query().Get("key"),
+		Platform:   platform(r.UserAgent()),
+		ConfigName: data.GetWireguardConfigName(),
+		HelpMail:   data.GetHelpMail(),
+	}
+
+	registration, err := data.GetRegistrationToken(page.Key)
+	if page.Key == "" || err != nil {
+		log.Println("unknown", remoteAddr, "opened registration page with an invalid or used key")
+
+		page.Key = ""
+		page.Invalid = true
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		page.Username = registration.Username
+		page.Uses = registration.NumUses
+	}
+
+	if err := resources.Render("registration.html", w, &page); err != nil {
+		log.Println(page.Username, remoteAddr, "unable to render registration page: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+}
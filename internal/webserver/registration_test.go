@@ -0,0 +1,111 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func TestPlatform(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36":  "android",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148":      "ios",
+		"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148":               "ios",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36":        "windows",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15": "macos",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":                                             "linux",
+		"curl/8.4.0": "linux",
+		"":           "linux",
+	}
+
+	for userAgent, expected := range tests {
+		if got := platform(userAgent); got != expected {
+			t.Errorf("%q guessed %s expected %s", userAgent, got, expected)
+		}
+	}
+}
+
+func openRegistrationPage(key, userAgent string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/register?key="+url.QueryEscape(key), nil)
+	r.Header.Set("User-Agent", userAgent)
+
+	w := httptest.NewRecorder()
+	registrationPage(w, r)
+
+	return w
+}
+
+func TestRegistrationPage(t *testing.T) {
+	token, err := data.GenerateToken(control.RegistrationResult{Username: "pagetester", NumUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.DeleteRegistrationToken(token)
+
+	w := openRegistrationPage(token, "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+	if w.Code != http.StatusOK {
+		t.Fatal("valid link was refused: ", w.Code)
+	}
+
+	if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Fatal("page containing the key could be cached or leak it: ", w.Header())
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "pagetester") || !strings.Contains(body, token) || !strings.Contains(body, "register 2 more devices") {
+		t.Fatal("page did not describe the link: ", body)
+	}
+
+	if !strings.Contains(body, "<details open>") {
+		t.Fatal("instructions for the users platform were not shown first")
+	}
+
+	// Opening the page must not use the link, mail scanners follow links before the user does
+	registration, err := data.GetRegistrationToken(token)
+	if err != nil || registration.NumUses != 2 {
+		t.Fatal("opening the page used the link: ", registration.NumUses, err)
+	}
+
+	if err := data.FinaliseRegistration(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := openRegistrationPage(token, "").Body.String(); !strings.Contains(body, "can only be used once") {
+		t.Fatal("page did not show the remaining uses: ", body)
+	}
+
+	if err := data.FinaliseRegistration(token); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openRegistrationPage(token, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatal("used up link was not invalid: ", w.Code)
+	}
+
+	if strings.Contains(w.Body.String(), token) || strings.Contains(w.Body.String(), "pagetester") {
+		t.Fatal("invalid link page still contained the key or user")
+	}
+}
+
+func TestRegistrationPageDeletedLink(t *testing.T) {
+	token, err := data.GenerateToken(control.RegistrationResult{Username: "pagetester", NumUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.DeleteRegistrationToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{token, "", "doesnotexist"} {
+		if w := openRegistrationPage(key, ""); w.Code != http.StatusNotFound {
+			t.Errorf("link %q was not invalid: %d", key, w.Code)
+		}
+	}
+}
@@ -41,6 +41,19 @@ type QrCodeRegistrationDisplay struct {
 	Username  string
 }
 
+type RegistrationPage struct {
+	Username string
+	Key      string
+	// One of windows, macos, linux, ios or android, guessed from the user agent
+	Platform   string
+	ConfigName string
+	Uses       int
+	HelpMail   string
+
+	// The link has been used as many times as it is allowed, has been deleted or never existed
+	Invalid bool
+}
+
 //go:embed templates/*
 var embeddedUI embed.FS
 
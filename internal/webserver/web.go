@@ -20,7 +20,6 @@ import (
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/router"
-	"github.com/NHAS/wag/internal/routetypes"
 	"github.com/NHAS/wag/internal/users"
 	"github.com/NHAS/wag/internal/utils"
 	"github.com/NHAS/wag/internal/webserver/authenticators"
@@ -38,6 +37,9 @@ var (
 
 	publicHTTPServ *http.Server
 	publicTLSServ  *http.Server
+
+	// Tunnel listeners for additional wireguard interfaces
+	interfaceServs []*http.Server
 )
 
 func Teardown() {
@@ -50,6 +52,10 @@ func Teardown() {
 		tunnelTLSServ.Close()
 	}
 
+	for _, serv := range interfaceServs {
+		serv.Close()
+	}
+
 	if publicHTTPServ != nil {
 		publicHTTPServ.Close()
 	}
@@ -82,6 +88,7 @@ func Start(errChan chan<- error) error {
 
 	public := httputils.NewMux()
 	public.Get("/static/", embeddedStatic)
+	public.Get("/register", registrationPage)
 	public.Get("/register_device", registerDevice)
 	public.Get("/reachability", reachability)
 
@@ -151,6 +158,9 @@ func Start(errChan chan<- error) error {
 
 	tunnel.Get("/status/", status)
 	tunnel.Get("/routes/", routes)
+	tunnel.Post("/device/name", deviceName)
+	tunnel.Post("/access/request", requestAccess)
+	tunnel.Get("/config/", deviceConfig)
 
 	tunnel.Get("/logout/", logout)
 
@@ -237,6 +247,38 @@ func Start(errChan chan<- error) error {
 		}()
 	}
 
+	// Additional interfaces serve the same tunnel site on their own server address
+	var interfaceListenAddresses []string
+	for _, iface := range config.AllInterfaces()[1:] {
+		serv := &http.Server{
+			Addr:         iface.ServerAddress.String() + ":" + config.Values.Webserver.Tunnel.Port,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  120 * time.Second,
+			TLSConfig:    tlsConfig,
+			Handler:      setSecurityHeaders(tunnel),
+		}
+		interfaceServs = append(interfaceServs, serv)
+		interfaceListenAddresses = append(interfaceListenAddresses, serv.Addr)
+
+		go func(name string) {
+			var err error
+			if config.Values.Webserver.Tunnel.SupportsTLS() {
+				err = serv.ListenAndServeTLS(config.Values.Webserver.Tunnel.CertPath, config.Values.Webserver.Tunnel.KeyPath)
+			} else {
+				err = serv.ListenAndServe()
+			}
+
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errChan <- fmt.Errorf("webserver tunnel listener for interface %q failed: %v", name, err)
+			}
+		}(iface.Name)
+	}
+
+	if len(interfaceListenAddresses) > 0 {
+		tunnelListenAddress += ", " + strings.Join(interfaceListenAddresses, ", ")
+	}
+
 	//Group the print statement so that multithreading won't disorder them
 	log.Println("Started listening:\n",
 		"\t\t\tTunnel Listener: ", tunnelListenAddress, "\n",
@@ -392,6 +434,9 @@ func reachability(w http.ResponseWriter, _ *http.Request) {
 func registerDevice(w http.ResponseWriter, r *http.Request) {
 	remoteAddr := utils.GetIPFromRequest(r)
 
+	// The response contains the devices private key
+	w.Header().Set("Cache-Control", "no-store")
+
 	key, err := url.PathUnescape(r.URL.Query().Get("key"))
 	if err != nil {
 		http.NotFound(w, r)
@@ -404,15 +449,28 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, overwrites, groups, err := data.GetRegistrationToken(key)
+	registration, err := data.GetRegistrationToken(key)
+	username := registration.Username
 	if err != nil {
 		log.Println(username, remoteAddr, "failed to get registration key:", err)
 		http.NotFound(w, r)
 		return
 	}
 
-	if len(groups) != 0 {
-		err := data.SetUserGroupMembership(username, groups)
+	// The token replaces the users groups, so check the source against the groups the user will end up in
+	var groups []string
+	if len(registration.Groups) != 0 {
+		groups = registration.Groups
+	}
+
+	if err := data.CheckSource(username, groups, remoteAddr); err != nil {
+		log.Println(username, remoteAddr, "registration rejected:", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if len(registration.Groups) != 0 {
+		err := data.SetUserGroupMembership(username, registration.Groups)
 		if err != nil {
 			log.Println(username, remoteAddr, "could not set user membership from registration token:", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
@@ -455,25 +513,31 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if registration.Email != "" {
+		if err := data.SetUserEmail(username, registration.Email); err != nil {
+			log.Println(username, remoteAddr, "could not set email address from registration token:", err)
+		}
+	}
+
 	var (
 		address string
 	)
-	if overwrites != "" {
+	if registration.Overwrites != "" {
 
-		err = user.SetDevicePublicKey(publickey.String(), overwrites)
+		err = user.SetDevicePublicKey(publickey.String(), registration.Overwrites)
 		if err != nil {
-			log.Println(username, remoteAddr, "could update '", overwrites, "': ", err)
+			log.Println(username, remoteAddr, "could update '", registration.Overwrites, "': ", err)
 			http.Error(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		address = overwrites
+		address = registration.Overwrites
 
 	} else {
 
 		// Make sure not to accidentally shadow the global err here as we're using a defer to monitor failures to delete the device
 		var device data.Device
-		device, err = user.AddDevice(publickey)
+		device, err = user.RegisterDevice(publickey, registration)
 		if err != nil {
 			log.Println(username, remoteAddr, "unable to add device: ", err)
 
@@ -494,13 +558,13 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	acl := data.GetEffectiveAcl(username)
-
-	wgPublicKey, wgPort, err := router.ServerDetails()
-	if err != nil {
-		log.Println(username, remoteAddr, "unable access wireguard device: ", err)
-		http.Error(w, "Server Error", http.StatusInternalServerError)
-		return
+	if name := r.URL.Query().Get("name"); name != "" {
+		err = data.SetDeviceName(username, address, name)
+		if err != nil {
+			log.Println(username, remoteAddr, "unable to set device name: ", err)
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	keyStr := privatekey.String()
@@ -516,56 +580,27 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dnsWithOutSubnet, err := data.GetDNS()
+	// When overwriting, the device keeps its tags and interface
+	var registeredDevice data.Device
+	registeredDevice, err = user.GetDevice(address)
 	if err != nil {
-		log.Println(username, remoteAddr, "unable get dns: ", err)
+		log.Println(username, remoteAddr, "unable to get device: ", err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	for i := 0; i < len(dnsWithOutSubnet); i++ {
-		dnsWithOutSubnet[i] = strings.TrimSuffix(dnsWithOutSubnet[i], "/32")
-	}
-
-	routes, err := routetypes.AclsToRoutes(append(acl.Allow, acl.Mfa...))
+	wireguardInterface, err := deviceInterface(registeredDevice, keyStr, presharedKey)
 	if err != nil {
-		log.Println(username, remoteAddr, "unable access parse acls to produce routes: ", err)
+		log.Println(username, remoteAddr, "unable to generate wireguard config: ", err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	wireguardInterface := resources.Interface{
-		ClientPrivateKey:   keyStr,
-		ClientAddress:      address,
-		ServerPublicKey:    wgPublicKey.String(),
-		CapturedAddresses:  routes,
-		DNS:                dnsWithOutSubnet,
-		ClientPresharedKey: presharedKey,
-	}
-
-	externalAddress, err := data.GetExternalAddress()
-	if err != nil {
-		log.Println(username, remoteAddr, "unable to get server external address from datastore: ", err)
-		http.Error(w, "Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	// If the external address defined in the config has a port, use that, otherwise defaultly add the same port as the wireguard device
-	_, _, err = net.SplitHostPort(externalAddress)
-	if err != nil {
-		externalAddress = fmt.Sprintf("%s:%d", externalAddress, wgPort)
-	}
-
-	wireguardInterface.ServerAddress = externalAddress
-
 	if r.URL.Query().Get("type") == "mobile" {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 
 		var wireguardProfile bytes.Buffer
-		err = resources.RenderWithFuncs("interface.tmpl", &wireguardProfile, &wireguardInterface, template.FuncMap{
-			"StringsJoin": strings.Join,
-			"Unescape":    func(s string) template.HTML { return template.HTML(s) },
-		})
+		err = renderInterface(&wireguardProfile, &wireguardInterface)
 		if err != nil {
 			log.Println(username, remoteAddr, "failed to execute template to generate wireguard config:", err)
 			http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -610,10 +645,7 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Content-Disposition", "attachment; filename="+data.GetWireguardConfigName())
 
-		err = resources.RenderWithFuncs("interface.tmpl", w, &wireguardInterface, template.FuncMap{
-			"StringsJoin": strings.Join,
-			"Unescape":    func(s string) template.HTML { return template.HTML(s) },
-		})
+		err = renderInterface(w, &wireguardInterface)
 		if err != nil {
 			log.Println(username, remoteAddr, "failed to execute template to generate wireguard config:", err)
 			http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -621,6 +653,11 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Not fatal, the device will be told its config may be out of date until it next fetches /config/
+	if err := data.SetDeviceConfigVersion(username, address, configVersion(wireguardInterface)); err != nil {
+		log.Println(username, remoteAddr, "unable to record device config version: ", err)
+	}
+
 	//Finish registration process
 	err = data.FinaliseRegistration(key)
 	if err != nil {
@@ -630,7 +667,7 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logMsg := "registered as"
-	if overwrites != "" {
+	if registration.Overwrites != "" {
 		logMsg = "overwrote"
 	}
 	log.Println(username, remoteAddr, "successfully", logMsg, address, ":", publickey.String())
@@ -651,7 +688,7 @@ func logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = user.Deauthenticate(clientTunnelIp.String())
+	err = user.Deauthenticate(clientTunnelIp.String(), "logged out")
 	if err != nil {
 		log.Println(user.Username, clientTunnelIp, "could not deauthenticate:", err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -676,7 +713,7 @@ func routes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	routes, err := router.GetRoutes(user.Username)
+	routes, err := router.GetDeviceRoutes(user.Username, remoteAddress.String())
 	if err != nil {
 		log.Println(user.Username, remoteAddress, "Getting routes from xdp failed: ", err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
@@ -698,7 +735,23 @@ func status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	acl := data.GetEffectiveAcl(user.Username)
+	device, err := user.GetDevice(remoteAddress.String())
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "Could not find device: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	acl := data.GetEffectiveDeviceAcl(user.Username, device.Interface, device.Tags)
+
+	wireguardInterface, err := deviceInterface(device, "", device.PresharedKey)
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "unable to generate wireguard config: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	version := configVersion(wireguardInterface)
 
 	w.Header().Set("Content-Disposition", "attachment; filename=acl")
 	w.Header().Set("Content-Type", "application/json")
@@ -706,10 +759,17 @@ func status(w http.ResponseWriter, r *http.Request) {
 		IsAuthorised bool
 		MFA          []string
 		Public       []string
+
+		// ConfigOutdated is set when policies have changed the routes since the device last downloaded its config, fetch /config/ to update
+		ConfigVersion  string
+		ConfigOutdated bool
 	}{
 		IsAuthorised: router.IsAuthed(remoteAddress.String()),
 		MFA:          acl.Mfa,
 		Public:       acl.Allow,
+
+		ConfigVersion:  version,
+		ConfigOutdated: device.ConfigVersion != version,
 	}
 
 	result, err := json.Marshal(&status)
@@ -722,11 +782,94 @@ func status(w http.ResponseWriter, r *http.Request) {
 	w.Write(result)
 }
 
+// deviceName allows a user to label the device they are connecting from
+func deviceName(w http.ResponseWriter, r *http.Request) {
+	remoteAddress := utils.GetIPFromRequest(r)
+	user, err := users.GetUserFromAddress(remoteAddress)
+	if err != nil {
+		log.Println("unknown", remoteAddress, "Could not find user: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = data.SetDeviceName(user.Username, remoteAddress.String(), r.FormValue("name"))
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "unable to set device name: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+// requestAccess lets an authorised user ask for temporary access to routes, which does nothing until an admin approves it
+func requestAccess(w http.ResponseWriter, r *http.Request) {
+	remoteAddress := utils.GetIPFromRequest(r)
+	user, err := users.GetUserFromAddress(remoteAddress)
+	if err != nil {
+		log.Println("unknown", remoteAddress, "Could not find user: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if !router.IsAuthed(remoteAddress.String()) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	duration, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil {
+		http.Error(w, "invalid duration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	routeList := func(value string) (result []string) {
+		for _, route := range strings.Split(value, ",") {
+			if route = strings.TrimSpace(route); route != "" {
+				result = append(result, route)
+			}
+		}
+		return result
+	}
+
+	grant, err := data.RequestAccess(user.Username, data.Grant{
+		Mfa:      routeList(r.FormValue("mfa")),
+		Allow:    routeList(r.FormValue("allow")),
+		Reason:   r.FormValue("reason"),
+		Duration: duration,
+	})
+	if err != nil {
+		log.Println(user.Username, remoteAddress, "unable to request access: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println(user.Username, remoteAddress, "requested temporary access for", grant.Duration, "request:", grant.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grant)
+}
+
 func publicKey(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Disposition", "attachment; filename=pubkey")
 	w.Header().Set("Content-Type", "text/plain")
 
-	wgPublicKey, _, err := router.ServerDetails()
+	// Each interface has its own key, so return the one the client is connected to
+	wgInterface := config.InterfaceForAddress(utils.GetIPFromRequest(r).String())
+
+	wgPublicKey, _, err := router.ServerDetails(wgInterface.DevName)
 	if err != nil {
 		log.Println("unable access wireguard device: ", err)
 		http.Error(w, "Server Error", http.StatusInternalServerError)
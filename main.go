@@ -19,8 +19,13 @@ var cmds = []commands.Command{
 	commands.Devices(),
 	commands.Users(),
 	commands.Firewall(),
+	commands.Lockdown(),
+	commands.Policy(),
+	commands.Objects(),
+	commands.Grants(),
 
 	commands.Webadmin(),
+	commands.Cluster(),
 
 	commands.VersionCmd(),
 
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func listAddressPools(w http.ResponseWriter, r *http.Request) {
+	pools, err := data.GetAddressPools()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(pools)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func addAddressPool(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pool := control.AddressPool{
+		Name:      r.FormValue("name"),
+		Subnet:    r.FormValue("subnet"),
+		Interface: r.FormValue("interface"),
+	}
+
+	err = data.AddAddressPool(pool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("address pool", pool.Name, "created:", pool.Subnet)
+
+	w.Write([]byte("OK"))
+}
+
+func deleteAddressPool(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := r.FormValue("name")
+
+	err = data.DeleteAddressPool(name)
+	if err != nil {
+		http.Error(w, "could not delete address pool: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("address pool", name, "deleted")
+
+	w.Write([]byte("OK"))
+}
+
+func listAddressReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := data.GetAddressReservations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(reservations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func addAddressReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reservation := control.AddressReservation{
+		Address:  r.FormValue("address"),
+		Username: r.FormValue("username"),
+	}
+
+	err = data.AddAddressReservation(reservation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("address", reservation.Address, "reserved for", reservation.Username)
+
+	w.Write([]byte("OK"))
+}
+
+func deleteAddressReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	address := r.FormValue("address")
+
+	err = data.DeleteAddressReservation(address)
+	if err != nil {
+		http.Error(w, "could not delete address reservation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("address reservation for", address, "deleted")
+
+	w.Write([]byte("OK"))
+}
@@ -2,9 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
 )
 
 func listErrors(w http.ResponseWriter, r *http.Request) {
@@ -68,3 +72,165 @@ func getLastMemberPing(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
 }
+
+func membersHealth(w http.ResponseWriter, r *http.Request) {
+
+	var result []control.ClusterMemberHealth
+	for _, member := range data.GetMembers() {
+		idHex := member.ID.String()
+
+		drained, err := data.IsDrained(idHex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		witness, err := data.IsWitness(idHex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		version, err := data.GetVersion(idHex)
+		if err != nil {
+			version = "unknown"
+		}
+
+		health := control.ClusterMemberHealth{
+			ID:        idHex,
+			Name:      member.Name,
+			PeerURLs:  member.PeerURLs,
+			IsLeader:  member.ID == data.GetLeader(),
+			IsLearner: member.IsLearner,
+			IsWitness: witness,
+			IsDrained: drained,
+			Version:   version,
+			Status:    "healthy",
+		}
+
+		if drained {
+			health.Status = "drained"
+		} else if !member.IsStarted() {
+			health.Status = "wait for first connection..."
+		} else if member.IsLearner {
+			health.Status = "learner"
+		}
+
+		if !member.IsLearner {
+			health.LastPing, err = data.GetLastPing(idHex)
+			if err != nil {
+				health.Status = "no last ping"
+			} else if health.LastPing.Before(time.Now().Add(-data.DeadNodeTimeout)) {
+				health.Status = "dead"
+			}
+		}
+
+		result = append(result, health)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func addMember(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := data.AddMember(r.FormValue("name"), r.FormValue("peer"), r.FormValue("manager"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("added new node: ", r.FormValue("name"), r.FormValue("peer"))
+
+	b, err := json.Marshal(data.NewNodeResponse{JoinToken: token})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func memberControl(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.FormValue("id")
+	action := r.FormValue("action")
+
+	if id == "" && action != "stepdown" && action != "witness" && action != "unwitness" {
+		http.Error(w, "No member specified", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "promote":
+		err = data.PromoteMember(id)
+	case "drain", "restore":
+		err = data.SetDrained(id, action == "drain")
+	case "stepdown":
+		if !data.IsLeader() {
+			err = errors.New("this node is not the leader, run stepdown on " + data.GetLeader().String())
+			break
+		}
+		err = data.StepDown()
+	case "witness", "unwitness":
+		// Only the node itself knows whether it is serving clients, so this always marks the node that was asked
+		err = data.SetWitness(action == "witness")
+	case "remove":
+		if data.GetServerID().String() == id {
+			http.Error(w, "cannot remove current node", http.StatusBadRequest)
+			return
+		}
+		err = data.RemoveMember(id)
+	default:
+		http.Error(w, "Unknown action: "+action, http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("cluster member control: ", action, id)
+
+	w.Write([]byte("OK"))
+}
+
+func resolveError(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "No error id specified", http.StatusBadRequest)
+		return
+	}
+
+	err = data.ResolveError(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
@@ -33,7 +33,7 @@ func newPolicy(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if err := data.SetAcl(acl.Effects, acls.Acl{Mfa: acl.MfaRoutes, Allow: acl.PublicRoutes, Deny: acl.DenyRoutes}, false); err != nil {
+	if err := data.SetAcl(acl.Effects, acls.Acl{Mfa: acl.MfaRoutes, Allow: acl.PublicRoutes, Deny: acl.DenyRoutes, Interfaces: acl.Interfaces}, false); err != nil {
 		log.Println("Unable to set acls: ", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -53,7 +53,7 @@ func editPolicy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := data.SetAcl(polciyData.Effects, acls.Acl{Mfa: polciyData.MfaRoutes, Allow: polciyData.PublicRoutes, Deny: polciyData.DenyRoutes}, true); err != nil {
+	if err := data.SetAcl(polciyData.Effects, acls.Acl{Mfa: polciyData.MfaRoutes, Allow: polciyData.PublicRoutes, Deny: polciyData.DenyRoutes, Interfaces: polciyData.Interfaces}, true); err != nil {
 		log.Println("Unable to set acls: ", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -64,6 +64,25 @@ func editPolicy(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK!"))
 }
 
+func simulatePolicy(w http.ResponseWriter, r *http.Request) {
+	var proposed control.PolicySimulation
+	if err := json.NewDecoder(r.Body).Decode(&proposed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := data.SimulatePolicyChange(proposed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, _ := json.Marshal(report)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
 func deletePolicies(w http.ResponseWriter, r *http.Request) {
 	var policyNames []string
 	if err := json.NewDecoder(r.Body).Decode(&policyNames); err != nil {
@@ -108,11 +127,38 @@ func newGroup(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	sessionPolicy := data.SessionPolicy{
+		InactivityTimeoutMinutes:  gData.InactivityTimeoutMinutes,
+		MaxSessionLifetimeMinutes: gData.MaxSessionLifetimeMinutes,
+		AllowedNetworks:           gData.AllowedNetworks,
+		AllowedCountries:          gData.AllowedCountries,
+	}
+
+	if err := sessionPolicy.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.ValidateGroupRules(gData.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if err := data.SetGroup(gData.Group, gData.Members, false); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := data.SetSessionPolicy(gData.Group, sessionPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := data.SetGroupRules(gData.Group, gData.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	log.Printf("new group '%s' added", gData.Group)
 
 	w.Write([]byte("OK!"))
@@ -128,11 +174,38 @@ func editGroup(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	sessionPolicy := data.SessionPolicy{
+		InactivityTimeoutMinutes:  gdata.InactivityTimeoutMinutes,
+		MaxSessionLifetimeMinutes: gdata.MaxSessionLifetimeMinutes,
+		AllowedNetworks:           gdata.AllowedNetworks,
+		AllowedCountries:          gdata.AllowedCountries,
+	}
+
+	if err := sessionPolicy.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.ValidateGroupRules(gdata.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if err := data.SetGroup(gdata.Group, gdata.Members, true); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := data.SetSessionPolicy(gdata.Group, sessionPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := data.SetGroupRules(gdata.Group, gdata.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	log.Printf("group '%s' edited", gdata.Group)
 
 	w.Write([]byte("OK!"))
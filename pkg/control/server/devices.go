@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/router"
@@ -45,11 +47,23 @@ func listDevices(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	handshakes := map[string]time.Time{}
+	peers, err := router.ListPeers()
+	if err != nil {
+		log.Println("unable to get wireguard peers for last handshake: ", err)
+	}
+
+	for _, peer := range peers {
+		handshakes[peer.PublicKey.String()] = peer.LastHandshakeTime
+	}
+
+	listed := make([]data.ListedDevice, 0, len(devices))
 	for i := range devices {
 		devices[i].Active = router.IsAuthed(devices[i].Address)
+		listed = append(listed, data.ListedDevice{Device: devices[i], LastHandshake: handshakes[devices[i].Publickey]})
 	}
 
-	b, err := json.Marshal(devices)
+	b, err := json.Marshal(listed)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -59,6 +73,61 @@ func listDevices(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func setDeviceName(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	address := r.FormValue("address")
+
+	device, err := data.GetDeviceByAddress(address)
+	if err != nil {
+		http.Error(w, "not found in database: "+err.Error(), 404)
+		return
+	}
+
+	err = data.SetDeviceName(device.Username, address, r.FormValue("name"))
+	if err != nil {
+		http.Error(w, "could not set device name: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+func setDeviceTags(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	address := r.FormValue("address")
+
+	device, err := data.GetDeviceByAddress(address)
+	if err != nil {
+		http.Error(w, "not found in database: "+err.Error(), 404)
+		return
+	}
+
+	var tags []string
+	if r.FormValue("tags") != "" {
+		tags = strings.Split(r.FormValue("tags"), ",")
+	}
+
+	err = data.SetDeviceTags(device.Username, address, tags)
+	if err != nil {
+		http.Error(w, "could not set device tags: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println(device.Username, " device", address, "tags set to", tags)
+
+	w.Write([]byte("OK"))
+}
+
 func lockDevice(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -167,3 +236,39 @@ func deleteDevice(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("OK"))
 }
+
+// deviceHistory returns the connection history of a device by address, or of all of a users devices by username
+func deviceHistory(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	username := r.FormValue("username")
+	address := r.FormValue("address")
+
+	var history []data.ConnectionEvent
+	switch {
+	case address != "":
+		history, err = data.GetConnectionHistory(username, address)
+	case username != "":
+		history, err = data.GetUserConnectionHistory(username)
+	default:
+		http.Error(w, "username or address must be supplied", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(history)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func grants(w http.ResponseWriter, r *http.Request) {
+	grants, err := data.GetGrants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, _ := json.Marshal(grants)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+func newGrant(w http.ResponseWriter, r *http.Request) {
+	var grant data.Grant
+	if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grant, err := data.GrantAccess(grant, grant.ApprovedBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("temporary access granted to %s by %s until %s: %s", grant.Effects, grant.ApprovedBy, grant.Expires.Format(time.RFC3339), grant.Reason)
+
+	w.Write([]byte("OK!"))
+}
+
+func approveGrant(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grant, err := data.ApproveAccessRequest(r.FormValue("id"), r.FormValue("by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("access request from %s approved by %s until %s: %s", grant.RequestedBy, grant.ApprovedBy, grant.Expires.Format(time.RFC3339), grant.Reason)
+
+	w.Write([]byte("OK!"))
+}
+
+func rejectGrant(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.RejectAccessRequest(r.FormValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("access request %s rejected", r.FormValue("id"))
+
+	w.Write([]byte("OK!"))
+}
+
+func revokeGrant(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.RevokeGrant(r.FormValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("grant %s revoked", r.FormValue("id"))
+
+	w.Write([]byte("OK!"))
+}
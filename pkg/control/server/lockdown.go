@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func lockdownStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := data.GetLockdownStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func startLockdown(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	duration, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil {
+		http.Error(w, "invalid duration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exemptGroups []string
+	for _, group := range strings.Split(r.FormValue("exempt"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			exemptGroups = append(exemptGroups, group)
+		}
+	}
+
+	lockdown, err := data.StartLockdown(r.FormValue("by"), r.FormValue("reason"), duration, exemptGroups, r.FormValue("block_public") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("lockdown started by %s until %s: %s", lockdown.By, lockdown.Expires.Format(time.RFC3339), lockdown.Reason)
+
+	w.Write([]byte("OK"))
+}
+
+func endLockdown(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = data.EndLockdown(r.FormValue("by"), r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("lockdown ended by %s", r.FormValue("by"))
+
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func objects(w http.ResponseWriter, r *http.Request) {
+	objects, err := data.GetObjects()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, _ := json.Marshal(objects)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+func newObject(w http.ResponseWriter, r *http.Request) {
+	var object control.ObjectData
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.SetObject(object, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("new object '%s' added", object.Object)
+
+	w.Write([]byte("OK!"))
+}
+
+func editObject(w http.ResponseWriter, r *http.Request) {
+	var object control.ObjectData
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := data.SetObject(object, true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("object '%s' edited", object.Object)
+
+	w.Write([]byte("OK!"))
+}
+
+func deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var objectNames []string
+	if err := json.NewDecoder(r.Body).Decode(&objectNames); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, objectName := range objectNames {
+		if err := data.RemoveObject(objectName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("object/s '%s' deleted", objectNames)
+
+	w.Write([]byte("OK!"))
+}
@@ -20,6 +20,10 @@ func listRegistrations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for i := range result {
+		result[i].Link = registrationLink(result[i].Token)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	b, err := json.Marshal(result)
@@ -31,6 +35,17 @@ func listRegistrations(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// registrationLink is empty if wag cannot work out its public address, the token can still be used with /register_device
+func registrationLink(token string) string {
+	link, err := data.RegistrationLink(token)
+	if err != nil {
+		log.Println("unable to create registration link: ", err)
+		return ""
+	}
+
+	return link
+}
+
 func newRegistration(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -41,6 +56,10 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 	token := r.FormValue("token")
 	username := r.FormValue("username")
 	overwrite := r.FormValue("overwrite")
+	iface := r.FormValue("interface")
+	pool := r.FormValue("pool")
+	address := r.FormValue("address")
+	email := r.FormValue("email")
 
 	groupsString := r.FormValue("groups")
 	usesString := r.FormValue("uses")
@@ -74,7 +93,7 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := control.RegistrationResult{Token: token, Username: username, Groups: groups, NumUses: uses}
+	resp := control.RegistrationResult{Token: token, Username: username, Overwrites: overwrite, Groups: groups, NumUses: uses, Interface: iface, Pool: pool, Address: address, Email: email}
 
 	tokenType := "registration"
 	if overwrite != "" {
@@ -82,12 +101,14 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if token != "" {
-		err := data.AddRegistrationToken(token, username, overwrite, groups, uses)
+		err := data.AddRegistrationToken(resp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		resp.Link = registrationLink(token)
+
 		b, err := json.Marshal(resp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -100,13 +121,14 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err = data.GenerateToken(username, overwrite, groups, uses)
+	token, err = data.GenerateToken(resp)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	resp.Token = token
+	resp.Link = registrationLink(token)
 
 	b, err := json.Marshal(resp)
 	if err != nil {
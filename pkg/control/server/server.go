@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/router"
@@ -30,6 +31,100 @@ func firewallRules(w http.ResponseWriter, r *http.Request) {
 	w.Write(result)
 }
 
+func flowLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(router.GetFlows())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+// traceDevice starts a packet trace and streams its events as json lines until the trace ends or the client disconnects
+func traceDevice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var duration time.Duration
+	if r.FormValue("duration") != "" {
+		duration, err = time.ParseDuration(r.FormValue("duration"))
+		if err != nil {
+			http.Error(w, "invalid duration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe first so no events are missed
+	events, unsubscribe := router.SubscribeTraces()
+	defer unsubscribe()
+
+	until, err := router.StartTrace(r.FormValue("address"), duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	address := net.ParseIP(r.FormValue("address")).String()
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	end := time.NewTimer(time.Until(until))
+	defer end.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end.C:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if event.Device != address {
+				continue
+			}
+
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func stopTrace(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = router.StopTrace(r.FormValue("address"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
 func version(w http.ResponseWriter, r *http.Request) {
 	if config.Version == "" {
 		config.Version = "DEBUG (git tag not injected)"
@@ -62,24 +157,76 @@ func shutdown(w http.ResponseWriter, r *http.Request) {
 	os.Exit(returnCode)
 }
 
-func StartControlSocket() error {
-
+func listen() (net.Listener, error) {
 	l, err := net.Listen("unix", config.Values.Socket)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//Yes I know this is doubling up on the umask, but meh
 	if err := os.Chmod(config.Values.Socket, 0760); err != nil {
-		return err
+		l.Close()
+		return nil, err
 	}
 
 	if config.Values.GID != nil {
 		if err := os.Chown(config.Values.Socket, -1, *config.Values.GID); err != nil {
-			return err
+			l.Close()
+			return nil, err
 		}
 	}
 
+	return l, nil
+}
+
+func serve(l net.Listener, controlMux http.Handler) {
+	go func() {
+		srv := &http.Server{
+			Handler: controlMux,
+		}
+
+		log.Println("failed to serve control socket: ", srv.Serve(l))
+	}()
+}
+
+func clusteringRoutes(controlMux *httputils.HTTPUtilMux) {
+	controlMux.Get("/clustering/errors", listErrors)
+	controlMux.Get("/clustering/members", listMembers)
+	controlMux.Get("/clustering/ping", getLastMemberPing)
+	controlMux.Get("/clustering/members/health", membersHealth)
+	controlMux.Post("/clustering/members/add", addMember)
+	controlMux.Post("/clustering/members/control", memberControl)
+	controlMux.Post("/clustering/errors/resolve", resolveError)
+}
+
+// StartWitnessControlSocket serves only the cluster, version and shutdown endpoints, as a witness has no devices, firewall or users of its own
+func StartWitnessControlSocket() error {
+	l, err := listen()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Started witness control socket: \n\t\t\t", config.Values.Socket)
+
+	controlMux := httputils.NewMux()
+
+	controlMux.Get("/version", version)
+	controlMux.Get("/version/bpf", bpfVersion)
+	controlMux.Post("/shutdown", shutdown)
+
+	clusteringRoutes(controlMux)
+
+	serve(l, controlMux)
+	return nil
+}
+
+func StartControlSocket() error {
+
+	l, err := listen()
+	if err != nil {
+		return err
+	}
+
 	log.Println("Started control socket: \n\t\t\t", config.Values.Socket)
 
 	controlMux := httputils.NewMux()
@@ -89,6 +236,16 @@ func StartControlSocket() error {
 	controlMux.Post("/device/unlock", unlockDevice)
 	controlMux.Get("/device/sessions", sessions)
 	controlMux.Post("/device/delete", deleteDevice)
+	controlMux.Post("/device/name", setDeviceName)
+	controlMux.Post("/device/tags", setDeviceTags)
+	controlMux.Get("/device/history", deviceHistory)
+
+	controlMux.Get("/device/pools/list", listAddressPools)
+	controlMux.Post("/device/pools/create", addAddressPool)
+	controlMux.Post("/device/pools/delete", deleteAddressPool)
+	controlMux.Get("/device/reservations/list", listAddressReservations)
+	controlMux.Post("/device/reservations/create", addAddressReservation)
+	controlMux.Post("/device/reservations/delete", deleteAddressReservation)
 
 	controlMux.Get("/users/groups", getUserGroups)
 	controlMux.Get("/users/list", listUsers)
@@ -108,16 +265,35 @@ func StartControlSocket() error {
 	controlMux.Post("/webadmin/add", addAdminUser)
 
 	controlMux.Get("/firewall/list", firewallRules)
+	controlMux.Get("/firewall/flows", flowLogs)
+	controlMux.Post("/firewall/trace", traceDevice)
+	controlMux.Post("/firewall/trace/stop", stopTrace)
 	controlMux.Get("/config/policies/list", policies)
 	controlMux.Post("/config/policy/edit", editPolicy)
 	controlMux.Post("/config/policy/create", newPolicy)
 	controlMux.Post("/config/policies/delete", deletePolicies)
+	controlMux.Post("/config/policy/simulate", simulatePolicy)
 
 	controlMux.Get("/config/group/list", groups)
 	controlMux.Post("/config/group/edit", editGroup)
 	controlMux.Post("/config/group/create", newGroup)
 	controlMux.Post("/config/group/delete", deleteGroup)
 
+	controlMux.Get("/config/objects/list", objects)
+	controlMux.Post("/config/object/edit", editObject)
+	controlMux.Post("/config/object/create", newObject)
+	controlMux.Post("/config/objects/delete", deleteObjects)
+
+	controlMux.Get("/config/grants/list", grants)
+	controlMux.Post("/config/grant/create", newGrant)
+	controlMux.Post("/config/grant/approve", approveGrant)
+	controlMux.Post("/config/grant/reject", rejectGrant)
+	controlMux.Post("/config/grant/revoke", revokeGrant)
+
+	controlMux.Get("/lockdown", lockdownStatus)
+	controlMux.Post("/lockdown/start", startLockdown)
+	controlMux.Post("/lockdown/end", endLockdown)
+
 	controlMux.Get("/config/settings", getAllSettings)
 	controlMux.Get("/config/settings/lockout", getLockout)
 
@@ -130,17 +306,9 @@ func StartControlSocket() error {
 	controlMux.Post("/registration/create", newRegistration)
 	controlMux.Post("/registration/delete", deleteRegistration)
 
-	controlMux.Get("/clustering/errors", listErrors)
-	controlMux.Get("/clustering/members", listMembers)
-	controlMux.Get("/clustering/ping", getLastMemberPing)
-
-	go func() {
-		srv := &http.Server{
-			Handler: controlMux,
-		}
+	clusteringRoutes(controlMux)
 
-		log.Println("failed to serve control socket: ", srv.Serve(l))
-	}()
+	serve(l, controlMux)
 	return nil
 }
 
@@ -1,11 +1,39 @@
 package control
 
+import "time"
+
 type RegistrationResult struct {
 	Token      string
 	Username   string
 	Groups     []string
 	Overwrites string
 	NumUses    int
+	Interface  string `json:",omitempty"`
+
+	// Devices registered with this token are given an address from the named pool
+	Pool string `json:",omitempty"`
+	// Devices registered with this token are given this exact address, may only be used once
+	Address string `json:",omitempty"`
+
+	// The registration link is mailed here, and it becomes the users email address once they register
+	Email string `json:",omitempty"`
+
+	// Public page that registers a device with this token, only set in control socket responses
+	Link string `json:",omitempty"`
+}
+
+// AddressPool is a sub range of a wireguard interface's subnet that registration tokens can allocate device addresses from.
+// Addresses in a pool are never randomly handed out to devices that did not ask for that pool
+type AddressPool struct {
+	Name      string `json:"name"`
+	Subnet    string `json:"subnet"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// AddressReservation holds an address for a user, so it can only be assigned to one of their devices
+type AddressReservation struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
 }
 
 type PolicyData struct {
@@ -13,11 +41,80 @@ type PolicyData struct {
 	PublicRoutes []string `json:"public_routes"`
 	MfaRoutes    []string `json:"mfa_routes"`
 	DenyRoutes   []string `json:"deny_routes"`
+	Interfaces   []string `json:"interfaces,omitempty"`
 }
 
 type GroupData struct {
 	Group   string   `json:"group"`
 	Members []string `json:"members"`
+
+	// Session overrides for members of the group, unset uses the cluster wide setting and -1 disables the timeout
+	InactivityTimeoutMinutes  *int `json:"inactivity_timeout_minutes,omitempty"`
+	MaxSessionLifetimeMinutes *int `json:"max_session_lifetime_minutes,omitempty"`
+
+	// Members may only register and authorise from these networks or ISO country codes, empty allows any source
+	AllowedNetworks  []string `json:"allowed_networks,omitempty"`
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+
+	// Users matching all of these rules are members without being listed, e.g claim:department=eng, mfa=webauthn or created>2024-01-01
+	Rules []string `json:"rules,omitempty"`
+}
+
+// ObjectData is a named network or service, Object is either network:<name> or service:<name> and is how policies refer to it.
+// Network entries are addresses, subnets or domains and service entries are the services of a rule, e.g 5432/tcp
+type ObjectData struct {
+	Object  string   `json:"object"`
+	Entries []string `json:"entries"`
+}
+
+// PolicySimulation is a proposed policy or group change, exactly one of Policy or Group must be set
+type PolicySimulation struct {
+	Policy *PolicyData `json:"policy,omitempty"`
+	Group  *GroupData  `json:"group,omitempty"`
+
+	// Simulate deleting the policy or group rather than creating or replacing it
+	Remove bool `json:"remove,omitempty"`
+}
+
+// SimulationReport lists the users whose access would change if a PolicySimulation was applied
+type SimulationReport struct {
+	Changes      []AccessChange `json:"changes"`
+	UsersChecked int            `json:"users_checked"`
+}
+
+type AccessChange struct {
+	Username string `json:"username"`
+	// Set when the change only applies to one of the users devices, e.g a tag policy
+	Device string `json:"device,omitempty"`
+
+	Gained []Access `json:"gained,omitempty"`
+	Lost   []Access `json:"lost,omitempty"`
+}
+
+// Access is a single network and port range a user can reach (or is denied), Type is one of mfa, public or deny
+type Access struct {
+	Network string `json:"network"`
+	Ports   string `json:"ports"`
+	Type    string `json:"type"`
+}
+
+func (a Access) String() string {
+	return a.Type + " " + a.Network + " " + a.Ports
+}
+
+type ClusterMemberHealth struct {
+	ID       string
+	Name     string
+	PeerURLs []string
+
+	IsLeader  bool
+	IsLearner bool
+	IsWitness bool
+	IsDrained bool
+
+	Version  string
+	LastPing time.Time
+	Status   string
 }
 
 const DefaultWagSocket = "/tmp/wag.sock"
@@ -75,7 +75,39 @@ func (c *CtrlClient) ListDevice(username string) (d []data.Device, err error) {
 		return nil, errors.New(string(result))
 	}
 
-	err = json.NewDecoder(response.Body).Decode(&d)
+	var listed []data.ListedDevice
+	err = json.NewDecoder(response.Body).Decode(&listed)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range listed {
+		device.Device.LastHandshake = device.LastHandshake
+		d = append(d, device.Device)
+	}
+
+	return d, nil
+}
+
+// ConnectionHistory returns the connection history of the device with address, or of all the users devices if address is empty
+func (c *CtrlClient) ConnectionHistory(username, address string) (history []data.ConnectionEvent, err error) {
+
+	response, err := c.httpClient.Get("http://unix/device/history?username=" + url.QueryEscape(username) + "&address=" + url.QueryEscape(address))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&history)
 
 	return
 }
@@ -89,6 +121,25 @@ func (c *CtrlClient) DeleteDevice(address string) error {
 	return c.simplepost("device/delete", form)
 }
 
+func (c *CtrlClient) SetDeviceName(address, name string) error {
+
+	form := url.Values{}
+	form.Add("address", address)
+	form.Add("name", name)
+
+	return c.simplepost("device/name", form)
+}
+
+// SetDeviceTags replaces all tags on the device, an empty list removes all tags
+func (c *CtrlClient) SetDeviceTags(address string, tags []string) error {
+
+	form := url.Values{}
+	form.Add("address", address)
+	form.Add("tags", strings.Join(tags, ","))
+
+	return c.simplepost("device/tags", form)
+}
+
 func (c *CtrlClient) LockDevice(address string) error {
 
 	form := url.Values{}
@@ -105,6 +156,85 @@ func (c *CtrlClient) UnlockDevice(address string) error {
 	return c.simplepost("device/unlock", form)
 }
 
+func (c *CtrlClient) ListAddressPools() (pools []control.AddressPool, err error) {
+
+	response, err := c.httpClient.Get("http://unix/device/pools/list")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&pools)
+
+	return
+}
+
+func (c *CtrlClient) AddAddressPool(pool control.AddressPool) error {
+
+	form := url.Values{}
+	form.Add("name", pool.Name)
+	form.Add("subnet", pool.Subnet)
+	form.Add("interface", pool.Interface)
+
+	return c.simplepost("device/pools/create", form)
+}
+
+func (c *CtrlClient) DeleteAddressPool(name string) error {
+
+	form := url.Values{}
+	form.Add("name", name)
+
+	return c.simplepost("device/pools/delete", form)
+}
+
+func (c *CtrlClient) ListAddressReservations() (reservations []control.AddressReservation, err error) {
+
+	response, err := c.httpClient.Get("http://unix/device/reservations/list")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&reservations)
+
+	return
+}
+
+func (c *CtrlClient) AddAddressReservation(reservation control.AddressReservation) error {
+
+	form := url.Values{}
+	form.Add("address", reservation.Address)
+	form.Add("username", reservation.Username)
+
+	return c.simplepost("device/reservations/create", form)
+}
+
+func (c *CtrlClient) DeleteAddressReservation(address string) error {
+
+	form := url.Values{}
+	form.Add("address", address)
+
+	return c.simplepost("device/reservations/delete", form)
+}
+
 // List Admin users, or if username is supplied get details from single user
 func (c *CtrlClient) ListAdminUsers(username string) (users []data.AdminModel, err error) {
 
@@ -335,6 +465,121 @@ func (c *CtrlClient) FirewallRules() (rules map[string]router.FirewallRules, err
 	return
 }
 
+func (c *CtrlClient) FlowLogs() (flows []router.Flow, err error) {
+
+	response, err := c.httpClient.Get("http://unix/firewall/flows")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&flows)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Trace starts a packet trace of the device with address on the node the socket belongs to, and calls onEvent for each packet until the trace ends
+func (c *CtrlClient) Trace(address string, duration time.Duration, onEvent func(router.TraceEvent)) error {
+
+	form := url.Values{}
+	form.Set("address", address)
+	if duration != 0 {
+		form.Set("duration", duration.String())
+	}
+
+	response, err := c.httpClient.Post("http://unix/firewall/trace", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+
+		return errors.New("Error: " + string(result))
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event router.TraceEvent
+		err := decoder.Decode(&event)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		onEvent(event)
+	}
+}
+
+func (c *CtrlClient) StopTrace(address string) error {
+
+	form := url.Values{}
+	form.Set("address", address)
+
+	return c.simplepost("firewall/trace/stop", form)
+}
+
+func (c *CtrlClient) GetLockdown() (status data.LockdownStatus, err error) {
+
+	response, err := c.httpClient.Get("http://unix/lockdown")
+	if err != nil {
+		return status, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return status, err
+		}
+
+		return status, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&status)
+	return
+}
+
+// StartLockdown deauthenticates every device in the cluster that does not belong to a member of exemptGroups, and blocks new authorisations until duration has passed
+func (c *CtrlClient) StartLockdown(by, reason string, duration time.Duration, exemptGroups []string, blockPublic bool) error {
+
+	form := url.Values{}
+	form.Set("by", by)
+	form.Set("reason", reason)
+	form.Set("duration", duration.String())
+	form.Set("exempt", strings.Join(exemptGroups, ","))
+	form.Set("block_public", fmt.Sprintf("%t", blockPublic))
+
+	return c.simplepost("lockdown/start", form)
+}
+
+func (c *CtrlClient) EndLockdown(by, reason string) error {
+
+	form := url.Values{}
+	form.Set("by", by)
+	form.Set("reason", reason)
+
+	return c.simplepost("lockdown/end", form)
+}
+
 func (c *CtrlClient) GetPolicies() (result []control.PolicyData, err error) {
 
 	response, err := c.httpClient.Get("http://unix/config/policies/list")
@@ -425,6 +670,32 @@ func (c *CtrlClient) RemovePolicies(policyNames []string) error {
 	return nil
 }
 
+// SimulatePolicy reports whose access would change if the proposed policy or group change was applied, without applying it
+func (c *CtrlClient) SimulatePolicy(proposed control.PolicySimulation) (report control.SimulationReport, err error) {
+
+	proposedData, err := json.Marshal(proposed)
+	if err != nil {
+		return report, err
+	}
+
+	response, err := c.httpClient.Post("http://unix/config/policy/simulate", "application/json", bytes.NewBuffer(proposedData))
+	if err != nil {
+		return report, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return report, err
+		}
+		return report, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&report)
+	return report, err
+}
+
 func (c *CtrlClient) GetGroups() (result []control.GroupData, err error) {
 
 	response, err := c.httpClient.Get("http://unix/config/group/list")
@@ -523,6 +794,86 @@ func (c *CtrlClient) RemoveGroup(groupNames []string) error {
 	return nil
 }
 
+// GetObjects lists the named networks and services that policies can refer to
+func (c *CtrlClient) GetObjects() (result []control.ObjectData, err error) {
+
+	response, err := c.httpClient.Get("http://unix/config/objects/list")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return
+}
+
+func (c *CtrlClient) setObject(path string, object control.ObjectData) error {
+
+	objectData, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.httpClient.Post("http://unix"+path, "application/json", bytes.NewBuffer(objectData))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(result))
+	}
+
+	return nil
+}
+
+// AddObject creates a named network (network:<name>) or service (service:<name>)
+func (c *CtrlClient) AddObject(object control.ObjectData) error {
+	return c.setObject("/config/object/create", object)
+}
+
+// EditObject replaces the entries of an object, every policy that refers to it is updated
+func (c *CtrlClient) EditObject(object control.ObjectData) error {
+	return c.setObject("/config/object/edit", object)
+}
+
+// RemoveObjects deletes objects, an object that is still used by a policy cannot be removed
+func (c *CtrlClient) RemoveObjects(objectNames []string) error {
+
+	objectData, err := json.Marshal(objectNames)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.httpClient.Post("http://unix/config/objects/delete", "application/json", bytes.NewBuffer(objectData))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(result))
+	}
+
+	return nil
+}
+
 func (c *CtrlClient) GetAllSettings() (allSettings data.AllSettings, err error) {
 
 	response, err := c.httpClient.Get("http://unix/config/settings")
@@ -627,26 +978,32 @@ func (c *CtrlClient) Registrations() (result []control.RegistrationResult, err e
 	return
 }
 
-func (c *CtrlClient) NewRegistration(token, username, overwrite string, uses int, groups ...string) (r control.RegistrationResult, err error) {
+// NewRegistration creates a registration token, if details.Token is empty one is generated.
+// Interface, Pool and Address control where new devices get their address from, if none are set a random address on the default interface is used
+func (c *CtrlClient) NewRegistration(details control.RegistrationResult) (r control.RegistrationResult, err error) {
 
-	if uses <= 0 {
+	if details.NumUses <= 0 {
 		err = errors.New("unable to create token with <= 0 uses")
 		return
 	}
 
 	form := url.Values{}
-	form.Add("username", username)
-	form.Add("token", token)
-	form.Add("overwrite", overwrite)
-	form.Add("uses", fmt.Sprintf("%d", uses))
-
-	for _, group := range groups {
+	form.Add("username", details.Username)
+	form.Add("token", details.Token)
+	form.Add("overwrite", details.Overwrites)
+	form.Add("interface", details.Interface)
+	form.Add("pool", details.Pool)
+	form.Add("address", details.Address)
+	form.Add("email", details.Email)
+	form.Add("uses", fmt.Sprintf("%d", details.NumUses))
+
+	for _, group := range details.Groups {
 		if !strings.HasPrefix(group, "group:") {
 			return r, errors.New("group does not have 'group:' prefix: " + group)
 		}
 	}
 
-	groupsJson, err := json.Marshal(groups)
+	groupsJson, err := json.Marshal(details.Groups)
 	if err != nil {
 		return r, err
 	}
@@ -738,7 +1095,7 @@ func (c *CtrlClient) GetClusterMembers() (clusterMembers []*membership.Member, e
 }
 
 func (c *CtrlClient) GetClusterMemberLastPing(id string) (t time.Time, err error) {
-	response, err := c.httpClient.Get("http://unix/clustering/members")
+	response, err := c.httpClient.Get("http://unix/clustering/ping?id=" + url.QueryEscape(id))
 	if err != nil {
 		return t, err
 	}
@@ -759,3 +1116,172 @@ func (c *CtrlClient) GetClusterMemberLastPing(id string) (t time.Time, err error
 
 	return t, nil
 }
+
+func (c *CtrlClient) GetClusterMembersHealth() (health []control.ClusterMemberHealth, err error) {
+	response, err := c.httpClient.Get("http://unix/clustering/members/health")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&health); err != nil {
+		return nil, errors.New("unable to decode json: " + err.Error())
+	}
+
+	return health, nil
+}
+
+// AddClusterMember adds a new learner to the cluster, returning the join token the new node must be started with
+func (c *CtrlClient) AddClusterMember(name, peerURL, managerURL string) (joinToken string, err error) {
+
+	form := url.Values{}
+	form.Add("name", name)
+	form.Add("peer", peerURL)
+	form.Add("manager", managerURL)
+
+	response, err := c.httpClient.Post("http://unix/clustering/members/add", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return "", err
+		}
+
+		return "", errors.New(string(result))
+	}
+
+	var newNode data.NewNodeResponse
+	if err := json.NewDecoder(response.Body).Decode(&newNode); err != nil {
+		return "", errors.New("unable to decode json: " + err.Error())
+	}
+
+	return newNode.JoinToken, nil
+}
+
+func (c *CtrlClient) clusterControl(id, action string) error {
+	form := url.Values{}
+	form.Add("id", id)
+	form.Add("action", action)
+
+	return c.simplepost("clustering/members/control", form)
+}
+
+func (c *CtrlClient) PromoteClusterMember(id string) error {
+	return c.clusterControl(id, "promote")
+}
+
+func (c *CtrlClient) DrainClusterMember(id string, drain bool) error {
+	if drain {
+		return c.clusterControl(id, "drain")
+	}
+	return c.clusterControl(id, "restore")
+}
+
+// StepDownLeader must be sent to the control socket of the current leader
+func (c *CtrlClient) StepDownLeader() error {
+	return c.clusterControl("", "stepdown")
+}
+
+// SetClusterMemberWitness marks the node this control socket belongs to as a witness, or removes the mark
+func (c *CtrlClient) SetClusterMemberWitness(witness bool) error {
+	if witness {
+		return c.clusterControl("", "witness")
+	}
+	return c.clusterControl("", "unwitness")
+}
+
+func (c *CtrlClient) RemoveClusterMember(id string) error {
+	return c.clusterControl(id, "remove")
+}
+
+func (c *CtrlClient) ResolveClusterError(id string) error {
+	form := url.Values{}
+	form.Add("id", id)
+
+	return c.simplepost("clustering/errors/resolve", form)
+}
+
+// GetGrants lists the active temporary access grants and the requests waiting for approval
+func (c *CtrlClient) GetGrants() (result []data.Grant, err error) {
+
+	response, err := c.httpClient.Get("http://unix/config/grants/list")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return
+}
+
+// GrantAccess gives a user or group temporary access, grant.ApprovedBy records who granted it
+func (c *CtrlClient) GrantAccess(grant data.Grant) error {
+
+	grantData, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.httpClient.Post("http://unix/config/grant/create", "application/json", bytes.NewBuffer(grantData))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(result))
+	}
+
+	return nil
+}
+
+func (c *CtrlClient) ApproveAccessRequest(id, by string) error {
+
+	form := url.Values{}
+	form.Set("id", id)
+	form.Set("by", by)
+
+	return c.simplepost("config/grant/approve", form)
+}
+
+func (c *CtrlClient) RejectAccessRequest(id string) error {
+
+	form := url.Values{}
+	form.Set("id", id)
+
+	return c.simplepost("config/grant/reject", form)
+}
+
+// RevokeGrant ends a temporary access grant before it expires
+func (c *CtrlClient) RevokeGrant(id string) error {
+
+	form := url.Values{}
+	form.Set("id", id)
+
+	return c.simplepost("config/grant/revoke", form)
+}
@@ -33,6 +33,8 @@ func clusterMembersUI(w http.ResponseWriter, r *http.Request) {
 		Members     []MembershipDTO
 		Leader      types.ID
 		CurrentNode string
+		Upgrade     *data.UpgradeStatus
+		Roaming     data.DeviceRoaming
 	}{
 		Page: Page{
 
@@ -48,6 +50,18 @@ func clusterMembersUI(w http.ResponseWriter, r *http.Request) {
 		CurrentNode: data.GetServerID().String(),
 	}
 
+	if upgrade, err := data.GetUpgradeStatus(); err == nil {
+		d.Upgrade = &upgrade
+	}
+
+	roaming, err := data.GetDeviceRoaming()
+	if err != nil {
+		log.Println("unable to get device roaming policy: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	d.Roaming = roaming
+
 	members := data.GetMembers()
 	for i := range data.GetMembers() {
 		drained, err := data.IsDrained(members[i].ID.String())
@@ -91,7 +105,7 @@ func clusterMembersUI(w http.ResponseWriter, r *http.Request) {
 					status += "(lagging ping)"
 				}
 
-				if lastPing.Before(time.Now().Add(-14 * time.Second)) {
+				if lastPing.Before(time.Now().Add(-data.DeadNodeTimeout)) {
 					status = "dead"
 				}
 
@@ -110,7 +124,7 @@ func clusterMembersUI(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	err := renderDefaults(w, r, d, "cluster/members.html", "delete_modal.html")
+	err = renderDefaults(w, r, d, "cluster/members.html", "delete_modal.html")
 
 	if err != nil {
 		log.Println("unable to render clustering page: ", err)
@@ -208,6 +222,63 @@ func nodeControl(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func upgradeStart(w http.ResponseWriter, r *http.Request) {
+	var upgradeReq data.UpgradeRequest
+	err := json.NewDecoder(r.Body).Decode(&upgradeReq)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = data.StartUpgrade(upgradeReq)
+	if err != nil {
+		log.Println("failed to start rolling upgrade: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("started rolling upgrade with binary: ", upgradeReq.BinaryPath)
+
+	w.Write([]byte("OK"))
+}
+
+func upgradeAbort(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := data.AbortUpgrade("aborted by " + u.Username)
+	if err != nil {
+		log.Println("failed to abort rolling upgrade: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+func roamingSettings(w http.ResponseWriter, r *http.Request) {
+	var roaming data.DeviceRoaming
+	err := json.NewDecoder(r.Body).Decode(&roaming)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = data.SetDeviceRoaming(roaming)
+	if err != nil {
+		log.Println("failed to set device roaming policy: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("device roaming enabled: %t, reauthentication required: %t", roaming.Enabled, roaming.RequireReauthentication)
+
+	w.Write([]byte("OK"))
+}
+
 func clusterEventsUI(w http.ResponseWriter, r *http.Request) {
 	_, u := sessionManager.GetSessionFromRequest(r)
 	if u == nil {
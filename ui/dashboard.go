@@ -72,7 +72,7 @@ func populateDashboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pubkey, port, err := router.ServerDetails()
+	pubkey, port, err := router.ServerDetails(config.Values.Wireguard.DevName)
 	if err != nil {
 		log.Println("error getting server details: ", err)
 
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/NHAS/wag/pkg/control"
 )
 
 func devicesMgmtUI(w http.ResponseWriter, r *http.Request) {
@@ -24,7 +27,7 @@ func devicesMgmtUI(w http.ResponseWriter, r *http.Request) {
 		ClusterState: clusterState,
 	}
 
-	err := renderDefaults(w, r, d, "management/devices.html", "delete_modal.html")
+	err := renderDefaults(w, r, d, "management/devices.html", "delete_modal.html", "history_modal.html")
 
 	if err != nil {
 		log.Println("unable to render devices page: ", err)
@@ -57,6 +60,20 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		reservations, err := ctrl.ListAddressReservations()
+		if err != nil {
+			log.Println("error getting address reservations: ", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			renderDefaults(w, r, nil, "error.html")
+			return
+		}
+
+		reserved := map[string]bool{}
+		for _, reservation := range reservations {
+			reserved[reservation.Address] = true
+		}
+
 		var deviceData []DevicesData
 
 		for _, dev := range allDevices {
@@ -64,9 +81,17 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 				Owner:        dev.Username,
 				Locked:       dev.Attempts >= lockout,
 				InternalIP:   dev.Address,
+				Interface:    dev.GetInterfaceName(),
+				Pool:         dev.Pool,
+				Reserved:     reserved[dev.Address],
 				PublicKey:    dev.Publickey,
 				LastEndpoint: dev.Endpoint.String(),
 				Active:       dev.Active,
+
+				Name:          dev.Name,
+				Tags:          dev.Tags,
+				Created:       formatDeviceTime(dev.Created),
+				LastHandshake: formatDeviceTime(dev.LastHandshake),
 			})
 		}
 
@@ -85,6 +110,10 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 		var action struct {
 			Action    string   `json:"action"`
 			Addresses []string `json:"addresses"`
+
+			// Only used by the "name" and "tags" actions
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&action)
@@ -109,6 +138,20 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
+			case "name":
+				err := ctrl.SetDeviceName(address, action.Name)
+				if err != nil {
+					log.Println("Error naming device: ", address, " err:", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			case "tags":
+				err := ctrl.SetDeviceTags(address, action.Tags)
+				if err != nil {
+					log.Println("Error tagging device: ", address, " err:", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
 			default:
 				http.Error(w, "invalid action", 400)
 				return
@@ -142,3 +185,188 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+func addressPools(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		pools, err := ctrl.ListAddressPools()
+		if err != nil {
+			log.Println("error getting address pools: ", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		if pools == nil {
+			pools = []control.AddressPool{}
+		}
+
+		b, err := json.Marshal(pools)
+		if err != nil {
+			log.Println("unable to marshal address pools: ", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	case "POST":
+		var pool control.AddressPool
+
+		err := json.NewDecoder(r.Body).Decode(&pool)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+
+		err = ctrl.AddAddressPool(pool)
+		if err != nil {
+			log.Println("Error adding address pool: ", pool.Name, " err:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("OK"))
+
+	case "DELETE":
+		var names []string
+
+		err := json.NewDecoder(r.Body).Decode(&names)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+
+		for _, name := range names {
+			err := ctrl.DeleteAddressPool(name)
+			if err != nil {
+				log.Println("Error deleting address pool: ", name, " err:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Write([]byte("OK"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func addressReservations(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		reservations, err := ctrl.ListAddressReservations()
+		if err != nil {
+			log.Println("error getting address reservations: ", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		if reservations == nil {
+			reservations = []control.AddressReservation{}
+		}
+
+		b, err := json.Marshal(reservations)
+		if err != nil {
+			log.Println("unable to marshal address reservations: ", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	case "POST":
+		var reservation control.AddressReservation
+
+		err := json.NewDecoder(r.Body).Decode(&reservation)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+
+		err = ctrl.AddAddressReservation(reservation)
+		if err != nil {
+			log.Println("Error reserving address: ", reservation.Address, " err:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("OK"))
+
+	case "DELETE":
+		var addresses []string
+
+		err := json.NewDecoder(r.Body).Decode(&addresses)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+
+		for _, address := range addresses {
+			err := ctrl.DeleteAddressReservation(address)
+			if err != nil {
+				log.Println("Error deleting address reservation: ", address, " err:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Write([]byte("OK"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// connectionHistory returns the connection history of a device by address, or of all of a users devices by username
+func connectionHistory(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	address := r.URL.Query().Get("address")
+
+	if username == "" && address == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	history, err := ctrl.ConnectionHistory(username, address)
+	if err != nil {
+		log.Println("error getting connection history: ", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	historyData := []ConnectionHistoryData{}
+	for _, event := range history {
+		historyData = append(historyData, ConnectionHistoryData{
+			Time:     formatDeviceTime(event.Time),
+			Type:     event.Type,
+			Username: event.Username,
+			Address:  event.Address,
+			Endpoint: event.Endpoint,
+			Node:     event.Node,
+			Reason:   event.Reason,
+		})
+	}
+
+	b, err := json.Marshal(historyData)
+	if err != nil {
+		log.Println("unable to marshal connection history: ", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func formatDeviceTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC822)
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
@@ -121,6 +122,135 @@ func wgDiagnositicsData(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func flowsDiagnositicsUI(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	d := struct {
+		Page
+	}{
+		Page: Page{
+
+			Description:  "Flow Log",
+			Title:        "Flows",
+			User:         u.Username,
+			WagVersion:   WagVersion,
+			ServerID:     serverID,
+			ClusterState: clusterState,
+		},
+	}
+
+	renderDefaults(w, r, d, "diagnostics/flows.html")
+}
+
+func flowsDiagnositicsData(w http.ResponseWriter, r *http.Request) {
+	result, err := json.Marshal(router.GetFlows())
+	if err != nil {
+		log.Println("unable to marshal flows: ", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+func flowsDiagnositicsExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", "attachment; filename=flows.jsonl")
+
+	encoder := json.NewEncoder(w)
+	for _, flow := range router.GetFlows() {
+		if err := encoder.Encode(flow); err != nil {
+			log.Println("unable to export flows: ", err)
+			return
+		}
+	}
+}
+
+func traceDiagnositicsUI(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	d := struct {
+		Page
+		Address string
+		Traces  []TraceData
+	}{
+		Page: Page{
+
+			Description:  "Packet Trace",
+			Title:        "Trace",
+			User:         u.Username,
+			WagVersion:   WagVersion,
+			ServerID:     serverID,
+			ClusterState: clusterState,
+		},
+		Address: r.URL.Query().Get("address"),
+	}
+
+	for address, until := range router.ActiveTraces() {
+		d.Traces = append(d.Traces, TraceData{Address: address, Until: until.Format(time.RFC1123)})
+	}
+
+	sort.Slice(d.Traces, func(i, j int) bool {
+		return d.Traces[i].Address < d.Traces[j].Address
+	})
+
+	renderDefaults(w, r, d, "diagnostics/trace.html")
+}
+
+func traceStart(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req TraceData
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	duration := time.Duration(req.DurationSeconds) * time.Second
+
+	until, err := router.StartTrace(req.Address, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println(u.Username, "started packet trace of", req.Address)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TraceData{Address: req.Address, Until: until.Format(time.RFC1123)})
+}
+
+func traceStop(w http.ResponseWriter, r *http.Request) {
+	var req TraceData
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = router.StopTrace(req.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
 func aclsTest(w http.ResponseWriter, r *http.Request) {
 	_, u := sessionManager.GetSessionFromRequest(r)
 	if u == nil {
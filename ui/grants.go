@@ -0,0 +1,147 @@
+package ui
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func grantsUI(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	d := Page{
+
+		Description:  "Temporary Access",
+		Title:        "Temporary Access",
+		User:         u.Username,
+		WagVersion:   WagVersion,
+		ServerID:     serverID,
+		ClusterState: clusterState,
+	}
+
+	err := renderDefaults(w, r, d, "policy/grants.html", "delete_modal.html")
+
+	if err != nil {
+		log.Println("unable to render grants page: ", err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		renderDefaults(w, r, nil, "error.html")
+		return
+	}
+}
+
+func grants(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		grants, err := ctrl.GetGrants()
+		if err != nil {
+			log.Println("unable to get grants from server: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if grants == nil {
+			grants = []data.Grant{}
+		}
+
+		b, err := json.Marshal(grants)
+		if err != nil {
+			log.Println("unable to marshal grants data: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	case "DELETE":
+		var grantsToRevoke []string
+		err := json.NewDecoder(r.Body).Decode(&grantsToRevoke)
+		if err != nil {
+			log.Println("error decoding grants to revoke: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		for _, id := range grantsToRevoke {
+			if err := ctrl.RevokeGrant(id); err != nil {
+				log.Println("error revoking grant: ", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		log.Println(u.Username, "revoked grants: ", grantsToRevoke)
+
+		w.Write([]byte("OK"))
+		return
+	case "PUT":
+		var req GrantRequestDecision
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Println("error decoding access request decision: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Approve {
+			err = ctrl.ApproveAccessRequest(req.ID, "admin "+u.Username)
+		} else {
+			err = ctrl.RejectAccessRequest(req.ID)
+		}
+
+		if err != nil {
+			log.Println("error deciding access request: ", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Println(u.Username, "decided access request", req.ID, "approved:", req.Approve)
+
+		w.Write([]byte("OK"))
+		return
+	case "POST":
+		var req GrantData
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Println("error decoding grant: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		err = ctrl.GrantAccess(data.Grant{
+			Effects:    req.Effects,
+			Mfa:        req.Mfa,
+			Allow:      req.Allow,
+			Reason:     req.Reason,
+			Duration:   time.Duration(req.DurationMinutes) * time.Minute,
+			ApprovedBy: "admin " + u.Username,
+		})
+		if err != nil {
+			log.Println("error granting access: ", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Println(u.Username, "granted temporary access to", req.Effects)
+
+		w.Write([]byte("OK"))
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
@@ -0,0 +1,95 @@
+package ui
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func lockdownUI(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	status, err := ctrl.GetLockdown()
+	if err != nil {
+		log.Println("unable to get lockdown status: ", err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		renderDefaults(w, r, nil, "error.html")
+		return
+	}
+
+	d := struct {
+		Page
+		Status data.LockdownStatus
+	}{
+		Page: Page{
+
+			Description:  "Lockdown",
+			Title:        "Lockdown",
+			User:         u.Username,
+			WagVersion:   WagVersion,
+			ServerID:     serverID,
+			ClusterState: clusterState,
+		},
+		Status: status,
+	}
+
+	renderDefaults(w, r, d, "settings/lockdown.html")
+}
+
+func lockdownStart(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req LockdownData
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = ctrl.StartLockdown("admin "+u.Username, req.Reason, time.Duration(req.DurationMinutes)*time.Minute, req.ExemptGroups, req.BlockPublic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println(u.Username, "started a cluster lockdown: ", req.Reason)
+
+	w.Write([]byte("OK"))
+}
+
+func lockdownEnd(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req LockdownData
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = ctrl.EndLockdown("admin "+u.Username, req.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println(u.Username, "ended the cluster lockdown")
+
+	w.Write([]byte("OK"))
+}
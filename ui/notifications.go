@@ -2,14 +2,19 @@ package ui
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/mailer"
+	"github.com/NHAS/wag/internal/router"
 	"github.com/gorilla/websocket"
 	"golang.org/x/exp/maps"
 )
@@ -72,7 +77,26 @@ func notificationsWS(notifications <-chan Notification) func(w http.ResponseWrit
 		servingConnections[r.RemoteAddr] = connectionChan
 		mapLck.Unlock()
 
-		for notf := range connectionChan {
+		// Trace events are not stored as notifications, and have their own channel so a busy trace cannot hold up notifications
+		traces, unsubscribe := router.SubscribeTraces()
+		defer unsubscribe()
+
+		for {
+			var notf Notification
+			select {
+			case notf = <-connectionChan:
+			case event, ok := <-traces:
+				if !ok {
+					return
+				}
+
+				notf = Notification{
+					Type:  "trace",
+					Time:  event.Time,
+					Trace: &event,
+				}
+			}
+
 			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
 			err := conn.WriteJSON(notf)
@@ -102,6 +126,10 @@ type Notification struct {
 	Time       time.Time
 	Color      string
 	OpenNewTab bool
+
+	// Set to "trace" for packet trace events, which are only shown on the trace page
+	Type  string             `json:",omitempty"`
+	Trace *router.TraceEvent `json:",omitempty"`
 }
 
 var (
@@ -202,6 +230,56 @@ func receiveErrorNotifications(notifications chan<- Notification) func(key strin
 	}
 }
 
+func receiveSecurityAlerts(notifications chan<- Notification) func(key string, current, previous data.SecurityAlert, et data.EventType) error {
+
+	return func(key string, current, previous data.SecurityAlert, et data.EventType) error {
+		switch et {
+		case data.CREATED:
+
+			notifications <- Notification{
+				ID:         current.AlertID,
+				Heading:    "Device Deauthenticated",
+				Message:    []string{current.Username + " " + current.Address, current.Reason},
+				Url:        "/management/devices/",
+				Time:       current.Time,
+				OpenNewTab: false,
+				Color:      "#db0b3c",
+			}
+		case data.DELETED:
+
+			notificationsMapLck.Lock()
+			delete(notificationsMap, previous.AlertID)
+			notificationsMapLck.Unlock()
+		}
+		return nil
+	}
+}
+
+func receiveAccessRequests(notifications chan<- Notification) func(key string, current, previous data.Grant, et data.EventType) error {
+
+	return func(key string, current, previous data.Grant, et data.EventType) error {
+		switch et {
+		case data.CREATED:
+
+			notifications <- Notification{
+				ID:         "access_request_" + current.ID,
+				Heading:    "Access Requested",
+				Message:    []string{current.RequestedBy + " requested access for " + current.Duration.String(), current.Reason},
+				Url:        "/policy/grants/",
+				Time:       current.Created,
+				OpenNewTab: false,
+				Color:      "#f6c23e",
+			}
+		case data.DELETED:
+
+			notificationsMapLck.Lock()
+			delete(notificationsMap, "access_request_"+current.ID)
+			notificationsMapLck.Unlock()
+		}
+		return nil
+	}
+}
+
 func monitorClusterMembers(notifications chan<- Notification) {
 	for {
 		currentMembers, err := ctrl.GetClusterMembers()
@@ -235,7 +313,7 @@ func monitorClusterMembers(notifications chan<- Notification) {
 					continue
 				}
 
-				if lastPing.Before(time.Now().Add(-14 * time.Second)) {
+				if lastPing.Before(time.Now().Add(-data.DeadNodeTimeout)) {
 
 					notificationsMapLck.Lock()
 					delete(notificationsMap, "node_degrading_"+currentMembers[i].ID.String())
@@ -277,3 +355,62 @@ func monitorClusterMembers(notifications chan<- Notification) {
 		time.Sleep(15 * time.Second)
 	}
 }
+
+// sendDigests emails the notifications raised in each interval to the admins. Intervals are aligned to the clock so that
+// every node agrees on them, and only the node that claims an interval sends its digest
+func sendDigests() {
+	interval := time.Duration(config.Values.Email.DigestIntervalMinutes) * time.Minute
+	managementURL := strings.TrimSuffix(config.Values.ManagementUI.ExternalURL, "/")
+
+	for {
+		end := time.Now().Truncate(interval).Add(interval)
+		time.Sleep(time.Until(end))
+
+		start := end.Add(-interval)
+
+		var digest mailer.DigestData
+		for _, n := range getNotifications() {
+			if n.Time.Before(start) || !n.Time.Before(end) {
+				continue
+			}
+
+			entry := mailer.DigestEntry{
+				Heading: n.Heading,
+				Message: n.Message,
+				Time:    n.Time,
+				URL:     n.Url,
+			}
+
+			if strings.HasPrefix(n.Url, "/") {
+				entry.URL = ""
+				if managementURL != "" {
+					entry.URL = managementURL + n.Url
+				}
+			}
+
+			digest.Notifications = append(digest.Notifications, entry)
+		}
+
+		if len(digest.Notifications) == 0 {
+			continue
+		}
+
+		claimed, err := data.ClaimEvent(fmt.Sprintf("digest-%d", end.Unix()))
+		if err != nil {
+			log.Println("unable to claim admin digest: ", err)
+			continue
+		}
+
+		if !claimed {
+			continue
+		}
+
+		// getNotifications is newest first
+		slices.Reverse(digest.Notifications)
+		digest.URL = managementURL
+
+		if err := mailer.Send(config.Values.Email.Admins, mailer.DigestTemplate, digest); err != nil {
+			log.Println("unable to send admin digest: ", err)
+		}
+	}
+}
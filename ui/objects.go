@@ -0,0 +1,118 @@
+package ui
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/NHAS/wag/pkg/control"
+)
+
+func objectsUI(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	d := Page{
+
+		Description:  "Objects",
+		Title:        "Objects",
+		User:         u.Username,
+		WagVersion:   WagVersion,
+		ServerID:     serverID,
+		ClusterState: clusterState,
+	}
+
+	err := renderDefaults(w, r, d, "policy/objects.html", "delete_modal.html")
+
+	if err != nil {
+		log.Println("unable to render objects page: ", err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		renderDefaults(w, r, nil, "error.html")
+		return
+	}
+}
+
+func objects(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		data, err := ctrl.GetObjects()
+		if err != nil {
+			log.Println("unable to get object data from server: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if data == nil {
+			data = []control.ObjectData{}
+		}
+
+		b, err := json.Marshal(data)
+		if err != nil {
+			log.Println("unable to marshal objects data: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	case "DELETE":
+		var objectsToRemove []string
+		err := json.NewDecoder(r.Body).Decode(&objectsToRemove)
+		if err != nil {
+			log.Println("error decoding object names to remove: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if err := ctrl.RemoveObjects(objectsToRemove); err != nil {
+			log.Println("error removing objects: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("OK"))
+		return
+	case "PUT":
+		var object control.ObjectData
+		err := json.NewDecoder(r.Body).Decode(&object)
+		if err != nil {
+			log.Println("error decoding object data to edit: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if err := ctrl.EditObject(object); err != nil {
+			log.Println("error editing object: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("OK"))
+		return
+	case "POST":
+		var object control.ObjectData
+		err := json.NewDecoder(r.Body).Decode(&object)
+		if err != nil {
+			log.Println("error decoding object data to add new object: ", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if err := ctrl.AddObject(object); err != nil {
+			log.Println("error adding object: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("OK"))
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
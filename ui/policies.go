@@ -118,3 +118,22 @@ func policies(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+func simulatePolicy(w http.ResponseWriter, r *http.Request) {
+	var proposed control.PolicySimulation
+	err := json.NewDecoder(r.Body).Decode(&proposed)
+	if err != nil {
+		log.Println("error decoding proposed policy change: ", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	report, err := ctrl.SimulatePolicy(proposed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -2,10 +2,16 @@ package ui
 
 import (
 	"encoding/json"
+	"image/png"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
 )
 
 func registrationUI(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +69,11 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 				Groups:     reg.Groups,
 				Overwrites: reg.Overwrites,
 				Uses:       reg.NumUses,
+				Interface:  reg.Interface,
+				Pool:       reg.Pool,
+				Address:    reg.Address,
+				Email:      reg.Email,
+				Link:       reg.Link,
 			})
 		}
 
@@ -111,6 +122,10 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 			Overwrites string
 			Groups     string
 			Uses       string
+			Interface  string
+			Pool       string
+			Address    string
+			Email      string
 		}
 
 		defer r.Body.Close()
@@ -122,6 +137,10 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 
 		b.Username = strings.TrimSpace(b.Username)
 		b.Overwrites = strings.TrimSpace(b.Overwrites)
+		b.Interface = strings.TrimSpace(b.Interface)
+		b.Pool = strings.TrimSpace(b.Pool)
+		b.Address = strings.TrimSpace(b.Address)
+		b.Email = strings.TrimSpace(b.Email)
 
 		uses, err := strconv.Atoi(b.Uses)
 		if err != nil {
@@ -140,14 +159,43 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 			groups = strings.Split(b.Groups, ",")
 		}
 
-		_, err = ctrl.NewRegistration(b.Token, b.Username, b.Overwrites, uses, groups...)
+		reg, err := ctrl.NewRegistration(control.RegistrationResult{
+			Token:      b.Token,
+			Username:   b.Username,
+			Overwrites: b.Overwrites,
+			Groups:     groups,
+			NumUses:    uses,
+			Interface:  b.Interface,
+			Pool:       b.Pool,
+			Address:    b.Address,
+			Email:      b.Email,
+		})
 		if err != nil {
 			log.Println("unable to create new registration token: ", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		w.Write([]byte("OK"))
+		// Returned so the link can be shown straight away
+		created, err := json.Marshal(TokensData{
+			Username:   reg.Username,
+			Token:      reg.Token,
+			Groups:     reg.Groups,
+			Overwrites: reg.Overwrites,
+			Uses:       reg.NumUses,
+			Interface:  reg.Interface,
+			Pool:       reg.Pool,
+			Address:    reg.Address,
+			Email:      reg.Email,
+			Link:       reg.Link,
+		})
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(created)
 		return
 
 	default:
@@ -155,3 +203,49 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 	}
 
 }
+
+// registrationQR is the registration link of a token as a QR code, for users to scan with their phone
+func registrationQR(w http.ResponseWriter, r *http.Request) {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+
+	registrations, err := ctrl.Registrations()
+	if err != nil {
+		log.Println("error getting registrations: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	i := slices.IndexFunc(registrations, func(reg control.RegistrationResult) bool {
+		return reg.Token == token
+	})
+	if i == -1 || registrations[i].Link == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	image, err := qr.Encode(registrations[i].Link, qr.M, qr.Auto)
+	if err != nil {
+		log.Println("failed to generate registration qr code: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	image, err = barcode.Scale(image, 300, 300)
+	if err != nil {
+		log.Println("failed to scale registration qr code: ", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := png.Encode(w, image); err != nil {
+		log.Println("failed to encode registration qr code: ", err)
+	}
+}
@@ -218,6 +218,115 @@ class NodeControls extends HTMLElement {
 
 }
 
+class StartUpgrade extends HTMLElement {
+
+    constructor() {
+        // Always call super first in constructor
+        super();
+    }
+
+    connectedCallback() {
+        this.binaryPath = this.querySelector("#binaryPath")
+        this.targetVersion = this.querySelector("#targetVersion")
+
+        this.startBtn = this.querySelector("#startUpgrade")
+        this.startBtn.addEventListener("click", () => clusterAction("/cluster/upgrade/start", {
+            "BinaryPath": this.binaryPath.value,
+            "TargetVersion": this.targetVersion.value,
+        }))
+    }
+}
+
+class DeviceRoaming extends HTMLElement {
+
+    constructor() {
+        // Always call super first in constructor
+        super();
+    }
+
+    connectedCallback() {
+        this.enabled = this.querySelector("#roamingEnabled")
+        this.reauthentication = this.querySelector("#roamingReauthentication")
+
+        this.saveBtn = this.querySelector("#saveRoaming")
+        this.saveBtn.addEventListener("click", () => clusterAction("/cluster/roaming", {
+            "Enabled": this.enabled.checked,
+            "RequireReauthentication": this.reauthentication.checked,
+        }))
+    }
+}
+
+class UpgradeControl extends HTMLElement {
+
+    constructor() {
+        // Always call super first in constructor
+        super();
+    }
+
+    connectedCallback() {
+        this.abortBtn = this.querySelector("#abortUpgrade")
+        if (this.abortBtn) {
+            this.abortBtn.addEventListener("click", () => clusterAction("/cluster/upgrade/abort", {}))
+
+            // Keep the progress up to date while the upgrade runs
+            setTimeout(() => window.location.reload(), 5000)
+        }
+    }
+}
+
+async function clusterAction(url, data) {
+    try {
+        let res = await fetch(url, {
+            method: "POST",
+            body: JSON.stringify(data),
+            headers: {
+                "Content-Type": "application/json",
+                "WAG-CSRF": document.querySelector("#csrf_token").value,
+            }
+        })
+
+        if (res.status !== 200) {
+            let errText = await res.text()
+            console.log("failed: ", errText)
+            Toastify({
+                text: errText,
+                position: "right",
+                gravity: "top",
+                offset: {
+                    y: 60,
+                    x: 10,
+                },
+                stopOnFocus: true,
+                style: {
+                    background: "#db0b3c",
+                }
+            }).showToast();
+            return
+        }
+
+        window.location.reload();
+
+    } catch (err) {
+        console.log("error controlling cluster: ", err)
+        Toastify({
+            text: err,
+            position: "right",
+            gravity: "top",
+            offset: {
+                y: 60,
+                x: 10,
+            },
+            stopOnFocus: true,
+            style: {
+                background: "#db0b3c",
+            }
+        }).showToast();
+    }
+}
+
 
 customElements.define("add-node", AddNode);
-customElements.define("node-control", NodeControls);
\ No newline at end of file
+customElements.define("node-control", NodeControls);
+customElements.define("start-upgrade", StartUpgrade);
+customElements.define("device-roaming", DeviceRoaming);
+customElements.define("upgrade-control", UpgradeControl);
\ No newline at end of file
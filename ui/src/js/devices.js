@@ -22,6 +22,31 @@ function ownersFormatter(values, row) {
   return a.outerHTML
 }
 
+function tagsFormatter(value) {
+  if (!value) {
+    return ""
+  }
+
+  return value.map(tag => {
+    let p = document.createElement('span')
+    p.className = "badge badge-info mr-1"
+    p.innerText = tag
+    return p.outerHTML
+  }).join("")
+}
+
+function reservedFormatter(value, row) {
+  let p = document.createElement('span')
+  p.innerText = row.internal_ip
+  if (row.reserved === true) {
+    let badge = document.createElement('span')
+    badge.className = "badge badge-secondary ml-1"
+    badge.innerText = "reserved"
+    p.append(badge)
+  }
+  return p.outerHTML
+}
+
 function lockedFormatter(value) {
   let p = document.createElement('p')
   if (value === true) {
@@ -45,6 +70,17 @@ $(function () {
       align: 'center',
       sortable: true,
       formatter: ownersFormatter
+    }, {
+      field: 'name',
+      title: 'Name',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'tags',
+      title: 'Tags',
+      align: 'center',
+      formatter: tagsFormatter
     }, {
       field: 'active',
       title: 'Active',
@@ -62,6 +98,18 @@ $(function () {
       title: 'Address',
       sortable: true,
       align: 'center',
+      formatter: reservedFormatter
+    }, {
+      field: 'pool',
+      title: 'Address Pool',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'interface',
+      title: 'Interface',
+      sortable: true,
+      align: 'center',
       escape: "true"
     }, {
       field: 'public_key',
@@ -75,12 +123,38 @@ $(function () {
       sortable: true,
       align: 'center',
       escape: "true"
+    }, {
+      field: 'last_handshake',
+      title: 'Last Handshake',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'created',
+      title: 'Created',
+      sortable: true,
+      align: 'center',
+      visible: false,
+      escape: "true"
+    }, {
+      field: 'history',
+      title: 'History',
+      align: 'center',
+      formatter: function (value, row) {
+        return historyButton({ address: row.internal_ip, owner: row.owner })
+      }
     }
   ])
 
+  $("#devicesTable").on("click", ".show-history", function () {
+    showHistory("Connection History of " + $(this).data("address"), { username: $(this).data("owner"), address: $(this).data("address") })
+  })
+
   var $remove = $('#remove')
   var $lock = $('#lock')
   var $unlock = $('#unlock')
+  var $rename = $('#rename')
+  var $tag = $('#tag')
 
 
   table.on('check.bs.table uncheck.bs.table ' +
@@ -91,6 +165,8 @@ $(function () {
       $("#removeStart").prop('disabled', enableModifications)
       $lock.prop('disabled', enableModifications)
       $unlock.prop('disabled', enableModifications)
+      $rename.prop('disabled', table.bootstrapTable('getSelections').length != 1)
+      $tag.prop('disabled', enableModifications)
 
       // save your data, here just save the current page
       selections = getIdSelections(table)
@@ -106,6 +182,26 @@ $(function () {
     action(ids, "unlock", table)
   })
 
+  $rename.on("click", function () {
+    var selected = table.bootstrapTable('getSelections')
+    let name = prompt("Device name", selected[0].name)
+    if (name === null) {
+      return
+    }
+
+    action(getIdSelections(table), "name", table, { "name": name })
+  })
+
+  $tag.on("click", function () {
+    var selected = table.bootstrapTable('getSelections')
+    let tags = prompt("Comma separated tags (replaces existing tags)", (selected[0].tags || []).join(","))
+    if (tags === null) {
+      return
+    }
+
+    action(getIdSelections(table), "tags", table, { "tags": tags.split(",").map(t => t.trim()).filter(t => t.length > 0) })
+  })
+
   $remove.on("click", function () {
     var ids = getIdSelections(table)
     table.bootstrapTable('remove', {
@@ -142,9 +238,37 @@ $(function () {
 
   $('#clearFilter').on("click", function () {
     table.bootstrapTable('filterBy', {})
+    $('#interfaceFilter').val("")
     $('#clearFilter').hide()
   })
 
+  table.on('load-success.bs.table', function (e, data) {
+    let $interfaceFilter = $('#interfaceFilter')
+    let current = $interfaceFilter.val()
+
+    let interfaces = [...new Set((data || []).map(row => row.interface))].sort()
+
+    $interfaceFilter.find('option:not(:first)').remove()
+    interfaces.forEach(name => {
+      $interfaceFilter.append($('<option>').val(name).text(name))
+    })
+
+    $interfaceFilter.val(current)
+    $interfaceFilter.toggle(interfaces.length > 1 || current !== "")
+  })
+
+  $('#interfaceFilter').on("change", function () {
+    let value = $(this).val()
+    if (value === "") {
+      table.bootstrapTable('filterBy', {})
+      $('#clearFilter').hide()
+      return
+    }
+
+    table.bootstrapTable('filterBy', { interface: value })
+    $('#clearFilter').show()
+  })
+
   const urlParams = new URLSearchParams(window.location.search);
   if (urlParams.toString().length > 0) {
     $('#clearFilter').show()
@@ -163,15 +287,151 @@ $(function () {
       filter.active = urlParams.get('active') == "true"
     }
 
+    if (urlParams.has('interface')) {
+      filter.interface = urlParams.get('interface')
+      $('#interfaceFilter').append($('<option>').val(filter.interface).text(filter.interface)).val(filter.interface)
+    }
+
     table.bootstrapTable('filterBy', filter)
   }
 
 });
 
-function action(onDevices, action, table) {
+$(function () {
+  let pools = createTable('#poolsTable', [
+    {
+      field: 'state',
+      checkbox: true,
+      align: 'center',
+    }, {
+      field: 'name',
+      title: 'Name',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'subnet',
+      title: 'Subnet',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'interface',
+      title: 'Interface',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }
+  ])
+
+  let reservations = createTable('#reservationsTable', [
+    {
+      field: 'state',
+      checkbox: true,
+      align: 'center',
+    }, {
+      field: 'address',
+      title: 'Address',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'username',
+      title: 'Username',
+      sortable: true,
+      align: 'center',
+      formatter: function (value) {
+        return ownersFormatter(value, { owner: value })
+      }
+    }
+  ])
+
+  pools.on('check.bs.table uncheck.bs.table check-all.bs.table uncheck-all.bs.table', function () {
+    $('#removePool').prop('disabled', !pools.bootstrapTable('getSelections').length)
+  })
+
+  reservations.on('check.bs.table uncheck.bs.table check-all.bs.table uncheck-all.bs.table', function () {
+    $('#removeReservation').prop('disabled', !reservations.bootstrapTable('getSelections').length)
+  })
+
+  $('#addPool').on("click", function () {
+    let name = prompt("Pool name")
+    if (!name) {
+      return
+    }
+
+    let subnet = prompt("Subnet, e.g 10.0.5.0/24")
+    if (!subnet) {
+      return
+    }
+
+    let iface = prompt("Wireguard interface (empty for the default interface)", "")
+    if (iface === null) {
+      return
+    }
+
+    addressingRequest("/management/devices/pools", "POST", { "name": name, "subnet": subnet, "interface": iface }, pools)
+  })
+
+  $('#removePool').on("click", function () {
+    let names = $.map(pools.bootstrapTable('getSelections'), row => row.name)
+    addressingRequest("/management/devices/pools", "DELETE", names, pools)
+    $('#removePool').prop('disabled', true)
+  })
+
+  $('#addReservation').on("click", function () {
+    let address = prompt("Address to reserve")
+    if (!address) {
+      return
+    }
+
+    let username = prompt("Reserved for user")
+    if (!username) {
+      return
+    }
+
+    addressingRequest("/management/devices/reservations", "POST", { "address": address, "username": username }, reservations)
+  })
+
+  $('#removeReservation').on("click", function () {
+    let addresses = $.map(reservations.bootstrapTable('getSelections'), row => row.address)
+    addressingRequest("/management/devices/reservations", "DELETE", addresses, reservations)
+    $('#removeReservation').prop('disabled', true)
+  })
+});
+
+function addressingRequest(url, method, data, table) {
+  fetch(url, {
+    method: method,
+    mode: 'same-origin',
+    cache: 'no-cache',
+    credentials: 'same-origin',
+    redirect: 'follow',
+    headers: {
+      'Content-Type': 'application/json',
+      'WAG-CSRF': $("#csrf_token").val()
+    },
+    body: JSON.stringify(data)
+  }).then((response) => {
+    if (response.status == 200) {
+      table.bootstrapTable('refresh')
+      $('#devicesTable').bootstrapTable('refresh')
+      $("#issue").hide()
+      return
+    }
+
+    response.text().then(txt => {
+      $("#issue").text(txt)
+      $("#issue").show()
+    })
+  })
+}
+
+function action(onDevices, action, table, extra = {}) {
   let data = {
     "action": action,
     "addresses": onDevices,
+    ...extra,
   }
 
   fetch("/management/devices/data", {
@@ -0,0 +1,127 @@
+function verdictFormatter(value) {
+  let p = document.createElement('p')
+  p.className = value === "allow" ? "badge badge-success" : "badge badge-danger"
+  p.innerText = value
+  return p.outerHTML
+}
+
+function directionFormatter(value) {
+  return value === true ? "inbound" : "outbound"
+}
+
+function reasonFormatter(value, row) {
+  let reasons = []
+  if (row.logged === true) {
+    reasons.push("logged")
+  }
+
+  if (row.sampled === true) {
+    reasons.push("sampled")
+  }
+
+  return reasons.join(", ")
+}
+
+function dateFormatter(value) {
+  return new Date(value).toLocaleString()
+}
+
+$(function () {
+  let table = createTable('#flowsTable', [
+    {
+      title: 'Last Seen',
+      field: 'last_seen',
+      sortable: true,
+      align: 'center',
+      formatter: dateFormatter,
+    },
+    {
+      title: 'User',
+      field: 'username',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    },
+    {
+      title: 'Device',
+      field: 'device',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    },
+    {
+      title: 'Direction',
+      field: 'inbound',
+      sortable: true,
+      align: 'center',
+      formatter: directionFormatter,
+    },
+    {
+      title: 'Source',
+      field: 'source',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    },
+    {
+      title: 'Destination',
+      field: 'destination',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    },
+    {
+      title: 'Protocol',
+      field: 'protocol',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    },
+    {
+      title: 'Port',
+      field: 'port',
+      sortable: true,
+      align: 'center',
+    },
+    {
+      title: 'Verdict',
+      field: 'verdict',
+      sortable: true,
+      align: 'center',
+      formatter: verdictFormatter,
+    },
+    {
+      title: 'Policy',
+      field: 'policy',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    },
+    {
+      title: 'Events',
+      field: 'events',
+      sortable: true,
+      align: 'center',
+    },
+    {
+      title: 'Reason',
+      field: 'logged',
+      align: 'center',
+      formatter: reasonFormatter,
+    },
+    {
+      title: 'First Seen',
+      field: 'first_seen',
+      sortable: true,
+      align: 'center',
+      visible: false,
+      formatter: dateFormatter,
+    }
+  ])
+
+  setInterval(function () {
+    if ($('#liveUpdates').is(':checked')) {
+      table.bootstrapTable('refresh', { silent: true })
+    }
+  }, 2000)
+});
@@ -0,0 +1,218 @@
+function getIdSelections(table) {
+  return $.map(table.bootstrapTable('getSelections'), function (row) {
+    return row.id
+  })
+}
+
+function responseHandler(res) {
+  $.each(res.rows, function (i, row) {
+    row.state = $.inArray(row.id, selections) !== -1
+  })
+  return res
+}
+
+function routesFormatter(value, row) {
+  let routes = []
+  if (row.mfa != null) {
+    routes = routes.concat(row.mfa.map(route => "mfa " + route))
+  }
+
+  if (row.allow != null) {
+    routes = routes.concat(row.allow.map(route => "allow " + route))
+  }
+
+  return routes.join(", ")
+}
+
+function statusFormatter(value, row) {
+  if (row.pending) {
+    return `Requested, ${Math.round(row.duration / 60000000000)} min`
+  }
+
+  return "Until " + new Date(row.expires).toLocaleString()
+}
+
+function operateFormatter(value, row, index) {
+  if (!row.pending) {
+    return ''
+  }
+
+  return [
+    '<a class="approve" href="javascript:void(0)" title="Approve">',
+    '<i class="icon-check"></i>',
+    '</a>  ',
+    '<a class="reject" href="javascript:void(0)" title="Reject">',
+    '<i class="icon-trash"></i>',
+    '</a>'
+  ].join('')
+}
+
+function decide(id, approve) {
+  fetch("/policy/grants/data", {
+    method: 'PUT',
+    mode: 'same-origin',
+    cache: 'no-cache',
+    credentials: 'same-origin',
+    redirect: 'follow',
+    headers: {
+      'Content-Type': 'application/json',
+      'WAG-CSRF': $("#csrf_token").val()
+    },
+    body: JSON.stringify({ "id": id, "approve": approve })
+  }).then((response) => {
+    $('#grantsTable').bootstrapTable('refresh')
+  })
+}
+
+window.operateEvents = {
+  'click .approve': function (e, value, row, index) {
+    decide(row.id, true)
+  },
+  'click .reject': function (e, value, row, index) {
+    decide(row.id, false)
+  }
+}
+
+$(function () {
+
+  let table = createTable('#grantsTable', [
+    {
+      field: 'state',
+      checkbox: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      title: 'User or Group',
+      field: 'effects',
+      align: 'center',
+      sortable: true,
+      escape: "true"
+    }, {
+      title: 'Routes',
+      field: 'mfa',
+      align: 'center',
+      escape: "true",
+      formatter: routesFormatter
+    }, {
+      title: 'Reason',
+      field: 'reason',
+      align: 'center',
+      escape: "true"
+    }, {
+      title: 'Requested By',
+      field: 'requested_by',
+      align: 'center',
+      sortable: true,
+      escape: "true"
+    }, {
+      title: 'Approved By',
+      field: 'approved_by',
+      align: 'center',
+      sortable: true,
+      escape: "true"
+    }, {
+      title: 'Status',
+      field: 'expires',
+      align: 'center',
+      sortable: true,
+      formatter: statusFormatter
+    }, {
+      field: 'decide',
+      title: 'Approve/Reject',
+      align: 'center',
+      clickToSelect: false,
+      events: window.operateEvents,
+      formatter: operateFormatter
+    }
+  ])
+
+  $(".modal").on("hidden.bs.modal", function () {
+    $("#formIssue").text("")
+    $("#formIssue").hide()
+  });
+
+  table.on('check.bs.table uncheck.bs.table ' +
+    'check-all.bs.table uncheck-all.bs.table',
+    function () {
+      $("#removeStart").prop('disabled', !table.bootstrapTable('getSelections').length)
+
+      selections = getIdSelections(table)
+    })
+
+  $('#remove').on("click", function () {
+    // Pending requests are rejected rather than revoked
+    let rows = table.bootstrapTable('getSelections')
+    rows.filter(row => row.pending).forEach(row => decide(row.id, false))
+
+    fetch("/policy/grants/data", {
+      method: 'DELETE',
+      mode: 'same-origin',
+      cache: 'no-cache',
+      credentials: 'same-origin',
+      redirect: 'follow',
+      headers: {
+        'Content-Type': 'application/json',
+        'WAG-CSRF': $("#csrf_token").val()
+      },
+      body: JSON.stringify(rows.filter(row => !row.pending).map(row => row.id))
+    }).then((response) => {
+      if (response.status == 200) {
+        $("#deleteModal").modal("hide")
+        table.bootstrapTable('refresh')
+        return
+      }
+
+      response.text().then(txt => {
+        $("#deleteIssue").text(txt)
+        $("#deleteIssue").show()
+        $("#deleteModal").modal("show")
+      })
+    })
+  })
+
+  $('#new').on("click", function () {
+    $("#effects").val("")
+    $("#duration").val("60")
+    $("#mfa").val("")
+    $("#allow").val("")
+    $("#reason").val("")
+
+    $("#grantModal").modal("show")
+  })
+
+  $('#saveGrant').on("click", function () {
+    let lines = (selector) => $(selector).val().split("\n").map(element => element.trim()).filter(element => element)
+
+    let data = {
+      "effects": $("#effects").val().trim(),
+      "mfa": lines("#mfa"),
+      "allow": lines("#allow"),
+      "reason": $("#reason").val(),
+      "duration": parseInt($("#duration").val()),
+    }
+
+    fetch("/policy/grants/data", {
+      method: 'POST',
+      mode: 'same-origin',
+      cache: 'no-cache',
+      credentials: 'same-origin',
+      redirect: 'follow',
+      headers: {
+        'Content-Type': 'application/json',
+        'WAG-CSRF': $("#csrf_token").val()
+      },
+      body: JSON.stringify(data)
+    }).then((response) => {
+      if (response.status == 200) {
+        $("#grantModal").modal("hide")
+        table.bootstrapTable('refresh')
+        return
+      }
+
+      response.text().then(txt => {
+        $("#formIssue").text(txt)
+        $("#formIssue").show()
+      })
+    })
+  })
+});
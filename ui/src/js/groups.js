@@ -35,6 +35,13 @@ window.operateEvents = {
       members_content = row.members.join("\n")
     }
     $("#members").val(members_content)
+    $("#rules").val((row.rules ?? []).join("\n"))
+
+    $("#inactivityTimeout").val(row.inactivity_timeout_minutes ?? "")
+    $("#maxSessionLifetime").val(row.max_session_lifetime_minutes ?? "")
+
+    $("#allowedNetworks").val((row.allowed_networks ?? []).join("\n"))
+    $("#allowedCountries").val((row.allowed_countries ?? []).join("\n"))
 
     $("#action").val("edit")
 
@@ -42,12 +49,47 @@ window.operateEvents = {
   }
 }
 
-function membersFormatter(values) {
-  if (values == null) {
-    return '0'
+function timeoutFormatter(value) {
+  if (value == null) {
+    return 'Default'
+  }
+
+  if (value < 0) {
+    return 'Disabled'
+  }
+
+  return value + ' min'
+}
+
+function optionalMinutes(selector) {
+  let value = $(selector).val()
+  if (value === "") {
+    return undefined
+  }
+
+  return parseInt(value)
+}
+
+function lines(selector) {
+  return $(selector).val().split("\n").map(element => element.trim()).filter(element => element)
+}
+
+function sourcesFormatter(value, row) {
+  let sources = (row.allowed_networks ?? []).concat(row.allowed_countries ?? [])
+  if (sources.length == 0) {
+    return 'Any'
   }
 
-  return values.length
+  return sources.join(", ")
+}
+
+function membersFormatter(values, row) {
+  let count = (values == null) ? '0' : values.length
+  if (row.rules != null && row.rules.length > 0) {
+    return `${count} + dynamic`
+  }
+
+  return count
 }
 
 
@@ -72,6 +114,24 @@ $(function () {
       align: 'center',
       formatter: membersFormatter
 
+    }, {
+      title: 'Inactivity Timeout',
+      field: 'inactivity_timeout_minutes',
+      sortable: true,
+      align: 'center',
+      formatter: timeoutFormatter
+    }, {
+      title: 'Max Session Lifetime',
+      field: 'max_session_lifetime_minutes',
+      sortable: true,
+      align: 'center',
+      formatter: timeoutFormatter
+    }, {
+      title: 'Allowed Sources',
+      field: 'allowed_networks',
+      align: 'center',
+      escape: "true",
+      formatter: sourcesFormatter
     }, {
       field: 'edit',
       title: 'Edit',
@@ -90,6 +150,7 @@ $(function () {
   $(".modal").on("hidden.bs.modal", function () {
     $("#formIssue").text("")
     $("#formIssue").hide()
+    $("#simulationResult").hide()
     $("#action").val("")
 
   });
@@ -150,24 +211,50 @@ $(function () {
     $("#action").val("new")
 
     $("#members").val("")
+    $("#rules").val("")
+    $("#inactivityTimeout").val("")
+    $("#maxSessionLifetime").val("")
+    $("#allowedNetworks").val("")
+    $("#allowedCountries").val("")
 
     $("#groupModal").modal("show")
   })
 
+  function groupData() {
+    let currentGroupName = $('#group').val();
+
+    return {
+      "group": currentGroupName.startsWith("group:") ? currentGroupName : `group:${currentGroupName}`,
+      "members": $('#members').val().split("\n").filter(element => element),
+      "rules": lines('#rules'),
+      "inactivity_timeout_minutes": optionalMinutes('#inactivityTimeout'),
+      "max_session_lifetime_minutes": optionalMinutes('#maxSessionLifetime'),
+      "allowed_networks": lines('#allowedNetworks'),
+      "allowed_countries": lines('#allowedCountries').map(country => country.toUpperCase()),
+    }
+  }
+
+  $("#simulate").on("click", function () {
+    simulate({ "group": groupData() }, "#simulationResult", "#formIssue")
+  })
+
   $save.on("click", function () {
     /*
     type GroupData struct {
     Group   string   `json:"group"`
     Members []string `json:"members"`
-    }
-    */
 
-    let currentGroupName = $('#group').val();
+    InactivityTimeoutMinutes  *int `json:"inactivity_timeout_minutes,omitempty"`
+    MaxSessionLifetimeMinutes *int `json:"max_session_lifetime_minutes,omitempty"`
 
-    let data = {
-      "group": currentGroupName.startsWith("group:") ? currentGroupName : `group:${currentGroupName}`,
-      "members": $('#members').val().split("\n").filter(element => element),
+    AllowedNetworks  []string `json:"allowed_networks,omitempty"`
+    AllowedCountries []string `json:"allowed_countries,omitempty"`
+
+    Rules []string `json:"rules,omitempty"`
     }
+    */
+
+    let data = groupData()
 
     let method = "POST";
     if ($('#action').val() == "edit") {
@@ -0,0 +1,92 @@
+function historyTypeFormatter(value) {
+  let p = document.createElement('p')
+  switch (value) {
+    case "deauthorised":
+    case "locked":
+      p.className = "badge badge-danger"
+      break
+    case "authorised":
+      p.className = "badge badge-success"
+      break
+    default:
+      p.className = "badge badge-secondary"
+  }
+  p.innerText = value
+  return p.outerHTML
+}
+
+function historyButton(dataset) {
+  let button = document.createElement('button')
+  button.className = "btn btn-sm btn-secondary show-history"
+  button.type = "button"
+  button.innerText = "History"
+
+  Object.keys(dataset).forEach(function (key) {
+    button.dataset[key] = dataset[key]
+  })
+
+  return button.outerHTML
+}
+
+function showHistory(title, query) {
+  $("#historyModalLabel").text(title)
+  $("#historyIssue").hide()
+  $("#historyTable").bootstrapTable('load', [])
+  $("#historyModal").modal("show")
+
+  fetch("/management/devices/history?" + new URLSearchParams(query), {
+    method: 'GET',
+    mode: 'same-origin',
+    cache: 'no-cache',
+    credentials: 'same-origin',
+    redirect: 'follow'
+  }).then((response) => {
+    if (response.status == 200) {
+      response.json().then(history => {
+        $("#historyTable").bootstrapTable('load', history)
+      })
+      return
+    }
+
+    response.text().then(txt => {
+      $("#historyIssue").text(txt)
+      $("#historyIssue").show()
+    })
+  })
+}
+
+$(function () {
+  createTable("#historyTable", [
+    {
+      field: 'time',
+      title: 'Time',
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'type',
+      title: 'Event',
+      align: 'center',
+      formatter: historyTypeFormatter
+    }, {
+      field: 'address',
+      title: 'Device',
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'endpoint',
+      title: 'Endpoint',
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'node',
+      title: 'Node',
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'reason',
+      title: 'Reason',
+      align: 'center',
+      escape: "true"
+    }
+  ])
+});
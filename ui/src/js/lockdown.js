@@ -0,0 +1,48 @@
+function lockdownRequest(url, data) {
+  return fetch(url, {
+    method: "POST",
+    body: JSON.stringify(data),
+    headers: {
+      "Content-Type": "application/json",
+      "WAG-CSRF": document.querySelector("#csrf_token").value,
+    }
+  }).then(async (res) => {
+    if (res.status !== 200) {
+      let issue = document.getElementById("issue")
+      issue.innerText = await res.text()
+      issue.hidden = false
+      return
+    }
+
+    window.location.reload()
+  })
+}
+
+$(function () {
+  let start = document.getElementById("startLockdown")
+  if (start != null) {
+    start.addEventListener("click", () => {
+      let exempt = document.getElementById("exempt").value.split(",").map(group => group.trim()).filter(group => group)
+
+      if (!confirm("This will deauthenticate every device in the cluster that is not in an exempt group. Continue?")) {
+        return
+      }
+
+      lockdownRequest("/settings/lockdown/start", {
+        reason: document.getElementById("reason").value,
+        duration: parseInt(document.getElementById("duration").value),
+        exempt_groups: exempt,
+        block_public: document.getElementById("blockPublic").checked,
+      })
+    })
+  }
+
+  let end = document.getElementById("endLockdown")
+  if (end != null) {
+    end.addEventListener("click", () => {
+      lockdownRequest("/settings/lockdown/end", {
+        reason: document.getElementById("endReason").value,
+      })
+    })
+  }
+})
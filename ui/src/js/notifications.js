@@ -21,6 +21,13 @@ if (dropDownlist.querySelectorAll(".notification").length > 0) {
 
 socket.onmessage = function (e) {
     const msg = JSON.parse(e.data)
+
+    if (msg.Type === "trace") {
+        // Packet trace events are handled by the trace page, if it is open
+        document.dispatchEvent(new CustomEvent("wag-trace", { detail: msg.Trace }))
+        return
+    }
+
     Toastify({
         text: msg.Message.join('\n'),
         className: "info",
@@ -0,0 +1,179 @@
+function getIdSelections(table) {
+  return $.map(table.bootstrapTable('getSelections'), function (row) {
+    return row.object
+  })
+}
+
+function responseHandler(res) {
+  $.each(res.rows, function (i, row) {
+    row.state = $.inArray(row.object, selections) !== -1
+  })
+  return res
+}
+
+function operateFormatter(value, row, index) {
+  return [
+    '<a class="edit" href="javascript:void(0)" title="Edit">',
+    '<i class="icon-pencil"></i>',
+    '</a>  '
+  ].join('')
+}
+
+window.operateEvents = {
+  'click .edit': function (e, value, row, index) {
+    $("#objectModalLabel").text("Edit Object")
+
+    let [kind, ...name] = row.object.split(":")
+
+    $("#kind").val(kind)
+    $("#kind").prop("disabled", true)
+    $("#name").val(name.join(":"))
+    $("#name").prop("disabled", true)
+
+    $("#entries").val((row.entries ?? []).join("\n"))
+
+    $("#action").val("edit")
+
+    $("#objectModal").modal("show")
+  }
+}
+
+function entriesFormatter(values) {
+  if (values == null) {
+    return ''
+  }
+
+  return values.join(", ")
+}
+
+$(function () {
+
+  let table = createTable('#objectsTable', [
+    {
+      field: 'state',
+      checkbox: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      title: 'Object',
+      field: 'object',
+      align: 'center',
+      sortable: true,
+      escape: "true"
+    }, {
+      title: 'Entries',
+      field: 'entries',
+      align: 'center',
+      escape: "true",
+      formatter: entriesFormatter
+    }, {
+      field: 'edit',
+      title: 'Edit',
+      align: 'center',
+      clickToSelect: false,
+      events: window.operateEvents,
+      formatter: operateFormatter
+    }
+  ])
+
+  $(".modal").on("hidden.bs.modal", function () {
+    $("#formIssue").text("")
+    $("#formIssue").hide()
+    $("#action").val("")
+  });
+
+  table.on('check.bs.table uncheck.bs.table ' +
+    'check-all.bs.table uncheck-all.bs.table',
+    function () {
+      $("#removeStart").prop('disabled', !table.bootstrapTable('getSelections').length)
+
+      selections = getIdSelections(table)
+    })
+
+  $('#remove').on("click", function () {
+    var ids = getIdSelections(table)
+
+    fetch("/policy/objects/data", {
+      method: 'DELETE',
+      mode: 'same-origin',
+      cache: 'no-cache',
+      credentials: 'same-origin',
+      redirect: 'follow',
+      headers: {
+        'Content-Type': 'application/json',
+        'WAG-CSRF': $("#csrf_token").val()
+      },
+      body: JSON.stringify(ids)
+    }).then((response) => {
+      if (response.status == 200) {
+        $("#deleteModal").modal("hide")
+        table.bootstrapTable('refresh')
+        return
+      }
+
+      // Objects still used by a policy are not removed, so show why
+      response.text().then(txt => {
+        $("#deleteIssue").text(txt)
+        $("#deleteIssue").show()
+        $("#deleteModal").modal("show")
+      })
+    })
+  })
+
+  $('#new').on("click", function () {
+    $("#objectModalLabel").text("New Object")
+
+    $("#kind").prop("disabled", false)
+    $("#kind").val("network")
+    $("#name").prop("disabled", false)
+    $("#name").val("")
+    $("#entries").val("")
+
+    $("#action").val("new")
+
+    $("#objectModal").modal("show")
+  })
+
+  $('#saveObject').on("click", function () {
+    /*
+    type ObjectData struct {
+      Object  string   `json:"object"`
+      Entries []string `json:"entries"`
+    }
+    */
+
+    let data = {
+      "object": $("#kind").val() + ":" + $("#name").val().trim(),
+      "entries": $("#entries").val().split("\n").map(element => element.trim()).filter(element => element),
+    }
+
+    let method = "POST";
+    if ($('#action').val() == "edit") {
+      method = "PUT"
+    }
+
+    fetch("/policy/objects/data", {
+      method: method,
+      mode: 'same-origin',
+      cache: 'no-cache',
+      credentials: 'same-origin',
+      redirect: 'follow',
+      headers: {
+        'Content-Type': 'application/json',
+        'WAG-CSRF': $("#csrf_token").val()
+      },
+      body: JSON.stringify(data)
+    }).then((response) => {
+      if (response.status == 200) {
+        $("#objectModal").modal("hide")
+        table.bootstrapTable('refresh')
+        return
+      }
+
+      response.text().then(txt => {
+        $("#formIssue").text(txt)
+        $("#formIssue").show()
+      })
+    })
+  })
+});
@@ -48,6 +48,7 @@ window.operateEvents = {
     }
     $("#deny_routes").val(deny_routes_content)
 
+    $("#interfaces").val((row.interfaces || []).join(","))
 
     $("#action").val("edit")
 
@@ -55,6 +56,16 @@ window.operateEvents = {
   }
 }
 
+function interfacesFormatter(values) {
+  if (values == null || values.length == 0) {
+    return 'All'
+  }
+
+  let p = document.createElement('p')
+  p.innerText = values.join(", ")
+  return p.outerHTML
+}
+
 function rulesFormatter(values) {
   if (values == null) {
     return '0'
@@ -99,6 +110,13 @@ $(function () {
       align: 'center',
       formatter: rulesFormatter
 
+    }, {
+      field: 'interfaces',
+      title: 'Interfaces',
+      sortable: true,
+      align: 'center',
+      formatter: interfacesFormatter
+
     },{
       field: 'edit',
       title: 'Edit',
@@ -116,6 +134,7 @@ $(function () {
   $(".modal").on("hidden.bs.modal", function () {
     $("#formIssue").text("")
     $("#formIssue").hide()
+    $("#simulationResult").hide()
     $("#action").val("")
 
   });
@@ -177,18 +196,27 @@ $(function () {
     $("#mfa_routes").val("")
     $("#public_routes").val("")
     $("#deny_routes").val("")
-
+    $("#interfaces").val("")
 
     $("#ruleModal").modal("show")
   })
 
-  $save.on("click", function () {
-    let data = {
+  function ruleData() {
+    return {
       "effects": $('#effects').val(),
       "deny_routes": $('#deny_routes').val().split("\n").filter(element => element),
       "mfa_routes": $('#mfa_routes').val().split("\n").filter(element => element),
       "public_routes": $('#public_routes').val().split("\n").filter(element => element),
+      "interfaces": $('#interfaces').val().split(",").map(element => element.trim()).filter(element => element),
     }
+  }
+
+  $("#simulate").on("click", function () {
+    simulate({ "policy": ruleData() }, "#simulationResult", "#formIssue")
+  })
+
+  $save.on("click", function () {
+    let data = ruleData()
 
     let method = "POST";
     if ($('#action').val() == "edit") {
@@ -0,0 +1,54 @@
+function escapeHtml(unsafe) {
+  return $('<div>').text(unsafe).html()
+}
+
+function renderAccess(prefix, accesses) {
+  if (accesses == null) {
+    return ""
+  }
+
+  return accesses.map(access => `<li><code>${prefix} ${escapeHtml(access.type)} ${escapeHtml(access.network)} ${escapeHtml(access.ports)}</code></li>`).join("")
+}
+
+// simulate posts a proposed policy or group change and shows who would gain or lose access, nothing is applied
+function simulate(proposed, resultSelector, issueSelector) {
+  $(issueSelector).hide()
+  $(resultSelector).hide()
+
+  fetch("/policy/simulate", {
+    method: 'POST',
+    mode: 'same-origin',
+    cache: 'no-cache',
+    credentials: 'same-origin',
+    redirect: 'follow',
+    headers: {
+      'Content-Type': 'application/json',
+      'WAG-CSRF': $("#csrf_token").val()
+    },
+    body: JSON.stringify(proposed)
+  }).then((response) => {
+    if (response.status != 200) {
+      response.text().then(txt => {
+        $(issueSelector).text(txt)
+        $(issueSelector).show()
+      })
+      return
+    }
+
+    response.json().then(report => {
+      let content = `<p>${report.changes.length} affected, ${report.users_checked} users checked</p>`
+
+      report.changes.forEach(change => {
+        let subject = escapeHtml(change.username)
+        if (change.device) {
+          subject += ` (${escapeHtml(change.device)})`
+        }
+
+        content += `<strong>${subject}</strong><ul class="list-unstyled ml-3">${renderAccess("+", change.gained)}${renderAccess("-", change.lost)}</ul>`
+      })
+
+      $(resultSelector).html(content)
+      $(resultSelector).show()
+    })
+  })
+}
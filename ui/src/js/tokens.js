@@ -35,6 +35,35 @@ function groupsFormatter(values) {
   return result
 }
 
+function linkFormatter(value, row) {
+  if (!value) {
+    return ""
+  }
+
+  let a = document.createElement('a')
+  a.href = value
+  a.target = "_blank"
+  a.rel = "noreferrer"
+  a.innerText = "Link"
+
+  let button = document.createElement('button')
+  button.className = "btn btn-sm btn-secondary ml-2 show-link"
+  button.type = "button"
+  button.dataset.token = row.token
+  button.dataset.link = value
+  button.dataset.username = row.username
+  button.innerText = "QR"
+
+  return a.outerHTML + button.outerHTML
+}
+
+function showLink(token, link, username) {
+  $("#linkModalUsername").text(username)
+  $("#linkModalLink").val(link)
+  $("#linkModalQR").attr("src", "/management/registration_tokens/qr?token=" + encodeURIComponent(token))
+  $("#linkModal").modal("show")
+}
+
 $(function () {
 
   let table = createTable("#tokensTable", [
@@ -73,9 +102,46 @@ $(function () {
       sortable: true,
       align: 'center',
       escape: "true"
+    }, {
+      field: 'interface',
+      title: 'Interface',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'pool',
+      title: 'Address Pool',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'address',
+      title: 'Static Address',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'email',
+      title: 'Email',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'link',
+      title: 'Registration Link',
+      align: 'center',
+      formatter: linkFormatter
     }
   ])
 
+  $("#tokensTable").on("click", ".show-link", function () {
+    showLink($(this).data("token"), $(this).data("link"), $(this).data("username"))
+  })
+
+  $("#copyLink").on("click", function () {
+    navigator.clipboard.writeText($("#linkModalLink").val())
+  })
+
 
   var $remove = $('#remove')
 
@@ -119,6 +185,10 @@ $(function () {
       "token": $('#token').val(),
       "overwrites": $('#overwrite').val(),
       "groups": $('#groups').val(),
+      "interface": $('#interface').val(),
+      "pool": $('#pool').val(),
+      "address": $('#address').val(),
+      "email": $('#email').val(),
       "uses": ($("#uses").val() == "" ? "1" : $("#uses").val())
     }
 
@@ -138,6 +208,12 @@ $(function () {
       if (response.status == 200) {
         $("#tokensModal").modal("hide")
         table.bootstrapTable('refresh')
+
+        response.json().then(token => {
+          if (token.link) {
+            showLink(token.token, token.link, token.username)
+          }
+        })
         return
       }
 
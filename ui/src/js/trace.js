@@ -0,0 +1,114 @@
+// Only keep the most recent events so long traces dont slow the page down
+const maxTraceRows = 1000
+
+function traceRequest(url, data) {
+  return fetch(url, {
+    method: "POST",
+    body: JSON.stringify(data),
+    headers: {
+      "Content-Type": "application/json",
+      "WAG-CSRF": document.querySelector("#csrf_token").value,
+    }
+  }).then(async (res) => {
+    let issue = document.getElementById("issue")
+    if (res.status !== 200) {
+      issue.innerText = await res.text()
+      issue.hidden = false
+      return null
+    }
+
+    issue.hidden = true
+    return res
+  })
+}
+
+function addActiveTrace(address, until) {
+  let list = document.getElementById("activeTraces")
+  let existing = list.querySelector('[data-address="' + CSS.escape(address) + '"]')
+  if (existing != null) {
+    existing.remove()
+  }
+
+  let li = document.createElement("li")
+  li.dataset.address = address
+  li.innerText = address + " until " + until + " "
+
+  let stop = document.createElement("a")
+  stop.href = "#"
+  stop.className = "stop-trace"
+  stop.innerText = "stop"
+  li.appendChild(stop)
+
+  list.appendChild(li)
+}
+
+function addTraceEvent(event) {
+  let row = document.createElement("tr")
+  row.className = event.verdict === "allow" ? "table-success" : "table-danger"
+
+  let columns = [
+    new Date(event.time).toLocaleTimeString(),
+    event.username,
+    event.source + ":" + event.source_port,
+    event.destination + ":" + event.destination_port,
+    event.protocol,
+    event.verdict,
+    event.reason,
+    event.policy,
+  ]
+
+  for (let i = 0; i < columns.length; i++) {
+    let td = document.createElement("td")
+    td.innerText = columns[i]
+    row.appendChild(td)
+  }
+
+  let body = document.getElementById("traceEvents")
+  body.prepend(row)
+
+  while (body.children.length > maxTraceRows) {
+    body.lastChild.remove()
+  }
+}
+
+$(function () {
+  document.getElementById("startTrace").addEventListener("click", async () => {
+    let address = document.getElementById("address").value.trim()
+    let res = await traceRequest("/diag/trace/start", {
+      address: address,
+      duration: parseInt(document.getElementById("duration").value),
+    })
+
+    if (res != null) {
+      let trace = await res.json()
+      addActiveTrace(trace.address, trace.until)
+    }
+  })
+
+  document.getElementById("clearTrace").addEventListener("click", () => {
+    document.getElementById("traceEvents").innerHTML = ""
+  })
+
+  document.getElementById("activeTraces").addEventListener("click", async (e) => {
+    if (!e.target.classList.contains("stop-trace")) {
+      return
+    }
+    e.preventDefault()
+
+    let li = e.target.closest("li")
+    let res = await traceRequest("/diag/trace/stop", { address: li.dataset.address })
+    if (res != null) {
+      li.remove()
+    }
+  })
+
+  // Trace events arrive over the notifications websocket
+  document.addEventListener("wag-trace", (e) => {
+    let address = document.getElementById("address").value.trim()
+    if (address !== "" && e.detail.device !== address) {
+      return
+    }
+
+    addTraceEvent(e.detail)
+  })
+});
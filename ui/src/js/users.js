@@ -96,9 +96,20 @@ $(function () {
       align: 'center',
       sortable: true,
       formatter: lockedFormatter
+    }, {
+      field: 'history',
+      title: 'History',
+      align: 'center',
+      formatter: function (value, row) {
+        return historyButton({ username: row.username })
+      }
     }
   ])
 
+  $("#table").on("click", ".show-history", function () {
+    showHistory("Connection History of " + $(this).data("username"), { username: $(this).data("username") })
+  })
+
 
   var $remove = $('#remove')
   var $lock = $('#lock')
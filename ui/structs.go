@@ -52,9 +52,27 @@ type DevicesData struct {
 	Locked     bool   `json:"is_locked"`
 	Active     bool   `json:"active"`
 	InternalIP string `json:"internal_ip"`
+	Interface  string `json:"interface"`
+	Pool       string `json:"pool"`
+	Reserved   bool   `json:"reserved"`
 
 	PublicKey    string `json:"public_key"`
 	LastEndpoint string `json:"last_endpoint"`
+
+	Name          string   `json:"name"`
+	Tags          []string `json:"tags"`
+	Created       string   `json:"created"`
+	LastHandshake string   `json:"last_handshake"`
+}
+
+type ConnectionHistoryData struct {
+	Time     string `json:"time"`
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Address  string `json:"address"`
+	Endpoint string `json:"endpoint"`
+	Node     string `json:"node"`
+	Reason   string `json:"reason"`
 }
 
 type TokensData struct {
@@ -63,6 +81,11 @@ type TokensData struct {
 	Groups     []string `json:"groups"`
 	Overwrites string   `json:"overwrites"`
 	Uses       int      `json:"uses"`
+	Interface  string   `json:"interface"`
+	Pool       string   `json:"pool"`
+	Address    string   `json:"address"`
+	Email      string   `json:"email"`
+	Link       string   `json:"link"`
 }
 
 type WgDevicesData struct {
@@ -73,3 +96,29 @@ type WgDevicesData struct {
 	EndpointAddress   string `json:"last_endpoint"`
 	LastHandshakeTime string `json:"last_handshake_time"`
 }
+
+type TraceData struct {
+	Address         string `json:"address"`
+	DurationSeconds int    `json:"duration,omitempty"`
+	Until           string `json:"until,omitempty"`
+}
+
+type LockdownData struct {
+	Reason          string   `json:"reason"`
+	DurationMinutes int      `json:"duration"`
+	ExemptGroups    []string `json:"exempt_groups"`
+	BlockPublic     bool     `json:"block_public"`
+}
+
+type GrantData struct {
+	Effects         string   `json:"effects"`
+	Mfa             []string `json:"mfa"`
+	Allow           []string `json:"allow"`
+	Reason          string   `json:"reason"`
+	DurationMinutes int      `json:"duration"`
+}
+
+type GrantRequestDecision struct {
+	ID      string `json:"id"`
+	Approve bool   `json:"approve"`
+}
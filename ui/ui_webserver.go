@@ -294,6 +294,9 @@ func StartWebServer(errs chan<- error) error {
 		protectedRoutes.Get("/cluster/members/", clusterMembersUI)
 		protectedRoutes.PostJSON("/cluster/members/new", newNode)
 		protectedRoutes.PostJSON("/cluster/members/control", nodeControl)
+		protectedRoutes.PostJSON("/cluster/upgrade/start", upgradeStart)
+		protectedRoutes.PostJSON("/cluster/upgrade/abort", upgradeAbort)
+		protectedRoutes.PostJSON("/cluster/roaming", roamingSettings)
 
 		protectedRoutes.Get("/cluster/events/", clusterEventsUI)
 		protectedRoutes.Post("/cluster/events/acknowledge", clusterEventsAcknowledge)
@@ -303,6 +306,14 @@ func StartWebServer(errs chan<- error) error {
 
 		protectedRoutes.Get("/diag/firewall", firewallDiagnositicsUI)
 
+		protectedRoutes.Get("/diag/flows", flowsDiagnositicsUI)
+		protectedRoutes.Get("/diag/flows/data", flowsDiagnositicsData)
+		protectedRoutes.Get("/diag/flows/export", flowsDiagnositicsExport)
+
+		protectedRoutes.Get("/diag/trace", traceDiagnositicsUI)
+		protectedRoutes.PostJSON("/diag/trace/start", traceStart)
+		protectedRoutes.PostJSON("/diag/trace/stop", traceStop)
+
 		protectedRoutes.GetOrPost("/diag/check", firewallCheckTest)
 
 		protectedRoutes.GetOrPost("/diag/acls", aclsTest)
@@ -312,9 +323,13 @@ func StartWebServer(errs chan<- error) error {
 
 		protectedRoutes.Get("/management/devices/", devicesMgmtUI)
 		protectedRoutes.AllowedMethods("/management/devices/data", httputils.JSON, devicesMgmt, http.MethodDelete, http.MethodPut, http.MethodGet)
+		protectedRoutes.AllowedMethods("/management/devices/pools", httputils.JSON, addressPools, http.MethodDelete, http.MethodPost, http.MethodGet)
+		protectedRoutes.AllowedMethods("/management/devices/reservations", httputils.JSON, addressReservations, http.MethodDelete, http.MethodPost, http.MethodGet)
+		protectedRoutes.Get("/management/devices/history", connectionHistory)
 
 		protectedRoutes.Get("/management/registration_tokens/", registrationUI)
 		protectedRoutes.AllowedMethods("/management/registration_tokens/data", httputils.JSON, registrationTokens, http.MethodDelete, http.MethodGet, http.MethodPost)
+		protectedRoutes.Get("/management/registration_tokens/qr", registrationQR)
 
 		protectedRoutes.Get("/policy/rules/", policiesUI)
 		protectedRoutes.AllowedMethods("/policy/rules/data", httputils.JSON, policies, http.MethodDelete, http.MethodGet, http.MethodPost, http.MethodPut)
@@ -322,17 +337,35 @@ func StartWebServer(errs chan<- error) error {
 		protectedRoutes.Get("/policy/groups/", groupsUI)
 		protectedRoutes.AllowedMethods("/policy/groups/data", httputils.JSON, groups, http.MethodDelete, http.MethodGet, http.MethodPost, http.MethodPut)
 
+		protectedRoutes.Get("/policy/objects/", objectsUI)
+		protectedRoutes.AllowedMethods("/policy/objects/data", httputils.JSON, objects, http.MethodDelete, http.MethodGet, http.MethodPost, http.MethodPut)
+
+		protectedRoutes.Get("/policy/grants/", grantsUI)
+		protectedRoutes.AllowedMethods("/policy/grants/data", httputils.JSON, grants, http.MethodDelete, http.MethodGet, http.MethodPost, http.MethodPut)
+
+		protectedRoutes.PostJSON("/policy/simulate", simulatePolicy)
+
 		protectedRoutes.Get("/settings/general", generalSettingsUI)
 		protectedRoutes.PostJSON("/settings/general/data", generalSettings)
 
+		protectedRoutes.Get("/settings/lockdown", lockdownUI)
+		protectedRoutes.PostJSON("/settings/lockdown/start", lockdownStart)
+		protectedRoutes.PostJSON("/settings/lockdown/end", lockdownEnd)
+
 		protectedRoutes.Get("/settings/management_users", adminUsersUI)
 		protectedRoutes.Get("/settings/management_users/data", adminUsersData)
 
 		notifications := make(chan Notification, 1)
 		protectedRoutes.HandleFunc("/notifications", notificationsWS(notifications))
 		data.RegisterEventListener(data.NodeErrors, true, receiveErrorNotifications(notifications))
+		data.RegisterEventListener(data.SecurityAlerts, true, receiveSecurityAlerts(notifications))
+		data.RegisterEventListener(data.GrantRequestsPrefix, true, receiveAccessRequests(notifications))
 		go monitorClusterMembers(notifications)
 
+		if len(config.Values.Email.Admins) > 0 {
+			go sendDigests()
+		}
+
 		should, err := data.ShouldCheckUpdates()
 		if err == nil && should {
 			startUpdateChecker(notifications)
@@ -25,7 +25,7 @@ func usersUI(w http.ResponseWriter, r *http.Request) {
 		ClusterState: clusterState,
 	}
 
-	err := renderDefaults(w, r, d, "management/users.html", "delete_modal.html")
+	err := renderDefaults(w, r, d, "management/users.html", "delete_modal.html", "history_modal.html")
 
 	if err != nil {
 		log.Println("unable to render users page: ", err)